@@ -48,6 +48,10 @@ func (wbl *WorkerBlacklist) collection() *mgo.Collection {
 	return wbl.session.DB("").C("worker_blacklist")
 }
 
+// Blacklist entries are kept this long after they expired, so that the worker is on probation
+// during that time. Afterwards the entry is removed from the database.
+const blacklistProbationPeriod = 7 * 24 * time.Hour
+
 // EnsureDBIndices ensures the MongoDB indices are there.
 func (wbl *WorkerBlacklist) EnsureDBIndices() {
 	coll := wbl.collection()
@@ -56,27 +60,68 @@ func (wbl *WorkerBlacklist) EnsureDBIndices() {
 		Name: "worker-id",
 		Key:  []string{"worker_id"},
 	})
-	coll.EnsureIndex(mgo.Index{
-		Name:        "cleanup",
-		Key:         []string{"_created"},
-		ExpireAfter: 7 * 24 * time.Hour,
-	})
 	coll.EnsureIndex(mgo.Index{
 		Name:     "unique",
 		Key:      []string{"worker_id", "job_id", "task_type"},
 		Unique:   true,
 		DropDups: true,
 	})
+
+	// Older versions removed all entries a week after their creation.
+	// Entries now carry their own cleanup timestamp.
+	if err := coll.DropIndexName("cleanup"); err == nil {
+		log.Info("removed old worker blacklist cleanup index")
+		wbl.migrateEntries()
+	}
+	coll.EnsureIndex(mgo.Index{
+		Name:        "cleanup-at",
+		Key:         []string{"cleanup_at"},
+		ExpireAfter: 1 * time.Second,
+	})
+}
+
+// migrateEntries gives entries from older versions the same expiry they would have had back then.
+func (wbl *WorkerBlacklist) migrateEntries() {
+	coll := wbl.collection()
+	iter := coll.Find(M{"cleanup_at": M{"$exists": false}}).Iter()
+	entry := WorkerBlacklistEntry{}
+	for iter.Next(&entry) {
+		expires := entry.Created.Add(7 * 24 * time.Hour)
+		cleanupAt := expires.Add(blacklistProbationPeriod)
+		selector := M{"worker_id": entry.WorkerID, "job_id": entry.JobID, "task_type": entry.TaskType}
+		if err := coll.Update(selector, M{"$set": M{"expires": expires, "cleanup_at": cleanupAt}}); err != nil {
+			log.WithError(err).Warning("unable to migrate worker blacklist entry")
+		}
+	}
+	if err := iter.Close(); err != nil {
+		log.WithError(err).Error("unable to migrate worker blacklist entries")
+	}
+}
+
+// activeEntryClauses returns '$or' clauses that match blacklist entries that have not expired.
+func activeEntryClauses() []M {
+	return []M{
+		M{"expires": M{"$exists": false}},
+		M{"expires": M{"$gt": time.Now()}},
+	}
 }
 
 // Add makes it impossible for the worker to run tasks of the same type on the same job.
+// When the worker is on probation, its existing blacklist entry is renewed.
 func (wbl *WorkerBlacklist) Add(workerID bson.ObjectId, task *Task) error {
 	coll := wbl.collection()
+	now := time.Now()
 	entry := WorkerBlacklistEntry{
 		WorkerID: workerID,
 		JobID:    task.Job,
 		TaskType: task.TaskType,
-		Created:  time.Now(),
+		Created:  now,
+	}
+	if wbl.config.BlacklistExpiry > 0 {
+		expires := now.Add(wbl.config.BlacklistExpiry)
+		cleanupAt := expires.Add(blacklistProbationPeriod)
+		entry.Expires = &expires
+		entry.CleanupAt = &cleanupAt
 	}
 
 	logger := log.WithFields(log.Fields{
@@ -84,24 +129,138 @@ func (wbl *WorkerBlacklist) Add(workerID bson.ObjectId, task *Task) error {
 		"job":       entry.JobID.Hex(),
 		"task_type": entry.TaskType,
 	})
-	if err := coll.Insert(&entry); err != nil {
-		if mgo.IsDup(err) {
-			logger.Warning("ignoring duplicate blacklist request")
-			return nil
-		}
+	if entry.Expires != nil {
+		logger = logger.WithField("expires", entry.Expires)
+	}
+
+	selector := M{
+		"worker_id": entry.WorkerID,
+		"job_id":    entry.JobID,
+		"task_type": entry.TaskType,
+	}
+	info, err := coll.Upsert(selector, &entry)
+	if err != nil {
 		logger.WithError(err).Error("unable to save black list entry")
 		return err
 	}
-	logger.Info("saved worker blacklist entry")
+	if info.UpsertedId == nil {
+		logger.Info("renewed worker blacklist entry")
+	} else {
+		logger.Info("saved worker blacklist entry")
+	}
 	return nil
 }
 
+// IsOnProbation returns true when the worker's blacklist entry for this job and task type has expired.
+func (wbl *WorkerBlacklist) IsOnProbation(workerID, jobID bson.ObjectId, taskType string) bool {
+	count, err := wbl.collection().Find(M{
+		"worker_id": workerID,
+		"job_id":    jobID,
+		"task_type": taskType,
+		"expires":   M{"$lte": time.Now()},
+	}).Count()
+	if err != nil {
+		log.WithError(err).Error("IsOnProbation: unable to query blacklist")
+		return false
+	}
+	return count > 0
+}
+
+// StartProbation records that the task is the worker's probation task, if the worker is on
+// probation for the task's job and type and has not been given a probation task yet.
+func (wbl *WorkerBlacklist) StartProbation(workerID bson.ObjectId, task *Task) {
+	err := wbl.collection().Update(M{
+		"worker_id":      workerID,
+		"job_id":         task.Job,
+		"task_type":      task.TaskType,
+		"expires":        M{"$lte": time.Now()},
+		"probation_task": M{"$exists": false},
+	}, M{"$set": M{"probation_task": task.ID}})
+
+	logger := log.WithFields(log.Fields{
+		"worker":    workerID.Hex(),
+		"job":       task.Job.Hex(),
+		"task_type": task.TaskType,
+		"task":      task.ID.Hex(),
+	})
+	switch err {
+	case nil:
+		logger.Info("worker is on probation, assigned its probation task")
+	case mgo.ErrNotFound:
+	default:
+		logger.WithError(err).Error("StartProbation: unable to record probation task")
+	}
+}
+
+// releaseEndedProbations forgets the probation tasks of the worker that have ended without
+// ending the probation, for example because another worker completed them. This allows the
+// worker to be given another probation task.
+func (wbl *WorkerBlacklist) releaseEndedProbations(workerID bson.ObjectId) {
+	entries := []WorkerBlacklistEntry{}
+	err := wbl.collection().Find(M{
+		"worker_id":      workerID,
+		"probation_task": M{"$exists": true},
+	}).All(&entries)
+	if err != nil {
+		log.WithError(err).Error("releaseEndedProbations: unable to query blacklist")
+		return
+	}
+
+	tasksColl := wbl.session.DB("").C("flamenco_tasks")
+	runningStatuses := append([]string{statusCancelRequested}, unfinishedTaskStatuses...)
+	for _, entry := range entries {
+		count, err := tasksColl.Find(M{
+			"_id":    *entry.ProbationTask,
+			"status": M{"$in": runningStatuses},
+		}).Count()
+		if err != nil || count > 0 {
+			continue
+		}
+		err = wbl.collection().Update(M{
+			"worker_id":      workerID,
+			"job_id":         entry.JobID,
+			"task_type":      entry.TaskType,
+			"probation_task": *entry.ProbationTask,
+		}, M{"$unset": M{"probation_task": true}})
+		if err != nil && err != mgo.ErrNotFound {
+			log.WithError(err).Error("releaseEndedProbations: unable to update blacklist entry")
+		}
+	}
+}
+
+// EndProbation removes the worker's expired blacklist entry for this job and task type,
+// as the worker has successfully completed a task. Active entries are kept.
+func (wbl *WorkerBlacklist) EndProbation(workerID bson.ObjectId, task *Task) {
+	info, err := wbl.collection().RemoveAll(M{
+		"worker_id": workerID,
+		"job_id":    task.Job,
+		"task_type": task.TaskType,
+		"expires":   M{"$lte": time.Now()},
+	})
+	logger := log.WithFields(log.Fields{
+		"worker":    workerID.Hex(),
+		"job":       task.Job.Hex(),
+		"task_type": task.TaskType,
+	})
+	if err != nil {
+		logger.WithError(err).Error("EndProbation: unable to remove blacklist entry")
+		return
+	}
+	if info.Removed > 0 {
+		logger.Info("worker completed task while on probation, removed from blacklist")
+	}
+}
+
 // BlacklistForWorker returns a partial MongoDB query that can be used to filter out blacklisted tasks.
+// Task types for which the worker is on probation are filtered out too, while its probation task runs.
 func (wbl *WorkerBlacklist) BlacklistForWorker(workerID bson.ObjectId) M {
+	wbl.releaseEndedProbations(workerID)
+
 	coll := wbl.collection()
 	pipe := coll.Pipe([]M{
 		M{"$match": M{
 			"worker_id": workerID,
+			"$or":       append(activeEntryClauses(), M{"probation_task": M{"$exists": true}}),
 		}},
 		M{"$group": M{
 			"_id":        "$job_id",
@@ -153,7 +312,11 @@ func (wbl *WorkerBlacklist) WorkersLeft(jobID bson.ObjectId, taskType string) ma
 	coll := wbl.collection()
 
 	// Construct list of blacklisted worker IDs.
-	query := coll.Find(M{"job_id": jobID, "task_type": taskType}).Select(M{"worker_id": true})
+	query := coll.Find(M{
+		"job_id":    jobID,
+		"task_type": taskType,
+		"$or":       activeEntryClauses(),
+	}).Select(M{"worker_id": true})
 	blacklisted := []bson.ObjectId{}
 	found := WorkerBlacklistEntry{}
 	iter := query.Iter()
@@ -23,6 +23,8 @@
 package flamenco
 
 import (
+	"time"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	mgo "gopkg.in/mgo.v2"
@@ -187,3 +189,97 @@ func (s *BlacklistTestSuite) TestRemoveLine(c *check.C) {
 	}}
 	assert.Equal(c, expect, blacklist)
 }
+
+func (s *BlacklistTestSuite) expireEntry(c *check.C, workerID, jobID bson.ObjectId, taskType string) {
+	err := s.db.C("worker_blacklist").Update(
+		M{"worker_id": workerID, "job_id": jobID, "task_type": taskType},
+		M{"$set": M{"expires": time.Now().Add(-time.Minute)}})
+	assert.Nil(c, err)
+}
+
+func (s *BlacklistTestSuite) TestExpiryAndProbation(c *check.C) {
+	assert.Nil(c, s.wbl.Add(s.workerLnx.ID, s.task1br))
+	assert.False(c, s.wbl.IsOnProbation(s.workerLnx.ID, s.job1, "blender-render"))
+
+	entry := WorkerBlacklistEntry{}
+	assert.Nil(c, s.db.C("worker_blacklist").Find(M{"worker_id": s.workerLnx.ID}).One(&entry))
+	if assert.NotNil(c, entry.Expires) && assert.NotNil(c, entry.CleanupAt) {
+		assert.True(c, entry.Expires.After(time.Now()))
+		assert.Equal(c, blacklistProbationPeriod, entry.CleanupAt.Sub(*entry.Expires))
+	}
+
+	// After expiry the worker may run the task type again, but is on probation.
+	s.expireEntry(c, s.workerLnx.ID, s.job1, "blender-render")
+	assert.Equal(c, M{}, s.wbl.BlacklistForWorker(s.workerLnx.ID))
+	assert.Equal(c, 2, len(s.wbl.WorkersLeft(s.job1, "blender-render")))
+	assert.True(c, s.wbl.IsOnProbation(s.workerLnx.ID, s.job1, "blender-render"))
+
+	// Adding it again should renew the ban.
+	assert.Nil(c, s.wbl.Add(s.workerLnx.ID, s.task1br))
+	assert.False(c, s.wbl.IsOnProbation(s.workerLnx.ID, s.job1, "blender-render"))
+	assert.Equal(c, 1, len(s.wbl.WorkersLeft(s.job1, "blender-render")))
+	count, err := s.db.C("worker_blacklist").Find(M{"worker_id": s.workerLnx.ID}).Count()
+	assert.Nil(c, err)
+	assert.Equal(c, 1, count)
+
+	// Completing a task should not end an active ban.
+	s.wbl.EndProbation(s.workerLnx.ID, s.task1br)
+	assert.Equal(c, 1, len(s.wbl.WorkersLeft(s.job1, "blender-render")))
+
+	// Completing a task while on probation should remove the entry.
+	s.expireEntry(c, s.workerLnx.ID, s.job1, "blender-render")
+	s.wbl.EndProbation(s.workerLnx.ID, s.task1br)
+	assert.False(c, s.wbl.IsOnProbation(s.workerLnx.ID, s.job1, "blender-render"))
+	count, err = s.db.C("worker_blacklist").Find(M{"worker_id": s.workerLnx.ID}).Count()
+	assert.Nil(c, err)
+	assert.Equal(c, 0, count)
+}
+
+func (s *BlacklistTestSuite) TestSingleProbationTask(c *check.C) {
+	setStatus := func(status string) {
+		assert.Nil(c, s.db.C("flamenco_tasks").UpdateId(s.task1br.ID, M{"$set": M{"status": status}}))
+	}
+	brOnJob1 := M{"$nor": []M{
+		M{"job": s.job1, "task_type": M{"$in": []string{"blender-render"}}},
+	}}
+
+	assert.Nil(c, s.wbl.Add(s.workerLnx.ID, s.task1br))
+	s.expireEntry(c, s.workerLnx.ID, s.job1, "blender-render")
+	assert.Equal(c, M{}, s.wbl.BlacklistForWorker(s.workerLnx.ID))
+
+	// Once the worker has its probation task, it gets no other tasks of that type.
+	setStatus(statusActive)
+	s.wbl.StartProbation(s.workerLnx.ID, s.task1br)
+	assert.Equal(c, brOnJob1, s.wbl.BlacklistForWorker(s.workerLnx.ID))
+	assert.True(c, s.wbl.IsOnProbation(s.workerLnx.ID, s.job1, "blender-render"))
+
+	// Also not when the probation task is re-queued, for example when the worker reconnects.
+	setStatus(statusClaimedByManager)
+	assert.Equal(c, brOnJob1, s.wbl.BlacklistForWorker(s.workerLnx.ID))
+
+	// Another task doesn't replace the probation task.
+	s.wbl.StartProbation(s.workerLnx.ID, s.task1fm)
+	entry := WorkerBlacklistEntry{}
+	assert.Nil(c, s.db.C("worker_blacklist").Find(M{"worker_id": s.workerLnx.ID}).One(&entry))
+	if assert.NotNil(c, entry.ProbationTask) {
+		assert.Equal(c, s.task1br.ID, *entry.ProbationTask)
+	}
+
+	// When another worker completes the probation task, the worker may get another one.
+	setStatus(statusCompleted)
+	assert.Equal(c, M{}, s.wbl.BlacklistForWorker(s.workerLnx.ID))
+	assert.True(c, s.wbl.IsOnProbation(s.workerLnx.ID, s.job1, "blender-render"))
+	assert.Nil(c, s.db.C("worker_blacklist").Find(M{"worker_id": s.workerLnx.ID}).One(&entry))
+	assert.Nil(c, entry.ProbationTask)
+}
+
+func (s *BlacklistTestSuite) TestNoExpiry(c *check.C) {
+	s.wbl.config.BlacklistExpiry = 0
+	assert.Nil(c, s.wbl.Add(s.workerLnx.ID, s.task1br))
+
+	entry := WorkerBlacklistEntry{}
+	assert.Nil(c, s.db.C("worker_blacklist").Find(M{"worker_id": s.workerLnx.ID}).One(&entry))
+	assert.Nil(c, entry.Expires)
+	assert.Nil(c, entry.CleanupAt)
+	assert.Equal(c, 1, len(s.wbl.WorkersLeft(s.job1, "blender-render")))
+}
@@ -0,0 +1,329 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armadillica/flamenco-manager/shaman"
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const checkoutUsageScanInterval = 10 * time.Minute
+
+// Returned by CheckoutUsageTracker.CheckoutUsage() until the tasks have been scanned.
+var errCheckoutUsageNotScanned = errors.New("tasks have not been scanned for Shaman checkouts yet")
+
+// CheckoutUsage records which jobs use a Shaman checkout.
+//
+// The Manager only knows about the tasks the Server sent it, so a job counts as finished
+// when none of its tasks in the Manager's database are unfinished. The Server may still
+// have tasks for the job, which is why Shaman does not remove a checkout for finished
+// jobs unless it has also been unused for long enough.
+type CheckoutUsage struct {
+	CheckoutID   string          `bson:"_id" json:"checkout_id"`
+	Jobs         []bson.ObjectId `bson:"jobs" json:"jobs"`
+	LastUsed     time.Time       `bson:"last_used" json:"last_used"`
+	JobsFinished *time.Time      `bson:"jobs_finished,omitempty" json:"jobs_finished,omitempty"` // nil while any job is unfinished.
+}
+
+// checkoutScan is the usage of a checkout, as found in the tasks of a single scan.
+type checkoutScan struct {
+	jobs        []bson.ObjectId
+	unfinished  bool
+	lastUpdated time.Time // Most recent update of the tasks of the finished jobs.
+}
+
+// CheckoutUsageTracker periodically scans the tasks for references to Shaman checkouts,
+// and records which job uses which checkout. Shaman uses this for its checkout retention policy.
+type CheckoutUsageTracker struct {
+	closable
+	config  *Conf
+	session *mgo.Session
+
+	// Matches "{checkout path}/{last 2 chars of ID}/{checkout ID}".
+	checkoutRegexp *regexp.Regexp
+
+	mutex   sync.Mutex
+	scanned bool // Only report usage after all tasks have been scanned at least once.
+}
+
+// CreateCheckoutUsageTracker creates a CheckoutUsageTracker, or returns nil if Shaman is disabled.
+func CreateCheckoutUsageTracker(config *Conf, session *mgo.Session) *CheckoutUsageTracker {
+	if !config.Shaman.Enabled {
+		return nil
+	}
+
+	checkoutPath := filepath.ToSlash(filepath.Clean(config.Shaman.CheckoutPath))
+	pattern := regexp.QuoteMeta(strings.TrimSuffix(checkoutPath, "/")) + `/([a-zA-Z0-9_]{2})/([a-zA-Z0-9_]+)`
+
+	return &CheckoutUsageTracker{
+		makeClosable(),
+		config,
+		session,
+		regexp.MustCompile(pattern),
+		sync.Mutex{},
+		false,
+	}
+}
+
+func (cut *CheckoutUsageTracker) collection(db *mgo.Database) *mgo.Collection {
+	return db.C("flamenco_checkout_usage")
+}
+
+// Go starts a goroutine that periodically scans the tasks for checkout usage.
+// The first scan happens after checkoutUsageScanInterval; call Scan() before Go() to scan at startup.
+func (cut *CheckoutUsageTracker) Go() {
+	cut.closableAdd(1)
+	go func() {
+		session := cut.session.Copy()
+		db := session.DB("")
+		defer session.Close()
+		defer cut.closableDone()
+		defer log.Info("CheckoutUsageTracker: shutting down.")
+
+		timer := Timer("CheckoutUsageTracker", checkoutUsageScanInterval, checkoutUsageScanInterval, &cut.closable)
+		for range timer {
+			cut.Scan(db)
+		}
+	}()
+}
+
+// Close gracefully shuts down the checkout usage tracker goroutine.
+func (cut *CheckoutUsageTracker) Close() {
+	log.Debug("CheckoutUsageTracker: Close() called.")
+	cut.closableCloseAndWait()
+	log.Debug("CheckoutUsageTracker: shutdown complete.")
+}
+
+// CheckoutUsage returns the usage of the checkout; implements shaman.CheckoutUsageProvider.
+func (cut *CheckoutUsageTracker) CheckoutUsage(checkoutID string) (shaman.CheckoutUsage, bool, error) {
+	cut.mutex.Lock()
+	scanned := cut.scanned
+	cut.mutex.Unlock()
+	if !scanned {
+		return shaman.CheckoutUsage{}, false, errCheckoutUsageNotScanned
+	}
+
+	session := cut.session.Copy()
+	defer session.Close()
+
+	usage := CheckoutUsage{}
+	err := cut.collection(session.DB("")).FindId(checkoutID).One(&usage)
+	if err == mgo.ErrNotFound {
+		return shaman.CheckoutUsage{}, false, nil
+	}
+	if err != nil {
+		return shaman.CheckoutUsage{}, false, err
+	}
+	return shaman.CheckoutUsage{LastUsed: usage.LastUsed, JobsFinished: usage.JobsFinished}, true, nil
+}
+
+// Scan finds the checkouts used by the tasks, and records their usage.
+func (cut *CheckoutUsageTracker) Scan(db *mgo.Database) {
+	logger := log.WithField("checkout_path", cut.config.Shaman.CheckoutPath)
+	logger.Debug("CheckoutUsageTracker: scanning tasks for checkout usage")
+
+	scans, err := cut.scanTasks(db)
+	if err != nil {
+		logger.WithError(err).Error("CheckoutUsageTracker: unable to scan tasks")
+		return
+	}
+
+	coll := cut.collection(db)
+	existing := map[string]CheckoutUsage{}
+	usage := CheckoutUsage{}
+	iter := coll.Find(nil).Iter()
+	for iter.Next(&usage) {
+		existing[usage.CheckoutID] = usage
+	}
+	if err := iter.Close(); err != nil {
+		logger.WithError(err).Error("CheckoutUsageTracker: unable to fetch checkout usage")
+		return
+	}
+
+	now := UtcNow()
+	for checkoutID, scan := range scans {
+		usage, found := existing[checkoutID]
+		if !found {
+			usage = CheckoutUsage{CheckoutID: checkoutID}
+		}
+		usage.merge(scan, *now)
+		if _, err := coll.UpsertId(checkoutID, &usage); err != nil {
+			logger.WithError(err).WithField("checkout_id", checkoutID).Error("CheckoutUsageTracker: unable to record checkout usage")
+			return
+		}
+	}
+
+	// When the tasks of unfinished jobs have disappeared from the database, we can't tell
+	// whether the jobs finished. They were in use until now, so they are considered to have
+	// finished just now.
+	for checkoutID, usage := range existing {
+		if _, found := scans[checkoutID]; found || usage.JobsFinished != nil {
+			continue
+		}
+		if err := coll.UpdateId(checkoutID, M{"$set": M{"jobs_finished": now, "last_used": now}}); err != nil {
+			logger.WithError(err).WithField("checkout_id", checkoutID).Error("CheckoutUsageTracker: unable to record checkout usage")
+			return
+		}
+	}
+
+	cut.mutex.Lock()
+	cut.scanned = true
+	cut.mutex.Unlock()
+	logger.WithField("checkout_count", len(scans)).Debug("CheckoutUsageTracker: scanned tasks for checkout usage")
+}
+
+// scanTasks returns the usage of each checkout referenced by the tasks.
+func (cut *CheckoutUsageTracker) scanTasks(db *mgo.Database) (map[string]*checkoutScan, error) {
+	type jobScan struct {
+		checkoutIDs map[string]bool
+		unfinished  bool
+		lastUpdated time.Time
+	}
+	jobs := map[bson.ObjectId]*jobScan{}
+
+	task := Task{}
+	iter := db.C("flamenco_tasks").Find(nil).
+		Select(M{"job": 1, "status": 1, "commands": 1, "last_updated": 1}).
+		Iter()
+	for iter.Next(&task) {
+		job, found := jobs[task.Job]
+		if !found {
+			job = &jobScan{checkoutIDs: map[string]bool{}}
+			jobs[task.Job] = job
+		}
+		for _, cmd := range task.Commands {
+			for _, checkoutID := range cut.checkoutIDs(cmd.Settings) {
+				job.checkoutIDs[checkoutID] = true
+			}
+		}
+		switch task.Status {
+		case statusCompleted, statusCanceled, statusFailed:
+		default:
+			job.unfinished = true
+		}
+		if task.LastUpdated != nil && task.LastUpdated.After(job.lastUpdated) {
+			job.lastUpdated = *task.LastUpdated
+		}
+		// Not all fields are selected, so prevent values from leaking into the next task.
+		task = Task{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	scans := map[string]*checkoutScan{}
+	for jobID, job := range jobs {
+		for checkoutID := range job.checkoutIDs {
+			scan, found := scans[checkoutID]
+			if !found {
+				scan = &checkoutScan{}
+				scans[checkoutID] = scan
+			}
+			scan.jobs = append(scan.jobs, jobID)
+			if job.unfinished {
+				scan.unfinished = true
+			} else if job.lastUpdated.After(scan.lastUpdated) {
+				scan.lastUpdated = job.lastUpdated
+			}
+		}
+	}
+	return scans, nil
+}
+
+// checkoutIDs returns the IDs of the checkouts referenced by the command settings.
+func (cut *CheckoutUsageTracker) checkoutIDs(settings interface{}) []string {
+	checkoutIDs := []string{}
+
+	switch value := settings.(type) {
+	case string:
+		expanded := filepath.ToSlash(ReplaceLocal(value, cut.config))
+		for _, match := range cut.checkoutRegexp.FindAllStringSubmatch(expanded, -1) {
+			// Checkouts are stored in a directory named after the last 2 characters of their ID.
+			if strings.HasSuffix(match[2], match[1]) {
+				checkoutIDs = append(checkoutIDs, match[2])
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			checkoutIDs = append(checkoutIDs, cut.checkoutIDs(item)...)
+		}
+	case bson.M:
+		for _, item := range value {
+			checkoutIDs = append(checkoutIDs, cut.checkoutIDs(item)...)
+		}
+	case map[string]interface{}:
+		for _, item := range value {
+			checkoutIDs = append(checkoutIDs, cut.checkoutIDs(item)...)
+		}
+	}
+
+	return checkoutIDs
+}
+
+// merge updates the usage with the results of a task scan.
+func (usage *CheckoutUsage) merge(scan *checkoutScan, now time.Time) {
+	for _, jobID := range scan.jobs {
+		if !containsObjectID(usage.Jobs, jobID) {
+			usage.Jobs = append(usage.Jobs, jobID)
+		}
+	}
+
+	if scan.unfinished {
+		usage.LastUsed = now
+		usage.JobsFinished = nil
+		return
+	}
+
+	finished := scan.lastUpdated
+	if finished.IsZero() {
+		// The tasks don't tell when they finished, so it's when we first saw it.
+		if usage.JobsFinished != nil {
+			return
+		}
+		finished = now
+	}
+	if finished.After(usage.LastUsed) {
+		usage.LastUsed = finished
+	}
+	if usage.JobsFinished == nil || finished.After(*usage.JobsFinished) {
+		usage.JobsFinished = &finished
+	}
+}
+
+func containsObjectID(haystack []bson.ObjectId, needle bson.ObjectId) bool {
+	for _, item := range haystack {
+		if item == needle {
+			return true
+		}
+	}
+	return false
+}
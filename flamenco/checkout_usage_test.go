@@ -0,0 +1,208 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// CheckoutIDsTestSuite tests finding checkouts in task settings and merging their usage, without MongoDB.
+type CheckoutIDsTestSuite struct {
+	config  Conf
+	tracker *CheckoutUsageTracker
+}
+
+var _ = check.Suite(&CheckoutIDsTestSuite{})
+
+func (s *CheckoutIDsTestSuite) SetUpTest(c *check.C) {
+	s.config = GetTestConfig()
+	s.config.Shaman.CheckoutPath = "/shared/flamenco/jobs/"
+	s.tracker = CreateCheckoutUsageTracker(&s.config, nil)
+}
+
+func (s *CheckoutIDsTestSuite) TestDisabled(c *check.C) {
+	s.config.Shaman.Enabled = false
+	assert.Nil(c, CreateCheckoutUsageTracker(&s.config, nil))
+}
+
+func (s *CheckoutIDsTestSuite) TestCheckoutIDs(c *check.C) {
+	settings := bson.M{
+		"filepath":      "/shared/flamenco/jobs/ab/1234ab/shot/file.blend",
+		"render_output": "/render/shot/######",
+		"args": []interface{}{
+			"--python-expr", "import sys; sys.path.append('/shared/flamenco/jobs/cd/5678cd/scripts')",
+		},
+		"nested":    bson.M{"path": "/shared/flamenco/jobs/ef/9012ef"},
+		"frames":    "1-100",
+		"chunk":     3,
+		"mismatch":  "/shared/flamenco/jobs/xx/1234ab/file.blend",
+		"elsewhere": "/shared/flamenco/jobs-backup/ab/1234ab/file.blend",
+	}
+	assert.ElementsMatch(c, []string{"1234ab", "5678cd", "9012ef"}, s.tracker.checkoutIDs(settings))
+}
+
+func (s *CheckoutIDsTestSuite) TestCheckoutIDsWithVariables(c *check.C) {
+	s.config.Shaman.CheckoutPath = "/opt/myblenderbuild/blender"
+	tracker := CreateCheckoutUsageTracker(&s.config, nil)
+
+	ids := tracker.checkoutIDs(bson.M{"blender_cmd": "{blender}/st/checkout_first --factory-startup"})
+	assert.Equal(c, []string{"checkout_first"}, ids)
+}
+
+func (s *CheckoutIDsTestSuite) TestMergeUnfinished(c *check.C) {
+	job1 := bson.NewObjectId()
+	job2 := bson.NewObjectId()
+	finished := time.Now().Add(-24 * time.Hour)
+	usage := CheckoutUsage{CheckoutID: "1234ab", Jobs: []bson.ObjectId{job1}, LastUsed: finished, JobsFinished: &finished}
+	now := time.Now()
+
+	usage.merge(&checkoutScan{jobs: []bson.ObjectId{job1, job2}, unfinished: true}, now)
+	assert.Equal(c, []bson.ObjectId{job1, job2}, usage.Jobs)
+	assert.Equal(c, now, usage.LastUsed)
+	assert.Nil(c, usage.JobsFinished)
+}
+
+func (s *CheckoutIDsTestSuite) TestMergeFinished(c *check.C) {
+	job := bson.NewObjectId()
+	usage := CheckoutUsage{CheckoutID: "1234ab"}
+	now := time.Now()
+	lastUpdated := now.Add(-time.Hour)
+
+	usage.merge(&checkoutScan{jobs: []bson.ObjectId{job}, lastUpdated: lastUpdated}, now)
+	assert.Equal(c, lastUpdated, usage.LastUsed)
+	assert.Equal(c, lastUpdated, *usage.JobsFinished)
+
+	// Scanning again later should not change anything.
+	usage.merge(&checkoutScan{jobs: []bson.ObjectId{job}, lastUpdated: lastUpdated}, now.Add(time.Hour))
+	assert.Equal(c, []bson.ObjectId{job}, usage.Jobs)
+	assert.Equal(c, lastUpdated, usage.LastUsed)
+	assert.Equal(c, lastUpdated, *usage.JobsFinished)
+}
+
+func (s *CheckoutIDsTestSuite) TestMergeFinishedWithoutTimestamp(c *check.C) {
+	usage := CheckoutUsage{CheckoutID: "1234ab"}
+	now := time.Now()
+
+	usage.merge(&checkoutScan{jobs: []bson.ObjectId{bson.NewObjectId()}}, now)
+	assert.Equal(c, now, *usage.JobsFinished)
+
+	// The first time the job was seen as finished counts.
+	usage.merge(&checkoutScan{jobs: []bson.ObjectId{bson.NewObjectId()}}, now.Add(time.Hour))
+	assert.Equal(c, now, *usage.JobsFinished)
+}
+
+// CheckoutUsageTrackerTestSuite tests recording checkout usage in MongoDB.
+type CheckoutUsageTrackerTestSuite struct {
+	config  Conf
+	session *mgo.Session
+	db      *mgo.Database
+	tracker *CheckoutUsageTracker
+}
+
+var _ = check.Suite(&CheckoutUsageTrackerTestSuite{})
+
+func (s *CheckoutUsageTrackerTestSuite) SetUpSuite(c *check.C) {
+	s.config = GetTestConfig()
+	s.config.Shaman.CheckoutPath = "/shared/flamenco/jobs"
+
+	s.session = MongoSession(&s.config)
+	s.db = s.session.DB("")
+}
+
+func (s *CheckoutUsageTrackerTestSuite) SetUpTest(c *check.C) {
+	s.tracker = CreateCheckoutUsageTracker(&s.config, s.session)
+}
+
+func (s *CheckoutUsageTrackerTestSuite) TearDownTest(c *check.C) {
+	log.Info("CheckoutUsageTrackerTestSuite tearing down test, dropping database.")
+	s.db.DropDatabase()
+}
+
+func (s *CheckoutUsageTrackerTestSuite) insertTask(c *check.C, taskID, status, blendfile string) Task {
+	task := ConstructTestTask(taskID, "blender-render")
+	task.Status = status
+	task.LastUpdated = UtcNow()
+	task.Commands = []Command{
+		Command{"blender_render", bson.M{"filepath": blendfile}},
+	}
+	assert.Nil(c, s.db.C("flamenco_tasks").Insert(&task))
+	return task
+}
+
+func (s *CheckoutUsageTrackerTestSuite) TestNotScannedYet(c *check.C) {
+	_, _, err := s.tracker.CheckoutUsage("1234ab")
+	assert.Equal(c, errCheckoutUsageNotScanned, err)
+}
+
+func (s *CheckoutUsageTrackerTestSuite) TestScan(c *check.C) {
+	task1 := s.insertTask(c, "1aaaaaaaaaaaaaaaaaaaaaaa", statusCompleted, "/shared/flamenco/jobs/ab/1234ab/file.blend")
+	s.insertTask(c, "2aaaaaaaaaaaaaaaaaaaaaaa", statusActive, "/shared/flamenco/jobs/ab/1234ab/file.blend")
+	s.tracker.Scan(s.db)
+
+	// The job is still active, so the checkout is still in use.
+	usage, found, err := s.tracker.CheckoutUsage("1234ab")
+	assert.Nil(c, err)
+	assert.True(c, found)
+	assert.Nil(c, usage.JobsFinished)
+
+	_, found, err = s.tracker.CheckoutUsage("5678cd")
+	assert.Nil(c, err)
+	assert.False(c, found)
+
+	// Once all tasks are done, the job is finished.
+	assert.Nil(c, s.db.C("flamenco_tasks").UpdateId(bson.ObjectIdHex("2aaaaaaaaaaaaaaaaaaaaaaa"),
+		M{"$set": M{"status": statusCanceled}}))
+	s.tracker.Scan(s.db)
+
+	usage, found, err = s.tracker.CheckoutUsage("1234ab")
+	assert.Nil(c, err)
+	assert.True(c, found)
+	if assert.NotNil(c, usage.JobsFinished) {
+		assert.WithinDuration(c, *task1.LastUpdated, *usage.JobsFinished, time.Second)
+	}
+
+	recorded := CheckoutUsage{}
+	assert.Nil(c, s.db.C("flamenco_checkout_usage").FindId("1234ab").One(&recorded))
+	assert.Equal(c, []bson.ObjectId{task1.Job}, recorded.Jobs)
+}
+
+func (s *CheckoutUsageTrackerTestSuite) TestJobDisappeared(c *check.C) {
+	s.insertTask(c, "1aaaaaaaaaaaaaaaaaaaaaaa", statusActive, "/shared/flamenco/jobs/ab/1234ab/file.blend")
+	s.tracker.Scan(s.db)
+
+	assert.Nil(c, s.db.C("flamenco_tasks").DropCollection())
+	s.tracker.Scan(s.db)
+
+	// The checkout was in use until the tasks disappeared.
+	usage, found, err := s.tracker.CheckoutUsage("1234ab")
+	assert.Nil(c, err)
+	assert.True(c, found)
+	assert.WithinDuration(c, time.Now(), usage.LastUsed, 5*time.Second)
+	assert.NotNil(c, usage.JobsFinished)
+}
@@ -32,6 +32,7 @@ import (
 	"net/url"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/armadillica/flamenco-manager/dynamicpool/azurebatch"
 	"github.com/armadillica/flamenco-manager/dynamicpool/dppoller"
@@ -49,7 +50,12 @@ type Dashboard struct {
 	session           *mgo.Session
 	config            *Conf
 	sleeper           *SleepScheduler
+	waker             *WorkerWaker
 	blacklist         *WorkerBlacklist
+	quarantine        *WorkerQuarantine
+	runtimes          *RuntimeEstimator
+	logIndex          *TaskLogIndex
+	logUploader       *TaskLogUploader
 	dynamicPoolPoller *dppoller.Poller
 
 	flamencoVersion string
@@ -65,7 +71,12 @@ type Dashboard struct {
 func CreateDashboard(config *Conf,
 	session *mgo.Session,
 	sleeper *SleepScheduler,
+	waker *WorkerWaker,
 	blacklist *WorkerBlacklist,
+	quarantine *WorkerQuarantine,
+	runtimes *RuntimeEstimator,
+	logIndex *TaskLogIndex,
+	logUploader *TaskLogUploader,
 	dynamicPoolPoller *dppoller.Poller,
 	flamencoVersion string,
 ) *Dashboard {
@@ -79,7 +90,12 @@ func CreateDashboard(config *Conf,
 		session,
 		config,
 		sleeper,
+		waker,
 		blacklist,
+		quarantine,
+		runtimes,
+		logIndex,
+		logUploader,
 		dynamicPoolPoller,
 		flamencoVersion,
 		serverURL.Host,
@@ -95,13 +111,25 @@ func (dash *Dashboard) AddRoutes(router *mux.Router, auther jwtauth.Authenticato
 	router.Handle("/as-json", auther.WrapFunc(dash.sendStatusReport)).Methods("GET")
 	router.Handle("/restart-to-websetup", auther.WrapFunc(dash.restartToWebSetup)).Methods("POST")
 	router.Handle("/set-sleep-schedule/{worker-id}", auther.WrapFunc(dash.setSleepSchedule)).Methods("POST")
+	router.Handle("/sleep-schedule-templates", auther.WrapFunc(dash.saveScheduleTemplate)).Methods("POST")
+	router.Handle("/sleep-schedule-templates/{template-name}", auther.WrapFunc(dash.deleteScheduleTemplate)).Methods("DELETE")
+	router.Handle("/parse-holiday-calendar", auther.WrapFunc(dash.parseHolidayCalendar)).Methods("POST")
 	router.Handle("/static/latest-image.jpg", auther.WrapFunc(dash.serveLatestImage)).Methods("GET")
 	router.Handle("/worker-action/{worker-id}", auther.WrapFunc(dash.workerAction)).Methods("POST")
+	router.Handle("/worker-action-bulk", auther.WrapFunc(dash.bulkWorkerAction)).Methods("POST")
 	router.Handle("/dynamic-pool-resize", auther.WrapFunc(dash.dynamicPoolResize)).Methods("POST")
+	router.Handle("/api/tasks", auther.WrapFunc(dash.queryTasks)).Methods("GET")
+	router.Handle("/api/tasks/{task-id}", auther.WrapFunc(dash.taskDetails)).Methods("GET")
+	router.Handle("/api/task-logs/search", auther.WrapFunc(dash.searchTaskLogs)).Methods("GET")
 
 	// Unprotected, treat as accessible to the world:
 	router.HandleFunc("/", dash.showStatusPage).Methods("GET")
 	router.HandleFunc("/latest-image", dash.showLatestImagePage).Methods("GET")
+	router.HandleFunc("/task-browser", dash.showTaskBrowserPage).Methods("GET")
+	router.HandleFunc("/task-browser/{task-id}", dash.showTaskDetailsPage).Methods("GET")
+	router.HandleFunc("/task-log-search", dash.showTaskLogSearchPage).Methods("GET")
+	router.HandleFunc("/job-gallery", dash.showJobGalleryPage).Methods("GET")
+	router.HandleFunc("/shaman-checkouts", dash.showShamanCheckoutsPage).Methods("GET")
 	router.HandleFunc("/restart-to-websetup", dash.restartToWebSetup).Methods("GET")
 	// When refreshing the setup page after we restarted to normal mode, just redirect to the dashboard.
 	router.HandleFunc("/setup", dash.redirectToDashboard).Methods("GET")
@@ -180,6 +208,11 @@ func (dash *Dashboard) showStatusPage(w http.ResponseWriter, r *http.Request) {
 	dash.showTemplate("templates/dashboard.html", w, r)
 }
 
+// showShamanCheckoutsPage shows the Shaman checkouts. The data is obtained from the Shaman endpoints.
+func (dash *Dashboard) showShamanCheckoutsPage(w http.ResponseWriter, r *http.Request) {
+	dash.showTemplate("templates/shaman-checkouts.html", w, r)
+}
+
 func (dash *Dashboard) showLatestImagePage(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, path.Join(dash.root, "static/latest-image.html"))
 }
@@ -231,21 +264,26 @@ func (dash *Dashboard) sendStatusReport(w http.ResponseWriter, r *http.Request)
 			// To get the info from the task itself, swap out these two lines with the two lines below.
 			// "current_task_status":  "$_task.status",
 			// "current_task_updated": "$_task.last_updated",
-			"current_task_status":  1,
-			"current_task_updated": 1,
-			"address":              1,
-			"current_task":         1,
-			"current_job":          "$_task.job",
-			"last_activity":        1,
-			"nickname":             1,
-			"platform":             1,
-			"software":             1,
-			"status":               1,
-			"status_requested":     1,
-			"lazy_status_request":  1,
-			"supported_task_types": 1,
-			"sleep_schedule":       1,
-			"blacklist":            1,
+			"current_task_status":        1,
+			"current_task_updated":       1,
+			"current_task_failure_class": 1,
+			"address":                    1,
+			"current_task":               1,
+			"current_job":                "$_task.job",
+			"last_activity":              1,
+			"nickname":                   1,
+			"platform":                   1,
+			"software":                   1,
+			"status":                     1,
+			"status_requested":           1,
+			"lazy_status_request":        1,
+			"drain_deadline":             1,
+			"mac_address":                1,
+			"wol_sent":                   1,
+			"quarantine":                 1,
+			"supported_task_types":       1,
+			"sleep_schedule":             1,
+			"blacklist":                  1,
 		}},
 		// 4: Sort.
 		M{"$sort": bson.D{
@@ -259,6 +297,26 @@ func (dash *Dashboard) sendStatusReport(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	scheduleTemplates, err := dash.sleeper.ScheduleTemplates(db)
+	if err != nil {
+		log.Errorf("Unable to fetch sleep schedule templates: %s", err.Error())
+		return
+	}
+
+	runtimeReport, err := dash.runtimes.Report(db)
+	if err != nil {
+		log.Errorf("Unable to estimate task runtimes: %s", err.Error())
+		return
+	}
+
+	var uploadReport *TaskLogUploadReport
+	if dash.logUploader != nil {
+		if uploadReport, err = dash.logUploader.Report(db); err != nil {
+			log.Errorf("Unable to inspect task log upload queue: %s", err.Error())
+			return
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "close")
@@ -271,6 +329,10 @@ func (dash *Dashboard) sendStatusReport(w http.ResponseWriter, r *http.Request)
 		Workers:           workers,
 		ManagerMode:       dash.config.Mode,
 		ManagerName:       dash.config.ManagerName,
+
+		SleepScheduleTemplates: scheduleTemplates,
+		Runtime:                runtimeReport,
+		TaskLogUploads:         uploadReport,
 	}
 	statusreport.Server.Name = dash.serverName
 	statusreport.Server.URL = dash.serverURL
@@ -333,57 +395,14 @@ func (dash *Dashboard) workerAction(w http.ResponseWriter, r *http.Request) {
 	action := r.FormValue("action")
 	logger = logger.WithField("action", action)
 
-	db := session.DB("")
-	var actionResult string
-	var actionErr error
-	actionHandlers := map[string]func(){
-		"set-status": func() {
-			requestedStatus := r.FormValue("status")
-			lazy := Lazyness(r.FormValue("lazy") == "true")
-			logger = logger.WithFields(log.Fields{
-				"requested_status": requestedStatus,
-				"lazy":             lazy,
-			})
-			actionErr = worker.RequestStatusChange(requestedStatus, lazy, db)
-		},
-		"shutdown": func() {
-			lazy := Lazyness(r.FormValue("lazy") == "true")
-			logger = logger.WithFields(log.Fields{
-				"lazy": lazy,
-			})
-			actionErr = worker.RequestStatusChange(workerStatusShutdown, lazy, db)
-		},
-		"ack-timeout": func() {
-			actionErr = worker.AckTimeout(db)
-		},
-		"send-test-job": func() {
-			actionResult, actionErr = CreateTestTask(worker, dash.config, db)
-		},
-		"forget-worker": func() {
-			actionErr = forgetWorker(worker, db)
-		},
-		"forget-blacklist-line": func() {
-			jobIDstr := r.FormValue("job_id")
-			taskType := r.FormValue("task_type")
-
-			if !bson.IsObjectIdHex(jobIDstr) {
-				actionErr = errors.New("Job ID is not a valid ObjectID")
-				return
-			}
-			actionErr = dash.blacklist.RemoveLine(worker.ID, bson.ObjectIdHex(jobIDstr), taskType)
-		},
-	}
-
-	handler, ok := actionHandlers[action]
-	if !ok {
+	actionResult, logger, actionErr := dash.performWorkerAction(worker, action, r.Form, logger, session.DB(""))
+	if actionErr == errInvalidWorkerAction {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "Invalid action")
 		logger.Warning("workerAction: invalid action requested")
 		return
 	}
 
-	handler()
-
 	if actionErr != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, actionErr)
@@ -400,6 +419,89 @@ func (dash *Dashboard) workerAction(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// workerActionHandler performs a single dashboard action on a worker.
+// Returns the action result, the logger with action-specific fields, and an error.
+type workerActionHandler func(dash *Dashboard, worker *Worker, params url.Values,
+	logger *log.Entry, db *mgo.Database) (string, *log.Entry, error)
+
+// workerActionHandlers maps the name of a dashboard worker action to its handler.
+var workerActionHandlers = map[string]workerActionHandler{
+	"set-status": func(dash *Dashboard, worker *Worker, params url.Values, logger *log.Entry, db *mgo.Database) (string, *log.Entry, error) {
+		requestedStatus := params.Get("status")
+		lazy := Lazyness(params.Get("lazy") == "true")
+		logger = logger.WithFields(log.Fields{
+			"requested_status": requestedStatus,
+			"lazy":             lazy,
+		})
+		return "", logger, worker.RequestStatusChange(requestedStatus, lazy, db)
+	},
+	"shutdown": func(dash *Dashboard, worker *Worker, params url.Values, logger *log.Entry, db *mgo.Database) (string, *log.Entry, error) {
+		lazy := Lazyness(params.Get("lazy") == "true")
+		logger = logger.WithFields(log.Fields{
+			"lazy": lazy,
+		})
+		return "", logger, worker.RequestStatusChange(workerStatusShutdown, lazy, db)
+	},
+	"drain": func(dash *Dashboard, worker *Worker, params url.Values, logger *log.Entry, db *mgo.Database) (string, *log.Entry, error) {
+		drainDuration := dash.config.WorkerDrainDeadline
+		if deadlineStr := params.Get("deadline"); deadlineStr != "" {
+			var err error
+			drainDuration, err = time.ParseDuration(deadlineStr)
+			if err != nil {
+				return "", logger, err
+			}
+		}
+		deadline := UtcNow().Add(drainDuration)
+		logger = logger.WithField("drain_deadline", deadline)
+		return "", logger, worker.RequestDrain(deadline, db)
+	},
+	"wake": func(dash *Dashboard, worker *Worker, params url.Values, logger *log.Entry, db *mgo.Database) (string, *log.Entry, error) {
+		return "", logger, dash.waker.WakeWorker(worker, db)
+	},
+	"ack-timeout": func(dash *Dashboard, worker *Worker, params url.Values, logger *log.Entry, db *mgo.Database) (string, *log.Entry, error) {
+		return "", logger, worker.AckTimeout(db)
+	},
+	"send-test-job": func(dash *Dashboard, worker *Worker, params url.Values, logger *log.Entry, db *mgo.Database) (string, *log.Entry, error) {
+		actionResult, err := CreateTestTask(worker, dash.config, db)
+		return actionResult, logger, err
+	},
+	"release-quarantine": func(dash *Dashboard, worker *Worker, params url.Values, logger *log.Entry, db *mgo.Database) (string, *log.Entry, error) {
+		actionResult, err := dash.quarantine.Release(worker, db)
+		return actionResult, logger, err
+	},
+	"forget-worker": func(dash *Dashboard, worker *Worker, params url.Values, logger *log.Entry, db *mgo.Database) (string, *log.Entry, error) {
+		return "", logger, forgetWorker(worker, db)
+	},
+	"forget-blacklist-line": func(dash *Dashboard, worker *Worker, params url.Values, logger *log.Entry, db *mgo.Database) (string, *log.Entry, error) {
+		jobIDstr := params.Get("job_id")
+		taskType := params.Get("task_type")
+
+		if !bson.IsObjectIdHex(jobIDstr) {
+			return "", logger, errors.New("Job ID is not a valid ObjectID")
+		}
+		return "", logger, dash.blacklist.RemoveLine(worker.ID, bson.ObjectIdHex(jobIDstr), taskType)
+	},
+}
+
+// isValidWorkerAction returns true when performWorkerAction knows the action.
+func isValidWorkerAction(action string) bool {
+	_, ok := workerActionHandlers[action]
+	return ok
+}
+
+// performWorkerAction performs a dashboard action on a single worker.
+// Returns the action result, the logger with action-specific fields, and an error.
+// The error is errInvalidWorkerAction when the action is unknown.
+func (dash *Dashboard) performWorkerAction(worker *Worker, action string, params url.Values,
+	logger *log.Entry, db *mgo.Database) (string, *log.Entry, error) {
+
+	handler, ok := workerActionHandlers[action]
+	if !ok {
+		return "", logger, errInvalidWorkerAction
+	}
+	return handler(dash, worker, params, logger, db)
+}
+
 func (dash *Dashboard) setSleepSchedule(w http.ResponseWriter, r *http.Request) {
 	session := dash.session.Clone()
 	defer session.Close()
@@ -424,10 +526,81 @@ func (dash *Dashboard) setSleepSchedule(w http.ResponseWriter, r *http.Request)
 	if err := dash.sleeper.SetSleepSchedule(worker, schedule, session.DB("")); err != nil {
 		logger.WithError(err).Error("unable to set worker schedule")
 		http.Error(w, "Error setting sleep schedule: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (dash *Dashboard) saveScheduleTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "expected JSON", http.StatusNotAcceptable)
+		return
+	}
+
+	var template SleepScheduleTemplate
+	if err := DecodeJSON(w, r.Body, &template, "saveScheduleTemplate"); err != nil {
+		return
+	}
+
+	session := dash.session.Clone()
+	defer session.Close()
+
+	logger := log.WithFields(log.Fields{
+		"remote_addr": r.RemoteAddr,
+		"template":    template.Name,
+	})
+	logger.Info("saving sleep schedule template")
+	if err := dash.sleeper.SaveScheduleTemplate(template, session.DB("")); err != nil {
+		logger.WithError(err).Error("unable to save sleep schedule template")
+		http.Error(w, "Error saving sleep schedule template: "+err.Error(), http.StatusBadRequest)
+		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (dash *Dashboard) deleteScheduleTemplate(w http.ResponseWriter, r *http.Request) {
+	templateName := mux.Vars(r)["template-name"]
+	logger := log.WithFields(log.Fields{
+		"remote_addr": r.RemoteAddr,
+		"template":    templateName,
+	})
+
+	session := dash.session.Clone()
+	defer session.Close()
+
+	logger.Info("deleting sleep schedule template")
+	err := dash.sleeper.DeleteScheduleTemplate(templateName, session.DB(""))
+	switch {
+	case err == mgo.ErrNotFound:
+		http.Error(w, "Sleep schedule template not found", http.StatusNotFound)
+	case err != nil:
+		logger.WithError(err).Error("unable to delete sleep schedule template")
+		http.Error(w, "Error deleting sleep schedule template: "+err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// parseHolidayCalendar returns the dates of the events in the posted iCalendar file,
+// so that the dashboard can use them as sleep schedule exception dates.
+func (dash *Dashboard) parseHolidayCalendar(w http.ResponseWriter, r *http.Request) {
+	dates, err := ParseICalendarDates(r.Body)
+	if err != nil {
+		log.WithField("remote_addr", r.RemoteAddr).WithError(err).Warning("unable to parse holiday calendar")
+		http.Error(w, "Error parsing iCalendar file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dates == nil {
+		dates = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(M{"dates": dates}); err != nil {
+		log.WithError(err).Warning("parseHolidayCalendar: unable to send response")
+	}
+}
+
 // On GET shows a confirmation screen, on POST actually restarts.
 func (dash *Dashboard) restartToWebSetup(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
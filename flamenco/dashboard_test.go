@@ -53,9 +53,10 @@ func (s *DashboardTestSuite) SetUpSuite(c *check.C) {
 }
 
 func (s *DashboardTestSuite) SetUpTest(c *check.C) {
-	s.sleeper = CreateSleepScheduler(s.session)
+	waker := CreateWorkerWaker(&s.config, s.session)
+	s.sleeper = CreateSleepScheduler(s.session, waker)
 	blacklist := CreateWorkerBlackList(&s.config, s.session)
-	s.dashboard = CreateDashboard(&s.config, s.session, s.sleeper, blacklist, nil, "unittest-1.0")
+	s.dashboard = CreateDashboard(&s.config, s.session, s.sleeper, waker, blacklist, CreateWorkerQuarantine(&s.config, s.session), CreateRuntimeEstimator(&s.config), nil, nil, nil, "unittest-1.0")
 	s.worker = Worker{
 		Platform:           "linux",
 		SupportedTaskTypes: []string{"sleeping"},
@@ -189,3 +190,109 @@ func (s *DashboardTestSuite) TestScheduleOverride(c *check.C) {
 	assert.Nil(c, err)
 	assert.Equal(c, workerStatusAsleep, found.StatusRequested)
 }
+
+func (s *DashboardTestSuite) sendBulkAction(c *check.C, request BulkWorkerActionRequest,
+	expectedStatusCode int) BulkWorkerActionResponse {
+
+	respRec, req := testJSONRequest(&request, "POST", "/worker-action-bulk")
+	s.dashboard.bulkWorkerAction(respRec, req)
+	assert.Equal(c, expectedStatusCode, respRec.Code)
+
+	response := BulkWorkerActionResponse{}
+	if expectedStatusCode == http.StatusOK {
+		parseJSON(c, respRec, http.StatusOK, &response)
+	}
+	return response
+}
+
+func (s *DashboardTestSuite) TestBulkActionByID(c *check.C) {
+	other := Worker{
+		Platform:           "windows",
+		SupportedTaskTypes: []string{"sleeping"},
+		Nickname:           "workerWin",
+		Status:             workerStatusAwake,
+	}
+	if err := StoreNewWorker(&other, s.db); err != nil {
+		c.Fatal("Unable to insert test worker", err)
+	}
+
+	resp := s.sendBulkAction(c, BulkWorkerActionRequest{
+		Action:    "set-status",
+		Params:    map[string]string{"status": workerStatusAsleep, "lazy": "true"},
+		WorkerIDs: []bson.ObjectId{s.worker.ID, other.ID},
+	}, http.StatusOK)
+
+	if assert.Len(c, resp.Results, 2) {
+		assert.True(c, resp.Results[0].OK)
+		assert.True(c, resp.Results[1].OK)
+	}
+	for _, workerID := range []bson.ObjectId{s.worker.ID, other.ID} {
+		found, err := FindWorkerByID(workerID, s.db)
+		assert.Nil(c, err)
+		assert.Equal(c, workerStatusAsleep, found.StatusRequested)
+		assert.Equal(c, Lazy, found.LazyStatusRequest)
+	}
+}
+
+func (s *DashboardTestSuite) TestBulkActionByFilter(c *check.C) {
+	other := Worker{
+		Platform:           "windows",
+		SupportedTaskTypes: []string{"blender-render"},
+		Nickname:           "render-win",
+		Status:             workerStatusAwake,
+	}
+	if err := StoreNewWorker(&other, s.db); err != nil {
+		c.Fatal("Unable to insert test worker", err)
+	}
+
+	resp := s.sendBulkAction(c, BulkWorkerActionRequest{
+		Action: "shutdown",
+		Filter: &WorkerFilter{Nickname: "render-*"},
+	}, http.StatusOK)
+	if assert.Len(c, resp.Results, 1) {
+		assert.Equal(c, other.ID, resp.Results[0].WorkerID)
+		assert.True(c, resp.Results[0].OK)
+	}
+
+	found, err := FindWorkerByID(s.worker.ID, s.db)
+	assert.Nil(c, err)
+	assert.Equal(c, "", found.StatusRequested)
+
+	resp = s.sendBulkAction(c, BulkWorkerActionRequest{
+		Action: "ack-timeout",
+		Filter: &WorkerFilter{Platform: "linux", TaskType: "sleeping"},
+	}, http.StatusOK)
+	if assert.Len(c, resp.Results, 1) {
+		// The worker isn't timed out, so this should fail for this worker only.
+		assert.Equal(c, s.worker.ID, resp.Results[0].WorkerID)
+		assert.False(c, resp.Results[0].OK)
+		assert.NotEmpty(c, resp.Results[0].Error)
+	}
+}
+
+func (s *DashboardTestSuite) TestBulkActionInvalid(c *check.C) {
+	// No selection at all.
+	s.sendBulkAction(c, BulkWorkerActionRequest{Action: "shutdown"}, http.StatusBadRequest)
+
+	// Unknown action.
+	s.sendBulkAction(c, BulkWorkerActionRequest{
+		Action:    "explode",
+		WorkerIDs: []bson.ObjectId{s.worker.ID},
+	}, http.StatusBadRequest)
+
+	// Unknown action, also when no worker matches the filter.
+	s.sendBulkAction(c, BulkWorkerActionRequest{
+		Action: "explode",
+		Filter: &WorkerFilter{Nickname: "nobody-*"},
+	}, http.StatusBadRequest)
+
+	// Bad nickname pattern.
+	s.sendBulkAction(c, BulkWorkerActionRequest{
+		Action: "shutdown",
+		Filter: &WorkerFilter{Nickname: "render-["},
+	}, http.StatusBadRequest)
+
+	found, err := FindWorkerByID(s.worker.ID, s.db)
+	assert.Nil(c, err)
+	assert.Equal(c, "", found.StatusRequested)
+}
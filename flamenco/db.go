@@ -80,6 +80,18 @@ func ensureIndices(session *mgo.Session) {
 		panic(err)
 	}
 
+	// Used by the RuntimeEstimator to find the recently completed tasks of a job.
+	index = mgo.Index{
+		Key:        []string{"job", "task_type", "status", "-last_updated"},
+		Unique:     false,
+		DropDups:   false,
+		Background: false,
+		Sparse:     false,
+	}
+	if err := db.C("flamenco_tasks").EnsureIndex(index); err != nil {
+		panic(err)
+	}
+
 	index = mgo.Index{
 		Key:        []string{"task_id", "received_on_manager"},
 		Unique:     false,
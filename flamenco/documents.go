@@ -52,6 +52,8 @@ const (
 	workerStatusTimeout  = "timeout"
 	workerStatusAsleep   = "asleep" // listens to a wakeup call, but performs no tasks.
 	workerStatusError    = "error"  // found something wrong with itself, may retry later.
+
+	workerStatusQuarantined = "quarantined" // failed too many tasks across jobs, receives no tasks.
 )
 
 // Command is an executable part of a Task
@@ -87,6 +89,19 @@ type Task struct {
 	WorkerID       *bson.ObjectId `bson:"worker_id,omitempty" json:"-"`        // The worker assigned to this task.
 	LastWorkerPing *time.Time     `bson:"last_worker_ping,omitempty" json:"-"` // When a worker last said it was working on this. Might not have been a task update.
 	LastUpdated    *time.Time     `bson:"last_updated,omitempty" json:"-"`     // when we have last seen an update.
+	FailureClass   string         `bson:"failure_class,omitempty" json:"-"`    // Why the task last failed, see FailureClassRule.
+	ActivatedAt    *time.Time     `bson:"activated_at,omitempty" json:"-"`     // When the task was last assigned to a worker.
+	Straggler      bool           `bson:"straggler,omitempty" json:"-"`        // Running far longer than its completed siblings.
+
+	// Problems found by the RenderOutputVerifier in files produced by this task.
+	RenderOutputProblems []RenderOutputProblem `bson:"render_output_problems,omitempty" json:"-"`
+	// Number of times the RenderOutputVerifier re-queued this task.
+	RenderOutputRequeues int `bson:"render_output_requeues,omitempty" json:"-"`
+
+	// A speculative duplicate of a straggler task, running on another worker.
+	SpeculativeWorkerID *bson.ObjectId `bson:"speculative_worker_id,omitempty" json:"-"`
+	SpeculativeWorker   string         `bson:"speculative_worker,omitempty" json:"-"`
+	SpeculativePing     *time.Time     `bson:"speculative_ping,omitempty" json:"-"`
 }
 
 // WorkerRef is a reference to a worker.
@@ -155,6 +170,7 @@ type WorkerRegistration struct {
 type WorkerSignonDoc struct {
 	SupportedTaskTypes []string `json:"supported_task_types,omitempty"`
 	Nickname           string   `json:"nickname,omitempty"`
+	MACAddress         string   `json:"mac_address,omitempty"` // For Wake-on-LAN.
 }
 
 // WorkerStatus indicates that a status change was requested on the worker.
@@ -185,11 +201,21 @@ type Worker struct {
 	CurrentTaskUpdated *time.Time    `bson:"current_task_updated,omitempty" json:"current_task_updated,omitempty"`
 	CurrentJob         bson.ObjectId `bson:"current_job,omitempty" json:"current_job,omitempty"`
 
+	CurrentTaskFailureClass string `bson:"current_task_failure_class,omitempty" json:"current_task_failure_class,omitempty"`
+
 	// For controlling sleeping & waking up. For values, see the workerStatusXXX constants.
 	StatusRequested   string       `bson:"status_requested" json:"status_requested"`
-	LazyStatusRequest Lazyness     `bson:"lazy_status_request" json:"lazy_status_request"` // Only apply requested status when current task is finished.
+	LazyStatusRequest Lazyness     `bson:"lazy_status_request" json:"lazy_status_request"`           // Only apply requested status when current task is finished.
+	DrainDeadline     *time.Time   `bson:"drain_deadline,omitempty" json:"drain_deadline,omitempty"` // Lazy status request becomes immediate after this time.
 	SleepSchedule     ScheduleInfo `bson:"sleep_schedule,omitempty" json:"sleep_schedule"`
 
+	// For waking up powered-off machines.
+	MACAddress    string     `bson:"mac_address,omitempty" json:"mac_address,omitempty"`
+	WakeOnLANSent *time.Time `bson:"wol_sent,omitempty" json:"wol_sent,omitempty"`
+
+	// For keeping a worker that fails tasks of every job away from all tasks.
+	Quarantine *WorkerQuarantineInfo `bson:"quarantine,omitempty" json:"quarantine,omitempty"`
+
 	// For preventing a failing worker from eating up all tasks of a certain job.
 	Blacklist []WorkerBlacklistEntry `json:"blacklist,omitempty"`
 }
@@ -208,6 +234,29 @@ type ScheduleInfo struct {
 	TimeStart *TimeOfDay `bson:"start,omitempty" json:"time_start,omitempty"`
 	TimeEnd   *TimeOfDay `bson:"end,omitempty" json:"time_end,omitempty"`
 	NextCheck *time.Time `bson:"next_check,omitempty" json:"next_check,omitempty"`
+
+	// IANA time zone name, like "Europe/Amsterdam", in which the days and times are
+	// interpreted. Empty means the Manager's local time zone.
+	TimeZone string `bson:"time_zone,omitempty" json:"time_zone,omitempty"`
+
+	// Dates ("YYYY-MM-DD", in TimeZone) on which the schedule does not apply, such as
+	// public holidays. The worker is kept awake on those days.
+	ExceptionDates []string `bson:"exception_dates,omitempty" json:"exception_dates,omitempty"`
+
+	// Name of the SleepScheduleTemplate this schedule follows. When set, the days,
+	// times, and calendar are copied from the template whenever the schedule is refreshed.
+	Template string `bson:"template,omitempty" json:"template,omitempty"`
+}
+
+// SleepScheduleTemplate is a named sleep schedule that can be followed by multiple workers.
+type SleepScheduleTemplate struct {
+	Name       string     `bson:"_id" json:"name"`
+	DaysOfWeek string     `bson:"days_of_week,omitempty" json:"days_of_week,omitempty"`
+	TimeStart  *TimeOfDay `bson:"start,omitempty" json:"time_start,omitempty"`
+	TimeEnd    *TimeOfDay `bson:"end,omitempty" json:"time_end,omitempty"`
+
+	TimeZone       string   `bson:"time_zone,omitempty" json:"time_zone,omitempty"`
+	ExceptionDates []string `bson:"exception_dates,omitempty" json:"exception_dates,omitempty"`
 }
 
 // UpstreamNotification sent to upstream Flamenco Server upon startup and when
@@ -257,6 +306,12 @@ type StatusReport struct {
 	} `json:"server"`
 
 	DynamicPools *DynamicPoolsStatus `json:"dynamic_pools,omitempty"`
+
+	SleepScheduleTemplates []SleepScheduleTemplate `json:"sleep_schedule_templates"`
+
+	Runtime *RuntimeReport `json:"runtime,omitempty"`
+
+	TaskLogUploads *TaskLogUploadReport `json:"task_log_uploads,omitempty"`
 }
 
 // DynamicPoolsStatus is part of a StatusReport and contains the status of the dynamic worker pools.
@@ -291,6 +346,24 @@ type WorkerBlacklistEntry struct {
 	WorkerID bson.ObjectId `bson:"worker_id" json:"worker_id,omitempty"`
 	JobID    bson.ObjectId `bson:"job_id" json:"job_id"`
 	TaskType string        `bson:"task_type" json:"task_type"`
+
+	// After this time the worker is on probation: it may run tasks of this type
+	// again, but a single failure bans it again. Nil means the ban never expires.
+	Expires *time.Time `bson:"expires,omitempty" json:"expires,omitempty"`
+	// The entry is removed from the database after this time.
+	CleanupAt *time.Time `bson:"cleanup_at,omitempty" json:"-"`
+	// The task the worker was given while on probation. Until that task ends, the worker
+	// gets no other tasks of this type.
+	ProbationTask *bson.ObjectId `bson:"probation_task,omitempty" json:"-"`
+}
+
+// WorkerQuarantineInfo describes why and since when a worker is quarantined.
+type WorkerQuarantineInfo struct {
+	Since  time.Time `bson:"since" json:"since"`
+	Reason string    `bson:"reason" json:"reason"`
+
+	// Set when a test task was queued to decide whether the worker can be released.
+	TestQueued *time.Time `bson:"test_queued,omitempty" json:"test_queued,omitempty"`
 }
 
 // TaskMetrics contains metrics on a specific task, such as timing information.
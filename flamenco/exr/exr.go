@@ -0,0 +1,557 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package exr decodes OpenEXR images, tone-mapping them to 8-bit sRGB.
+//
+// Only single-part scanline images are supported, with the NONE, RLE, ZIPS and ZIP
+// compression methods. This covers the files Blender writes with its default settings.
+// Importing this package registers the decoder with the image package.
+package exr
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+)
+
+const magic = "\x76\x2f\x31\x01"
+
+// Flags in the version field.
+const (
+	flagTiled     = 0x200
+	flagMultiPart = 0x1000
+	flagNonImage  = 0x800
+)
+
+// Compression methods.
+const (
+	compressionNone = 0
+	compressionRLE  = 1
+	compressionZIPS = 2
+	compressionZIP  = 3
+)
+
+// Pixel types of channels.
+const (
+	pixelUint  = 0
+	pixelHalf  = 1
+	pixelFloat = 2
+)
+
+// Images with more pixels are refused, so that a corrupt header cannot make the decoder
+// allocate more memory than is available. This allows images up to 8192×8192 pixels.
+const maxPixels = 1 << 26
+
+// A FormatError reports that the input is not a valid OpenEXR image.
+type FormatError string
+
+func (e FormatError) Error() string { return "exr: invalid format: " + string(e) }
+
+// An UnsupportedError reports that the input uses a valid but unimplemented OpenEXR feature.
+type UnsupportedError string
+
+func (e UnsupportedError) Error() string { return "exr: unsupported feature: " + string(e) }
+
+func init() {
+	image.RegisterFormat("exr", magic, Decode, DecodeConfig)
+}
+
+type channel struct {
+	name      string
+	pixelType int32
+	xSampling int32
+	ySampling int32
+}
+
+func (c channel) size() int {
+	if c.pixelType == pixelHalf {
+		return 2
+	}
+	return 4
+}
+
+type header struct {
+	channels    []channel
+	compression byte
+	dataWindow  image.Rectangle // Max is inclusive, as in the file.
+}
+
+func (h *header) width() int  { return h.dataWindow.Max.X - h.dataWindow.Min.X + 1 }
+func (h *header) height() int { return h.dataWindow.Max.Y - h.dataWindow.Min.Y + 1 }
+
+// DecodeConfig returns the dimensions of an OpenEXR image without decoding it.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{
+		ColorModel: color.NRGBAModel,
+		Width:      h.width(),
+		Height:     h.height(),
+	}, nil
+}
+
+// Decode reads an OpenEXR image. The linear colours are tone-mapped to sRGB.
+func Decode(r io.Reader) (image.Image, error) {
+	// The offset table refers to positions in the file, so just read it all.
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	reader := bytes.NewReader(data)
+	h, err := readHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	headerSize := len(data) - reader.Len()
+	return decodeScanlines(data, headerSize, h)
+}
+
+func readHeader(r io.Reader) (*header, error) {
+	var start [8]byte
+	if _, err := io.ReadFull(r, start[:]); err != nil {
+		return nil, FormatError("not an OpenEXR file")
+	}
+	if string(start[:4]) != magic {
+		return nil, FormatError("not an OpenEXR file")
+	}
+	version := binary.LittleEndian.Uint32(start[4:])
+	if version&0xff != 2 {
+		return nil, UnsupportedError(fmt.Sprintf("version %d", version&0xff))
+	}
+	if version&(flagTiled|flagMultiPart|flagNonImage) != 0 {
+		return nil, UnsupportedError("tiled, deep or multi-part image")
+	}
+
+	h := &header{compression: 0xff}
+	haveDataWindow := false
+	for {
+		name, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			break
+		}
+		if _, err = readString(r); err != nil { // attribute type
+			return nil, err
+		}
+		var size int32
+		if err = binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return nil, err
+		}
+		if size < 0 || size > 1<<24 {
+			return nil, FormatError(fmt.Sprintf("attribute %q has invalid size %d", name, size))
+		}
+		value := make([]byte, size)
+		if _, err = io.ReadFull(r, value); err != nil {
+			return nil, err
+		}
+
+		switch name {
+		case "channels":
+			if h.channels, err = parseChannels(value); err != nil {
+				return nil, err
+			}
+		case "compression":
+			if len(value) != 1 {
+				return nil, FormatError("invalid compression attribute")
+			}
+			h.compression = value[0]
+		case "dataWindow":
+			if len(value) != 16 {
+				return nil, FormatError("invalid dataWindow attribute")
+			}
+			h.dataWindow.Min.X = int(int32(binary.LittleEndian.Uint32(value[0:])))
+			h.dataWindow.Min.Y = int(int32(binary.LittleEndian.Uint32(value[4:])))
+			h.dataWindow.Max.X = int(int32(binary.LittleEndian.Uint32(value[8:])))
+			h.dataWindow.Max.Y = int(int32(binary.LittleEndian.Uint32(value[12:])))
+			haveDataWindow = true
+		}
+	}
+
+	switch {
+	case len(h.channels) == 0:
+		return nil, FormatError("no channels")
+	case !haveDataWindow || h.width() <= 0 || h.height() <= 0:
+		return nil, FormatError("invalid data window")
+	case h.compression == 0xff:
+		return nil, FormatError("missing compression attribute")
+	}
+	return h, nil
+}
+
+func readString(r io.Reader) (string, error) {
+	var buf []byte
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		if len(buf) >= 255 {
+			return "", FormatError("name too long")
+		}
+		buf = append(buf, b[0])
+	}
+}
+
+func parseChannels(value []byte) ([]channel, error) {
+	channels := []channel{}
+	for len(value) > 0 {
+		end := bytes.IndexByte(value, 0)
+		if end < 0 {
+			return nil, FormatError("invalid channel list")
+		}
+		if end == 0 {
+			break
+		}
+		name := string(value[:end])
+		value = value[end+1:]
+		if len(value) < 16 {
+			return nil, FormatError("invalid channel list")
+		}
+		ch := channel{
+			name:      name,
+			pixelType: int32(binary.LittleEndian.Uint32(value[0:])),
+			xSampling: int32(binary.LittleEndian.Uint32(value[8:])),
+			ySampling: int32(binary.LittleEndian.Uint32(value[12:])),
+		}
+		if ch.pixelType < pixelUint || ch.pixelType > pixelFloat {
+			return nil, FormatError(fmt.Sprintf("channel %q has invalid pixel type %d", name, ch.pixelType))
+		}
+		if ch.xSampling != 1 || ch.ySampling != 1 {
+			return nil, UnsupportedError(fmt.Sprintf("subsampled channel %q", name))
+		}
+		channels = append(channels, ch)
+		value = value[16:]
+	}
+	return channels, nil
+}
+
+func linesPerChunk(compression byte) (int, error) {
+	switch compression {
+	case compressionNone, compressionRLE, compressionZIPS:
+		return 1, nil
+	case compressionZIP:
+		return 16, nil
+	}
+	return 0, UnsupportedError(fmt.Sprintf("compression method %d", compression))
+}
+
+// maxCompressionRatio returns how many times smaller than the pixel data the compression
+// method can make it. Pixel data larger than this can't be stored in the file.
+func maxCompressionRatio(compression byte) int {
+	switch compression {
+	case compressionRLE:
+		return 64 // A 2-byte run encodes at most 128 bytes.
+	case compressionZIPS, compressionZIP:
+		return 1032 // The maximum ratio of the deflate algorithm.
+	}
+	return 1
+}
+
+func decodeScanlines(data []byte, offset int, h *header) (image.Image, error) {
+	chunkLines, err := linesPerChunk(h.compression)
+	if err != nil {
+		return nil, err
+	}
+	width, height := h.width(), h.height()
+	if width > maxPixels || height > maxPixels || width*height > maxPixels {
+		return nil, UnsupportedError("image dimensions too large")
+	}
+	pixelSize := 0
+	for _, ch := range h.channels {
+		pixelSize += ch.size()
+	}
+	lineSize := pixelSize * width
+
+	chunkCount := (height + chunkLines - 1) / chunkLines
+	if offset+chunkCount*8 > len(data) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	// Check before allocating anything for the pixels.
+	if lineSize*height > maxCompressionRatio(h.compression)*(len(data)-offset) {
+		return nil, FormatError("data window too large for file size")
+	}
+
+	selected := selectChannels(h.channels)
+	if selected == nil {
+		return nil, UnsupportedError("no RGB or Y channels")
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for chunk := 0; chunk < chunkCount; chunk++ {
+		chunkOffset := binary.LittleEndian.Uint64(data[offset+chunk*8:])
+		if chunkOffset > uint64(len(data)-8) {
+			return nil, FormatError(fmt.Sprintf("chunk %d has invalid offset", chunk))
+		}
+		pos := int(chunkOffset)
+		y := int(int32(binary.LittleEndian.Uint32(data[pos:]))) - h.dataWindow.Min.Y
+		packedSize := int(int32(binary.LittleEndian.Uint32(data[pos+4:])))
+		if y < 0 || y >= height || packedSize < 0 || pos+8+packedSize > len(data) {
+			return nil, FormatError(fmt.Sprintf("chunk %d is invalid", chunk))
+		}
+
+		lines := chunkLines
+		if y+lines > height {
+			lines = height - y
+		}
+		pixels, err := decompress(h.compression, data[pos+8:pos+8+packedSize], lines*lineSize)
+		if err != nil {
+			return nil, FormatError(fmt.Sprintf("chunk %d: %v", chunk, err))
+		}
+		for line := 0; line < lines; line++ {
+			readLine(img, y+line, pixels[line*lineSize:(line+1)*lineSize], h.channels, selected)
+		}
+	}
+	return img, nil
+}
+
+// selectedChannels contains the indices of the channels used for red, green and blue,
+// and of the alpha channel, or -1 if there is none.
+type selectedChannels struct {
+	rgb   [3]int
+	alpha int
+}
+
+// selectChannels picks the channels to show. It prefers the R, G and B channels; in
+// multi-layer files (like Blender writes them) the first layer with all three is used.
+// Luminance-only images use the Y channel for all three. The A channel of the same layer
+// is used for alpha. Returns nil if nothing matches.
+func selectChannels(channels []channel) *selectedChannels {
+	index := map[string]int{}
+	for i, ch := range channels {
+		index[ch.name] = i
+	}
+
+	prefixes := []string{""}
+	for _, ch := range channels {
+		if strings.HasSuffix(ch.name, ".R") {
+			prefixes = append(prefixes, strings.TrimSuffix(ch.name, "R"))
+		}
+	}
+	alpha := func(prefix string) int {
+		if a, ok := index[prefix+"A"]; ok {
+			return a
+		}
+		return -1
+	}
+	for _, prefix := range prefixes {
+		r, okR := index[prefix+"R"]
+		g, okG := index[prefix+"G"]
+		b, okB := index[prefix+"B"]
+		if okR && okG && okB {
+			return &selectedChannels{[3]int{r, g, b}, alpha(prefix)}
+		}
+	}
+	if y, ok := index["Y"]; ok {
+		return &selectedChannels{[3]int{y, y, y}, alpha("")}
+	}
+	return nil
+}
+
+// readLine converts one line of pixel data to sRGB. The data contains all pixels of the
+// first channel, then all pixels of the second channel, etc. in the order of the channel
+// list, which is alphabetical. OpenEXR colours are premultiplied by alpha, so they are
+// divided by alpha before tone mapping.
+func readLine(img *image.NRGBA, y int, line []byte, channels []channel, selected *selectedChannels) {
+	width := img.Bounds().Dx()
+	starts := make([]int, len(channels))
+	start := 0
+	for i, ch := range channels {
+		starts[i] = start
+		start += ch.size() * width
+	}
+
+	row := img.Pix[y*img.Stride:]
+	value := func(x, chIndex int) float32 {
+		ch := channels[chIndex]
+		return readValue(line[starts[chIndex]+x*ch.size():], ch.pixelType)
+	}
+	for x := 0; x < width; x++ {
+		alpha := float32(1)
+		if selected.alpha >= 0 {
+			alpha = value(x, selected.alpha)
+		}
+		switch {
+		case alpha != alpha || alpha <= 0: // NaN or fully transparent
+			row[x*4+0], row[x*4+1], row[x*4+2], row[x*4+3] = 0, 0, 0, 0
+			continue
+		case alpha >= 1:
+			alpha = 1
+		}
+		for component, chIndex := range selected.rgb {
+			row[x*4+component] = toneMap(value(x, chIndex) / alpha)
+		}
+		row[x*4+3] = byte(math.Round(float64(alpha) * 255))
+	}
+}
+
+func readValue(data []byte, pixelType int32) float32 {
+	switch pixelType {
+	case pixelHalf:
+		return halfToFloat(binary.LittleEndian.Uint16(data))
+	case pixelFloat:
+		return math.Float32frombits(binary.LittleEndian.Uint32(data))
+	default:
+		// Unsigned integers are typically IDs, show them as-is but clipped.
+		return float32(binary.LittleEndian.Uint32(data)) / 255
+	}
+}
+
+// halfToFloat converts an IEEE 754 half-precision float to a float32.
+func halfToFloat(half uint16) float32 {
+	sign := uint32(half>>15) << 31
+	exponent := uint32(half>>10) & 0x1f
+	mantissa := uint32(half) & 0x3ff
+
+	switch {
+	case exponent == 0 && mantissa == 0:
+		return math.Float32frombits(sign)
+	case exponent == 0:
+		// Subnormal number.
+		value := float32(mantissa) / (1 << 24)
+		if sign != 0 {
+			return -value
+		}
+		return value
+	case exponent == 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mantissa<<13)
+	}
+	return math.Float32frombits(sign | (exponent+127-15)<<23 | mantissa<<13)
+}
+
+// Linear value above which highlights are compressed, instead of being clipped.
+const toneMapKnee = 0.8
+
+// toneMap converts a linear scene value to an 8-bit sRGB value. Highlights above the knee
+// are rolled off smoothly towards 1.0, so that over-exposed areas keep some detail.
+func toneMap(value float32) byte {
+	v := float64(value)
+	switch {
+	case v != v || v <= 0: // NaN or negative
+		return 0
+	case v > toneMapKnee:
+		shoulder := 1 - toneMapKnee
+		v = toneMapKnee + shoulder*(1-math.Exp(-(v-toneMapKnee)/shoulder))
+	}
+
+	// The sRGB transfer function.
+	if v <= 0.0031308 {
+		v *= 12.92
+	} else {
+		v = 1.055*math.Pow(v, 1/2.4) - 0.055
+	}
+	return byte(math.Min(255, math.Round(v*255)))
+}
+
+func decompress(compression byte, packed []byte, size int) ([]byte, error) {
+	if compression == compressionNone || len(packed) == size {
+		// Chunks that don't get smaller by compression are stored uncompressed.
+		if len(packed) != size {
+			return nil, fmt.Errorf("expected %d bytes, got %d", size, len(packed))
+		}
+		return packed, nil
+	}
+
+	var raw []byte
+	switch compression {
+	case compressionRLE:
+		var err error
+		if raw, err = decompressRLE(packed, size); err != nil {
+			return nil, err
+		}
+	case compressionZIPS, compressionZIP:
+		zr, err := zlib.NewReader(bytes.NewReader(packed))
+		if err != nil {
+			return nil, err
+		}
+		raw = make([]byte, size)
+		if _, err = io.ReadFull(zr, raw); err != nil {
+			return nil, err
+		}
+	}
+	return reorder(undoPredictor(raw)), nil
+}
+
+func decompressRLE(packed []byte, size int) ([]byte, error) {
+	raw := make([]byte, 0, size)
+	for len(packed) > 0 {
+		count := int(int8(packed[0]))
+		packed = packed[1:]
+		if count < 0 {
+			count = -count
+			if count > len(packed) || len(raw)+count > size {
+				return nil, errors.New("invalid RLE data")
+			}
+			raw = append(raw, packed[:count]...)
+			packed = packed[count:]
+			continue
+		}
+		if len(packed) == 0 || len(raw)+count+1 > size {
+			return nil, errors.New("invalid RLE data")
+		}
+		for i := 0; i <= count; i++ {
+			raw = append(raw, packed[0])
+		}
+		packed = packed[1:]
+	}
+	if len(raw) != size {
+		return nil, fmt.Errorf("expected %d bytes, got %d", size, len(raw))
+	}
+	return raw, nil
+}
+
+// undoPredictor reverses the delta encoding that is applied before RLE and ZIP compression.
+func undoPredictor(data []byte) []byte {
+	for i := 1; i < len(data); i++ {
+		data[i] = data[i-1] + data[i] - 128
+	}
+	return data
+}
+
+// reorder interleaves the two halves of the data; the compressor puts the even bytes
+// in the first half and the odd bytes in the second.
+func reorder(data []byte) []byte {
+	out := make([]byte, len(data))
+	half := (len(data) + 1) / 2
+	for i := range out {
+		if i%2 == 0 {
+			out[i] = data[i/2]
+		} else {
+			out[i] = data[half+i/2]
+		}
+	}
+	return out
+}
@@ -0,0 +1,340 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package exr
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Half-float values for the test images.
+const (
+	halfZero = 0x0000
+	halfHalf = 0x3800 // 0.5
+	halfOne  = 0x3c00 // 1.0
+	halfTwo  = 0x4000 // 2.0
+)
+
+// testChannel is a channel of an image written by encode().
+type testChannel struct {
+	name   string
+	values []uint16 // half floats, one per pixel, row by row.
+}
+
+// encode writes a scanline OpenEXR file with half-float channels.
+// The channels should be sorted by name, like OpenEXR itself does.
+func encode(t *testing.T, width, height int, compression byte, channels []testChannel) []byte {
+	var buf bytes.Buffer
+	write := func(value interface{}) {
+		assert.Nil(t, binary.Write(&buf, binary.LittleEndian, value))
+	}
+	attribute := func(name, typeName string, value []byte) {
+		buf.WriteString(name + "\x00" + typeName + "\x00")
+		write(int32(len(value)))
+		buf.Write(value)
+	}
+
+	buf.WriteString(magic)
+	write(uint32(2))
+
+	var chlist bytes.Buffer
+	for _, ch := range channels {
+		chlist.WriteString(ch.name + "\x00")
+		binary.Write(&chlist, binary.LittleEndian, []int32{pixelHalf, 0, 1, 1})
+	}
+	chlist.WriteByte(0)
+	attribute("channels", "chlist", chlist.Bytes())
+	attribute("compression", "compression", []byte{compression})
+	var window bytes.Buffer
+	binary.Write(&window, binary.LittleEndian, []int32{0, 0, int32(width - 1), int32(height - 1)})
+	attribute("dataWindow", "box2i", window.Bytes())
+	attribute("displayWindow", "box2i", window.Bytes())
+	buf.WriteByte(0)
+
+	chunkLines, err := linesPerChunk(compression)
+	assert.Nil(t, err)
+	chunks := [][]byte{}
+	for y := 0; y < height; y += chunkLines {
+		var raw bytes.Buffer
+		for line := y; line < y+chunkLines && line < height; line++ {
+			for _, ch := range channels {
+				binary.Write(&raw, binary.LittleEndian, ch.values[line*width:(line+1)*width])
+			}
+		}
+		chunk := bytes.Buffer{}
+		binary.Write(&chunk, binary.LittleEndian, int32(y))
+		packed := compress(t, compression, raw.Bytes())
+		binary.Write(&chunk, binary.LittleEndian, int32(len(packed)))
+		chunk.Write(packed)
+		chunks = append(chunks, chunk.Bytes())
+	}
+
+	offset := buf.Len() + 8*len(chunks)
+	for _, chunk := range chunks {
+		write(uint64(offset))
+		offset += len(chunk)
+	}
+	for _, chunk := range chunks {
+		buf.Write(chunk)
+	}
+	return buf.Bytes()
+}
+
+// compress is the inverse of decompress().
+func compress(t *testing.T, compression byte, raw []byte) []byte {
+	if compression == compressionNone {
+		return raw
+	}
+
+	// Split into even and odd bytes, then apply the predictor.
+	tmp := make([]byte, 0, len(raw))
+	for i := 0; i < len(raw); i += 2 {
+		tmp = append(tmp, raw[i])
+	}
+	for i := 1; i < len(raw); i += 2 {
+		tmp = append(tmp, raw[i])
+	}
+	for i := len(tmp) - 1; i > 0; i-- {
+		tmp[i] = tmp[i] - tmp[i-1] + 128
+	}
+
+	var packed bytes.Buffer
+	switch compression {
+	case compressionRLE:
+		// Runs of identical bytes, and everything else as literals of one byte.
+		for i := 0; i < len(tmp); {
+			run := 1
+			for i+run < len(tmp) && tmp[i+run] == tmp[i] && run < 128 {
+				run++
+			}
+			if run > 1 {
+				packed.WriteByte(byte(run - 1))
+			} else {
+				packed.WriteByte(byte(0xff)) // -1: one literal byte
+			}
+			packed.WriteByte(tmp[i])
+			i += run
+		}
+	default:
+		zw := zlib.NewWriter(&packed)
+		zw.Write(tmp)
+		assert.Nil(t, zw.Close())
+	}
+	return packed.Bytes()
+}
+
+func gradient(width, height int, value func(x, y int) uint16) []uint16 {
+	values := make([]uint16, 0, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			values = append(values, value(x, y))
+		}
+	}
+	return values
+}
+
+func TestDecodeCompressions(t *testing.T) {
+	width, height := 5, 37 // More than two ZIP chunks, the last one partial.
+	channels := []testChannel{
+		{"A", gradient(width, height, func(x, y int) uint16 { return halfOne })},
+		{"B", gradient(width, height, func(x, y int) uint16 { return halfZero })},
+		{"G", gradient(width, height, func(x, y int) uint16 { return uint16(y * 0x100) })},
+		{"R", gradient(width, height, func(x, y int) uint16 { return halfOne })},
+	}
+
+	for _, compression := range []byte{compressionNone, compressionRLE, compressionZIPS, compressionZIP} {
+		data := encode(t, width, height, compression, channels)
+
+		config, format, err := image.DecodeConfig(bytes.NewReader(data))
+		if !assert.Nil(t, err, "compression %d", compression) {
+			continue
+		}
+		assert.Equal(t, "exr", format)
+		assert.Equal(t, width, config.Width)
+		assert.Equal(t, height, config.Height)
+
+		img, format, err := image.Decode(bytes.NewReader(data))
+		if !assert.Nil(t, err, "compression %d", compression) {
+			continue
+		}
+		assert.Equal(t, "exr", format)
+		rgba := img.(*image.NRGBA)
+		for y := 0; y < height; y++ {
+			green := toneMap(halfToFloat(uint16(y * 0x100)))
+			for x := 0; x < width; x++ {
+				expect := [4]byte{toneMap(1), green, 0, 0xff}
+				offset := rgba.PixOffset(x, y)
+				if !assert.Equal(t, expect[:], rgba.Pix[offset:offset+4], "compression %d, pixel %d,%d", compression, x, y) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeLayers(t *testing.T) {
+	// Blender writes multi-layer files with channel names like "ViewLayer.Combined.R".
+	fill := func(value uint16) []uint16 { return []uint16{value, value} }
+	channels := []testChannel{
+		{"ViewLayer.Combined.A", fill(halfOne)},
+		{"ViewLayer.Combined.B", fill(halfZero)},
+		{"ViewLayer.Combined.G", fill(halfHalf)},
+		{"ViewLayer.Combined.R", fill(halfTwo)},
+		{"ViewLayer.Depth.Z", fill(halfTwo)},
+	}
+	img, err := Decode(bytes.NewReader(encode(t, 2, 1, compressionZIP, channels)))
+	if !assert.Nil(t, err) {
+		return
+	}
+	r, g, b, a := img.At(1, 0).RGBA()
+	assert.Equal(t, uint32(toneMap(2)), r>>8)
+	assert.Equal(t, uint32(toneMap(0.5)), g>>8)
+	assert.Equal(t, uint32(0), b>>8)
+	assert.Equal(t, uint32(0xff), a>>8)
+
+	// Luminance-only images are shown in greyscale.
+	img, err = Decode(bytes.NewReader(encode(t, 2, 1, compressionNone, []testChannel{{"Y", fill(halfHalf)}})))
+	if !assert.Nil(t, err) {
+		return
+	}
+	r, g, b, _ = img.At(0, 0).RGBA()
+	assert.Equal(t, []uint32{188, 188, 188}, []uint32{r >> 8, g >> 8, b >> 8})
+
+	_, err = Decode(bytes.NewReader(encode(t, 2, 1, compressionNone, []testChannel{{"Z", fill(halfHalf)}})))
+	assert.NotNil(t, err)
+}
+
+func TestDecodeAlpha(t *testing.T) {
+	// Colours are premultiplied by alpha in OpenEXR, but not in the decoded image.
+	channels := []testChannel{
+		{"A", []uint16{halfOne, halfHalf, halfZero}},
+		{"B", []uint16{halfZero, halfZero, halfZero}},
+		{"G", []uint16{halfHalf, halfHalf, halfZero}},
+		{"R", []uint16{halfOne, halfHalf, halfOne}},
+	}
+	img, err := Decode(bytes.NewReader(encode(t, 3, 1, compressionNone, channels)))
+	if !assert.Nil(t, err) {
+		return
+	}
+	nrgba := img.(*image.NRGBA)
+	assert.Equal(t, []byte{
+		toneMap(1), toneMap(0.5), 0, 0xff,
+		toneMap(1), toneMap(1), 0, 0x80,
+		0, 0, 0, 0,
+	}, nrgba.Pix)
+
+	file, err := os.Open("testdata/transparent.exr")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer file.Close()
+	img, err = Decode(file)
+	if !assert.Nil(t, err) {
+		return
+	}
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			_, _, _, a := img.At(x, y).RGBA()
+			assert.Equal(t, uint32(0), a, "pixel %d,%d", x, y)
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	_, err := Decode(bytes.NewReader([]byte("not an EXR file")))
+	assert.IsType(t, FormatError(""), err)
+
+	data := encode(t, 2, 2, compressionZIP, []testChannel{{"Y", []uint16{1, 2, 3, 4}}})
+	_, err = Decode(bytes.NewReader(data[:len(data)-4]))
+	assert.NotNil(t, err, "truncated file should not decode")
+
+	// PIZ compression is not supported.
+	piz := bytes.Replace(data, []byte("compression\x00compression\x00\x01\x00\x00\x00\x03"),
+		[]byte("compression\x00compression\x00\x01\x00\x00\x00\x04"), 1)
+	_, err = Decode(bytes.NewReader(piz))
+	assert.IsType(t, UnsupportedError(""), err)
+}
+
+// withDataWindow returns the image with the given maximum coordinates of its data window.
+func withDataWindow(data []byte, maxX, maxY int32) []byte {
+	attribute := []byte("dataWindow\x00box2i\x00\x10\x00\x00\x00")
+	start := bytes.Index(data, attribute) + len(attribute)
+	patched := append([]byte{}, data...)
+	binary.LittleEndian.PutUint32(patched[start+8:], uint32(maxX))
+	binary.LittleEndian.PutUint32(patched[start+12:], uint32(maxY))
+	return patched
+}
+
+func TestDecodeHugeDataWindow(t *testing.T) {
+	data := encode(t, 2, 2, compressionZIP, []testChannel{{"Y", []uint16{1, 2, 3, 4}}})
+
+	// Used to make the decoder run out of memory, which crashes the entire Manager.
+	huge := withDataWindow(data, 0x7ffffff0, 1)
+	_, err := Decode(bytes.NewReader(huge))
+	assert.IsType(t, UnsupportedError(""), err)
+	// The dimensions can be inspected without decoding.
+	config, err := DecodeConfig(bytes.NewReader(huge))
+	assert.Nil(t, err)
+	assert.Equal(t, 0x7ffffff1, config.Width)
+
+	// Allowed dimensions, but too large to be stored in such a small file.
+	uncompressed := encode(t, 2, 2, compressionNone, []testChannel{{"Y", []uint16{1, 2, 3, 4}}})
+	_, err = Decode(bytes.NewReader(withDataWindow(uncompressed, 4095, 1)))
+	assert.IsType(t, FormatError(""), err)
+	_, err = Decode(bytes.NewReader(withDataWindow(data, 1<<20-1, 1)))
+	assert.IsType(t, FormatError(""), err)
+}
+
+func TestHalfToFloat(t *testing.T) {
+	assert.Equal(t, float32(0), halfToFloat(halfZero))
+	assert.Equal(t, float32(0.5), halfToFloat(halfHalf))
+	assert.Equal(t, float32(1), halfToFloat(halfOne))
+	assert.Equal(t, float32(-2), halfToFloat(0xc000))
+	assert.Equal(t, float32(65504), halfToFloat(0x7bff))
+	assert.Equal(t, float32(math.Pow(2, -24)), halfToFloat(0x0001))
+	assert.True(t, math.IsInf(float64(halfToFloat(0x7c00)), 1))
+	assert.True(t, math.IsNaN(float64(halfToFloat(0x7e00))))
+}
+
+func TestToneMap(t *testing.T) {
+	assert.Equal(t, byte(0), toneMap(-1))
+	assert.Equal(t, byte(0), toneMap(float32(math.NaN())))
+	assert.Equal(t, byte(0), toneMap(0))
+	assert.Equal(t, byte(188), toneMap(0.5)) // plain sRGB below the knee
+	assert.Equal(t, byte(255), toneMap(float32(math.Inf(1))))
+
+	// Highlights are compressed instead of clipped.
+	previous := toneMap(toneMapKnee)
+	for _, value := range []float32{1, 1.5, 2} {
+		current := toneMap(value)
+		assert.True(t, current > previous, "toneMap(%v)=%d should be brighter than %d", value, current, previous)
+		previous = current
+	}
+}
@@ -0,0 +1,86 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FailureClassRule maps the log of a failing task to a failure class.
+type FailureClassRule struct {
+	Class   string `yaml:"class"`
+	Pattern string `yaml:"pattern"` // Regular expression, matched against the last log chunk of the failing task.
+
+	// Failures of this class are not held against the worker, for example because every
+	// worker would fail the same way. Such failures never blacklist or quarantine a worker.
+	SkipBlacklist bool `yaml:"skip_blacklist,omitempty"`
+}
+
+type compiledFailureClassRule struct {
+	FailureClassRule
+	regexp *regexp.Regexp
+}
+
+// failureClassifier determines the failure class of failing tasks from their logs.
+type failureClassifier struct {
+	rules []compiledFailureClassRule
+}
+
+// Default rules, used when the configuration file doesn't specify any.
+var defaultFailureClassRules = []FailureClassRule{
+	{Class: "out-of-memory", Pattern: `(?i)(out of memory|std::bad_alloc|MemoryError|cannot allocate memory)`},
+	{Class: "missing-file", Pattern: `(?i)(no such file or directory|file not found|cannot read file)`, SkipBlacklist: true},
+	{Class: "license", Pattern: `(?i)(licen[cs]e (error|expired|not found|checkout failed)|no licen[cs]e)`},
+	{Class: "blender-crash", Pattern: `(?i)(segmentation fault|SIGSEGV|writing: .*\.crash\.txt)`},
+	{Class: "timeout", Pattern: `(?i)(timed out|timeout)`},
+}
+
+// newFailureClassifier compiles the rules. Rules with an invalid pattern are logged and skipped.
+func newFailureClassifier(rules []FailureClassRule) *failureClassifier {
+	fc := failureClassifier{}
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey:    err,
+				"failure_class": rule.Class,
+				"pattern":       rule.Pattern,
+			}).Error("invalid failure class pattern, ignoring this rule")
+			continue
+		}
+		fc.rules = append(fc.rules, compiledFailureClassRule{rule, re})
+	}
+	return &fc
+}
+
+// classify returns the first rule that matches the log, or nil if none of them do.
+func (fc *failureClassifier) classify(logText string) *FailureClassRule {
+	for idx := range fc.rules {
+		if fc.rules[idx].regexp.MatchString(logText) {
+			return &fc.rules[idx].FailureClassRule
+		}
+	}
+	return nil
+}
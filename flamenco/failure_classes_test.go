@@ -0,0 +1,68 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+)
+
+type FailureClassifierTestSuite struct{}
+
+var _ = check.Suite(&FailureClassifierTestSuite{})
+
+func (s *FailureClassifierTestSuite) TestDefaultRules(c *check.C) {
+	fc := newFailureClassifier(defaultFailureClassRules)
+	assert.Equal(c, len(defaultFailureClassRules), len(fc.rules))
+
+	classOf := func(logText string) string {
+		rule := fc.classify(logText)
+		if rule == nil {
+			return ""
+		}
+		return rule.Class
+	}
+
+	assert.Equal(c, "", classOf(""))
+	assert.Equal(c, "", classOf("Fra:1 Mem:12.00M | Rendering 1 / 64 samples\n"))
+	assert.Equal(c, "out-of-memory", classOf("Error: Out of memory in CUDA queue enqueue (integrator_shade_surface)\n"))
+	assert.Equal(c, "missing-file", classOf("Warning: Unable to open '/render/shot.blend': No such file or directory\n"))
+	assert.Equal(c, "license", classOf("ERROR: license checkout failed for feature 'render'\n"))
+	assert.Equal(c, "blender-crash", classOf("Writing: /tmp/shot.crash.txt\nSegmentation fault (core dumped)\n"))
+	assert.Equal(c, "timeout", classOf("Connection to shared storage timed out\n"))
+}
+
+func (s *FailureClassifierTestSuite) TestRuleOrder(c *check.C) {
+	fc := newFailureClassifier([]FailureClassRule{
+		{Class: "invalid", Pattern: "(unclosed"},
+		{Class: "first", Pattern: "fail"},
+		{Class: "second", Pattern: "failure"},
+	})
+	assert.Equal(c, 2, len(fc.rules), "invalid rules should be skipped")
+
+	rule := fc.classify("there was a failure")
+	if assert.NotNil(c, rule) {
+		assert.Equal(c, "first", rule.Class)
+	}
+	assert.Nil(c, fc.classify("all good"))
+}
@@ -23,6 +23,7 @@
 package flamenco
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
@@ -41,6 +42,8 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 var imageExtensions = map[string]bool{
@@ -69,12 +72,21 @@ const imageQueueSize = 3
 // LatestImageSystem ties an ImageWatcher to a the fswatcher_middle and fswatcher_http stuff,
 // allowing the results to be pushed via HTTP to browsers.
 type LatestImageSystem struct {
+	config       *Conf
+	session      *mgo.Session
 	imageWatcher *ImageWatcher
 	broadcaster  *chantools.OneToManyChan
-
-	// Paths to images can be sent to this channel, and will be
+	// Broadcasts "{job ID}/{thumbnail filename}" for images added to a job gallery.
+	jobBroadcaster *chantools.OneToManyChan
+	galleries      *jobGalleries
+	// Checks the files produced by workers; nil when verification is disabled.
+	verifier *RenderOutputVerifier
+	// Collects the frames of each job for its preview movie; nil when disabled.
+	previewMovies *PreviewMovieAssembler
+
+	// Images can be sent to this channel, and will be
 	// run through the middleware and sent to the broadcaster.
-	imageCreated chan string
+	imageCreated chan producedImage
 }
 
 // Struct to keep track of image files in a heap.
@@ -105,18 +117,29 @@ type ImageWatcher struct {
 }
 
 // CreateLatestImageSystem sets up a LatestImageSystem
-func CreateLatestImageSystem(watchPath string) *LatestImageSystem {
-	lis := &LatestImageSystem{}
-
-	if watchPath != "" {
-		lis.imageWatcher = CreateImageWatcher(watchPath, imageQueueSize)
-		lis.imageCreated = lis.imageWatcher.imageCreated
-	} else {
-		lis.imageCreated = make(chan string, imageQueueSize)
+func CreateLatestImageSystem(config *Conf, session *mgo.Session, verifier *RenderOutputVerifier,
+	previewMovies *PreviewMovieAssembler) *LatestImageSystem {
+	converter, err := createImageConverter(config)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to create image converter")
 	}
 
 	imageDir := path.Dir(LatestImageLocation)
-	err := os.MkdirAll(imageDir, 0777)
+	lis := &LatestImageSystem{
+		config:        config,
+		session:       session,
+		imageCreated:  make(chan producedImage, imageQueueSize),
+		verifier:      verifier,
+		previewMovies: previewMovies,
+		galleries:     newJobGalleries(path.Join(imageDir, jobGalleriesDirname), config.LatestImagesPerJob, converter),
+	}
+
+	if config.WatchForLatestImage != "" {
+		lis.imageWatcher = CreateImageWatcher(config.WatchForLatestImage, imageQueueSize)
+		go lis.attributeWatchedImages()
+	}
+
+	err = os.MkdirAll(imageDir, 0777)
 	if err != nil && !os.IsExist(err) {
 		logrus.WithFields(logrus.Fields{
 			logrus.ErrorKey: err,
@@ -124,12 +147,44 @@ func CreateLatestImageSystem(watchPath string) *LatestImageSystem {
 		}).Fatal("unable to create directory for latest image")
 	}
 
-	middleware := ConvertAndForward(lis.imageCreated)
+	middleware, jobMiddleware := ConvertAndForward(lis.imageCreated, converter, lis.galleries)
 	lis.broadcaster = chantools.NewOneToManyChan(middleware)
+	lis.jobBroadcaster = chantools.NewOneToManyChan(jobMiddleware)
 
 	return lis
 }
 
+// attributeWatchedImages attributes the images found by the image watcher to jobs,
+// and passes them on to the middleware.
+func (lis *LatestImageSystem) attributeWatchedImages() {
+	defer close(lis.imageCreated)
+
+	for imagePath := range lis.imageWatcher.ImageCreated {
+		lis.imageCreated <- producedImage{
+			path:  imagePath,
+			jobID: lis.jobOfImagePath(imagePath),
+		}
+	}
+}
+
+func (lis *LatestImageSystem) jobOfImagePath(imagePath string) bson.ObjectId {
+	if lis.session == nil {
+		return ""
+	}
+	session := lis.session.Copy()
+	defer session.Close()
+	return jobOfImagePath(imagePath, lis.config, session.DB(""))
+}
+
+func (lis *LatestImageSystem) currentTaskOfWorker(workerID string) *Task {
+	if lis.session == nil {
+		return nil
+	}
+	session := lis.session.Copy()
+	defer session.Close()
+	return currentTaskOfWorker(workerID, session.DB(""))
+}
+
 // AddRoutes adds the HTTP Server-Side Events endpoint to the router.
 func (lis *LatestImageSystem) AddRoutes(
 	router *mux.Router,
@@ -139,6 +194,10 @@ func (lis *LatestImageSystem) AddRoutes(
 	router.Handle("/imagewatch", userAuth.WrapFunc(lis.serverSideEvents)).Methods("GET")
 	router.Handle("/latest-image.jpg", userAuth.WrapFunc(lis.serveLatestImage)).Methods("GET")
 	router.HandleFunc("/output-produced", workerAuth.Wrap(lis.outputProduced)).Methods("POST")
+	router.Handle("/imagewatch/jobs/{job-id}", userAuth.WrapFunc(lis.jobServerSideEvents)).Methods("GET")
+	router.Handle("/latest-image/jobs/{job-id}/{filename}", userAuth.WrapFunc(lis.serveJobImage)).Methods("GET")
+	router.Handle("/api/latest-images/jobs", userAuth.WrapFunc(lis.listJobGalleries)).Methods("GET")
+	router.Handle("/api/latest-images/jobs/{job-id}", userAuth.WrapFunc(lis.listJobImages)).Methods("GET")
 
 	// Just for logging stuff, nothing special.
 	go func() {
@@ -168,12 +227,18 @@ func (lis *LatestImageSystem) outputProduced(w http.ResponseWriter, r *auth.Auth
 		return
 	}
 
-	// I don't want to hook up MongoDB to the LatestImageSystem, so we can't find
-	// the worker's nickname.
+	// The images are attributed to the job of the worker's current task.
+	var jobID bson.ObjectId
+	task := lis.currentTaskOfWorker(r.Username)
 	logFields := log.Fields{
 		"worker":      r.Username,
 		"remote_addr": r.RemoteAddr,
 	}
+	if task != nil {
+		jobID = task.Job
+		logFields["job_id"] = jobID.Hex()
+		logFields["task_id"] = task.ID.Hex()
+	}
 
 	if len(payload.Paths) == 0 {
 		w.WriteHeader(http.StatusUnprocessableEntity)
@@ -181,13 +246,20 @@ func (lis *LatestImageSystem) outputProduced(w http.ResponseWriter, r *auth.Auth
 		return
 	}
 
+	if lis.verifier != nil && task != nil {
+		lis.verifier.Queue(bson.ObjectIdHex(r.Username), task.ID, payload.Paths)
+	}
+	if lis.previewMovies != nil && task != nil {
+		lis.previewMovies.AddFrames(task, payload.Paths)
+	}
+
 	log.WithFields(logFields).WithField("image_count", len(payload.Paths)).Debug("LatestImageSystem: files were produced on worker")
 	for _, path := range payload.Paths {
 		logFields["path"] = path
 
 		// Send the path to the channel to push it through the conversion & to the browser.
 		select {
-		case lis.imageCreated <- path:
+		case lis.imageCreated <- producedImage{path, jobID}:
 			log.WithFields(logFields).Info("LatestImageSystem: output was queued for conversion")
 		default:
 			log.WithFields(logFields).Warning("LatestImageSystem: output was discarded, conversion queue is full")
@@ -212,6 +284,62 @@ func (lis *LatestImageSystem) serveLatestImage(w http.ResponseWriter, r *http.Re
 	http.ServeFile(w, r, LatestImageLocation)
 }
 
+func (lis *LatestImageSystem) jobServerSideEvents(w http.ResponseWriter, r *http.Request) {
+	jobID, err := ObjectIDFromRequest(w, r, "job-id")
+	if err != nil {
+		return
+	}
+	JobImageHTTPPush(w, r, lis.jobBroadcaster, jobID)
+}
+
+// Serve a thumbnail from a job gallery.
+func (lis *LatestImageSystem) serveJobImage(w http.ResponseWriter, r *http.Request) {
+	jobID, err := ObjectIDFromRequest(w, r, "job-id")
+	if err != nil {
+		return
+	}
+	thumbPath, err := lis.galleries.thumbnailPath(jobID, mux.Vars(r)["filename"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.ServeFile(w, r, thumbPath)
+}
+
+// listJobGalleries sends a summary of the gallery of every job as JSON.
+func (lis *LatestImageSystem) listJobGalleries(w http.ResponseWriter, r *http.Request) {
+	galleries, err := lis.galleries.galleries()
+	if err != nil {
+		log.WithError(err).Error("LatestImageSystem: unable to list job galleries")
+		http.Error(w, "unable to list job galleries", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(galleries); err != nil {
+		log.WithError(err).Debug("LatestImageSystem: unable to send job galleries")
+	}
+}
+
+// listJobImages sends the thumbnails of one job as JSON, newest first.
+func (lis *LatestImageSystem) listJobImages(w http.ResponseWriter, r *http.Request) {
+	jobID, err := ObjectIDFromRequest(w, r, "job-id")
+	if err != nil {
+		return
+	}
+	images, err := lis.galleries.images(jobID)
+	if err != nil {
+		log.WithError(err).WithField("job_id", jobID.Hex()).Error("LatestImageSystem: unable to list job gallery")
+		http.Error(w, "unable to list job gallery", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(images); err != nil {
+		log.WithError(err).Debug("LatestImageSystem: unable to send job gallery")
+	}
+}
+
 // Go starts the image watcher, if the path to watch isn't empty.
 func (lis *LatestImageSystem) Go() {
 	if lis.imageWatcher == nil {
@@ -26,14 +26,37 @@ import (
 	"fmt"
 	"net/http"
 	"path/filepath"
+	"strings"
 
 	"github.com/armadillica/flamenco-manager/flamenco/chantools"
 
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
 )
 
 // ImageWatcherHTTPPush starts a server-side events channel.
 func ImageWatcherHTTPPush(w http.ResponseWriter, r *http.Request, broadcaster *chantools.OneToManyChan) {
+	imageEventStream(w, r, broadcaster, func(path string) (string, bool) {
+		return filepath.Base(path), true
+	})
+}
+
+// JobImageHTTPPush starts a server-side events channel for the gallery of a single job.
+// It sends the URL of each new thumbnail.
+func JobImageHTTPPush(w http.ResponseWriter, r *http.Request, broadcaster *chantools.OneToManyChan, jobID bson.ObjectId) {
+	prefix := jobID.Hex() + "/"
+	imageEventStream(w, r, broadcaster, func(message string) (string, bool) {
+		if !strings.HasPrefix(message, prefix) {
+			return "", false
+		}
+		return jobGalleryImageURL(jobID, strings.TrimPrefix(message, prefix)), true
+	})
+}
+
+// imageEventStream sends an 'image' event for every broadcast message; 'filter' returns
+// the data to send, and whether to send anything at all.
+func imageEventStream(w http.ResponseWriter, r *http.Request, broadcaster *chantools.OneToManyChan,
+	filter func(message string) (string, bool)) {
 	logger := log.WithFields(log.Fields{
 		"remote_addr": r.RemoteAddr,
 		"url":         r.URL.Path,
@@ -80,14 +103,18 @@ func ImageWatcherHTTPPush(w http.ResponseWriter, r *http.Request, broadcaster *c
 		case <-closeNotifier.CloseNotify():
 			logger.Debug("ImageWatcher: Connection closed")
 			return
-		case path, ok := <-pathChannel:
+		case message, ok := <-pathChannel:
 			if !ok {
 				// Shutting down.
 				return
 			}
+			data, send := filter(message)
+			if !send {
+				continue
+			}
 			logger.Debug("ImageWatcher: Sending notification")
 			fmt.Fprintf(w, "event: image\n")
-			fmt.Fprintf(w, "data: %s\n\n", filepath.Base(path))
+			fmt.Fprintf(w, "data: %s\n\n", data)
 			f.Flush()
 		}
 	}
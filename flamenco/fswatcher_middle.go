@@ -23,48 +23,63 @@
 package flamenco
 
 import (
-	"bytes"
 	"path"
 
 	"github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
 )
 
+// producedImage is an image that was rendered, optionally attributed to the job it was rendered for.
+type producedImage struct {
+	path  string
+	jobID bson.ObjectId
+}
+
 // ConvertAndForward copies each image it reads from 'images', converts it to a browser-
-// friendly file, and forwards the new filename to the returned channel. It always converts
+// friendly file with the given converter, and forwards the new filename to the returned channel. It always converts
 // to JPEG, even when the file is a browser-supported format (like PNG), so that the HTML
 // can always refer to /static/latest-image.jpg to show the latest render.
-func ConvertAndForward(images <-chan string) <-chan string {
+//
+// Images attributed to a job are also added to the job's gallery, and "{job ID}/{thumbnail}"
+// is forwarded to the second returned channel.
+func ConvertAndForward(images <-chan producedImage, converter imageConverter, galleries *jobGalleries) (<-chan string, <-chan string) {
 	output := make(chan string)
-	logger := logrus.WithField("dst", LatestImageLocation)
+	jobOutput := make(chan string)
 	outname := path.Base(LatestImageLocation)
 
 	go func() {
+		defer close(output)
+		defer close(jobOutput)
 
-		for path := range images {
-			logger = logger.WithField("src", path)
+		for image := range images {
+			logger := logrus.WithFields(logrus.Fields{
+				"dst": LatestImageLocation,
+				"src": image.path,
+			})
+			if image.jobID != "" {
+				logger = logger.WithField("job_id", image.jobID.Hex())
+			}
 			logger.Info("ConvertAndForward: Converting image")
 
-			cmd := imageMagickConvert(path,
-				"-quality", "85",
-				"-resize", "1920x1080>", // convert to 2MPixels max, but never enlarge.
-				LatestImageLocation)
-
-			var stdout, stderr bytes.Buffer
-			cmd.Stdout = &stdout
-			cmd.Stderr = &stderr
-
-			if err := cmd.Run(); err != nil {
-				logger.WithFields(logrus.Fields{
-					logrus.ErrorKey: err,
-					"stdout":        stdout.String(),
-					"stderr":        stderr.String(),
-				}).Error("ConvertAndForward: error converting image")
+			err := converter.convert(image.path, LatestImageLocation, latestImageMaxSize, latestImageQuality)
+			if err != nil {
+				logger.WithError(err).Error("ConvertAndForward: error converting image")
 				continue
 			}
 
 			output <- outname
+
+			if image.jobID == "" || galleries == nil {
+				continue
+			}
+			thumbnail, err := galleries.add(image.jobID, LatestImageLocation, image.path)
+			if err != nil {
+				logger.WithError(err).Error("ConvertAndForward: error adding image to job gallery")
+				continue
+			}
+			jobOutput <- image.jobID.Hex() + "/" + thumbnail
 		}
 	}()
 
-	return output
+	return output, jobOutput
 }
@@ -46,7 +46,7 @@ func (s *LISQueueingTestSuite) SetUpTest(c *check.C) {
 
 	// Construct a LatestImageSystem without any middleware, so we can test filling up the queue.
 	s.lis = &LatestImageSystem{
-		imageCreated: make(chan string, 3), // mimick imageQueueSize = 3
+		imageCreated: make(chan producedImage, 3), // mimick imageQueueSize = 3
 	}
 }
 
@@ -72,12 +72,12 @@ func (s *LISQueueingTestSuite) TestImageQueueing(t *check.C) {
 	}
 
 	// The queue should contain the first "imageQueueSize" items now.
-	assert.Equal(t, "/path/to/img-000.jpg", <-s.lis.imageCreated)
-	assert.Equal(t, "/path/to/img-001.jpg", <-s.lis.imageCreated)
-	assert.Equal(t, "/path/to/img-002.jpg", <-s.lis.imageCreated)
+	assert.Equal(t, "/path/to/img-000.jpg", (<-s.lis.imageCreated).path)
+	assert.Equal(t, "/path/to/img-001.jpg", (<-s.lis.imageCreated).path)
+	assert.Equal(t, "/path/to/img-002.jpg", (<-s.lis.imageCreated).path)
 	select {
-	case filename := <-s.lis.imageCreated:
-		assert.Fail(t, "not expecting queued image %q", filename)
+	case image := <-s.lis.imageCreated:
+		assert.Fail(t, "not expecting queued image %q", image.path)
 	default:
 		// the channel is empty, as we expected.
 	}
@@ -0,0 +1,208 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png" // register the PNG decoder.
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/image/draw"
+
+	// Image formats supported by the built-in converter, in addition to PNG and JPEG.
+	_ "github.com/armadillica/flamenco-manager/flamenco/exr"
+	_ "golang.org/x/image/tiff"
+)
+
+// Values for the 'image_converter' setting.
+const (
+	imageConverterAuto        = "auto"
+	imageConverterBuiltin     = "builtin"
+	imageConverterImageMagick = "imagemagick"
+)
+
+// Size and quality of the latest image shown on the dashboard.
+var latestImageMaxSize = image.Pt(1920, 1080) // 2 MPixels
+
+const latestImageQuality = 85
+
+// Images with more pixels are not decoded. The decoders allocate memory for all pixels as
+// soon as they have read the header, which may be corrupt. This allows 8192×8192 pixels.
+const maxDecodePixels = 1 << 26
+
+var errImageTooLarge = errors.New("image dimensions too large")
+
+// imageDecodeError is returned by the built-in converter when it cannot decode an image.
+type imageDecodeError struct {
+	path string
+	err  error
+}
+
+func (e imageDecodeError) Error() string {
+	return fmt.Sprintf("unable to decode %s: %v", e.path, e.err)
+}
+
+// decodeImageFile decodes the image, after checking that its dimensions are sane.
+func decodeImageFile(file io.ReadSeeker) (image.Image, error) {
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	if config.Width < 0 || config.Height < 0 || int64(config.Width)*int64(config.Height) > maxDecodePixels {
+		return nil, errImageTooLarge
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(file)
+	return img, err
+}
+
+// imageConverter converts rendered images to JPEG files that can be shown in a browser.
+type imageConverter interface {
+	// convert writes the image at srcPath as JPEG to dstPath. It is scaled down to fit
+	// within maxSize, keeping its aspect ratio, but never enlarged.
+	convert(srcPath, dstPath string, maxSize image.Point, quality int) error
+}
+
+// createImageConverter returns the image converter chosen in the configuration.
+func createImageConverter(config *Conf) (imageConverter, error) {
+	switch config.ImageConverter {
+	case "", imageConverterAuto:
+		return fallbackImageConverter{builtinImageConverter{}, imageMagickConverter{}}, nil
+	case imageConverterBuiltin:
+		return builtinImageConverter{}, nil
+	case imageConverterImageMagick:
+		return imageMagickConverter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown image converter %q", config.ImageConverter)
+	}
+}
+
+// builtinImageConverter converts PNG, JPEG, TIFF and OpenEXR images without external tools.
+// OpenEXR images are tone-mapped from linear to sRGB.
+type builtinImageConverter struct{}
+
+func (builtinImageConverter) convert(srcPath, dstPath string, maxSize image.Point, quality int) error {
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	src, err := decodeImageFile(srcFile)
+	if err != nil {
+		return imageDecodeError{srcPath, err}
+	}
+
+	img := src
+	size := fitImageSize(src.Bounds().Size(), maxSize)
+	if size != src.Bounds().Size() {
+		scaled := image.NewRGBA(image.Rectangle{Max: size})
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), src, src.Bounds(), draw.Src, nil)
+		img = scaled
+	}
+
+	// Write to a temporary file first, so that the destination is never served half-written.
+	tempPath := dstPath + ".tmp"
+	dstFile, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	err = jpeg.Encode(dstFile, img, &jpeg.Options{Quality: quality})
+	if closeErr := dstFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return os.Rename(tempPath, dstPath)
+}
+
+// fitImageSize returns the size of the image when scaled down to fit within maxSize.
+func fitImageSize(size, maxSize image.Point) image.Point {
+	if size.X <= maxSize.X && size.Y <= maxSize.Y {
+		return size
+	}
+	// Compare the aspect ratios to see which side limits the size.
+	if size.X*maxSize.Y > size.Y*maxSize.X {
+		height := (size.Y*maxSize.X + size.X/2) / size.X
+		return image.Pt(maxSize.X, maxInt(height, 1))
+	}
+	width := (size.X*maxSize.Y + size.Y/2) / size.Y
+	return image.Pt(maxInt(width, 1), maxSize.Y)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// fallbackImageConverter uses the built-in converter, and falls back to another converter
+// for images that the built-in converter cannot decode. Images that are too large are not
+// passed to the fallback.
+type fallbackImageConverter struct {
+	builtin  imageConverter
+	fallback imageConverter
+}
+
+func (conv fallbackImageConverter) convert(srcPath, dstPath string, maxSize image.Point, quality int) error {
+	err := conv.builtin.convert(srcPath, dstPath, maxSize, quality)
+	decodeErr, ok := err.(imageDecodeError)
+	if !ok || decodeErr.err == errImageTooLarge {
+		return err
+	}
+
+	log.WithError(err).WithField("path", srcPath).Debug("falling back to ImageMagick to convert image")
+	if fallbackErr := conv.fallback.convert(srcPath, dstPath, maxSize, quality); fallbackErr != nil {
+		return fmt.Errorf("%v; fallback: %v", err, fallbackErr)
+	}
+	return nil
+}
+
+// imageMagickConverter runs ImageMagick's 'convert' command.
+type imageMagickConverter struct{}
+
+func (imageMagickConverter) convert(srcPath, dstPath string, maxSize image.Point, quality int) error {
+	cmd := imageMagickConvert(srcPath,
+		"-quality", fmt.Sprintf("%d", quality),
+		"-resize", fmt.Sprintf("%dx%d>", maxSize.X, maxSize.Y), // never enlarge.
+		dstPath)
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, output.String())
+	}
+	return nil
+}
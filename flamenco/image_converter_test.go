@@ -0,0 +1,222 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/tiff"
+
+	check "gopkg.in/check.v1"
+)
+
+type ImageConverterTestSuite struct {
+	tempdir string
+}
+
+var _ = check.Suite(&ImageConverterTestSuite{})
+
+func (s *ImageConverterTestSuite) SetUpTest(c *check.C) {
+	var err error
+	s.tempdir, err = ioutil.TempDir("", "testimages")
+	assert.Nil(c, err)
+}
+
+func (s *ImageConverterTestSuite) TearDownTest(c *check.C) {
+	os.RemoveAll(s.tempdir)
+}
+
+// writeImage writes a red image of the given size, with the given encoder.
+func (s *ImageConverterTestSuite) writeImage(c *check.C, filename string, width, height int,
+	encode func(io.Writer, image.Image) error) string {
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: 0xff, A: 0xff})
+		}
+	}
+
+	imgPath := filepath.Join(s.tempdir, filename)
+	file, err := os.Create(imgPath)
+	assert.Nil(c, err)
+	defer file.Close()
+	assert.Nil(c, encode(file, img))
+	return imgPath
+}
+
+// writeHugePNG writes a small PNG file whose header claims it is huge.
+func writeHugePNG(c *check.C, imgPath string) {
+	img := image.NewGray(image.Rect(0, 0, 2, 2))
+	file, err := os.Create(imgPath)
+	assert.Nil(c, err)
+	defer file.Close()
+	assert.Nil(c, png.Encode(file, img))
+
+	// The IHDR chunk comes right after the 8-byte signature, as length, type, data and CRC.
+	ihdr := make([]byte, 4+13)
+	_, err = file.ReadAt(ihdr, 12)
+	assert.Nil(c, err)
+	binary.BigEndian.PutUint32(ihdr[4:], 65536)
+	binary.BigEndian.PutUint32(ihdr[8:], 65536)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(ihdr))
+	_, err = file.WriteAt(append(ihdr, crc...), 12)
+	assert.Nil(c, err)
+}
+
+func (s *ImageConverterTestSuite) decodeJPEG(c *check.C, imgPath string) image.Image {
+	file, err := os.Open(imgPath)
+	assert.Nil(c, err)
+	defer file.Close()
+	img, err := jpeg.Decode(file)
+	assert.Nil(c, err)
+	return img
+}
+
+func (s *ImageConverterTestSuite) TestFitImageSize(c *check.C) {
+	maxSize := image.Pt(1920, 1080)
+	assert.Equal(c, image.Pt(800, 600), fitImageSize(image.Pt(800, 600), maxSize))
+	assert.Equal(c, image.Pt(1920, 1080), fitImageSize(image.Pt(1920, 1080), maxSize))
+	assert.Equal(c, image.Pt(1920, 1080), fitImageSize(image.Pt(3840, 2160), maxSize))
+	assert.Equal(c, image.Pt(1920, 960), fitImageSize(image.Pt(4000, 2000), maxSize))
+	assert.Equal(c, image.Pt(540, 1080), fitImageSize(image.Pt(1000, 2000), maxSize))
+	assert.Equal(c, image.Pt(1920, 1), fitImageSize(image.Pt(10000, 1), maxSize))
+}
+
+func (s *ImageConverterTestSuite) TestBuiltinConvert(c *check.C) {
+	converter := builtinImageConverter{}
+	encoders := map[string]func(io.Writer, image.Image) error{
+		"render.png": png.Encode,
+		"render.tif": func(w io.Writer, img image.Image) error { return tiff.Encode(w, img, nil) },
+		"render.jpg": func(w io.Writer, img image.Image) error { return jpeg.Encode(w, img, nil) },
+	}
+
+	for filename, encode := range encoders {
+		srcPath := s.writeImage(c, filename, 200, 100, encode)
+		dstPath := filepath.Join(s.tempdir, "converted.jpg")
+
+		// Scaled down to fit.
+		assert.Nil(c, converter.convert(srcPath, dstPath, image.Pt(100, 100), 85), filename)
+		img := s.decodeJPEG(c, dstPath)
+		assert.Equal(c, image.Pt(100, 50), img.Bounds().Size(), filename)
+		r, g, b, _ := img.At(50, 25).RGBA()
+		assert.True(c, r>>8 > 0xf0 && g>>8 < 0x10 && b>>8 < 0x10, "%s: colour %d %d %d", filename, r>>8, g>>8, b>>8)
+
+		// Never enlarged.
+		assert.Nil(c, converter.convert(srcPath, dstPath, image.Pt(1920, 1080), 85), filename)
+		assert.Equal(c, image.Pt(200, 100), s.decodeJPEG(c, dstPath).Bounds().Size(), filename)
+
+		_, err := os.Stat(dstPath + ".tmp")
+		assert.True(c, os.IsNotExist(err), "temporary file should be gone")
+	}
+}
+
+func (s *ImageConverterTestSuite) TestBuiltinConvertInvalid(c *check.C) {
+	srcPath := filepath.Join(s.tempdir, "render.png")
+	dstPath := filepath.Join(s.tempdir, "converted.jpg")
+	assert.Nil(c, ioutil.WriteFile(srcPath, []byte("not really a PNG file"), 0644))
+
+	err := builtinImageConverter{}.convert(srcPath, dstPath, latestImageMaxSize, 85)
+	assert.NotNil(c, err)
+	_, err = os.Stat(dstPath)
+	assert.True(c, os.IsNotExist(err), "nothing should have been written")
+
+	err = builtinImageConverter{}.convert(filepath.Join(s.tempdir, "nonexistant.png"), dstPath, latestImageMaxSize, 85)
+	assert.True(c, os.IsNotExist(err))
+}
+
+func (s *ImageConverterTestSuite) TestCreateImageConverter(c *check.C) {
+	config := Conf{}
+	converter, err := createImageConverter(&config)
+	assert.Nil(c, err)
+	assert.IsType(c, fallbackImageConverter{}, converter)
+
+	config.ImageConverter = imageConverterBuiltin
+	converter, err = createImageConverter(&config)
+	assert.Nil(c, err)
+	assert.IsType(c, builtinImageConverter{}, converter)
+
+	config.ImageConverter = imageConverterImageMagick
+	converter, err = createImageConverter(&config)
+	assert.Nil(c, err)
+	assert.IsType(c, imageMagickConverter{}, converter)
+
+	config.ImageConverter = "photoshop"
+	_, err = createImageConverter(&config)
+	assert.NotNil(c, err)
+}
+
+func (s *ImageConverterTestSuite) TestBuiltinConvertHuge(c *check.C) {
+	srcPath := filepath.Join(s.tempdir, "render.png")
+	dstPath := filepath.Join(s.tempdir, "converted.jpg")
+	writeHugePNG(c, srcPath)
+
+	err := builtinImageConverter{}.convert(srcPath, dstPath, latestImageMaxSize, 85)
+	assert.NotNil(c, err)
+	assert.Contains(c, err.Error(), errImageTooLarge.Error())
+}
+
+// recordingConverter records the images it was asked to convert.
+type recordingConverter struct {
+	converted *[]string
+}
+
+func (conv recordingConverter) convert(srcPath, dstPath string, maxSize image.Point, quality int) error {
+	*conv.converted = append(*conv.converted, srcPath)
+	return nil
+}
+
+func (s *ImageConverterTestSuite) TestFallbackConvert(c *check.C) {
+	converted := []string{}
+	converter := fallbackImageConverter{builtinImageConverter{}, recordingConverter{&converted}}
+	dstPath := filepath.Join(s.tempdir, "converted.jpg")
+
+	// Images the built-in converter handles are not passed to the fallback.
+	pngPath := s.writeImage(c, "render.png", 64, 48, png.Encode)
+	assert.Nil(c, converter.convert(pngPath, dstPath, latestImageMaxSize, 85))
+	assert.Empty(c, converted)
+
+	// Images it cannot decode are.
+	unknownPath := filepath.Join(s.tempdir, "render.dpx")
+	assert.Nil(c, ioutil.WriteFile(unknownPath, []byte("SDPX and then some"), 0644))
+	assert.Nil(c, converter.convert(unknownPath, dstPath, latestImageMaxSize, 85))
+	assert.Equal(c, []string{unknownPath}, converted)
+
+	// Images that are too large, or that don't exist, are not.
+	hugePath := filepath.Join(s.tempdir, "huge.png")
+	writeHugePNG(c, hugePath)
+	assert.NotNil(c, converter.convert(hugePath, dstPath, latestImageMaxSize, 85))
+	assert.NotNil(c, converter.convert(filepath.Join(s.tempdir, "nonexistant.png"), dstPath, latestImageMaxSize, 85))
+	assert.Equal(c, []string{unknownPath}, converted)
+}
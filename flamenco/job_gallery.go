@@ -0,0 +1,316 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armadillica/flamenco-manager/flamenco/slugify"
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Directory, relative to the latest image, where the per-job thumbnails are stored.
+const jobGalleriesDirname = "jobs"
+
+// Size and quality of the thumbnails in the per-job galleries.
+var jobGalleryThumbnailSize = image.Pt(480, 270)
+
+const jobGalleryThumbnailQuality = 80
+
+// JobGalleryImage is a thumbnail of an image rendered for a job.
+type JobGalleryImage struct {
+	Filename string    `json:"filename"`
+	Source   string    `json:"source"` // slugified basename of the rendered image.
+	Created  time.Time `json:"created"`
+	URL      string    `json:"url"`
+}
+
+// JobGallery summarises the thumbnails of one job.
+type JobGallery struct {
+	JobID      bson.ObjectId    `json:"job_id"`
+	ImageCount int              `json:"image_count"`
+	Latest     *JobGalleryImage `json:"latest"`
+}
+
+// jobGalleries keeps the thumbnails of the last-rendered images of each job.
+// Every job has its own directory with at most maxImages thumbnails.
+type jobGalleries struct {
+	mutex     sync.Mutex
+	root      string
+	maxImages int
+
+	// Creates a thumbnail of srcPath at dstPath; can be overridden by unit tests.
+	makeThumbnail func(srcPath, dstPath string) error
+}
+
+func newJobGalleries(root string, maxImages int, converter imageConverter) *jobGalleries {
+	return &jobGalleries{
+		root:      root,
+		maxImages: maxImages,
+		makeThumbnail: func(srcPath, dstPath string) error {
+			return converter.convert(srcPath, dstPath, jobGalleryThumbnailSize, jobGalleryThumbnailQuality)
+		},
+	}
+}
+
+func (jg *jobGalleries) jobDir(jobID bson.ObjectId) string {
+	return filepath.Join(jg.root, jobID.Hex())
+}
+
+// thumbnailFilename returns the filename for a thumbnail. It starts with the creation
+// timestamp, so that sorting by filename sorts by age.
+func thumbnailFilename(sourcePath string, created time.Time) string {
+	basename := filepath.Base(sourcePath)
+	source := slugify.Marshal(strings.TrimSuffix(basename, filepath.Ext(basename)), false)
+	return fmt.Sprintf("%019d-%s.jpg", created.UnixNano(), source)
+}
+
+// parseThumbnailFilename is the inverse of thumbnailFilename().
+func parseThumbnailFilename(filename string) (source string, created time.Time, ok bool) {
+	if !strings.HasSuffix(filename, ".jpg") {
+		return "", time.Time{}, false
+	}
+	parts := strings.SplitN(strings.TrimSuffix(filename, ".jpg"), "-", 2)
+	if len(parts) != 2 {
+		return "", time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return parts[1], time.Unix(0, nanos).UTC(), true
+}
+
+func jobGalleryImageURL(jobID bson.ObjectId, filename string) string {
+	return fmt.Sprintf("/latest-image/jobs/%s/%s", jobID.Hex(), filename)
+}
+
+// add creates a thumbnail of the image in the job's gallery, and removes the oldest
+// thumbnails when there are too many. Returns the thumbnail's filename.
+func (jg *jobGalleries) add(jobID bson.ObjectId, imagePath, sourcePath string) (string, error) {
+	jg.mutex.Lock()
+	defer jg.mutex.Unlock()
+
+	jobDir := jg.jobDir(jobID)
+	if err := os.MkdirAll(jobDir, 0777); err != nil {
+		return "", err
+	}
+
+	filename := thumbnailFilename(sourcePath, time.Now())
+	if err := jg.makeThumbnail(imagePath, filepath.Join(jobDir, filename)); err != nil {
+		return "", err
+	}
+
+	jg.prune(jobID)
+	return filename, nil
+}
+
+// prune removes the oldest thumbnails of the job, so that at most maxImages remain.
+func (jg *jobGalleries) prune(jobID bson.ObjectId) {
+	filenames, err := jg.thumbnailFilenames(jobID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"job_id":     jobID.Hex(),
+			log.ErrorKey: err,
+		}).Warning("unable to list job gallery for cleanup")
+		return
+	}
+	if len(filenames) <= jg.maxImages {
+		return
+	}
+
+	// The filenames are sorted newest first.
+	for _, filename := range filenames[jg.maxImages:] {
+		thumbPath := filepath.Join(jg.jobDir(jobID), filename)
+		if err := os.Remove(thumbPath); err != nil {
+			log.WithFields(log.Fields{
+				"path":       thumbPath,
+				log.ErrorKey: err,
+			}).Warning("unable to remove old thumbnail from job gallery")
+		}
+	}
+}
+
+// thumbnailFilenames returns the thumbnail filenames of the job, newest first.
+func (jg *jobGalleries) thumbnailFilenames(jobID bson.ObjectId) ([]string, error) {
+	infos, err := ioutil.ReadDir(jg.jobDir(jobID))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	filenames := []string{}
+	for _, info := range infos {
+		if _, _, ok := parseThumbnailFilename(info.Name()); ok && !info.IsDir() {
+			filenames = append(filenames, info.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(filenames)))
+	return filenames, nil
+}
+
+// images returns the thumbnails of the job, newest first.
+func (jg *jobGalleries) images(jobID bson.ObjectId) ([]JobGalleryImage, error) {
+	jg.mutex.Lock()
+	defer jg.mutex.Unlock()
+
+	filenames, err := jg.thumbnailFilenames(jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]JobGalleryImage, 0, len(filenames))
+	for _, filename := range filenames {
+		source, created, _ := parseThumbnailFilename(filename)
+		images = append(images, JobGalleryImage{
+			Filename: filename,
+			Source:   source,
+			Created:  created,
+			URL:      jobGalleryImageURL(jobID, filename),
+		})
+	}
+	return images, nil
+}
+
+// galleries returns a summary of the gallery of every job, most recently updated first.
+func (jg *jobGalleries) galleries() ([]JobGallery, error) {
+	infos, err := ioutil.ReadDir(jg.root)
+	if os.IsNotExist(err) {
+		return []JobGallery{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	galleries := []JobGallery{}
+	for _, info := range infos {
+		if !info.IsDir() || !bson.IsObjectIdHex(info.Name()) {
+			continue
+		}
+		jobID := bson.ObjectIdHex(info.Name())
+		images, err := jg.images(jobID)
+		if err != nil {
+			return nil, err
+		}
+		if len(images) == 0 {
+			continue
+		}
+		galleries = append(galleries, JobGallery{
+			JobID:      jobID,
+			ImageCount: len(images),
+			Latest:     &images[0],
+		})
+	}
+
+	sort.Slice(galleries, func(i, j int) bool {
+		return galleries[i].Latest.Created.After(galleries[j].Latest.Created)
+	})
+	return galleries, nil
+}
+
+// thumbnailPath returns the path of the thumbnail, or an error when the filename is invalid.
+func (jg *jobGalleries) thumbnailPath(jobID bson.ObjectId, filename string) (string, error) {
+	if _, _, ok := parseThumbnailFilename(filename); !ok || path.Base(filename) != filename {
+		return "", fmt.Errorf("invalid thumbnail filename %q", filename)
+	}
+	return filepath.Join(jg.jobDir(jobID), filename), nil
+}
+
+// currentTaskOfWorker returns the worker's current task, or nil if unknown.
+// Only the task's ID, job and status are loaded.
+func currentTaskOfWorker(workerID string, db *mgo.Database) *Task {
+	worker, err := FindWorker(workerID, M{"current_task": 1}, db)
+	if err != nil || worker.CurrentTask == nil {
+		return nil
+	}
+
+	task := Task{}
+	err = db.C("flamenco_tasks").FindId(*worker.CurrentTask).Select(M{"job": 1, "status": 1}).One(&task)
+	if err != nil {
+		return nil
+	}
+	return &task
+}
+
+// jobOfImagePath returns the job of the active task that renders to the image's directory,
+// or an empty ID if unknown.
+func jobOfImagePath(imagePath string, config *Conf, db *mgo.Database) bson.ObjectId {
+	tasks := []Task{}
+	err := db.C("flamenco_tasks").
+		Find(M{"status": statusActive}).
+		Select(M{"job": 1, "commands": 1}).
+		All(&tasks)
+	if err != nil {
+		log.WithError(err).Warning("unable to find active tasks for attributing image to job")
+		return ""
+	}
+	return matchRenderOutput(imagePath, tasks, config)
+}
+
+// matchRenderOutput returns the job of the task whose render output directory contains the
+// image. When multiple directories match, the deepest one wins.
+func matchRenderOutput(imagePath string, tasks []Task, config *Conf) bson.ObjectId {
+	imagePath = filepath.Clean(imagePath)
+
+	var bestJob bson.ObjectId
+	bestLength := 0
+	for _, task := range tasks {
+		for _, cmd := range task.Commands {
+			renderOutput, ok := cmd.Settings["render_output"].(string)
+			if !ok || renderOutput == "" {
+				continue
+			}
+			if config != nil {
+				renderOutput = ReplaceLocal(renderOutput, config)
+			}
+			outputDir := filepath.Dir(filepath.Clean(renderOutput))
+			if !strings.HasPrefix(imagePath, outputDir+string(filepath.Separator)) {
+				continue
+			}
+			if len(outputDir) > bestLength {
+				bestJob = task.Job
+				bestLength = len(outputDir)
+			}
+		}
+	}
+	return bestJob
+}
+
+func (dash *Dashboard) showJobGalleryPage(w http.ResponseWriter, r *http.Request) {
+	dash.showTemplate("templates/job-gallery.html", w, r)
+}
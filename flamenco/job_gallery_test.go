@@ -0,0 +1,173 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+
+	check "gopkg.in/check.v1"
+)
+
+type JobGalleryTestSuite struct {
+	galleries *jobGalleries
+	jobID     bson.ObjectId
+}
+
+var _ = check.Suite(&JobGalleryTestSuite{})
+
+func (s *JobGalleryTestSuite) SetUpTest(c *check.C) {
+	root, err := ioutil.TempDir("", "testgalleries")
+	assert.Nil(c, err)
+
+	s.galleries = newJobGalleries(root, 3, nil)
+	s.galleries.makeThumbnail = func(srcPath, dstPath string) error {
+		return ioutil.WriteFile(dstPath, []byte("thumbnail of "+srcPath), 0644)
+	}
+	s.jobID = bson.NewObjectId()
+}
+
+func (s *JobGalleryTestSuite) TearDownTest(c *check.C) {
+	os.RemoveAll(s.galleries.root)
+}
+
+func (s *JobGalleryTestSuite) TestThumbnailFilename(c *check.C) {
+	created := time.Date(2019, 5, 3, 14, 15, 16, 123456789, time.UTC)
+	filename := thumbnailFilename("/render/shot 010/frame-0042.exr", created)
+	assert.Equal(c, "1556892916123456789-frame-0042.jpg", filename)
+
+	source, parsed, ok := parseThumbnailFilename(filename)
+	assert.True(c, ok)
+	assert.Equal(c, "frame-0042", source)
+	assert.True(c, created.Equal(parsed))
+
+	for _, invalid := range []string{"", "frame.jpg", "1234-frame.png", "abc-frame.jpg"} {
+		_, _, ok := parseThumbnailFilename(invalid)
+		assert.False(c, ok, "%q should be invalid", invalid)
+	}
+}
+
+func (s *JobGalleryTestSuite) TestAddAndPrune(c *check.C) {
+	added := []string{}
+	for _, frame := range []string{"0001", "0002", "0003", "0004", "0005"} {
+		filename, err := s.galleries.add(s.jobID, "/latest.jpg", "/render/frame-"+frame+".png")
+		assert.Nil(c, err)
+		added = append(added, filename)
+	}
+
+	images, err := s.galleries.images(s.jobID)
+	assert.Nil(c, err)
+	if !assert.Len(c, images, 3) {
+		return
+	}
+	// Newest first, and the two oldest should have been removed.
+	assert.Equal(c, added[4], images[0].Filename)
+	assert.Equal(c, added[3], images[1].Filename)
+	assert.Equal(c, added[2], images[2].Filename)
+	assert.Equal(c, "frame-0005", images[0].Source)
+	assert.Equal(c, "/latest-image/jobs/"+s.jobID.Hex()+"/"+added[4], images[0].URL)
+
+	_, err = os.Stat(filepath.Join(s.galleries.jobDir(s.jobID), added[0]))
+	assert.True(c, os.IsNotExist(err))
+}
+
+func (s *JobGalleryTestSuite) TestImagesOfUnknownJob(c *check.C) {
+	images, err := s.galleries.images(bson.NewObjectId())
+	assert.Nil(c, err)
+	assert.Empty(c, images)
+}
+
+func (s *JobGalleryTestSuite) TestGalleries(c *check.C) {
+	galleries, err := s.galleries.galleries()
+	assert.Nil(c, err)
+	assert.Empty(c, galleries)
+
+	otherJobID := bson.NewObjectId()
+	_, err = s.galleries.add(s.jobID, "/latest.jpg", "/render/a.png")
+	assert.Nil(c, err)
+	_, err = s.galleries.add(s.jobID, "/latest.jpg", "/render/b.png")
+	assert.Nil(c, err)
+	_, err = s.galleries.add(otherJobID, "/latest.jpg", "/render/c.png")
+	assert.Nil(c, err)
+
+	// Unrelated files and directories should be ignored.
+	assert.Nil(c, os.MkdirAll(filepath.Join(s.galleries.root, "not-a-job"), 0755))
+	assert.Nil(c, ioutil.WriteFile(filepath.Join(s.galleries.jobDir(s.jobID), "README.txt"), []byte("hi"), 0644))
+
+	galleries, err = s.galleries.galleries()
+	assert.Nil(c, err)
+	if !assert.Len(c, galleries, 2) {
+		return
+	}
+	// Most recently updated first.
+	assert.Equal(c, otherJobID, galleries[0].JobID)
+	assert.Equal(c, 1, galleries[0].ImageCount)
+	assert.Equal(c, "c", galleries[0].Latest.Source)
+	assert.Equal(c, s.jobID, galleries[1].JobID)
+	assert.Equal(c, 2, galleries[1].ImageCount)
+	assert.Equal(c, "b", galleries[1].Latest.Source)
+}
+
+func (s *JobGalleryTestSuite) TestThumbnailPath(c *check.C) {
+	thumbPath, err := s.galleries.thumbnailPath(s.jobID, "1556892916123456789-frame-0042.jpg")
+	assert.Nil(c, err)
+	assert.Equal(c, filepath.Join(s.galleries.root, s.jobID.Hex(), "1556892916123456789-frame-0042.jpg"), thumbPath)
+
+	for _, invalid := range []string{"../../etc/passwd", "1556892916123456789-../secret.jpg", "README.txt"} {
+		_, err := s.galleries.thumbnailPath(s.jobID, invalid)
+		assert.NotNil(c, err, "%q should be rejected", invalid)
+	}
+}
+
+func (s *JobGalleryTestSuite) TestMatchRenderOutput(c *check.C) {
+	config := Conf{}
+	config.VariablesLookup = map[string]map[string]map[string]string{
+		"workers": {runtime.GOOS: {"render": "/shared/render"}},
+	}
+	jobA := bson.NewObjectId()
+	jobB := bson.NewObjectId()
+	renderTask := func(jobID bson.ObjectId, renderOutput string) Task {
+		return Task{
+			Job: jobID,
+			Commands: []Command{
+				{Name: "blender_render", Settings: bson.M{"render_output": renderOutput}},
+			},
+		}
+	}
+	tasks := []Task{
+		renderTask(jobA, "{render}/shot/######.png"),
+		renderTask(jobB, "{render}/shot/lighting/######.png"),
+		{Job: bson.NewObjectId(), Commands: []Command{{Name: "echo", Settings: bson.M{"message": "hi"}}}},
+	}
+
+	assert.Equal(c, jobA, matchRenderOutput("/shared/render/shot/000001.png", tasks, &config))
+	assert.Equal(c, jobB, matchRenderOutput("/shared/render/shot/lighting/000001.png", tasks, &config))
+	assert.Equal(c, bson.ObjectId(""), matchRenderOutput("/shared/render/other/000001.png", tasks, &config))
+	assert.Equal(c, bson.ObjectId(""), matchRenderOutput("/shared/render/shotgun/000001.png", tasks, &config))
+}
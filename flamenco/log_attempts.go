@@ -0,0 +1,155 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Written as the first line of the task log when a worker starts a new attempt at running the task.
+const taskLogAttemptHeader = "%s Manager assigned task to worker %s"
+const taskLogAttemptMarker = " Manager assigned task to worker "
+
+// TaskLogAttempt describes the log file of one attempt at running a task.
+type TaskLogAttempt struct {
+	Attempt    int        `json:"attempt"` // 0 for the current attempt, 1 for the one before that, etc.
+	Size       int64      `json:"size"`
+	Compressed bool       `json:"compressed"`
+	Started    *time.Time `json:"started,omitempty"`
+	Modified   time.Time  `json:"modified"`
+	Worker     string     `json:"worker,omitempty"`
+	URL        string     `json:"url"`
+
+	// Changes when the log is rotated, so that readers can tell that a new attempt started.
+	generation int
+}
+
+// taskLogAttemptFilename returns the filename of the log of the given attempt; see rotateLogFile().
+func taskLogAttemptFilename(basename string, attempt int) string {
+	if attempt == 0 {
+		return basename
+	}
+	return basename + "." + strconv.Itoa(attempt)
+}
+
+// writeAttemptHeader starts the log of a new attempt at running the task.
+func (tuq *TaskUpdateQueue) writeAttemptHeader(task *Task, worker *Worker) {
+	header := fmt.Sprintf(taskLogAttemptHeader, UtcNow().Format(IsoFormat), worker.Nickname)
+	if err := tuq.writeTaskLog(task, header); err != nil {
+		log.WithFields(log.Fields{
+			"task_id":    task.ID.Hex(),
+			"worker":     worker.Identifier(),
+			log.ErrorKey: err,
+		}).Warning("unable to write attempt header to task log")
+	}
+}
+
+// parseAttemptHeader returns the start time and worker from the attempt header line.
+func parseAttemptHeader(line string) (started *time.Time, worker string) {
+	markerIndex := strings.Index(line, taskLogAttemptMarker)
+	if markerIndex < 0 {
+		return nil, ""
+	}
+	worker = strings.TrimSpace(line[markerIndex+len(taskLogAttemptMarker):])
+	if timestamp, err := time.Parse(IsoFormat, line[:markerIndex]); err == nil {
+		started = &timestamp
+	}
+	return started, worker
+}
+
+// readAttemptHeader reads the attempt header from the first line of the log.
+func readAttemptHeader(reader io.Reader, compressed bool) (*time.Time, string) {
+	if compressed {
+		gzReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, ""
+		}
+		defer gzReader.Close()
+		reader = gzReader
+	}
+
+	line, _, err := bufio.NewReader(reader).ReadLine()
+	if err != nil {
+		return nil, ""
+	}
+	return parseAttemptHeader(string(line))
+}
+
+// sortedAttempts returns the attempts, current attempt first.
+func sortedAttempts(byAttempt map[int]TaskLogAttempt) []TaskLogAttempt {
+	attempts := make([]TaskLogAttempt, 0, len(byAttempt))
+	for _, attempt := range byAttempt {
+		attempts = append(attempts, attempt)
+	}
+	sort.Slice(attempts, func(i, j int) bool { return attempts[i].Attempt < attempts[j].Attempt })
+	return attempts
+}
+
+// ListTaskLogAttempts returns the logs of all attempts at running the task, current attempt first.
+func ListTaskLogAttempts(jobID, taskID bson.ObjectId, store TaskLogStore) ([]TaskLogAttempt, error) {
+	attempts, err := store.Attempts(jobID, taskID)
+	if err != nil {
+		return nil, err
+	}
+	for index := range attempts {
+		attempts[index].URL = fmt.Sprintf("/logfile/%s/%s/attempts/%d",
+			jobID.Hex(), taskID.Hex(), attempts[index].Attempt)
+	}
+	return attempts, nil
+}
+
+// ServeTaskLogAttempts sends the list of task log attempts as JSON.
+func ServeTaskLogAttempts(w http.ResponseWriter, r *http.Request,
+	jobID, taskID bson.ObjectId, tuq *TaskUpdateQueue) {
+
+	logger := log.WithFields(log.Fields{
+		"remote_addr": r.RemoteAddr,
+		"job_id":      jobID.Hex(),
+		"task_id":     taskID.Hex(),
+	})
+
+	attempts, err := ListTaskLogAttempts(jobID, taskID, tuq.logStore)
+	if err != nil {
+		logger.WithError(err).Error("unable to list task log attempts")
+		http.Error(w, "unable to list task log attempts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(attempts); err != nil {
+		logger.WithError(err).Debug("unable to send task log attempts")
+	}
+}
@@ -0,0 +1,116 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+
+	check "gopkg.in/check.v1"
+)
+
+type LogAttemptsTestSuite struct {
+	config  Conf
+	jobID   bson.ObjectId
+	taskID  bson.ObjectId
+	logpath string
+}
+
+var _ = check.Suite(&LogAttemptsTestSuite{})
+
+func (s *LogAttemptsTestSuite) SetUpTest(c *check.C) {
+	temppath, err := ioutil.TempDir("", "testlogs")
+	assert.Nil(c, err)
+	s.config = Conf{}
+	s.config.TaskLogsPath = temppath
+	s.jobID = bson.NewObjectId()
+	s.taskID = bson.NewObjectId()
+
+	dirname, basename := taskLogPath(s.jobID, s.taskID, &s.config)
+	assert.Nil(c, os.MkdirAll(dirname, 0755))
+	s.logpath = filepath.Join(dirname, basename)
+}
+
+func (s *LogAttemptsTestSuite) TearDownTest(c *check.C) {
+	os.RemoveAll(s.config.TaskLogsPath)
+}
+
+func (s *LogAttemptsTestSuite) TestParseAttemptHeader(c *check.C) {
+	started, worker := parseAttemptHeader("2019-11-20T14:03:00+0000 Manager assigned task to worker Ozzy")
+	assert.Equal(c, "Ozzy", worker)
+	if assert.NotNil(c, started) {
+		assert.True(c, time.Date(2019, 11, 20, 14, 3, 0, 0, time.UTC).Equal(*started))
+	}
+
+	started, worker = parseAttemptHeader("Blender 2.81 (sub 16)")
+	assert.Nil(c, started)
+	assert.Equal(c, "", worker)
+}
+
+func (s *LogAttemptsTestSuite) TestNoAttempts(c *check.C) {
+	attempts, err := ListTaskLogAttempts(s.jobID, s.taskID, newLocalTaskLogStore(&s.config))
+	assert.Nil(c, err)
+	assert.Empty(c, attempts)
+}
+
+func (s *LogAttemptsTestSuite) TestListAttempts(c *check.C) {
+	assert.Nil(c, ioutil.WriteFile(s.logpath, []byte("2019-11-20T14:03:00+0000 Manager assigned task to worker second\n"), 0644))
+	assert.Nil(c, ioutil.WriteFile(s.logpath+".gz", []byte("stale compressed copy"), 0644))
+	assert.Nil(c, ioutil.WriteFile(s.logpath+".2", []byte("no header\n"), 0644))
+
+	// Write the first attempt's log gzipped.
+	gzFile, err := os.Create(s.logpath + ".1.gz")
+	assert.Nil(c, err)
+	gzWriter := gzip.NewWriter(gzFile)
+	_, err = gzWriter.Write([]byte("2019-11-20T13:40:00+0000 Manager assigned task to worker first\nrendering\n"))
+	assert.Nil(c, err)
+	assert.Nil(c, gzWriter.Close())
+	assert.Nil(c, gzFile.Close())
+
+	attempts, err := ListTaskLogAttempts(s.jobID, s.taskID, newLocalTaskLogStore(&s.config))
+	assert.Nil(c, err)
+	if !assert.Len(c, attempts, 3) {
+		return
+	}
+
+	assert.Equal(c, 0, attempts[0].Attempt)
+	assert.False(c, attempts[0].Compressed)
+	assert.Equal(c, "second", attempts[0].Worker)
+	assert.NotNil(c, attempts[0].Started)
+
+	assert.Equal(c, 1, attempts[1].Attempt)
+	assert.True(c, attempts[1].Compressed)
+	assert.Equal(c, "first", attempts[1].Worker)
+
+	assert.Equal(c, 2, attempts[2].Attempt)
+	assert.Equal(c, "", attempts[2].Worker)
+	assert.Nil(c, attempts[2].Started)
+	assert.Equal(c, int64(len("no header\n")), attempts[2].Size)
+	assert.Equal(c, "/logfile/"+s.jobID.Hex()+"/"+s.taskID.Hex()+"/attempts/2", attempts[2].URL)
+}
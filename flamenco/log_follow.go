@@ -0,0 +1,257 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Interval for checking whether a followed task is still active.
+const taskLogFollowCheckInterval = 5 * time.Second
+
+// taskLogFollower reads the lines that were appended to a task log since the last read.
+type taskLogFollower struct {
+	store      TaskLogStore
+	jobID      bson.ObjectId
+	taskID     bson.ObjectId
+	offset     int64
+	generation int
+	// Set when reading starts halfway a line, which then is skipped.
+	skipPartialLine bool
+}
+
+// newTaskLogFollower creates a follower that starts with at most the last 'tailBytes' bytes of the log.
+func newTaskLogFollower(store TaskLogStore, jobID, taskID bson.ObjectId, tailBytes int64) *taskLogFollower {
+	follower := taskLogFollower{store: store, jobID: jobID, taskID: taskID}
+	if logfile, info, err := store.Open(jobID, taskID, 0); err == nil {
+		logfile.Close()
+		follower.generation = info.generation
+		if !info.Compressed && info.Size > tailBytes {
+			follower.offset = info.Size - tailBytes
+			follower.skipPartialLine = true
+		}
+	}
+	return &follower
+}
+
+// readNewLines returns the complete lines written since the last call.
+// When the log was rotated, it starts reading the new log from the start.
+func (follower *taskLogFollower) readNewLines() ([]string, error) {
+	logfile, info, err := follower.store.Open(follower.jobID, follower.taskID, 0)
+	if os.IsNotExist(err) {
+		// The task may not have logged anything yet.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer logfile.Close()
+
+	if info.Compressed {
+		// Only logs of finished tasks are compressed, so there is nothing to follow.
+		return nil, nil
+	}
+	if info.generation != follower.generation || info.Size < follower.offset {
+		follower.offset = 0
+		follower.skipPartialLine = false
+	}
+	follower.generation = info.generation
+	if info.Size == follower.offset {
+		return nil, nil
+	}
+
+	startOffset := follower.offset
+	if _, err := logfile.Seek(startOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	contents := make([]byte, info.Size-startOffset)
+	if _, err := io.ReadFull(logfile, contents); err != nil {
+		return nil, err
+	}
+
+	// Only consume complete lines; the rest is read again next time.
+	lastNewline := bytes.LastIndexByte(contents, '\n')
+	if lastNewline < 0 {
+		return nil, nil
+	}
+	contents = contents[:lastNewline]
+	follower.offset = startOffset + int64(lastNewline) + 1
+
+	lines := []string{}
+	for _, line := range bytes.Split(contents, []byte{'\n'}) {
+		if follower.skipPartialLine {
+			follower.skipPartialLine = false
+			continue
+		}
+		lines = append(lines, string(line))
+	}
+	return lines, nil
+}
+
+// sendTaskLogLines sends the lines as a single Server-Sent Event.
+func sendTaskLogLines(w io.Writer, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "event: log\n")
+	for _, line := range lines {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// FollowTaskLog streams the task log as Server-Sent Events for as long as the task is active.
+// It starts with the tail of the current log, and then sends new lines as they are written.
+func FollowTaskLog(w http.ResponseWriter, r *http.Request,
+	jobID, taskID bson.ObjectId, tuq *TaskUpdateQueue, session *mgo.Session) {
+
+	logger := log.WithFields(log.Fields{
+		"remote_addr": r.RemoteAddr,
+		"job_id":      jobID.Hex(),
+		"task_id":     taskID.Hex(),
+	})
+
+	// Make sure that the writer supports flushing.
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		logger.Error("FollowTaskLog: Streaming unsupported; writer does not implement http.Flusher interface")
+		return
+	}
+
+	// Listen to the closing of the http connection via the CloseNotifier
+	closeNotifier, ok := w.(http.CloseNotifier)
+	if !ok {
+		http.Error(w, "Cannot stream", http.StatusInternalServerError)
+		logger.Error("FollowTaskLog: Streaming unsupported; writer does not implement http.CloseNotifier interface")
+		return
+	}
+
+	mongoSess := session.Copy()
+	defer mongoSess.Close()
+	tasksColl := mongoSess.DB("").C("flamenco_tasks")
+
+	taskStatus := func() (string, error) {
+		task := Task{}
+		err := tasksColl.Find(M{"_id": taskID, "job": jobID}).Select(M{"status": 1}).One(&task)
+		return task.Status, err
+	}
+	status, err := taskStatus()
+	if err == mgo.ErrNotFound {
+		http.Error(w, "task not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Error("FollowTaskLog: unable to find task")
+		http.Error(w, "unable to find task", http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribe before reading the file, so that no writes are missed.
+	notifications := make(chan string)
+	tuq.logBroadcaster.AddOutputChan(notifications)
+	defer func() {
+		tuq.logBroadcaster.RemoveOutputChan(notifications)
+		// Consume notifications that were already being sent, so those goroutines can finish.
+		go func() {
+			for {
+				select {
+				case <-notifications:
+				case <-time.After(time.Second):
+					return
+				}
+			}
+		}()
+	}()
+
+	// Set the headers related to event streaming.
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	f.Flush()
+
+	logger.Info("FollowTaskLog: following task log")
+	defer logger.Debug("FollowTaskLog: Closed HTTP stream")
+
+	follower := newTaskLogFollower(tuq.logStore, jobID, taskID, logBytesTail)
+	sendNewLines := func() {
+		lines, err := follower.readNewLines()
+		if err != nil {
+			logger.WithError(err).Warning("FollowTaskLog: unable to read task log")
+			return
+		}
+		sendTaskLogLines(w, lines)
+		f.Flush()
+	}
+	sendEnd := func(status string) {
+		sendNewLines()
+		fmt.Fprintf(w, "event: end\n")
+		fmt.Fprintf(w, "data: %s\n\n", status)
+		f.Flush()
+	}
+
+	sendNewLines()
+	if !IsRunnableTaskStatus(status) {
+		sendEnd(status)
+		return
+	}
+
+	ticker := time.NewTicker(taskLogFollowCheckInterval)
+	defer ticker.Stop()
+	wantedTaskID := taskID.Hex()
+
+	for {
+		select {
+		case <-closeNotifier.CloseNotify():
+			logger.Debug("FollowTaskLog: Connection closed")
+			return
+		case notifiedTaskID, ok := <-notifications:
+			if !ok {
+				// Shutting down.
+				return
+			}
+			if notifiedTaskID == wantedTaskID {
+				sendNewLines()
+			}
+		case <-ticker.C:
+			status, err := taskStatus()
+			if err != nil {
+				logger.WithError(err).Warning("FollowTaskLog: unable to check task status")
+				continue
+			}
+			if !IsRunnableTaskStatus(status) {
+				sendEnd(status)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+
+	check "gopkg.in/check.v1"
+)
+
+type LogFollowTestSuite struct {
+	config   Conf
+	store    *localTaskLogStore
+	jobID    bson.ObjectId
+	taskID   bson.ObjectId
+	filename string
+}
+
+var _ = check.Suite(&LogFollowTestSuite{})
+
+func (s *LogFollowTestSuite) SetUpTest(c *check.C) {
+	temppath, err := ioutil.TempDir("", "testlogs")
+	assert.Nil(c, err)
+	s.config = Conf{}
+	s.config.TaskLogsPath = temppath
+	s.store = newLocalTaskLogStore(&s.config)
+
+	s.jobID = bson.NewObjectId()
+	s.taskID = bson.NewObjectId()
+	s.filename = s.store.logPath(s.jobID, s.taskID)
+	assert.Nil(c, os.MkdirAll(filepath.Dir(s.filename), 0755))
+}
+
+func (s *LogFollowTestSuite) TearDownTest(c *check.C) {
+	os.RemoveAll(s.config.TaskLogsPath)
+}
+
+func (s *LogFollowTestSuite) appendLog(c *check.C, contents string) {
+	logfile, err := os.OpenFile(s.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	assert.Nil(c, err)
+	defer logfile.Close()
+	_, err = logfile.WriteString(contents)
+	assert.Nil(c, err)
+}
+
+func (s *LogFollowTestSuite) TestNonexistingFile(c *check.C) {
+	follower := newTaskLogFollower(s.store, s.jobID, s.taskID, 1024)
+	lines, err := follower.readNewLines()
+	assert.Nil(c, err)
+	assert.Empty(c, lines)
+}
+
+func (s *LogFollowTestSuite) TestCompleteLines(c *check.C) {
+	s.appendLog(c, "line 1\nline 2\n")
+	follower := newTaskLogFollower(s.store, s.jobID, s.taskID, 1024)
+
+	lines, err := follower.readNewLines()
+	assert.Nil(c, err)
+	assert.Equal(c, []string{"line 1", "line 2"}, lines)
+
+	lines, err = follower.readNewLines()
+	assert.Nil(c, err)
+	assert.Empty(c, lines)
+
+	// Incomplete lines should only be returned when they are complete.
+	s.appendLog(c, "line 3\nline")
+	lines, err = follower.readNewLines()
+	assert.Nil(c, err)
+	assert.Equal(c, []string{"line 3"}, lines)
+
+	s.appendLog(c, " 4\n")
+	lines, err = follower.readNewLines()
+	assert.Nil(c, err)
+	assert.Equal(c, []string{"line 4"}, lines)
+}
+
+func (s *LogFollowTestSuite) TestStartAtTail(c *check.C) {
+	s.appendLog(c, string(bytes.Repeat([]byte("x"), 100))+"\nline 1\nline 2\n")
+	follower := newTaskLogFollower(s.store, s.jobID, s.taskID, 20)
+
+	// The partial line at the start of the tail should be skipped.
+	lines, err := follower.readNewLines()
+	assert.Nil(c, err)
+	assert.Equal(c, []string{"line 1", "line 2"}, lines)
+}
+
+func (s *LogFollowTestSuite) TestRotatedFile(c *check.C) {
+	s.appendLog(c, "old attempt 1\nold attempt 2\n")
+	follower := newTaskLogFollower(s.store, s.jobID, s.taskID, 1024)
+	_, err := follower.readNewLines()
+	assert.Nil(c, err)
+
+	assert.Nil(c, rotateLogFile(s.filename))
+	s.appendLog(c, "new attempt\n")
+
+	lines, err := follower.readNewLines()
+	assert.Nil(c, err)
+	assert.Equal(c, []string{"new attempt"}, lines)
+}
+
+func (s *LogFollowTestSuite) TestRotatedSameSize(c *check.C) {
+	s.appendLog(c, "attempt 1\n")
+	follower := newTaskLogFollower(s.store, s.jobID, s.taskID, 1024)
+	_, err := follower.readNewLines()
+	assert.Nil(c, err)
+
+	// The new log has the same size, so only the rotation can tell it apart.
+	assert.Nil(c, s.store.Rotate(s.jobID, s.taskID))
+	s.appendLog(c, "attempt 2\n")
+
+	lines, err := follower.readNewLines()
+	assert.Nil(c, err)
+	assert.Equal(c, []string{"attempt 2"}, lines)
+}
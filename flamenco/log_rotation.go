@@ -59,18 +59,30 @@ func createNumberedPath(path string) numberedPath {
 }
 
 // rotateLogFile renames 'logpath' to 'logpath.1', and increases numbers for already-existing files.
+// Gzipped log files keep their ".gz" suffix, so 'logpath.1.gz' is renamed to 'logpath.2.gz'.
 func rotateLogFile(logpath string) error {
 	logger := log.WithField("logpath", logpath)
+	gzpath := logpath + ".gz"
+	toRotate := logpath
 
 	// Don't do anything if the file doesn't exist yet.
 	_, err := os.Stat(logpath)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if !os.IsNotExist(err) {
+			logger.WithError(err).Warning("unable to stat logfile")
+			return err
+		}
+		if _, gzErr := os.Stat(gzpath); gzErr != nil {
 			logger.Debug("log file does not exist, no need to rotate")
 			return nil
 		}
-		logger.WithError(err).Warning("unable to stat logfile")
-		return err
+		// Only the compressed log file remains, so rotate that one instead.
+		toRotate = gzpath
+	} else if _, gzErr := os.Stat(gzpath); gzErr == nil {
+		// The gzipped file is a compressed copy of the log file, which is about to be rotated.
+		if err := os.Remove(gzpath); err != nil {
+			logger.WithError(err).Warning("rotateLogFile: unable to remove compressed copy of log file")
+		}
 	}
 
 	pattern := logpath + ".*"
@@ -83,14 +95,22 @@ func rotateLogFile(logpath string) error {
 		logger.Debug("rotateLogFile: no existing files to rotate")
 	} else {
 		// Rotate the files in reverse numerical order (so n→n+1 comes after n+1→n+2)
-		var numbered = make(byNumber, len(existing))
-		for idx := range existing {
-			numbered[idx] = createNumberedPath(existing[idx])
+		var numbered = make(byNumber, 0, len(existing))
+		for _, existingPath := range existing {
+			if existingPath == gzpath {
+				continue
+			}
+			numberedPath := createNumberedPath(strings.TrimSuffix(existingPath, ".gz"))
+			numberedPath.path = existingPath
+			numbered = append(numbered, numberedPath)
 		}
 		sort.Sort(numbered)
 
 		for _, numberedPath := range numbered {
 			newName := numberedPath.basepath + "." + strconv.Itoa(numberedPath.number+1)
+			if strings.HasSuffix(numberedPath.path, ".gz") {
+				newName += ".gz"
+			}
 			err := os.Rename(numberedPath.path, newName)
 			if err != nil {
 				logger.WithFields(log.Fields{
@@ -104,7 +124,10 @@ func rotateLogFile(logpath string) error {
 
 	// Rotate the pointed-to file.
 	newName := logpath + ".1"
-	if err := os.Rename(logpath, newName); err != nil {
+	if toRotate == gzpath {
+		newName += ".gz"
+	}
+	if err := os.Rename(toRotate, newName); err != nil {
 		logger.WithField("new_name", newName).WithError(err).Error("rotateLogFile: unable to rename log file for rotating")
 		return err
 	}
@@ -123,3 +123,31 @@ func (s *LogRotationTestSuite) TestMultipleFilesWithHoles(c *check.C) {
 	assert.Equal(c, "file .5", read(filepath+".6"))
 	assert.Equal(c, "file .7", read(filepath+".8"))
 }
+
+func (s *LogRotationTestSuite) TestGzippedFiles(c *check.C) {
+	filepath := filepath.Join(s.temppath, "existing.txt")
+	assert.Nil(c, ioutil.WriteFile(filepath, []byte("thefile"), 0666))
+	assert.Nil(c, ioutil.WriteFile(filepath+".gz", []byte("compressed thefile"), 0666))
+	assert.Nil(c, ioutil.WriteFile(filepath+".1.gz", []byte("file .1"), 0666))
+	assert.Nil(c, ioutil.WriteFile(filepath+".2", []byte("file .2"), 0666))
+
+	err := rotateLogFile(filepath)
+
+	assert.Nil(c, err)
+	assert.False(c, fileExists(filepath))
+	assert.False(c, fileExists(filepath+".gz"), "the compressed copy should have been removed")
+	assert.True(c, fileExists(filepath+".1"))
+	assert.True(c, fileExists(filepath+".2.gz"))
+	assert.True(c, fileExists(filepath+".3"))
+}
+
+func (s *LogRotationTestSuite) TestOnlyGzippedFile(c *check.C) {
+	filepath := filepath.Join(s.temppath, "existing.txt")
+	assert.Nil(c, ioutil.WriteFile(filepath+".gz", []byte("compressed thefile"), 0666))
+
+	err := rotateLogFile(filepath)
+
+	assert.Nil(c, err)
+	assert.False(c, fileExists(filepath+".gz"))
+	assert.True(c, fileExists(filepath+".1.gz"))
+}
@@ -28,8 +28,6 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"path"
-	"path/filepath"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -64,39 +62,43 @@ func humanizeByteSize(size int64) string {
 // Depending on the User-Agent header it servers head+tail or the entire file.
 func ServeTaskLog(w http.ResponseWriter, r *http.Request,
 	jobID, taskID bson.ObjectId, tuq *TaskUpdateQueue) {
+	ServeTaskLogAttempt(w, r, jobID, taskID, 0, tuq)
+}
+
+// ServeTaskLogAttempt serves the task log file of an attempt at running the task.
+// Attempt 0 is the current attempt, 1 the one before that, etc.
+func ServeTaskLogAttempt(w http.ResponseWriter, r *http.Request,
+	jobID, taskID bson.ObjectId, attempt int, tuq *TaskUpdateQueue) {
 
-	dirname, basename := tuq.taskLogPath(jobID, taskID)
-	filename := filepath.Join(dirname, basename)
+	_, basename := tuq.taskLogPath(jobID, taskID)
+	basename = taskLogAttemptFilename(basename, attempt)
 
 	userAgent := r.Header.Get("User-Agent")
 	showEntireFile := strings.HasPrefix(userAgent, "Wget/") || strings.HasPrefix(userAgent, "curl/")
 
 	logger := log.WithFields(log.Fields{
 		"remote_addr": r.RemoteAddr,
-		"log_file":    filename,
+		"job_id":      jobID.Hex(),
+		"task_id":     taskID.Hex(),
+		"attempt":     attempt,
 		"entire_file": showEntireFile,
 	})
 
-	stat, err := os.Stat(filename)
+	logfile, info, err := tuq.logStore.Open(jobID, taskID, attempt)
+	if os.IsNotExist(err) {
+		logger.Info("unable to find task log file")
+		http.Error(w, "unable to stat task log file", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		if os.IsNotExist(err) {
-			// Attempt to access the gzipped file.
-			filename += ".gz"
-			basename = path.Base(filename)
-			stat, err = os.Stat(filename)
-			logger = logger.WithField("log_file", filename)
-		}
-		if os.IsNotExist(err) {
-			logger.Info("unable to find task log file")
-			http.Error(w, "unable to stat task log file", http.StatusNotFound)
-			return
-		}
-		if err != nil {
-			logger.WithError(err).Error("unable to stat task log file")
-			http.Error(w, "unable to access task log file", http.StatusInternalServerError)
-		}
+		logger.WithError(err).Error("unable to open task log file")
+		http.Error(w, "unable to access task log file", http.StatusInternalServerError)
+		return
+	}
+	defer logfile.Close()
 
-		// If we're here, we could succesfully stat the gzipped file.
+	if info.Compressed {
+		basename += ".gz"
 		w.Header().Set("Content-Encoding", "gzip")
 		w.Header().Set("Content-Disposition", "attachment; filename=\""+basename+"\"")
 		showEntireFile = true
@@ -104,24 +106,16 @@ func ServeTaskLog(w http.ResponseWriter, r *http.Request,
 	} else {
 		// Check the file size -- if it's smaller than head + tail combined, we just send the entire thing.
 		// This only makes sense when we send files uncompressed, though.
-		showEntireFile = showEntireFile || stat.Size() < int64(logBytesHead+logBytesTail)
+		showEntireFile = showEntireFile || info.Size < int64(logBytesHead+logBytesTail)
 	}
 
 	logger.Info("serving task log file")
 
 	w.Header().Set("Content-Type", "text/plain")
 	if showEntireFile {
-		http.ServeFile(w, r, filename)
-		return
-	}
-
-	logfile, err := os.Open(filename)
-	if err != nil {
-		logger.WithError(err).Error("unable to open task log file")
-		http.Error(w, "unable to open task log file", http.StatusInternalServerError)
+		http.ServeContent(w, r, basename, info.Modified, logfile)
 		return
 	}
-	defer logfile.Close()
 
 	w.WriteHeader(http.StatusOK)
 	reader := bufio.NewReader(logfile)
@@ -130,7 +124,7 @@ func ServeTaskLog(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	offset, err := logfile.Seek(-logBytesTail, 2) // 2 = 'from the end'
+	offset, err := logfile.Seek(-logBytesTail, io.SeekEnd)
 	if err != nil {
 		logger.WithError(err).Info("unable to seek in log file")
 		return
@@ -0,0 +1,497 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/armadillica/flamenco-manager/jwtauth"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	previewMovieCheckInitialSleep = 1 * time.Minute
+	previewMovieCheckInterval     = 30 * time.Second
+
+	// Task type of the manager-local task that encodes the preview movie.
+	// Only workers that support this task type (and have FFmpeg) will pick it up.
+	previewMovieTaskType = "video-encoding"
+
+	// A single frame does not make a movie.
+	previewMovieMinFrames = 2
+
+	// Filename of the preview movie, written next to the frames it was made from.
+	previewMovieFilename = "preview.mp4"
+)
+
+// Statuses of a PreviewMovie.
+const (
+	previewMovieStatusCollecting = "collecting" // Frames are being rendered.
+	previewMovieStatusQueued     = "queued"     // The encoding task has been queued.
+	previewMovieStatusCompleted  = "completed"  // The movie has been encoded.
+	previewMovieStatusFailed     = "failed"     // The encoding task failed or disappeared.
+	previewMovieStatusSkipped    = "skipped"    // The job finished without enough frames for a movie.
+)
+
+// PreviewMovie keeps track of the frames produced for a job, and the preview movie made from them.
+type PreviewMovie struct {
+	JobID      bson.ObjectId  `bson:"_id" json:"job_id"`
+	Status     string         `bson:"status" json:"status"`
+	Frames     []string       `bson:"frames" json:"-"`
+	FrameCount int            `bson:"frame_count,omitempty" json:"frame_count,omitempty"` // Number of frames in the movie.
+	OutputFile string         `bson:"output_file,omitempty" json:"output_file,omitempty"`
+	TaskID     *bson.ObjectId `bson:"task_id,omitempty" json:"task_id,omitempty"`
+	Updated    time.Time      `bson:"updated" json:"updated"`
+}
+
+// PreviewMovieAssembler collects the files produced for each job, and queues a manager-local
+// task that encodes them into a preview movie when the job's render tasks have completed.
+type PreviewMovieAssembler struct {
+	closable
+	config  *Conf
+	session *mgo.Session
+}
+
+// CreatePreviewMovieAssembler creates a PreviewMovieAssembler, or returns nil if the
+// configuration disables preview movies.
+func CreatePreviewMovieAssembler(config *Conf, session *mgo.Session) *PreviewMovieAssembler {
+	if !config.PreviewMovies {
+		log.Debug("preview movies will not be created")
+		return nil
+	}
+	log.WithFields(log.Fields{
+		"fps":               config.PreviewMovieFPS,
+		"render_task_types": config.PreviewMovieRenderTaskTypes,
+	}).Info("preview movies will be created")
+
+	return &PreviewMovieAssembler{
+		makeClosable(),
+		config,
+		session,
+	}
+}
+
+func (pma *PreviewMovieAssembler) collection(db *mgo.Database) *mgo.Collection {
+	return db.C("flamenco_preview_movies")
+}
+
+// EnsureDBIndices creates the indices needed to find preview movies by status.
+func (pma *PreviewMovieAssembler) EnsureDBIndices() {
+	session := pma.session.Copy()
+	defer session.Close()
+
+	pma.collection(session.DB("")).EnsureIndex(mgo.Index{
+		Name: "status",
+		Key:  []string{"status"},
+	})
+}
+
+// AddFrames records the image files produced for the task.
+// Files produced by manager-local tasks are ignored.
+func (pma *PreviewMovieAssembler) AddFrames(task *Task, paths []string) {
+	if task.isManagerLocalTask() {
+		return
+	}
+
+	var frames []string
+	for _, path := range paths {
+		if imageExtensions[strings.ToLower(filepath.Ext(path))] {
+			frames = append(frames, path)
+		}
+	}
+	if len(frames) == 0 {
+		return
+	}
+
+	logger := log.WithFields(log.Fields{
+		"job_id":      task.Job.Hex(),
+		"task_id":     task.ID.Hex(),
+		"frame_count": len(frames),
+	})
+	session := pma.session.Copy()
+	defer session.Close()
+	coll := pma.collection(session.DB(""))
+	addFrames := M{"frames": M{"$each": frames}}
+
+	// New frames for a job that already has a movie mean the movie is outdated. When the
+	// movie is still being encoded, the frames are picked up by the next movie instead.
+	err := coll.Update(
+		M{"_id": task.Job, "status": M{"$ne": previewMovieStatusQueued}},
+		M{
+			"$addToSet": addFrames,
+			"$set":      M{"status": previewMovieStatusCollecting, "updated": UtcNow()},
+		})
+	if err == mgo.ErrNotFound {
+		_, err = coll.UpsertId(task.Job, M{
+			"$addToSet":    addFrames,
+			"$setOnInsert": M{"status": previewMovieStatusCollecting, "updated": UtcNow()},
+		})
+	}
+	if err != nil {
+		logger.WithError(err).Error("PreviewMovieAssembler: unable to record produced frames")
+		return
+	}
+	logger.Debug("PreviewMovieAssembler: recorded produced frames")
+}
+
+// Go starts a goroutine that periodically queues and tracks preview movie tasks.
+func (pma *PreviewMovieAssembler) Go() {
+	pma.closableAdd(1)
+	go func() {
+		session := pma.session.Copy()
+		db := session.DB("")
+		defer session.Close()
+		defer pma.closableDone()
+		defer log.Info("PreviewMovieAssembler: shutting down.")
+
+		timer := Timer("PreviewMovieAssembler", previewMovieCheckInterval, previewMovieCheckInitialSleep, &pma.closable)
+		for range timer {
+			pma.check(db)
+		}
+	}()
+}
+
+// Close gracefully shuts down the preview movie assembler goroutine.
+func (pma *PreviewMovieAssembler) Close() {
+	log.Debug("PreviewMovieAssembler: Close() called.")
+	pma.closableCloseAndWait()
+	log.Debug("PreviewMovieAssembler: shutdown complete.")
+}
+
+func (pma *PreviewMovieAssembler) check(db *mgo.Database) {
+	var movies []PreviewMovie
+	query := M{"status": M{"$in": []string{previewMovieStatusCollecting, previewMovieStatusQueued}}}
+	if err := pma.collection(db).Find(query).All(&movies); err != nil {
+		log.WithError(err).Error("PreviewMovieAssembler: unable to find preview movies")
+		return
+	}
+
+	for _, movie := range movies {
+		switch movie.Status {
+		case previewMovieStatusCollecting:
+			pma.queueWhenRendered(&movie, db)
+		case previewMovieStatusQueued:
+			pma.updateFromTask(&movie, db)
+		}
+	}
+}
+
+// queueWhenRendered queues the encoding task when all render tasks of the job have completed.
+// When the job finishes without enough frames to make a movie, the movie is skipped instead;
+// new frames for the job make it collect again.
+func (pma *PreviewMovieAssembler) queueWhenRendered(movie *PreviewMovie, db *mgo.Database) {
+	logger := log.WithField("job_id", movie.JobID.Hex())
+
+	// The Manager only knows about the tasks the Server sent it, so this is the best we can do.
+	renderTasks := M{
+		"job":       movie.JobID,
+		"job_type":  M{"$ne": managerLocalJobType},
+		"task_type": M{"$in": pma.config.PreviewMovieRenderTaskTypes},
+	}
+	var renderTask Task
+	err := db.C("flamenco_tasks").Find(renderTasks).One(&renderTask)
+	if err == mgo.ErrNotFound {
+		// The frames came from other task types, or the tasks have been cleaned up.
+		pma.skip(movie, "job has no known render tasks", db)
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Error("PreviewMovieAssembler: unable to find render tasks")
+		return
+	}
+	renderTasks["status"] = M{"$in": append([]string{statusCancelRequested}, unfinishedTaskStatuses...)}
+	unfinished, err := db.C("flamenco_tasks").Find(renderTasks).Count()
+	if err != nil {
+		logger.WithError(err).Error("PreviewMovieAssembler: unable to count unfinished render tasks")
+		return
+	}
+	if unfinished > 0 {
+		return
+	}
+	renderTasks["status"] = M{"$ne": statusCompleted}
+	notCompleted, err := db.C("flamenco_tasks").Find(renderTasks).Count()
+	if err != nil {
+		logger.WithError(err).Error("PreviewMovieAssembler: unable to count failed render tasks")
+		return
+	}
+	if notCompleted > 0 {
+		pma.skip(movie, "not all render tasks completed", db)
+		return
+	}
+
+	inputFiles, outputFile, frameCount := previewMovieInput(movie.Frames)
+	logger = logger.WithFields(log.Fields{
+		"input_files": inputFiles,
+		"output_file": outputFile,
+		"frame_count": frameCount,
+	})
+	if frameCount < previewMovieMinFrames {
+		pma.skip(movie, "too few frames for a preview movie", db)
+		return
+	}
+
+	task := Task{
+		ID:          bson.NewObjectId(),
+		Manager:     bson.ObjectIdHex(pma.config.ManagerID),
+		Project:     renderTask.Project,
+		User:        renderTask.User,
+		Name:        "Preview movie for job " + movie.JobID.Hex(),
+		Status:      statusQueued,
+		Priority:    renderTask.Priority,
+		Job:         movie.JobID,
+		JobPriority: renderTask.JobPriority,
+		JobType:     managerLocalJobType,
+		TaskType:    previewMovieTaskType,
+		Log:         "Created locally on Flamenco Manager\n",
+		Activity:    "queued",
+
+		Commands: []Command{
+			Command{
+				Name: "create_video",
+				Settings: bson.M{
+					"ffmpeg_cmd":  "{ffmpeg}",
+					"input_files": inputFiles,
+					"output_file": outputFile,
+					"fps":         pma.config.PreviewMovieFPS,
+				},
+			},
+		},
+	}
+	if err := db.C("flamenco_tasks").Insert(task); err != nil {
+		logger.WithError(err).Error("PreviewMovieAssembler: unable to insert preview movie task")
+		return
+	}
+
+	err = pma.collection(db).Update(
+		M{"_id": movie.JobID, "status": previewMovieStatusCollecting},
+		M{"$set": M{
+			"status":      previewMovieStatusQueued,
+			"task_id":     task.ID,
+			"output_file": outputFile,
+			"frame_count": frameCount,
+			"updated":     UtcNow(),
+		}})
+	if err != nil {
+		// Frames came in while queueing; the movie will be queued again later.
+		logger.WithError(err).Warning("PreviewMovieAssembler: unable to mark preview movie as queued")
+		return
+	}
+	logger.WithField("task_id", task.ID.Hex()).Info("PreviewMovieAssembler: queued preview movie task")
+}
+
+// skip marks the collecting movie as skipped, so that it is no longer checked.
+func (pma *PreviewMovieAssembler) skip(movie *PreviewMovie, reason string, db *mgo.Database) {
+	logger := log.WithFields(log.Fields{
+		"job_id": movie.JobID.Hex(),
+		"reason": reason,
+	})
+
+	err := pma.collection(db).Update(
+		M{"_id": movie.JobID, "status": previewMovieStatusCollecting},
+		M{"$set": M{"status": previewMovieStatusSkipped, "updated": UtcNow()}})
+	if err != nil {
+		// Frames came in while skipping; the movie will be checked again later.
+		logger.WithError(err).Warning("PreviewMovieAssembler: unable to mark preview movie as skipped")
+		return
+	}
+	logger.Info("PreviewMovieAssembler: job finished, skipping preview movie")
+}
+
+// updateFromTask copies the status of the encoding task to the preview movie.
+func (pma *PreviewMovieAssembler) updateFromTask(movie *PreviewMovie, db *mgo.Database) {
+	logger := log.WithField("job_id", movie.JobID.Hex())
+
+	var status string
+	var task Task
+	if movie.TaskID == nil {
+		status = previewMovieStatusFailed
+	} else if err := db.C("flamenco_tasks").FindId(*movie.TaskID).Select(M{"status": 1}).One(&task); err != nil {
+		if err != mgo.ErrNotFound {
+			logger.WithError(err).Error("PreviewMovieAssembler: unable to find preview movie task")
+			return
+		}
+		status = previewMovieStatusFailed
+	} else {
+		switch task.Status {
+		case statusCompleted:
+			status = previewMovieStatusCompleted
+		case statusFailed, statusCanceled:
+			status = previewMovieStatusFailed
+		default:
+			return
+		}
+	}
+
+	err := pma.collection(db).Update(
+		M{"_id": movie.JobID, "status": previewMovieStatusQueued},
+		M{"$set": M{"status": status, "updated": UtcNow()}})
+	if err != nil {
+		logger.WithError(err).Error("PreviewMovieAssembler: unable to update preview movie status")
+		return
+	}
+	logger.WithField("status", status).Info("PreviewMovieAssembler: preview movie task finished")
+}
+
+// previewMovieInput determines the FFmpeg input glob and output file for the frames.
+// Frames are grouped by directory and extension, and the largest group is used, so that
+// stray files (like a test render) don't end up in the movie.
+func previewMovieInput(frames []string) (inputFiles, outputFile string, frameCount int) {
+	groups := map[string]int{}
+	for _, frame := range frames {
+		dir, _ := splitWorkerPath(frame)
+		if dir == "" {
+			continue
+		}
+		groups[dir+"\x00"+strings.ToLower(filepath.Ext(frame))]++
+	}
+
+	// Sort the keys so that ties are broken the same way every time.
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var best string
+	for _, key := range keys {
+		if groups[key] > frameCount {
+			best, frameCount = key, groups[key]
+		}
+	}
+	if frameCount == 0 {
+		return "", "", 0
+	}
+
+	parts := strings.SplitN(best, "\x00", 2)
+	dir, ext := parts[0], parts[1]
+	sep := workerPathSeparator(dir)
+	return dir + sep + "*" + ext, dir + sep + previewMovieFilename, frameCount
+}
+
+// splitWorkerPath splits a path as reported by a worker into directory and filename.
+// Workers can run on another platform than the Manager, so both kinds of slashes are accepted.
+func splitWorkerPath(path string) (dir, filename string) {
+	idx := strings.LastIndexAny(path, `/\`)
+	if idx < 0 {
+		return "", path
+	}
+	return path[:idx], path[idx+1:]
+}
+
+func workerPathSeparator(path string) string {
+	if strings.Contains(path, `\`) && !strings.Contains(path, "/") {
+		return `\`
+	}
+	return "/"
+}
+
+// AddRoutes adds the HTTP routes for listing and serving preview movies.
+func (pma *PreviewMovieAssembler) AddRoutes(router *mux.Router, auther jwtauth.Authenticator) {
+	router.Handle("/api/preview-movies", auther.WrapFunc(pma.listPreviewMovies)).Methods("GET")
+	router.Handle("/api/preview-movies/{job-id}", auther.WrapFunc(pma.sendPreviewMovie)).Methods("GET")
+	router.Handle("/preview-movie/{job-id}", auther.WrapFunc(pma.servePreviewMovie)).Methods("GET")
+}
+
+func (pma *PreviewMovieAssembler) listPreviewMovies(w http.ResponseWriter, r *http.Request) {
+	session := pma.session.Copy()
+	defer session.Close()
+
+	movies := []PreviewMovie{}
+	err := pma.collection(session.DB("")).Find(M{}).Select(M{"frames": 0}).Sort("-updated").All(&movies)
+	if err != nil {
+		log.WithError(err).Error("PreviewMovieAssembler: unable to list preview movies")
+		http.Error(w, "unable to list preview movies", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(movies)
+}
+
+// findPreviewMovie returns the preview movie of the job in the request, or nil after responding
+// with an error.
+func (pma *PreviewMovieAssembler) findPreviewMovie(w http.ResponseWriter, r *http.Request, db *mgo.Database) *PreviewMovie {
+	jobID, err := ObjectIDFromRequest(w, r, "job-id")
+	if err != nil {
+		return nil
+	}
+
+	movie := PreviewMovie{}
+	err = pma.collection(db).FindId(jobID).Select(M{"frames": 0}).One(&movie)
+	if err == mgo.ErrNotFound {
+		http.Error(w, "this job has no preview movie", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		log.WithError(err).WithField("job_id", jobID.Hex()).Error("PreviewMovieAssembler: unable to find preview movie")
+		http.Error(w, "unable to find preview movie", http.StatusInternalServerError)
+		return nil
+	}
+	return &movie
+}
+
+func (pma *PreviewMovieAssembler) sendPreviewMovie(w http.ResponseWriter, r *http.Request) {
+	session := pma.session.Copy()
+	defer session.Close()
+
+	movie := pma.findPreviewMovie(w, r, session.DB(""))
+	if movie == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(movie)
+}
+
+// servePreviewMovie serves the movie file. Variables in the path the worker wrote it to are
+// replaced for the Manager's platform, just like the job gallery does for render outputs.
+func (pma *PreviewMovieAssembler) servePreviewMovie(w http.ResponseWriter, r *http.Request) {
+	session := pma.session.Copy()
+	defer session.Close()
+
+	movie := pma.findPreviewMovie(w, r, session.DB(""))
+	if movie == nil {
+		return
+	}
+	// The file of an earlier encoding is served while a newer one is being made.
+	if movie.OutputFile == "" {
+		http.Error(w, "preview movie has not been made yet", http.StatusNotFound)
+		return
+	}
+	outputFile := ReplaceLocal(movie.OutputFile, pma.config)
+	if _, err := os.Stat(outputFile); err != nil {
+		http.Error(w, "preview movie file cannot be found", http.StatusNotFound)
+		return
+	}
+	http.ServeFile(w, r, outputFile)
+}
@@ -0,0 +1,261 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// PreviewMovieInputTestSuite tests determining the FFmpeg input, without MongoDB.
+type PreviewMovieInputTestSuite struct{}
+
+var _ = check.Suite(&PreviewMovieInputTestSuite{})
+
+func (s *PreviewMovieInputTestSuite) TestLargestGroup(c *check.C) {
+	inputFiles, outputFile, frameCount := previewMovieInput([]string{
+		"/render/shot/frames/0001.png",
+		"/render/shot/frames/0002.png",
+		"/render/shot/frames/0003.PNG",
+		"/render/shot/frames/0001.exr",
+		"/render/test/0001.png",
+	})
+	assert.Equal(c, "/render/shot/frames/*.png", inputFiles)
+	assert.Equal(c, "/render/shot/frames/preview.mp4", outputFile)
+	assert.Equal(c, 3, frameCount)
+}
+
+func (s *PreviewMovieInputTestSuite) TestWindowsPaths(c *check.C) {
+	inputFiles, outputFile, frameCount := previewMovieInput([]string{
+		`R:\shot\frames\0001.jpg`,
+		`R:\shot\frames\0002.jpg`,
+	})
+	assert.Equal(c, `R:\shot\frames\*.jpg`, inputFiles)
+	assert.Equal(c, `R:\shot\frames\preview.mp4`, outputFile)
+	assert.Equal(c, 2, frameCount)
+}
+
+func (s *PreviewMovieInputTestSuite) TestNoFrames(c *check.C) {
+	inputFiles, outputFile, frameCount := previewMovieInput([]string{"0001.png"})
+	assert.Equal(c, "", inputFiles)
+	assert.Equal(c, "", outputFile)
+	assert.Equal(c, 0, frameCount)
+}
+
+// PreviewMovieAssemblerTestSuite tests collecting frames and queueing the encoding task.
+type PreviewMovieAssemblerTestSuite struct {
+	config    Conf
+	session   *mgo.Session
+	db        *mgo.Database
+	assembler *PreviewMovieAssembler
+	task      Task
+}
+
+var _ = check.Suite(&PreviewMovieAssemblerTestSuite{})
+
+func (s *PreviewMovieAssemblerTestSuite) SetUpSuite(c *check.C) {
+	s.config = GetTestConfig()
+	s.config.PreviewMovies = true
+	s.config.PreviewMovieRenderTaskTypes = []string{"blender-render"}
+
+	s.session = MongoSession(&s.config)
+	s.db = s.session.DB("")
+}
+
+func (s *PreviewMovieAssemblerTestSuite) SetUpTest(c *check.C) {
+	s.assembler = CreatePreviewMovieAssembler(&s.config, s.session)
+
+	s.task = ConstructTestTask("1aaaaaaaaaaaaaaaaaaaaaaa", "blender-render")
+	s.task.Status = statusActive
+	assert.Nil(c, s.db.C("flamenco_tasks").Insert(&s.task))
+}
+
+func (s *PreviewMovieAssemblerTestSuite) TearDownTest(c *check.C) {
+	log.Info("PreviewMovieAssemblerTestSuite tearing down test, dropping database.")
+	s.db.DropDatabase()
+}
+
+func (s *PreviewMovieAssemblerTestSuite) findMovie(c *check.C) PreviewMovie {
+	movie := PreviewMovie{}
+	assert.Nil(c, s.db.C("flamenco_preview_movies").FindId(s.task.Job).One(&movie))
+	return movie
+}
+
+func (s *PreviewMovieAssemblerTestSuite) completeTask(c *check.C, task *Task) {
+	assert.Nil(c, s.db.C("flamenco_tasks").UpdateId(task.ID, M{"$set": M{"status": statusCompleted}}))
+}
+
+func (s *PreviewMovieAssemblerTestSuite) TestDisabled(c *check.C) {
+	config := GetTestConfig()
+	assert.Nil(c, CreatePreviewMovieAssembler(&config, s.session))
+}
+
+func (s *PreviewMovieAssemblerTestSuite) TestAddFrames(c *check.C) {
+	s.assembler.AddFrames(&s.task, []string{"/render/0001.png", "/render/0001.blend"})
+	s.assembler.AddFrames(&s.task, []string{"/render/0001.png", "/render/0002.png"})
+
+	movie := s.findMovie(c)
+	assert.Equal(c, previewMovieStatusCollecting, movie.Status)
+	assert.Equal(c, []string{"/render/0001.png", "/render/0002.png"}, movie.Frames)
+}
+
+func (s *PreviewMovieAssemblerTestSuite) TestManagerLocalTaskIgnored(c *check.C) {
+	s.task.JobType = managerLocalJobType
+	s.assembler.AddFrames(&s.task, []string{"/render/0001.png"})
+
+	count, err := s.db.C("flamenco_preview_movies").Count()
+	assert.Nil(c, err)
+	assert.Equal(c, 0, count)
+}
+
+func (s *PreviewMovieAssemblerTestSuite) TestQueueWhenRendered(c *check.C) {
+	s.assembler.AddFrames(&s.task, []string{"/render/0001.png", "/render/0002.png"})
+
+	// The render task is still active, so nothing should be queued.
+	s.assembler.check(s.db)
+	assert.Equal(c, previewMovieStatusCollecting, s.findMovie(c).Status)
+
+	s.completeTask(c, &s.task)
+	s.assembler.check(s.db)
+
+	movie := s.findMovie(c)
+	assert.Equal(c, previewMovieStatusQueued, movie.Status)
+	assert.Equal(c, "/render/preview.mp4", movie.OutputFile)
+	assert.Equal(c, 2, movie.FrameCount)
+	if !assert.NotNil(c, movie.TaskID) {
+		return
+	}
+
+	task := Task{}
+	assert.Nil(c, s.db.C("flamenco_tasks").FindId(*movie.TaskID).One(&task))
+	assert.True(c, task.isManagerLocalTask())
+	assert.Equal(c, s.task.Job, task.Job)
+	assert.Equal(c, previewMovieTaskType, task.TaskType)
+	assert.Equal(c, statusQueued, task.Status)
+	assert.Equal(c, "create_video", task.Commands[0].Name)
+	assert.Equal(c, "{ffmpeg}", task.Commands[0].Settings["ffmpeg_cmd"])
+	assert.Equal(c, "/render/*.png", task.Commands[0].Settings["input_files"])
+	assert.Equal(c, "/render/preview.mp4", task.Commands[0].Settings["output_file"])
+
+	// Completing the encoding task completes the movie.
+	s.completeTask(c, &task)
+	s.assembler.check(s.db)
+	assert.Equal(c, previewMovieStatusCompleted, s.findMovie(c).Status)
+
+	// New frames make the movie outdated.
+	s.assembler.AddFrames(&s.task, []string{"/render/0003.png"})
+	assert.Equal(c, previewMovieStatusCollecting, s.findMovie(c).Status)
+}
+
+func (s *PreviewMovieAssemblerTestSuite) TestTooFewFrames(c *check.C) {
+	s.assembler.AddFrames(&s.task, []string{"/render/0001.png"})
+	s.completeTask(c, &s.task)
+	s.assembler.check(s.db)
+
+	assert.Equal(c, previewMovieStatusSkipped, s.findMovie(c).Status)
+	count, err := s.db.C("flamenco_tasks").Count()
+	assert.Nil(c, err)
+	assert.Equal(c, 1, count)
+
+	// New frames make the job collect again.
+	s.assembler.AddFrames(&s.task, []string{"/render/0002.png"})
+	assert.Equal(c, previewMovieStatusCollecting, s.findMovie(c).Status)
+	s.assembler.check(s.db)
+	assert.Equal(c, previewMovieStatusQueued, s.findMovie(c).Status)
+}
+
+func (s *PreviewMovieAssemblerTestSuite) TestFailedRenderTask(c *check.C) {
+	s.assembler.AddFrames(&s.task, []string{"/render/0001.png", "/render/0002.png"})
+	assert.Nil(c, s.db.C("flamenco_tasks").UpdateId(s.task.ID, M{"$set": M{"status": statusFailed}}))
+	s.assembler.check(s.db)
+
+	assert.Equal(c, previewMovieStatusSkipped, s.findMovie(c).Status)
+	count, err := s.db.C("flamenco_tasks").Count()
+	assert.Nil(c, err)
+	assert.Equal(c, 1, count)
+}
+
+func (s *PreviewMovieAssemblerTestSuite) TestRenderTasksCleanedUp(c *check.C) {
+	s.assembler.AddFrames(&s.task, []string{"/render/0001.png", "/render/0002.png"})
+	assert.Nil(c, s.db.C("flamenco_tasks").RemoveId(s.task.ID))
+	s.assembler.check(s.db)
+
+	assert.Equal(c, previewMovieStatusSkipped, s.findMovie(c).Status)
+}
+
+func (s *PreviewMovieAssemblerTestSuite) TestFramesWhileQueued(c *check.C) {
+	s.assembler.AddFrames(&s.task, []string{"/render/0001.png", "/render/0002.png"})
+	s.completeTask(c, &s.task)
+	s.assembler.check(s.db)
+
+	s.assembler.AddFrames(&s.task, []string{"/render/0003.png"})
+	movie := s.findMovie(c)
+	assert.Equal(c, previewMovieStatusQueued, movie.Status)
+	assert.Len(c, movie.Frames, 3)
+}
+
+func (s *PreviewMovieAssemblerTestSuite) TestTaskDisappeared(c *check.C) {
+	s.assembler.AddFrames(&s.task, []string{"/render/0001.png", "/render/0002.png"})
+	s.completeTask(c, &s.task)
+	s.assembler.check(s.db)
+
+	movie := s.findMovie(c)
+	assert.Nil(c, s.db.C("flamenco_tasks").RemoveId(*movie.TaskID))
+	s.assembler.check(s.db)
+	assert.Equal(c, previewMovieStatusFailed, s.findMovie(c).Status)
+}
+
+func (s *PreviewMovieAssemblerTestSuite) TestServeTranslatesPath(c *check.C) {
+	renderDir, err := ioutil.TempDir("", "preview-movie")
+	assert.Nil(c, err)
+	defer os.RemoveAll(renderDir)
+	assert.Nil(c, ioutil.WriteFile(filepath.Join(renderDir, previewMovieFilename), []byte("movie"), 0644))
+
+	defer func(lookup map[string]map[string]map[string]string) { s.config.VariablesLookup = lookup }(s.config.VariablesLookup)
+	s.config.VariablesLookup = map[string]map[string]map[string]string{
+		"workers": {runtime.GOOS: {"render": renderDir}},
+	}
+	assert.Nil(c, s.db.C("flamenco_preview_movies").Insert(PreviewMovie{
+		JobID:      s.task.Job,
+		Status:     previewMovieStatusCompleted,
+		OutputFile: "{render}/" + previewMovieFilename,
+	}))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/preview-movie/{job-id}", s.assembler.servePreviewMovie)
+	respRec := httptest.NewRecorder()
+	router.ServeHTTP(respRec, httptest.NewRequest("GET", "/preview-movie/"+s.task.Job.Hex(), nil))
+
+	assert.Equal(c, http.StatusOK, respRec.Code)
+	assert.Equal(c, "movie", respRec.Body.String())
+}
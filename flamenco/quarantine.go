@@ -0,0 +1,264 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// WorkerQuarantine keeps track of task failures across jobs, and keeps workers that fail
+// tasks of any job away from all tasks.
+type WorkerQuarantine struct {
+	config  *Conf
+	session *mgo.Session
+}
+
+// workerTaskOutcome records whether a worker completed or failed a task.
+type workerTaskOutcome struct {
+	WorkerID  bson.ObjectId `bson:"worker_id"`
+	JobID     bson.ObjectId `bson:"job_id"`
+	TaskID    bson.ObjectId `bson:"task_id"`
+	Failed    bool          `bson:"failed"`
+	Timestamp time.Time     `bson:"timestamp"`
+	CleanupAt time.Time     `bson:"cleanup_at"`
+}
+
+// quarantineStats summarises the task outcomes of a worker within the quarantine window.
+type quarantineStats struct {
+	finishedTasks int
+	failedTasks   int
+	failedJobs    map[bson.ObjectId]bool
+}
+
+var errNotQuarantined = errors.New("worker is not quarantined")
+
+// CreateWorkerQuarantine creates a new WorkerQuarantine instance.
+func CreateWorkerQuarantine(config *Conf, session *mgo.Session) *WorkerQuarantine {
+	return &WorkerQuarantine{
+		config,
+		session,
+	}
+}
+
+func (wq *WorkerQuarantine) collection(db *mgo.Database) *mgo.Collection {
+	return db.C("worker_task_outcomes")
+}
+
+// EnsureDBIndices ensures the MongoDB indices are there.
+func (wq *WorkerQuarantine) EnsureDBIndices() {
+	coll := wq.collection(wq.session.DB(""))
+
+	coll.EnsureIndex(mgo.Index{
+		Name: "worker-timestamp",
+		Key:  []string{"worker_id", "timestamp"},
+	})
+	coll.EnsureIndex(mgo.Index{
+		Name:        "cleanup-at",
+		Key:         []string{"cleanup_at"},
+		ExpireAfter: 1 * time.Second,
+	})
+}
+
+// RecordTaskOutcome stores that the worker completed or failed the task, and quarantines the
+// worker when it has failed too many tasks. Outcomes of test tasks decide whether a worker
+// can be released from quarantine.
+//
+// Make sure that you include the status and quarantine in the projection when you fetch
+// the worker from MongoDB.
+func (wq *WorkerQuarantine) RecordTaskOutcome(worker *Worker, task *Task, failed bool, db *mgo.Database) {
+	if task.isManagerLocalTask() {
+		wq.handleTestTaskOutcome(worker, failed, db)
+		return
+	}
+	if wq.config.QuarantineWindow <= 0 {
+		return
+	}
+
+	logger := log.WithFields(log.Fields{
+		"worker":  worker.Identifier(),
+		"task_id": task.ID.Hex(),
+		"job_id":  task.Job.Hex(),
+		"failed":  failed,
+	})
+
+	now := time.Now().UTC()
+	outcome := workerTaskOutcome{
+		WorkerID:  worker.ID,
+		JobID:     task.Job,
+		TaskID:    task.ID,
+		Failed:    failed,
+		Timestamp: now,
+		CleanupAt: now.Add(wq.config.QuarantineWindow),
+	}
+	if err := wq.collection(db).Insert(outcome); err != nil {
+		logger.WithError(err).Error("unable to record task outcome")
+		return
+	}
+
+	if !failed || worker.Quarantine != nil {
+		return
+	}
+
+	stats, err := wq.recentStats(worker.ID, now, db)
+	if err != nil {
+		logger.WithError(err).Error("unable to fetch recent task outcomes")
+		return
+	}
+	reason := stats.quarantineReason(wq.config)
+	if reason == "" {
+		return
+	}
+	if err := wq.quarantine(worker, reason, db); err != nil {
+		logger.WithError(err).Error("unable to quarantine worker")
+	}
+}
+
+// recentStats summarises the outcomes of the worker's tasks within the quarantine window.
+func (wq *WorkerQuarantine) recentStats(workerID bson.ObjectId, now time.Time, db *mgo.Database) (quarantineStats, error) {
+	outcomes := []workerTaskOutcome{}
+	err := wq.collection(db).Find(M{
+		"worker_id": workerID,
+		"timestamp": M{"$gt": now.Add(-wq.config.QuarantineWindow)},
+	}).All(&outcomes)
+	if err != nil {
+		return quarantineStats{}, err
+	}
+	return summariseOutcomes(outcomes), nil
+}
+
+func summariseOutcomes(outcomes []workerTaskOutcome) quarantineStats {
+	stats := quarantineStats{
+		failedJobs: map[bson.ObjectId]bool{},
+	}
+	for _, outcome := range outcomes {
+		stats.finishedTasks++
+		if outcome.Failed {
+			stats.failedTasks++
+			stats.failedJobs[outcome.JobID] = true
+		}
+	}
+	return stats
+}
+
+// quarantineReason returns why the worker should be quarantined, or an empty string if it should not.
+func (stats quarantineStats) quarantineReason(config *Conf) string {
+	if stats.finishedTasks == 0 {
+		return ""
+	}
+	if stats.failedTasks < config.QuarantineFailureCount {
+		return ""
+	}
+	if len(stats.failedJobs) < config.QuarantineJobCount {
+		return ""
+	}
+	failureRate := float64(stats.failedTasks) / float64(stats.finishedTasks)
+	if failureRate < config.QuarantineFailureRate {
+		return ""
+	}
+	return fmt.Sprintf("failed %d of %d tasks of %d jobs within %v",
+		stats.failedTasks, stats.finishedTasks, len(stats.failedJobs), config.QuarantineWindow)
+}
+
+// quarantine prevents the worker from receiving any tasks, until it is released.
+func (wq *WorkerQuarantine) quarantine(worker *Worker, reason string, db *mgo.Database) error {
+	log.WithFields(log.Fields{
+		"worker":     worker.Identifier(),
+		"old_status": worker.Status,
+		"reason":     reason,
+	}).Warning("quarantining worker")
+
+	worker.Status = workerStatusQuarantined
+	worker.Quarantine = &WorkerQuarantineInfo{
+		Since:  time.Now().UTC(),
+		Reason: reason,
+	}
+	return db.C("flamenco_workers").UpdateId(worker.ID, M{"$set": M{
+		"status":     worker.Status,
+		"quarantine": worker.Quarantine,
+	}})
+}
+
+// Release releases the worker from quarantine. When configured to do so, test tasks are
+// queued first, and the worker is only released after completing one.
+func (wq *WorkerQuarantine) Release(worker *Worker, db *mgo.Database) (string, error) {
+	if worker.Quarantine == nil {
+		return "", errNotQuarantined
+	}
+
+	if !wq.config.QuarantineTestTask {
+		return "", wq.endQuarantine(worker, db)
+	}
+
+	result, err := queueTestTasks(worker, wq.config, db)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	worker.Quarantine.TestQueued = &now
+	err = db.C("flamenco_workers").UpdateId(worker.ID, M{"$set": M{"quarantine.test_queued": now}})
+	return result, err
+}
+
+// handleTestTaskOutcome releases a quarantined worker when it completed its test task.
+func (wq *WorkerQuarantine) handleTestTaskOutcome(worker *Worker, failed bool, db *mgo.Database) {
+	if worker.Quarantine == nil || worker.Quarantine.TestQueued == nil {
+		return
+	}
+	logger := log.WithField("worker", worker.Identifier())
+
+	if !failed {
+		if err := wq.endQuarantine(worker, db); err != nil {
+			logger.WithError(err).Error("unable to release worker from quarantine")
+		}
+		return
+	}
+
+	logger.Warning("quarantined worker failed its test task, keeping it in quarantine")
+	worker.Quarantine.TestQueued = nil
+	err := db.C("flamenco_workers").UpdateId(worker.ID, M{"$unset": M{"quarantine.test_queued": true}})
+	if err != nil {
+		logger.WithError(err).Error("unable to update quarantined worker")
+	}
+}
+
+// endQuarantine lets the worker receive tasks again, and forgets its earlier failures.
+func (wq *WorkerQuarantine) endQuarantine(worker *Worker, db *mgo.Database) error {
+	log.WithField("worker", worker.Identifier()).Info("releasing worker from quarantine")
+
+	if _, err := wq.collection(db).RemoveAll(M{"worker_id": worker.ID}); err != nil {
+		return err
+	}
+
+	worker.Status = workerStatusAwake
+	worker.Quarantine = nil
+	return db.C("flamenco_workers").UpdateId(worker.ID, M{
+		"$set":   M{"status": worker.Status},
+		"$unset": M{"quarantine": true},
+	})
+}
@@ -0,0 +1,210 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	check "gopkg.in/check.v1"
+)
+
+type QuarantineStatsTestSuite struct{}
+
+var _ = check.Suite(&QuarantineStatsTestSuite{})
+
+func (s *QuarantineStatsTestSuite) TestQuarantineReason(c *check.C) {
+	config := GetTestConfig()
+	config.QuarantineWindow = time.Hour
+	config.QuarantineFailureCount = 3
+	config.QuarantineJobCount = 2
+	config.QuarantineFailureRate = 0.5
+
+	job1 := bson.NewObjectId()
+	job2 := bson.NewObjectId()
+	outcome := func(jobID bson.ObjectId, failed bool) workerTaskOutcome {
+		return workerTaskOutcome{JobID: jobID, Failed: failed}
+	}
+
+	// Nothing happened yet.
+	assert.Equal(c, "", summariseOutcomes(nil).quarantineReason(&config))
+
+	// Too few failures.
+	stats := summariseOutcomes([]workerTaskOutcome{
+		outcome(job1, true), outcome(job2, true),
+	})
+	assert.Equal(c, "", stats.quarantineReason(&config))
+
+	// Enough failures, but all of the same job; that's for the blacklist to handle.
+	stats = summariseOutcomes([]workerTaskOutcome{
+		outcome(job1, true), outcome(job1, true), outcome(job1, true),
+	})
+	assert.Equal(c, "", stats.quarantineReason(&config))
+
+	// Enough failures of different jobs, but too many completed tasks.
+	stats = summariseOutcomes([]workerTaskOutcome{
+		outcome(job1, true), outcome(job2, true), outcome(job1, true),
+		outcome(job1, false), outcome(job2, false), outcome(job2, false), outcome(job2, false),
+	})
+	assert.Equal(c, "", stats.quarantineReason(&config))
+
+	// This worker should be quarantined.
+	stats = summariseOutcomes([]workerTaskOutcome{
+		outcome(job1, true), outcome(job2, true), outcome(job1, false), outcome(job1, true),
+	})
+	assert.Equal(c, "failed 3 of 4 tasks of 2 jobs within 1h0m0s", stats.quarantineReason(&config))
+}
+
+type WorkerQuarantineTestSuite struct {
+	config Conf
+	db     *mgo.Database
+	wq     *WorkerQuarantine
+	worker Worker
+}
+
+var _ = check.Suite(&WorkerQuarantineTestSuite{})
+
+func (s *WorkerQuarantineTestSuite) SetUpTest(c *check.C) {
+	s.config = GetTestConfig()
+	s.config.QuarantineWindow = time.Hour
+	s.config.QuarantineFailureCount = 2
+	s.config.QuarantineJobCount = 2
+	s.config.QuarantineFailureRate = 0.5
+	session := MongoSession(&s.config)
+	s.db = session.DB("")
+	s.wq = CreateWorkerQuarantine(&s.config, session)
+	s.wq.EnsureDBIndices()
+
+	s.worker = Worker{
+		Platform:           "linux",
+		SupportedTaskTypes: []string{"sleeping", "test-blender-render"},
+		Nickname:           "worker",
+		Status:             workerStatusAwake,
+	}
+	if err := StoreNewWorker(&s.worker, s.db); err != nil {
+		c.Fatal("Unable to insert test worker", err)
+	}
+}
+
+func (s *WorkerQuarantineTestSuite) TearDownTest(c *check.C) {
+	log.Info("WorkerQuarantineTestSuite tearing down test, dropping database.")
+	s.db.DropDatabase()
+}
+
+func (s *WorkerQuarantineTestSuite) taskOfJob(jobID bson.ObjectId) *Task {
+	task := ConstructTestTask(bson.NewObjectId().Hex(), "sleeping")
+	task.Job = jobID
+	return &task
+}
+
+func (s *WorkerQuarantineTestSuite) TestSingleJobNotQuarantined(c *check.C) {
+	job := bson.NewObjectId()
+	for i := 0; i < 5; i++ {
+		s.wq.RecordTaskOutcome(&s.worker, s.taskOfJob(job), true, s.db)
+	}
+
+	found, err := FindWorkerByID(s.worker.ID, s.db)
+	assert.Nil(c, err)
+	assert.Equal(c, workerStatusAwake, found.Status)
+	assert.Nil(c, found.Quarantine)
+}
+
+func (s *WorkerQuarantineTestSuite) TestQuarantineAndRelease(c *check.C) {
+	s.wq.RecordTaskOutcome(&s.worker, s.taskOfJob(bson.NewObjectId()), true, s.db)
+	s.wq.RecordTaskOutcome(&s.worker, s.taskOfJob(bson.NewObjectId()), true, s.db)
+
+	found, err := FindWorkerByID(s.worker.ID, s.db)
+	assert.Nil(c, err)
+	assert.Equal(c, workerStatusQuarantined, found.Status)
+	if assert.NotNil(c, found.Quarantine) {
+		assert.Equal(c, "failed 2 of 2 tasks of 2 jobs within 1h0m0s", found.Quarantine.Reason)
+	}
+
+	// Asking for a task should not wake up the worker.
+	assert.Nil(c, found.SetAwake(s.db))
+	found, err = FindWorkerByID(s.worker.ID, s.db)
+	assert.Nil(c, err)
+	assert.Equal(c, workerStatusQuarantined, found.Status)
+
+	// Releasing should also forget the failures.
+	_, err = s.wq.Release(found, s.db)
+	assert.Nil(c, err)
+	found, err = FindWorkerByID(s.worker.ID, s.db)
+	assert.Nil(c, err)
+	assert.Equal(c, workerStatusAwake, found.Status)
+	assert.Nil(c, found.Quarantine)
+
+	count, err := s.db.C("worker_task_outcomes").Find(M{"worker_id": s.worker.ID}).Count()
+	assert.Nil(c, err)
+	assert.Equal(c, 0, count)
+
+	_, err = s.wq.Release(found, s.db)
+	assert.Equal(c, errNotQuarantined, err)
+}
+
+func (s *WorkerQuarantineTestSuite) TestReleaseAfterTestTask(c *check.C) {
+	s.config.QuarantineTestTask = true
+	s.config.TestTasks.BlenderRender.JobStorage = c.MkDir()
+	s.config.TestTasks.BlenderRender.RenderOutput = c.MkDir()
+
+	s.wq.RecordTaskOutcome(&s.worker, s.taskOfJob(bson.NewObjectId()), true, s.db)
+	s.wq.RecordTaskOutcome(&s.worker, s.taskOfJob(bson.NewObjectId()), true, s.db)
+	found, err := FindWorkerByID(s.worker.ID, s.db)
+	assert.Nil(c, err)
+
+	_, err = s.wq.Release(found, s.db)
+	assert.Nil(c, err)
+	found, err = FindWorkerByID(s.worker.ID, s.db)
+	assert.Nil(c, err)
+	assert.Equal(c, workerStatusQuarantined, found.Status)
+	if !assert.NotNil(c, found.Quarantine) {
+		return
+	}
+	assert.NotNil(c, found.Quarantine.TestQueued)
+
+	testTask := Task{}
+	err = s.db.C("flamenco_tasks").Find(M{"worker_id": s.worker.ID, "job_type": managerLocalJobType}).One(&testTask)
+	assert.Nil(c, err)
+
+	// A failed test task keeps the worker in quarantine.
+	s.wq.RecordTaskOutcome(found, &testTask, true, s.db)
+	found, err = FindWorkerByID(s.worker.ID, s.db)
+	assert.Nil(c, err)
+	assert.Equal(c, workerStatusQuarantined, found.Status)
+	if assert.NotNil(c, found.Quarantine) {
+		assert.Nil(c, found.Quarantine.TestQueued)
+	}
+
+	// A completed test task releases it.
+	_, err = s.wq.Release(found, s.db)
+	assert.Nil(c, err)
+	s.wq.RecordTaskOutcome(found, &testTask, false, s.db)
+	found, err = FindWorkerByID(s.worker.ID, s.db)
+	assert.Nil(c, err)
+	assert.Equal(c, workerStatusAwake, found.Status)
+	assert.Nil(c, found.Quarantine)
+}
@@ -0,0 +1,320 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/armadillica/flamenco-manager/flamenco/exr"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/image/tiff"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// Number of produced files that can wait for verification; more are not verified.
+	renderOutputVerifierQueueSize = 100
+
+	// Tasks are re-queued at most this many times for render output problems, so that a task
+	// that legitimately renders a black frame doesn't keep being re-rendered.
+	renderOutputMaxRequeues = 3
+)
+
+// Extensions of the images that the verifier can decode. Other files are only checked for size.
+var renderOutputDecodableExtensions = map[string]bool{
+	".exr":  true,
+	".jpeg": true,
+	".jpg":  true,
+	".png":  true,
+	".tif":  true,
+	".tiff": true,
+}
+
+// RenderOutputProblem is stored on a task when a file it produced fails verification.
+type RenderOutputProblem struct {
+	Path    string    `bson:"path" json:"path"`
+	Problem string    `bson:"problem" json:"problem"`
+	Worker  string    `bson:"worker" json:"worker"`
+	Checked time.Time `bson:"checked" json:"checked"`
+}
+
+// RenderOutputVerifier checks files produced by workers, to find empty, corrupt, black and
+// transparent frames before they end up in the comp.
+type RenderOutputVerifier struct {
+	closable
+	config    *Conf
+	session   *mgo.Session
+	queue     *TaskUpdateQueue
+	scheduler *TaskScheduler
+	outputs   chan producedOutput
+}
+
+// producedOutput is a file produced by a worker for a task.
+type producedOutput struct {
+	path     string
+	workerID bson.ObjectId
+	taskID   bson.ObjectId
+}
+
+// CreateRenderOutputVerifier creates a RenderOutputVerifier, or returns nil if the configuration
+// disables render output verification.
+func CreateRenderOutputVerifier(config *Conf, session *mgo.Session, queue *TaskUpdateQueue,
+	scheduler *TaskScheduler) *RenderOutputVerifier {
+
+	if !config.VerifyRenderOutput {
+		log.Debug("render output will not be verified")
+		return nil
+	}
+	log.WithField("requeue", config.VerifyRenderOutputRequeue).Info("render output will be verified")
+
+	return &RenderOutputVerifier{
+		makeClosable(),
+		config,
+		session,
+		queue,
+		scheduler,
+		make(chan producedOutput, renderOutputVerifierQueueSize),
+	}
+}
+
+// Queue schedules the files produced by the worker for the task for verification.
+// This never blocks; when the queue is full the files are not verified.
+func (rov *RenderOutputVerifier) Queue(workerID, taskID bson.ObjectId, paths []string) {
+	for _, path := range paths {
+		select {
+		case rov.outputs <- producedOutput{path, workerID, taskID}:
+		default:
+			log.WithFields(log.Fields{
+				"path":    path,
+				"task_id": taskID.Hex(),
+			}).Warning("RenderOutputVerifier: queue is full, not verifying produced file")
+		}
+	}
+}
+
+// Go starts a goroutine that verifies the queued files.
+func (rov *RenderOutputVerifier) Go() {
+	rov.closableAdd(1)
+	go func() {
+		session := rov.session.Copy()
+		db := session.DB("")
+		defer session.Close()
+		defer rov.closableDone()
+		defer log.Info("RenderOutputVerifier: shutting down.")
+
+		for {
+			select {
+			case <-rov.doneChan:
+				return
+			case output := <-rov.outputs:
+				rov.verify(output, db)
+			}
+		}
+	}()
+}
+
+// Close signals the RenderOutputVerifier goroutine to stop and waits for it to close.
+func (rov *RenderOutputVerifier) Close() {
+	log.Debug("RenderOutputVerifier: Close() called.")
+	rov.closableCloseAndWait()
+	log.Debug("RenderOutputVerifier: shutdown complete.")
+}
+
+func (rov *RenderOutputVerifier) verify(output producedOutput, db *mgo.Database) {
+	logger := log.WithFields(log.Fields{
+		"path":      output.path,
+		"task_id":   output.taskID.Hex(),
+		"worker_id": output.workerID.Hex(),
+	})
+
+	problem := verifyRenderOutput(output.path, rov.config.VerifyRenderOutputMinSize)
+	if problem == "" {
+		logger.Debug("RenderOutputVerifier: produced file is fine")
+		return
+	}
+	logger = logger.WithField("problem", problem)
+	logger.Warning("RenderOutputVerifier: produced file failed verification")
+
+	task := Task{}
+	if err := db.C("flamenco_tasks").FindId(output.taskID).One(&task); err != nil {
+		logger.WithError(err).Error("RenderOutputVerifier: unable to find task to record problem")
+		return
+	}
+	worker, err := FindWorkerByID(output.workerID, db)
+	if err != nil {
+		logger.WithError(err).Error("RenderOutputVerifier: unable to find worker to record problem")
+		return
+	}
+
+	renderProblem := RenderOutputProblem{
+		Path:    output.path,
+		Problem: problem,
+		Worker:  worker.Identifier(),
+		Checked: time.Now().UTC(),
+	}
+	tupdate := TaskUpdate{
+		isManagerLocal: task.isManagerLocalTask(),
+		TaskID:         task.ID,
+		Activity:       fmt.Sprintf("Render output %s failed verification: %s", filepath.Base(output.path), problem),
+		Log: fmt.Sprintf("%s: Manager found a problem with render output %s produced by worker %s: %s",
+			time.Now().Format(IsoFormat), output.path, worker.Identifier(), problem),
+	}
+	extraUpdates := bson.M{"$push": bson.M{"render_output_problems": renderProblem}}
+	if err := rov.queue.QueueTaskUpdateWithExtra(&task, &tupdate, db, extraUpdates); err != nil {
+		logger.WithError(err).Error("RenderOutputVerifier: unable to record problem on task")
+		return
+	}
+
+	if !rov.config.VerifyRenderOutputRequeue {
+		return
+	}
+	if task.RenderOutputRequeues >= renderOutputMaxRequeues {
+		logger.WithField("requeue_count", task.RenderOutputRequeues).
+			Warning("RenderOutputVerifier: task was re-queued too often, not re-queueing again")
+		return
+	}
+	reason := fmt.Sprintf("render output %s failed verification: %s", filepath.Base(output.path), problem)
+	switch task.Status {
+	case statusActive:
+		err = rov.scheduler.ReturnTask(worker, log.Fields{"task_id": task.ID.Hex()}, db, &task, reason)
+	case statusCompleted:
+		// Verification runs after the worker reported the output, so usually the task has
+		// completed by now, and ReturnTask() would leave it alone.
+		err = rov.requeueCompletedTask(&task, worker, reason, db)
+	default:
+		logger.WithField("task_status", task.Status).Info("RenderOutputVerifier: task is not active or completed, not re-queueing")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Error("RenderOutputVerifier: unable to re-queue task")
+		return
+	}
+
+	if err := db.C("flamenco_tasks").UpdateId(task.ID, bson.M{"$inc": bson.M{"render_output_requeues": 1}}); err != nil {
+		logger.WithError(err).Error("RenderOutputVerifier: unable to count re-queue of task")
+	}
+}
+
+// requeueCompletedTask queues the task again, unassigning it from the worker that rendered it.
+func (rov *RenderOutputVerifier) requeueCompletedTask(task *Task, worker *Worker, reason string, db *mgo.Database) error {
+	// Lock the task scheduler so that the task isn't assigned before it's unassigned.
+	rov.scheduler.mutex.Lock()
+	defer rov.scheduler.mutex.Unlock()
+
+	wIdent := worker.Identifier()
+	tupdate := TaskUpdate{
+		isManagerLocal: task.isManagerLocalTask(),
+		TaskID:         task.ID,
+		TaskStatus:     statusClaimedByManager,
+		Worker:         "-", // no longer assigned to any worker
+		Activity:       fmt.Sprintf("Re-queued completed task rendered by worker %s: %s", wIdent, reason),
+		Log: fmt.Sprintf("%s: Manager re-queued completed task rendered by worker %s: %s",
+			time.Now().Format(IsoFormat), wIdent, reason),
+	}
+	unassign := bson.M{
+		"$set":   bson.M{"worker": ""},
+		"$unset": bson.M{"worker_id": true},
+	}
+	return rov.queue.QueueTaskUpdateWithExtra(task, &tupdate, db, unassign)
+}
+
+// verifyRenderOutput checks a produced file, and returns a description of the problem
+// with it, or an empty string if it is fine.
+func verifyRenderOutput(path string, minSize int64) string {
+	stat, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		return "file does not exist"
+	case err != nil:
+		return fmt.Sprintf("unable to inspect file: %v", err)
+	case stat.IsDir():
+		return "path is a directory"
+	case stat.Size() == 0:
+		return "file is empty"
+	case stat.Size() < minSize:
+		return fmt.Sprintf("file is only %d bytes", stat.Size())
+	}
+
+	if !renderOutputDecodableExtensions[strings.ToLower(filepath.Ext(path))] {
+		return ""
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Sprintf("unable to open file: %v", err)
+	}
+	defer file.Close()
+
+	img, err := decodeImageFile(file)
+	if err == errImageTooLarge {
+		return err.Error()
+	}
+	switch err.(type) {
+	case nil:
+		return imageContentProblem(img)
+	case png.UnsupportedError, jpeg.UnsupportedError, tiff.UnsupportedError, exr.UnsupportedError:
+		// Valid file, but we can't look inside.
+		log.WithFields(log.Fields{
+			"path":       path,
+			log.ErrorKey: err,
+		}).Debug("RenderOutputVerifier: unable to verify image contents")
+		return ""
+	default:
+		return fmt.Sprintf("unable to decode image: %v", err)
+	}
+}
+
+// imageContentProblem returns a description of the problem if the image is entirely
+// transparent or entirely black, or an empty string if it is not.
+func imageContentProblem(img image.Image) string {
+	transparent, black := true, true
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a != 0 {
+				transparent = false
+			}
+			// Anything that would be visible in 8 bits per channel is not black.
+			if r >= 0x101 || g >= 0x101 || b >= 0x101 {
+				black = false
+			}
+			if !transparent && !black {
+				return ""
+			}
+		}
+	}
+
+	if transparent {
+		return "image is entirely transparent"
+	}
+	return "image is entirely black"
+}
@@ -0,0 +1,289 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	httpmock "gopkg.in/jarcoal/httpmock.v1"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// RenderOutputCheckTestSuite tests the checks on produced files, without MongoDB.
+type RenderOutputCheckTestSuite struct {
+	tempdir string
+}
+
+var _ = check.Suite(&RenderOutputCheckTestSuite{})
+
+func (s *RenderOutputCheckTestSuite) SetUpTest(c *check.C) {
+	var err error
+	s.tempdir, err = ioutil.TempDir("", "testrenderoutput")
+	assert.Nil(c, err)
+}
+
+func (s *RenderOutputCheckTestSuite) TearDownTest(c *check.C) {
+	os.RemoveAll(s.tempdir)
+}
+
+// writePNG writes a 4x4 PNG where every pixel has the given colour, except pixel (1, 2).
+func (s *RenderOutputCheckTestSuite) writePNG(c *check.C, filename string, fill, pixel color.Color) string {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			img.Set(x, y, fill)
+		}
+	}
+	img.Set(1, 2, pixel)
+
+	imgPath := filepath.Join(s.tempdir, filename)
+	file, err := os.Create(imgPath)
+	assert.Nil(c, err)
+	defer file.Close()
+	assert.Nil(c, png.Encode(file, img))
+	return imgPath
+}
+
+func (s *RenderOutputCheckTestSuite) TestFileSize(c *check.C) {
+	assert.Equal(c, "file does not exist", verifyRenderOutput(filepath.Join(s.tempdir, "nonexistant.png"), 0))
+	assert.Equal(c, "path is a directory", verifyRenderOutput(s.tempdir, 0))
+
+	emptyPath := filepath.Join(s.tempdir, "empty.exr")
+	assert.Nil(c, ioutil.WriteFile(emptyPath, []byte{}, 0644))
+	assert.Equal(c, "file is empty", verifyRenderOutput(emptyPath, 0))
+
+	// Files we can't decode are only checked for size.
+	videoPath := filepath.Join(s.tempdir, "preview.mkv")
+	assert.Nil(c, ioutil.WriteFile(videoPath, []byte("not really a video"), 0644))
+	assert.Equal(c, "", verifyRenderOutput(videoPath, 0))
+	assert.Equal(c, "file is only 18 bytes", verifyRenderOutput(videoPath, 1024))
+}
+
+func (s *RenderOutputCheckTestSuite) TestDecodability(c *check.C) {
+	black := color.NRGBA{A: 0xff}
+	white := color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	imgPath := s.writePNG(c, "frame.png", black, white)
+	assert.Equal(c, "", verifyRenderOutput(imgPath, 0))
+
+	contents, err := ioutil.ReadFile(imgPath)
+	assert.Nil(c, err)
+	truncatedPath := filepath.Join(s.tempdir, "truncated.png")
+	assert.Nil(c, ioutil.WriteFile(truncatedPath, contents[:len(contents)/2], 0644))
+	assert.Contains(c, verifyRenderOutput(truncatedPath, 0), "unable to decode image")
+
+	// The extension determines whether the file should be decodable.
+	garbagePath := filepath.Join(s.tempdir, "garbage.JPG")
+	assert.Nil(c, ioutil.WriteFile(garbagePath, []byte("this is no JPEG"), 0644))
+	assert.Contains(c, verifyRenderOutput(garbagePath, 0), "unable to decode image")
+}
+
+func (s *RenderOutputCheckTestSuite) TestHugeImage(c *check.C) {
+	// Decoding would allocate memory for all pixels, so only the header should be read.
+	imgPath := filepath.Join(s.tempdir, "huge.png")
+	writeHugePNG(c, imgPath)
+	assert.Equal(c, "image dimensions too large", verifyRenderOutput(imgPath, 0))
+}
+
+func (s *RenderOutputCheckTestSuite) TestImageContents(c *check.C) {
+	black := color.NRGBA{A: 0xff}
+	transparent := color.NRGBA{}
+	almostBlack := color.NRGBA{R: 1, A: 0xff}
+	transparentRed := color.NRGBA{R: 0xff}
+
+	assert.Equal(c, "image is entirely black", verifyRenderOutput(s.writePNG(c, "black.png", black, black), 0))
+	assert.Equal(c, "image is entirely transparent",
+		verifyRenderOutput(s.writePNG(c, "transparent.png", transparent, transparent), 0))
+	assert.Equal(c, "image is entirely black",
+		verifyRenderOutput(s.writePNG(c, "black-and-transparent.png", transparent, black), 0))
+
+	// A single visible pixel is enough.
+	assert.Equal(c, "", verifyRenderOutput(s.writePNG(c, "dark.png", black, almostBlack), 0))
+	assert.Equal(c, "", verifyRenderOutput(s.writePNG(c, "alpha.png", transparent, color.NRGBA{A: 1, R: 0xff}), 0))
+	// Non-premultiplied colour without alpha is not visible.
+	assert.Equal(c, "image is entirely transparent",
+		verifyRenderOutput(s.writePNG(c, "invisible.png", transparent, transparentRed), 0))
+
+	// OpenEXR files have their alpha channel checked too.
+	assert.Equal(c, "image is entirely transparent",
+		verifyRenderOutput(filepath.Join("exr", "testdata", "transparent.exr"), 0))
+}
+
+// RenderOutputVerifierTestSuite tests recording problems on tasks.
+type RenderOutputVerifierTestSuite struct {
+	config   Conf
+	session  *mgo.Session
+	db       *mgo.Database
+	sched    *TaskScheduler
+	verifier *RenderOutputVerifier
+	worker   Worker
+	task     Task
+	tempdir  string
+}
+
+var _ = check.Suite(&RenderOutputVerifierTestSuite{})
+
+func (s *RenderOutputVerifierTestSuite) SetUpSuite(c *check.C) {
+	s.config = GetTestConfig()
+	s.config.VerifyRenderOutput = true
+
+	s.session = MongoSession(&s.config)
+	s.db = s.session.DB("")
+}
+
+func (s *RenderOutputVerifierTestSuite) SetUpTest(c *check.C) {
+	httpmock.Activate()
+
+	var err error
+	s.tempdir, err = ioutil.TempDir("", "testrenderoutput")
+	assert.Nil(c, err)
+	s.config.TaskLogsPath = s.tempdir
+	s.config.VerifyRenderOutputRequeue = false
+
+	upstream := ConnectUpstream(&s.config, s.session)
+	blacklist := CreateWorkerBlackList(&s.config, s.session)
+	queue := CreateTaskUpdateQueue(&s.config, blacklist, CreateWorkerQuarantine(&s.config, s.session), nil, newLocalTaskLogStore(&s.config))
+	pusher := CreateTaskUpdatePusher(&s.config, upstream, s.session, queue, nil)
+	s.sched = CreateTaskScheduler(&s.config, upstream, s.session, queue, blacklist, pusher)
+	s.verifier = CreateRenderOutputVerifier(&s.config, s.session, queue, s.sched)
+
+	s.worker = Worker{
+		Platform:           "linux",
+		SupportedTaskTypes: []string{"testing"},
+		Nickname:           "renderer",
+		Status:             workerStatusAwake,
+	}
+	if err := StoreNewWorker(&s.worker, s.db); err != nil {
+		c.Fatal("Unable to insert test worker", err)
+	}
+
+	s.task = ConstructTestTask("1aaaaaaaaaaaaaaaaaaaaaaa", "testing")
+	assert.Nil(c, s.db.C("flamenco_tasks").Insert(&s.task))
+	assert.Nil(c, s.sched.assignTaskToWorker(&s.task, &s.worker, s.db, log.WithField("testing", "testing")))
+}
+
+func (s *RenderOutputVerifierTestSuite) TearDownTest(c *check.C) {
+	log.Info("RenderOutputVerifierTestSuite tearing down test, dropping database.")
+	s.db.DropDatabase()
+	os.RemoveAll(s.tempdir)
+	httpmock.DeactivateAndReset()
+}
+
+func (s *RenderOutputVerifierTestSuite) emptyOutput(c *check.C) producedOutput {
+	outputPath := filepath.Join(s.tempdir, "frame-0001.exr")
+	assert.Nil(c, ioutil.WriteFile(outputPath, []byte{}, 0644))
+	return producedOutput{outputPath, s.worker.ID, s.task.ID}
+}
+
+func (s *RenderOutputVerifierTestSuite) findTask(c *check.C) Task {
+	found := Task{}
+	assert.Nil(c, s.db.C("flamenco_tasks").FindId(s.task.ID).One(&found))
+	return found
+}
+
+func (s *RenderOutputVerifierTestSuite) TestDisabled(c *check.C) {
+	config := GetTestConfig()
+	assert.Nil(c, CreateRenderOutputVerifier(&config, s.session, nil, nil))
+}
+
+func (s *RenderOutputVerifierTestSuite) TestRecordProblem(c *check.C) {
+	output := s.emptyOutput(c)
+	s.verifier.verify(output, s.db)
+
+	found := s.findTask(c)
+	assert.Equal(c, statusActive, found.Status, "task should not be re-queued")
+	assert.Contains(c, found.Activity, "frame-0001.exr failed verification: file is empty")
+	if assert.Len(c, found.RenderOutputProblems, 1) {
+		problem := found.RenderOutputProblems[0]
+		assert.Equal(c, output.path, problem.Path)
+		assert.Equal(c, "file is empty", problem.Problem)
+		assert.Equal(c, s.worker.Identifier(), problem.Worker)
+	}
+
+	logDir, logFile := taskLogPath(s.task.Job, s.task.ID, &s.config)
+	contents, err := ioutil.ReadFile(filepath.Join(logDir, logFile))
+	assert.Nil(c, err)
+	assert.Contains(c, string(contents), "Manager found a problem with render output "+output.path)
+}
+
+func (s *RenderOutputVerifierTestSuite) TestRequeue(c *check.C) {
+	s.config.VerifyRenderOutputRequeue = true
+	s.verifier.verify(s.emptyOutput(c), s.db)
+
+	found := s.findTask(c)
+	assert.Equal(c, statusClaimedByManager, found.Status)
+	assert.Len(c, found.RenderOutputProblems, 1)
+	assert.Equal(c, 1, found.RenderOutputRequeues)
+}
+
+func (s *RenderOutputVerifierTestSuite) TestRequeueCompleted(c *check.C) {
+	s.config.VerifyRenderOutputRequeue = true
+	// Verification usually happens after the task has completed.
+	assert.Nil(c, s.db.C("flamenco_tasks").UpdateId(s.task.ID, M{"$set": M{"status": statusCompleted}}))
+
+	s.verifier.verify(s.emptyOutput(c), s.db)
+
+	found := s.findTask(c)
+	assert.Equal(c, statusClaimedByManager, found.Status)
+	assert.Nil(c, found.WorkerID)
+	assert.Equal(c, "", found.Worker)
+	assert.Len(c, found.RenderOutputProblems, 1)
+	assert.Equal(c, 1, found.RenderOutputRequeues)
+	assert.Contains(c, found.Activity, "Re-queued completed task rendered by worker renderer")
+}
+
+func (s *RenderOutputVerifierTestSuite) TestRequeueLimit(c *check.C) {
+	s.config.VerifyRenderOutputRequeue = true
+	// Problems without re-queue, for example because the task wasn't active, don't count.
+	problems := make([]RenderOutputProblem, renderOutputMaxRequeues)
+	assert.Nil(c, s.db.C("flamenco_tasks").UpdateId(s.task.ID, M{"$set": M{"render_output_problems": problems}}))
+	s.verifier.verify(s.emptyOutput(c), s.db)
+	found := s.findTask(c)
+	assert.Equal(c, statusClaimedByManager, found.Status)
+	assert.Equal(c, 1, found.RenderOutputRequeues)
+
+	assert.Nil(c, s.db.C("flamenco_tasks").UpdateId(s.task.ID, M{"$set": M{
+		"status":                 statusActive,
+		"render_output_requeues": renderOutputMaxRequeues,
+	}}))
+	s.verifier.verify(s.emptyOutput(c), s.db)
+
+	found = s.findTask(c)
+	assert.Equal(c, statusActive, found.Status, "task should not be re-queued again")
+	assert.Len(c, found.RenderOutputProblems, renderOutputMaxRequeues+2)
+	assert.Equal(c, renderOutputMaxRequeues, found.RenderOutputRequeues)
+}
+
+func (s *RenderOutputVerifierTestSuite) TestQueueFull(c *check.C) {
+	paths := make([]string, renderOutputVerifierQueueSize+5)
+	// Should not block, even though nothing reads from the queue.
+	s.verifier.Queue(s.worker.ID, s.task.ID, paths)
+	assert.Len(c, s.verifier.outputs, renderOutputVerifierQueueSize)
+}
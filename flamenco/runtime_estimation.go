@@ -0,0 +1,309 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// RuntimeEstimator learns how long tasks take from the completed tasks of the same job,
+// and uses that to estimate when active tasks and unfinished jobs will be done.
+type RuntimeEstimator struct {
+	config *Conf
+
+	// Expected runtimes are cached, as the dashboard asks for them on every poll.
+	mutex     sync.Mutex
+	cache     map[runtimeKey]cachedRuntime
+	lastPrune time.Time
+}
+
+// cachedRuntime is an expected runtime, and when it was computed.
+type cachedRuntime struct {
+	seconds  float64
+	computed time.Time
+}
+
+// Expected runtimes are recomputed from the database once they are older than this.
+const runtimeCacheDuration = 1 * time.Minute
+
+// RuntimeReport is part of a StatusReport and contains the runtime estimates.
+type RuntimeReport struct {
+	Jobs  []JobRuntimeEstimate  `json:"jobs"`
+	Tasks []TaskRuntimeEstimate `json:"tasks"`
+}
+
+// JobRuntimeEstimate contains the estimated time of completion of an unfinished job.
+type JobRuntimeEstimate struct {
+	JobID     bson.ObjectId `json:"job_id"`
+	TasksLeft int           `json:"tasks_left"`
+	// Median runtime in seconds per task type, only for task types with completed tasks.
+	TaskRuntimes map[string]float64 `json:"task_runtimes"`
+	// Nil when it cannot be estimated, for example when no task of some type has completed yet.
+	ETA *time.Time `json:"eta,omitempty"`
+}
+
+// TaskRuntimeEstimate contains the estimated time of completion of an active task.
+type TaskRuntimeEstimate struct {
+	TaskID   bson.ObjectId `json:"task_id"`
+	JobID    bson.ObjectId `json:"job_id"`
+	TaskType string        `json:"task_type"`
+	Worker   string        `json:"worker"`
+	Elapsed  float64       `json:"elapsed"`  // seconds since the task was assigned to its worker.
+	Expected float64       `json:"expected"` // median runtime in seconds of its completed siblings.
+	ETA      time.Time     `json:"eta"`
+	Anomaly  bool          `json:"anomaly"` // running for more than RuntimeAnomalyFactor times the expected runtime.
+}
+
+// runtimeKey identifies the tasks that are expected to take about the same time.
+type runtimeKey struct {
+	jobID    bson.ObjectId
+	taskType string
+}
+
+// Task statuses that still need a worker to spend time on them.
+var unfinishedTaskStatuses = []string{statusQueued, statusClaimedByManager, statusActive, statusSoftFailed}
+
+// CreateRuntimeEstimator creates a new RuntimeEstimator.
+func CreateRuntimeEstimator(config *Conf) *RuntimeEstimator {
+	return &RuntimeEstimator{
+		config: config,
+		cache:  map[runtimeKey]cachedRuntime{},
+	}
+}
+
+// Report estimates the completion time of all unfinished jobs and active tasks.
+func (re *RuntimeEstimator) Report(db *mgo.Database) (*RuntimeReport, error) {
+	var tasks []Task
+	query := M{"status": M{"$in": unfinishedTaskStatuses}}
+	projection := M{"job": 1, "task_type": 1, "status": 1, "worker": 1, "activated_at": 1}
+	if err := db.C("flamenco_tasks").Find(query).Select(projection).All(&tasks); err != nil {
+		return nil, err
+	}
+
+	var workers []Worker
+	workerQuery := M{"status": M{"$in": []string{workerStatusAwake, workerStatusStarting}}}
+	if err := db.C("flamenco_workers").Find(workerQuery).Select(M{"supported_task_types": 1}).All(&workers); err != nil {
+		return nil, err
+	}
+
+	expected := map[runtimeKey]float64{}
+	for _, task := range tasks {
+		key := runtimeKey{task.Job, task.TaskType}
+		if _, seen := expected[key]; seen {
+			continue
+		}
+		runtime, err := re.ExpectedRuntime(task.Job, task.TaskType, db)
+		if err != nil {
+			return nil, err
+		}
+		expected[key] = runtime
+	}
+
+	return estimateRuntimes(tasks, workers, expected, *UtcNow(), re.config.RuntimeAnomalyFactor), nil
+}
+
+// ExpectedRuntime returns the median runtime in seconds of the recently completed tasks
+// of the given job and type, or 0 if there are none. The result is cached for
+// runtimeCacheDuration.
+func (re *RuntimeEstimator) ExpectedRuntime(jobID bson.ObjectId, taskType string, db *mgo.Database) (float64, error) {
+	key := runtimeKey{jobID, taskType}
+	now := time.Now()
+
+	re.mutex.Lock()
+	cached, found := re.cache[key]
+	re.mutex.Unlock()
+	if found && now.Sub(cached.computed) < runtimeCacheDuration {
+		return cached.seconds, nil
+	}
+
+	runtime, err := re.queryExpectedRuntime(jobID, taskType, db)
+	if err != nil {
+		return 0, err
+	}
+
+	re.mutex.Lock()
+	defer re.mutex.Unlock()
+	re.cache[key] = cachedRuntime{runtime, now}
+	re.pruneCache(now)
+	return runtime, nil
+}
+
+// pruneCache forgets expired runtimes, so that finished jobs don't stay in the cache.
+// Assumes re.mutex is locked.
+func (re *RuntimeEstimator) pruneCache(now time.Time) {
+	if now.Sub(re.lastPrune) < runtimeCacheDuration {
+		return
+	}
+	for key, cached := range re.cache {
+		if now.Sub(cached.computed) >= runtimeCacheDuration {
+			delete(re.cache, key)
+		}
+	}
+	re.lastPrune = now
+}
+
+// queryExpectedRuntime computes the expected runtime from the database.
+func (re *RuntimeEstimator) queryExpectedRuntime(jobID bson.ObjectId, taskType string, db *mgo.Database) (float64, error) {
+	var completed []Task
+	query := M{
+		"job":       jobID,
+		"task_type": taskType,
+		"status":    statusCompleted,
+	}
+	projection := M{"metrics": 1, "activated_at": 1, "last_updated": 1}
+	err := db.C("flamenco_tasks").Find(query).Select(projection).
+		Sort("-last_updated").Limit(re.config.RuntimeEstimationSamples).All(&completed)
+	if err != nil {
+		return 0, err
+	}
+
+	runtimes := make([]float64, 0, len(completed))
+	for idx := range completed {
+		if runtime := taskRuntime(&completed[idx]); runtime > 0 {
+			runtimes = append(runtimes, runtime)
+		}
+	}
+	return median(runtimes), nil
+}
+
+// taskRuntime returns the runtime in seconds of a completed task. The timing metrics reported
+// by the worker are preferred; without those the time since the task was assigned is used.
+func taskRuntime(task *Task) float64 {
+	if task.Metrics != nil && len(task.Metrics.Timing) > 0 {
+		total := 0.0
+		for _, seconds := range task.Metrics.Timing {
+			total += seconds
+		}
+		return total
+	}
+	if task.ActivatedAt == nil || task.LastUpdated == nil {
+		return 0
+	}
+	return task.LastUpdated.Sub(*task.ActivatedAt).Seconds()
+}
+
+// median returns the median of the values, or 0 if there are none.
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 1 {
+		return sorted[middle]
+	}
+	return (sorted[middle-1] + sorted[middle]) / 2
+}
+
+// estimateRuntimes computes the ETAs of unfinished tasks and their jobs. The work left for
+// each task type is divided over the workers that can run it.
+func estimateRuntimes(tasks []Task, workers []Worker, expected map[runtimeKey]float64,
+	now time.Time, anomalyFactor float64) *RuntimeReport {
+
+	capacity := map[string]int{}
+	for _, worker := range workers {
+		for _, taskType := range worker.SupportedTaskTypes {
+			capacity[taskType]++
+		}
+	}
+
+	report := RuntimeReport{
+		Jobs:  []JobRuntimeEstimate{},
+		Tasks: []TaskRuntimeEstimate{},
+	}
+	jobIndex := map[bson.ObjectId]int{}
+	unknownETA := map[bson.ObjectId]bool{}
+	workLeft := map[runtimeKey]float64{}
+
+	for _, task := range tasks {
+		key := runtimeKey{task.Job, task.TaskType}
+		runtime := expected[key]
+
+		idx, found := jobIndex[task.Job]
+		if !found {
+			idx = len(report.Jobs)
+			jobIndex[task.Job] = idx
+			report.Jobs = append(report.Jobs, JobRuntimeEstimate{
+				JobID:        task.Job,
+				TaskRuntimes: map[string]float64{},
+			})
+		}
+		job := &report.Jobs[idx]
+		job.TasksLeft++
+
+		if runtime <= 0 {
+			unknownETA[task.Job] = true
+			continue
+		}
+		job.TaskRuntimes[task.TaskType] = runtime
+
+		remaining := runtime
+		if task.Status == statusActive && task.ActivatedAt != nil {
+			elapsed := now.Sub(*task.ActivatedAt).Seconds()
+			remaining = math.Max(runtime-elapsed, 0)
+			report.Tasks = append(report.Tasks, TaskRuntimeEstimate{
+				TaskID:   task.ID,
+				JobID:    task.Job,
+				TaskType: task.TaskType,
+				Worker:   task.Worker,
+				Elapsed:  elapsed,
+				Expected: runtime,
+				ETA:      now.Add(secondsToDuration(remaining)),
+				Anomaly:  isStraggler(elapsed, runtime, anomalyFactor),
+			})
+		}
+
+		if capacity[task.TaskType] == 0 {
+			unknownETA[task.Job] = true
+			continue
+		}
+		workLeft[key] += remaining
+	}
+
+	// Task types are assumed to be run one after the other, so their durations add up.
+	jobDuration := map[bson.ObjectId]float64{}
+	for key, seconds := range workLeft {
+		jobDuration[key.jobID] += seconds / float64(capacity[key.taskType])
+	}
+	for idx := range report.Jobs {
+		job := &report.Jobs[idx]
+		if unknownETA[job.JobID] {
+			continue
+		}
+		eta := now.Add(secondsToDuration(jobDuration[job.JobID]))
+		job.ETA = &eta
+	}
+
+	return &report
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,133 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type RuntimeEstimationTestSuite struct{}
+
+var _ = check.Suite(&RuntimeEstimationTestSuite{})
+
+func (s *RuntimeEstimationTestSuite) TestMedian(c *check.C) {
+	assert.Equal(c, 0.0, median(nil))
+	assert.Equal(c, 3.0, median([]float64{3}))
+	assert.Equal(c, 3.0, median([]float64{5, 1, 3}))
+	assert.Equal(c, 2.5, median([]float64{4, 1, 3, 2}))
+}
+
+func (s *RuntimeEstimationTestSuite) TestTaskRuntime(c *check.C) {
+	activated := time.Date(2019, 12, 1, 10, 0, 0, 0, time.UTC)
+	updated := activated.Add(90 * time.Second)
+
+	assert.Equal(c, 0.0, taskRuntime(&Task{}))
+	assert.Equal(c, 90.0, taskRuntime(&Task{ActivatedAt: &activated, LastUpdated: &updated}))
+
+	// Timing metrics from the worker take precedence.
+	task := Task{
+		ActivatedAt: &activated,
+		LastUpdated: &updated,
+		Metrics:     &TaskMetrics{Timing: map[string]float64{"download": 5, "render": 60}},
+	}
+	assert.Equal(c, 65.0, taskRuntime(&task))
+}
+
+func (s *RuntimeEstimationTestSuite) TestEstimateRuntimes(c *check.C) {
+	now := time.Date(2019, 12, 1, 10, 0, 0, 0, time.UTC)
+	job1 := bson.NewObjectId()
+	job2 := bson.NewObjectId()
+	activated := func(secondsAgo int) *time.Time {
+		stamp := now.Add(-time.Duration(secondsAgo) * time.Second)
+		return &stamp
+	}
+
+	active := Task{ID: bson.NewObjectId(), Job: job1, TaskType: "blender-render", Status: statusActive,
+		Worker: "worker1", ActivatedAt: activated(40)}
+	slow := Task{ID: bson.NewObjectId(), Job: job1, TaskType: "blender-render", Status: statusActive,
+		Worker: "worker2", ActivatedAt: activated(400)}
+	tasks := []Task{
+		active,
+		slow,
+		{Job: job1, TaskType: "blender-render", Status: statusQueued},
+		{Job: job1, TaskType: "blender-render", Status: statusQueued},
+		{Job: job2, TaskType: "file-management", Status: statusQueued},
+	}
+	workers := []Worker{
+		{SupportedTaskTypes: []string{"blender-render", "file-management"}},
+		{SupportedTaskTypes: []string{"blender-render"}},
+	}
+	expected := map[runtimeKey]float64{
+		runtimeKey{job1, "blender-render"}: 100,
+	}
+
+	report := estimateRuntimes(tasks, workers, expected, now, 3)
+
+	if !assert.Len(c, report.Tasks, 2) {
+		return
+	}
+	assert.Equal(c, active.ID, report.Tasks[0].TaskID)
+	assert.Equal(c, 40.0, report.Tasks[0].Elapsed)
+	assert.Equal(c, now.Add(60*time.Second), report.Tasks[0].ETA)
+	assert.False(c, report.Tasks[0].Anomaly)
+	assert.Equal(c, now, report.Tasks[1].ETA)
+	assert.True(c, report.Tasks[1].Anomaly)
+
+	if !assert.Len(c, report.Jobs, 2) {
+		return
+	}
+	// 60 seconds left on the active tasks, 200 on the queued ones, divided over two workers.
+	assert.Equal(c, job1, report.Jobs[0].JobID)
+	assert.Equal(c, 4, report.Jobs[0].TasksLeft)
+	assert.Equal(c, map[string]float64{"blender-render": 100}, report.Jobs[0].TaskRuntimes)
+	if assert.NotNil(c, report.Jobs[0].ETA) {
+		assert.Equal(c, now.Add(130*time.Second), *report.Jobs[0].ETA)
+	}
+
+	// No file-management task has completed yet, so there is no estimate.
+	assert.Equal(c, job2, report.Jobs[1].JobID)
+	assert.Equal(c, 1, report.Jobs[1].TasksLeft)
+	assert.Nil(c, report.Jobs[1].ETA)
+}
+
+func (s *RuntimeEstimationTestSuite) TestExpectedRuntimeCache(c *check.C) {
+	re := CreateRuntimeEstimator(&Conf{})
+	jobID := bson.NewObjectId()
+	now := time.Now()
+
+	// A fresh runtime is served from the cache, without touching the database.
+	re.cache[runtimeKey{jobID, "blender-render"}] = cachedRuntime{47, now}
+	runtime, err := re.ExpectedRuntime(jobID, "blender-render", nil)
+	assert.Nil(c, err)
+	assert.Equal(c, 47.0, runtime)
+
+	// Expired runtimes are forgotten.
+	re.cache[runtimeKey{jobID, "file-management"}] = cachedRuntime{3, now.Add(-runtimeCacheDuration)}
+	re.pruneCache(now)
+	assert.Len(c, re.cache, 1)
+	assert.Contains(c, re.cache, runtimeKey{jobID, "blender-render"})
+}
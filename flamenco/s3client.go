@@ -0,0 +1,323 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3AmzDateFormat   = "20060102T150405Z"
+	s3ShortDateFormat = "20060102"
+	s3Service         = "s3"
+	s3DefaultRegion   = "us-east-1"
+	s3RequestTimeout  = 1 * time.Minute
+)
+
+// s3Client is a minimal client for S3-compatible object storage, such as Amazon S3 or MinIO.
+// It only supports what is needed to store task logs, and uses path-style addressing
+// (https://endpoint/bucket/key) as that is supported by all implementations.
+type s3Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+
+	httpClient *http.Client
+	// Returns the current time; can be overridden by unit tests.
+	now func() time.Time
+}
+
+// s3Object describes an object returned by listObjects().
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type s3ListBucketResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+// s3Error is returned when the storage service responds with an error.
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (err s3Error) Error() string {
+	return fmt.Sprintf("S3 error %d %s: %s", err.StatusCode, err.Code, err.Message)
+}
+
+func newS3Client(config TaskLogStorageS3Config) (*s3Client, error) {
+	if config.Endpoint == "" {
+		return nil, errors.New("no S3 endpoint configured")
+	}
+	if config.Bucket == "" {
+		return nil, errors.New("no S3 bucket configured")
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: %v", config.Endpoint, err)
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q, expected something like https://hostname", config.Endpoint)
+	}
+
+	region := config.Region
+	if region == "" {
+		region = s3DefaultRegion
+	}
+
+	return &s3Client{
+		endpoint:   endpoint,
+		region:     region,
+		bucket:     config.Bucket,
+		accessKey:  config.AccessKey,
+		secretKey:  config.SecretKey,
+		httpClient: &http.Client{Timeout: s3RequestTimeout},
+		now:        time.Now,
+	}, nil
+}
+
+// objectURL returns the URL of the object with the given key; an empty key refers to the bucket.
+// The path and query are encoded exactly as they are signed, as S3 verifies the signature
+// against the URL as it was sent.
+func (client *s3Client) objectURL(key string, query url.Values) *url.URL {
+	objURL := *client.endpoint
+	objURL.Path = strings.TrimSuffix(objURL.Path, "/") + "/" + client.bucket + "/" + key
+	objURL.RawPath = s3CanonicalURI(objURL.Path)
+	objURL.RawQuery = s3CanonicalQuery(query)
+	return &objURL
+}
+
+// do performs a signed request, and returns the response when its status code is 2xx.
+func (client *s3Client) do(method, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, client.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	payloadHash := sha256.Sum256(body)
+	signS3Request(req, hex.EncodeToString(payloadHash[:]),
+		client.accessKey, client.secretKey, client.region, client.now())
+
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	s3err := s3Error{StatusCode: resp.StatusCode}
+	if respBody, err := ioutil.ReadAll(resp.Body); err == nil {
+		xml.Unmarshal(respBody, &s3err)
+	}
+	if resp.StatusCode == http.StatusNotFound && s3err.Code != "NoSuchBucket" {
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: key, Err: os.ErrNotExist}
+	}
+	return nil, s3err
+}
+
+// putObject stores the data as object with the given key, overwriting any existing object.
+func (client *s3Client) putObject(key string, data []byte) error {
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain")
+	resp, err := client.do(http.MethodPut, key, nil, data, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// getObject returns the contents of the object. When length > 0, only that many bytes
+// starting at offset are returned.
+func (client *s3Client) getObject(key string, offset, length int64) ([]byte, error) {
+	header := http.Header{}
+	if length > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	}
+	resp, err := client.do(http.MethodGet, key, nil, nil, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// listObjects returns all objects whose key starts with the prefix, sorted by key.
+func (client *s3Client) listObjects(prefix string) ([]s3Object, error) {
+	objects := []s3Object{}
+	continuationToken := ""
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		resp, err := client.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		result := s3ListBucketResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode S3 object listing: %v", err)
+		}
+
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		continuationToken = result.NextContinuationToken
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// signS3Request adds the headers for AWS Signature Version 4 to the request.
+func signS3Request(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(s3AmzDateFormat)
+	shortDate := now.Format(s3ShortDateFormat)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Sign the host, the Range header if present, and the x-amz-* headers.
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lowerName := strings.ToLower(name)
+		if lowerName == "range" || strings.HasPrefix(lowerName, "x-amz-") {
+			headers[lowerName] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+
+	canonicalHeaders := strings.Builder{}
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3CanonicalURI(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := strings.Join([]string{shortDate, region, s3Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	signingKey := s3HMAC([]byte("AWS4"+secretKey), shortDate)
+	signingKey = s3HMAC(signingKey, region)
+	signingKey = s3HMAC(signingKey, s3Service)
+	signingKey = s3HMAC(signingKey, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, accessKey, scope, signedHeaders, signature))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3URIEncode encodes everything except the characters that are unreserved in RFC 3986.
+func s3URIEncode(value string, encodeSlash bool) string {
+	encoded := strings.Builder{}
+	for _, char := range []byte(value) {
+		switch {
+		case 'A' <= char && char <= 'Z', 'a' <= char && char <= 'z', '0' <= char && char <= '9',
+			char == '-', char == '_', char == '.', char == '~':
+			encoded.WriteByte(char)
+		case char == '/' && !encodeSlash:
+			encoded.WriteByte(char)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", char)
+		}
+	}
+	return encoded.String()
+}
+
+func s3CanonicalURI(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return s3URIEncode(path, false)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, s3URIEncode(name, true)+"="+s3URIEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
@@ -0,0 +1,202 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Format of ScheduleInfo.ExceptionDates entries.
+const scheduleDateFormat = "2006-01-02"
+
+// Limits the number of days a single calendar event can span, to protect against broken files.
+const maxCalendarEventDays = 366
+
+// location returns the time zone in which the schedule should be interpreted.
+func (si ScheduleInfo) location() (*time.Location, error) {
+	if si.TimeZone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(si.TimeZone)
+}
+
+// isExceptionDate returns true iff the date of the given timestamp is one of the exception dates.
+// The timestamp should already be in the schedule's time zone.
+func (si ScheduleInfo) isExceptionDate(forTime time.Time) bool {
+	date := forTime.Format(scheduleDateFormat)
+	for _, exceptionDate := range si.ExceptionDates {
+		if exceptionDate == date {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanupScheduleCalendar checks the time zone and exception dates of a schedule.
+// Returns the exception dates sorted and without duplicates.
+func cleanupScheduleCalendar(timeZone string, exceptionDates []string) ([]string, error) {
+	if timeZone != "" {
+		if _, err := time.LoadLocation(timeZone); err != nil {
+			return nil, fmt.Errorf("invalid time zone %q: %v", timeZone, err)
+		}
+	}
+	if len(exceptionDates) == 0 {
+		return nil, nil
+	}
+
+	unique := map[string]bool{}
+	for _, date := range exceptionDates {
+		date = strings.TrimSpace(date)
+		if _, err := time.Parse(scheduleDateFormat, date); err != nil {
+			return nil, fmt.Errorf("invalid exception date %q, expected YYYY-MM-DD", date)
+		}
+		unique[date] = true
+	}
+
+	cleaned := make([]string, 0, len(unique))
+	for date := range unique {
+		cleaned = append(cleaned, date)
+	}
+	sort.Strings(cleaned)
+	return cleaned, nil
+}
+
+// ParseICalendarDates returns the dates of all events in an iCalendar (RFC 5545) file,
+// in the format used for ScheduleInfo.ExceptionDates. Multi-day events produce all
+// dates they span. Recurring events (RRULE) are not expanded; only their first
+// occurrence is used.
+func ParseICalendarDates(reader io.Reader) ([]string, error) {
+	var dates []string
+	var dtstart, dtend string
+	inEvent := false
+
+	handleLine := func(line string) error {
+		name, value := splitICalendarLine(line)
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			inEvent = true
+			dtstart, dtend = "", ""
+		case name == "END" && value == "VEVENT":
+			inEvent = false
+			eventDates, err := icalEventDates(dtstart, dtend)
+			if err != nil {
+				return err
+			}
+			dates = append(dates, eventDates...)
+		case inEvent && name == "DTSTART":
+			dtstart = value
+		case inEvent && name == "DTEND":
+			dtend = value
+		}
+		return nil
+	}
+
+	// Long lines are folded by inserting a newline followed by a space or tab.
+	scanner := bufio.NewScanner(reader)
+	var unfolded string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			unfolded += line[1:]
+			continue
+		}
+		if unfolded != "" {
+			if err := handleLine(unfolded); err != nil {
+				return nil, err
+			}
+		}
+		unfolded = line
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if unfolded != "" {
+		if err := handleLine(unfolded); err != nil {
+			return nil, err
+		}
+	}
+
+	return cleanupScheduleCalendar("", dates)
+}
+
+// splitICalendarLine splits "DTSTART;VALUE=DATE:20191225" into ("DTSTART", "20191225").
+func splitICalendarLine(line string) (name, value string) {
+	colon := strings.Index(line, ":")
+	if colon < 0 {
+		return strings.ToUpper(line), ""
+	}
+	name = line[:colon]
+	if semicolon := strings.Index(name, ";"); semicolon >= 0 {
+		name = name[:semicolon]
+	}
+	return strings.ToUpper(name), strings.TrimSpace(line[colon+1:])
+}
+
+// icalEventDates returns the dates spanned by an event.
+// DTEND of all-day events is exclusive, as is a DTEND at midnight.
+func icalEventDates(dtstart, dtend string) ([]string, error) {
+	if dtstart == "" {
+		return nil, nil
+	}
+	start, _, err := parseICalendarDate(dtstart)
+	if err != nil {
+		return nil, err
+	}
+	if dtend == "" {
+		return []string{start.Format(scheduleDateFormat)}, nil
+	}
+
+	end, endIsMidnight, err := parseICalendarDate(dtend)
+	if err != nil {
+		return nil, err
+	}
+	if endIsMidnight && end.After(start) {
+		end = end.AddDate(0, 0, -1)
+	}
+
+	dates := []string{}
+	for day := start; !day.After(end) && len(dates) < maxCalendarEventDays; day = day.AddDate(0, 0, 1) {
+		dates = append(dates, day.Format(scheduleDateFormat))
+	}
+	return dates, nil
+}
+
+// parseICalendarDate parses the date part of an iCalendar DATE or DATE-TIME value.
+// The returned bool indicates whether the value refers to the very start of the day.
+func parseICalendarDate(value string) (time.Time, bool, error) {
+	if len(value) < 8 {
+		return time.Time{}, false, fmt.Errorf("invalid iCalendar date %q", value)
+	}
+	date, err := time.Parse("20060102", value[:8])
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid iCalendar date %q", value)
+	}
+	timePart := strings.TrimSuffix(value[8:], "Z")
+	isMidnight := timePart == "" || timePart == "T000000"
+	return date, isMidnight, nil
+}
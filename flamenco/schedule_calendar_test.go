@@ -0,0 +1,150 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"strings"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	check "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type ScheduleCalendarTestSuite struct {
+	amsterdam *time.Location
+}
+
+var _ = check.Suite(&ScheduleCalendarTestSuite{})
+
+func (s *ScheduleCalendarTestSuite) SetUpSuite(c *check.C) {
+	var err error
+	s.amsterdam, err = time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		c.Fatal("Unable to load time zone", err)
+	}
+}
+
+func (s *ScheduleCalendarTestSuite) TestCleanupScheduleCalendar(c *check.C) {
+	cleaned, err := cleanupScheduleCalendar("Europe/Amsterdam", []string{"2019-12-26", " 2019-12-25", "2019-12-26"})
+	assert.Nil(c, err)
+	assert.Equal(c, []string{"2019-12-25", "2019-12-26"}, cleaned)
+
+	cleaned, err = cleanupScheduleCalendar("", nil)
+	assert.Nil(c, err)
+	assert.Nil(c, cleaned)
+
+	_, err = cleanupScheduleCalendar("Mars/Olympus_Mons", nil)
+	assert.NotNil(c, err)
+
+	_, err = cleanupScheduleCalendar("", []string{"25-12-2019"})
+	assert.NotNil(c, err)
+}
+
+func (s *ScheduleCalendarTestSuite) TestParseICalendarDates(c *check.C) {
+	ics := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"BEGIN:VEVENT",
+		"SUMMARY:Christmas",
+		"DTSTART;VALUE=DATE:20191225",
+		"DTEND;VALUE=DATE:20191227",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"SUMMARY:King's Day, with a description that is long enough to be folded onto",
+		"  the next line",
+		"DTSTART;VALUE=DATE:20200427",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"DTSTART;TZID=Europe/Amsterdam:20191231T120000",
+		"DTEND;TZID=Europe/Amsterdam:20200101T120000",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+
+	dates, err := ParseICalendarDates(strings.NewReader(ics))
+	assert.Nil(c, err)
+	assert.Equal(c, []string{"2019-12-25", "2019-12-26", "2019-12-31", "2020-01-01", "2020-04-27"}, dates)
+
+	_, err = ParseICalendarDates(strings.NewReader("BEGIN:VEVENT\nDTSTART:tomorrow\nEND:VEVENT\n"))
+	assert.NotNil(c, err)
+}
+
+func (s *ScheduleCalendarTestSuite) TestScheduledStatusInTimeZone(c *check.C) {
+	ss := CreateSleepScheduler(nil, nil)
+	worker := Worker{
+		ID:       bson.NewObjectId(),
+		Nickname: "je moeder",
+		SleepSchedule: ScheduleInfo{
+			ScheduleActive: true,
+			TimeZone:       "Europe/Amsterdam",
+			DaysOfWeek:     "mo tu we th fr",
+			TimeStart:      &TimeOfDay{9, 0},
+			TimeEnd:        &TimeOfDay{17, 0},
+			ExceptionDates: []string{"2019-12-25"},
+		},
+		Status: workerStatusAwake,
+	}
+
+	// 09:30 in Amsterdam is 08:30 UTC.
+	now := time.Date(2019, 12, 24, 8, 30, 0, 0, time.UTC)
+	assert.Equal(c, workerStatusAsleep, ss.scheduledWorkerStatus(&worker, now))
+	now = time.Date(2019, 12, 24, 7, 30, 0, 0, time.UTC)
+	assert.Equal(c, "", ss.scheduledWorkerStatus(&worker, now))
+
+	// On an exception date the worker should stay awake.
+	now = time.Date(2019, 12, 25, 8, 30, 0, 0, time.UTC)
+	assert.Equal(c, "", ss.scheduledWorkerStatus(&worker, now))
+	worker.Status = workerStatusAsleep
+	assert.Equal(c, workerStatusAwake, ss.scheduledWorkerStatus(&worker, now))
+}
+
+func (s *ScheduleCalendarTestSuite) TestNextCheckAcrossDST(c *check.C) {
+	schedule := ScheduleInfo{
+		TimeZone:  "Europe/Amsterdam",
+		TimeStart: &TimeOfDay{1, 0},
+		TimeEnd:   &TimeOfDay{17, 0},
+	}
+
+	// Clocks go forward on 2019-03-31 at 02:00; the next check should still be at 17:00 wall time.
+	now := time.Date(2019, 3, 31, 0, 30, 0, 0, s.amsterdam)
+	expect := time.Date(2019, 3, 31, 1, 0, 0, 0, s.amsterdam)
+	assert.True(c, expect.Equal(*schedule.calculateNextCheck(now)))
+
+	now = time.Date(2019, 3, 31, 3, 30, 0, 0, s.amsterdam)
+	expect = time.Date(2019, 3, 31, 17, 0, 0, 0, s.amsterdam)
+	assert.True(c, expect.Equal(*schedule.calculateNextCheck(now)))
+
+	// Clocks go back on 2019-10-27 at 03:00; after 17:00 the next check is at midnight.
+	now = time.Date(2019, 10, 26, 18, 0, 0, 0, s.amsterdam)
+	expect = time.Date(2019, 10, 27, 0, 0, 0, 0, s.amsterdam)
+	assert.True(c, expect.Equal(*schedule.calculateNextCheck(now)))
+
+	// 17:00 the next day; 23 hours of wall-clock time, but 24 real hours because the clocks go back.
+	schedule.TimeStart = nil
+	now = time.Date(2019, 10, 26, 18, 0, 0, 0, s.amsterdam)
+	next := *schedule.calculateNextCheck(now)
+	assert.True(c, time.Date(2019, 10, 27, 17, 0, 0, 0, s.amsterdam).Equal(next))
+	assert.Equal(c, 24*time.Hour, next.Sub(now))
+}
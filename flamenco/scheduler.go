@@ -167,10 +167,19 @@ func (ts *TaskScheduler) ScheduleTask(w http.ResponseWriter, r *auth.Authenticat
 	}
 
 	logger = logger.WithField("task_id", task.ID.Hex())
-	if err := ts.assignTaskToWorker(task, worker, db, logger); err != nil {
+
+	// An active task of another worker can only be given out as speculative duplicate.
+	speculative := task.Status == statusActive && task.WorkerID != nil && *task.WorkerID != worker.ID
+	if speculative {
+		err = ts.assignSpeculativeTask(task, worker, db, logger)
+	} else {
+		err = ts.assignTaskToWorker(task, worker, db, logger)
+	}
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	ts.blacklist.StartProbation(worker.ID, task)
 
 	// Perform variable replacement on the task.
 	ReplaceVariables(ts.config, task, worker)
@@ -189,12 +198,21 @@ func (ts *TaskScheduler) ScheduleTask(w http.ResponseWriter, r *auth.Authenticat
 	// Push a task log line stating we've assigned this task to the given worker.
 	// This is done here, instead of by the worker, so that it's logged even if the worker fails.
 	msg := fmt.Sprintf("Manager assigned task %s to worker %s", task.ID.Hex(), worker.Identifier())
+	if speculative {
+		msg = fmt.Sprintf("Manager assigned a speculative duplicate of task %s to worker %s", task.ID.Hex(), worker.Identifier())
+	}
 	ts.queue.LogTaskActivity(worker, task, msg, time.Now().Format(IsoFormat)+": "+msg, db)
 }
 
 func (ts *TaskScheduler) assignTaskToWorker(task *Task, worker *Worker, db *mgo.Database, logger *log.Entry) error {
 	logger.Info("assignTaskToWorker: assigning task to worker")
 
+	localSet := bson.M{
+		"worker":           worker.Nickname,
+		"worker_id":        worker.ID,
+		"last_worker_ping": UtcNow(),
+	}
+
 	// Update the task status to "active", pushing it as a task update to the Server too.
 	if task.Status != statusActive {
 		logger.WithFields(log.Fields{
@@ -207,6 +225,7 @@ func (ts *TaskScheduler) assignTaskToWorker(task *Task, worker *Worker, db *mgo.
 		//  such triggers are always handled properly.
 		ts.queue.onTaskStatusMayHaveChanged(task, statusActive, db)
 		task.Status = statusActive
+		localSet["activated_at"] = UtcNow()
 	} else {
 		logger.Info("assignTaskToWorker: task already active")
 	}
@@ -215,18 +234,21 @@ func (ts *TaskScheduler) assignTaskToWorker(task *Task, worker *Worker, db *mgo.
 		TaskStatus:     task.Status,
 		isManagerLocal: task.isManagerLocalTask(),
 	}
-	localUpdates := bson.M{
-		"$set": bson.M{
-			"worker":           worker.Nickname,
-			"worker_id":        worker.ID,
-			"last_worker_ping": UtcNow(),
-		},
+	localUpdates := bson.M{"$set": localSet}
+	if _, activated := localSet["activated_at"]; activated {
+		// This is a new run of the task, so whatever happened to the previous run no longer applies.
+		GetOrCreateMap(localUpdates, "$unset")["straggler"] = true
+		unsetSpeculativeRun(localUpdates)
 	}
 	if err := ts.queue.QueueTaskUpdateWithExtra(task, &tupdate, db, localUpdates); err != nil {
 		logger.WithError(err).Error("Unable to queue task update while assigning task")
 		return err
 	}
 
+	if _, activated := localSet["activated_at"]; activated {
+		ts.queue.writeAttemptHeader(task, worker)
+	}
+
 	// Update the "Current task" on the Worker as well.
 	worker.SetCurrentTask(task.ID, db)
 
@@ -281,8 +303,11 @@ func (ts *TaskScheduler) fetchTaskFromQueueOrManager(
 	// Note that this task type could be blacklisted, but since it's active that is unlikely.
 	alreadyAssignedTask := Task{}
 	findErr := tasksColl.Find(M{
-		"status":    statusActive,
-		"worker_id": worker.ID,
+		"status": statusActive,
+		"$or": []M{
+			M{"worker_id": worker.ID},
+			M{"speculative_worker_id": worker.ID},
+		},
 	}).One(&alreadyAssignedTask)
 	if findErr == nil {
 		// We found an already-assigned task. Just return that.
@@ -297,14 +322,21 @@ func (ts *TaskScheduler) fetchTaskFromQueueOrManager(
 
 	blacklist := ts.blacklist.BlacklistForWorker(worker.ID)
 
+	taskMatch := M{
+		"status":    M{"$in": schedulableTaskStatuses},
+		"task_type": M{"$in": worker.SupportedTaskTypes},
+	}
+	if worker.Quarantine != nil {
+		// Quarantined workers only get the test tasks that were queued for them.
+		taskMatch["job_type"] = managerLocalJobType
+		taskMatch["worker_id"] = worker.ID
+	}
+
 	// Perform the monster MongoDB aggregation query to schedule a task.
 	result := aggregationPipelineResult{}
 	query := []M{
 		// Select only tasks that have a runnable status & acceptable task type.
-		M{"$match": M{
-			"status":    M{"$in": schedulableTaskStatuses},
-			"task_type": M{"$in": worker.SupportedTaskTypes},
-		}},
+		M{"$match": taskMatch},
 		// Filter out any task type that's blacklisted.
 		M{"$match": blacklist},
 		// Unwind the parents array, so that we can do a lookup in the next stage.
@@ -374,6 +406,9 @@ func (ts *TaskScheduler) fetchTaskFromQueueOrManager(
 
 	err := pipe.One(&result)
 	if err == mgo.ErrNotFound {
+		if task := ts.fetchSpeculativeTask(db, worker); task != nil {
+			return task
+		}
 		log.WithFields(logFields).Debug("TaskScheduler: no more tasks available for worker")
 		ts.maybeKickTaskDownloader()
 		w.WriteHeader(204)
@@ -441,6 +476,14 @@ func (ts *TaskScheduler) ReturnTask(worker *Worker, logFields log.Fields,
 	ts.mutex.Lock()
 	defer ts.mutex.Unlock()
 
+	// Returning a speculative duplicate just stops the duplicate.
+	if task.isSpeculativeFor(worker.ID) {
+		logger.Info("ReturnTask: worker returned speculative duplicate of task")
+		updates := bson.M{}
+		unsetSpeculativeRun(updates)
+		return db.C("flamenco_tasks").UpdateId(task.ID, updates)
+	}
+
 	// Get the task and check whether it's assigned to this worker at all.
 	if task.WorkerID != nil && *task.WorkerID != worker.ID {
 		logger.WithField("other_worker", task.WorkerID.Hex()).Info("ReturnTask: task was assigned to other worker")
@@ -481,6 +524,12 @@ func (ts *TaskScheduler) WorkerMayRunTask(w http.ResponseWriter, r *auth.Authent
 	statusRequested := ""
 
 	logFields["task_id"] = taskID.Hex()
+	drainExpired := worker.drainDeadlinePassed(*UtcNow())
+	if drainExpired {
+		if err := worker.expireDrainDeadline(db); err != nil {
+			log.WithFields(logFields).WithError(err).Error("WorkerMayRunTask: unable to expire drain deadline")
+		}
+	}
 	if worker.StatusRequested != "" && worker.LazyStatusRequest == Immediate {
 		statusRequested = worker.StatusRequested
 	}
@@ -506,7 +555,7 @@ func (ts *TaskScheduler) WorkerMayRunTask(w http.ResponseWriter, r *auth.Authent
 		if err := db.C("flamenco_tasks").FindId(taskID).One(&task); err != nil {
 			log.WithFields(logFields).Warning("WorkerMayRunTask: unable to find task")
 			response.Reason = fmt.Sprintf("unable to find task %s", taskID.Hex())
-		} else if task.WorkerID != nil && *task.WorkerID != worker.ID {
+		} else if task.WorkerID != nil && *task.WorkerID != worker.ID && !task.isSpeculativeFor(worker.ID) {
 			logFields["other_worker"] = task.WorkerID.Hex()
 			log.WithFields(logFields).Warning("WorkerMayRunTask: task was assigned to other worker")
 			response.Reason = fmt.Sprintf("task %s reassigned to another worker", taskID.Hex())
@@ -523,6 +572,13 @@ func (ts *TaskScheduler) WorkerMayRunTask(w http.ResponseWriter, r *auth.Authent
 		}
 	}()
 
+	if drainExpired {
+		// This has to happen outside the locked section, as ReturnTask() locks the scheduler too.
+		if err := worker.returnAllTasks(logFields, db, ts, "worker did not finish draining before the deadline"); err != nil {
+			log.WithFields(logFields).WithError(err).Error("WorkerMayRunTask: unable to re-queue tasks of drained worker")
+		}
+	}
+
 	// Send the response
 	w.Header().Set("Content-Type", "application/json")
 	encoder := json.NewEncoder(w)
@@ -26,6 +26,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"time"
 
 	"github.com/armadillica/flamenco-manager/flamenco/httperror"
 
@@ -76,7 +77,7 @@ func (s *SchedulerTestSuite) SetUpTest(c *check.C) {
 
 	s.upstream = ConnectUpstream(&s.config, s.session)
 	s.blacklist = CreateWorkerBlackList(&s.config, s.session)
-	s.queue = CreateTaskUpdateQueue(&s.config, s.blacklist)
+	s.queue = CreateTaskUpdateQueue(&s.config, s.blacklist, CreateWorkerQuarantine(&s.config, s.session), nil, newLocalTaskLogStore(&s.config))
 	pusher := CreateTaskUpdatePusher(&s.config, s.upstream, s.session, s.queue, nil)
 	s.sched = CreateTaskScheduler(&s.config, s.upstream, s.session, s.queue, s.blacklist, pusher)
 
@@ -620,6 +621,39 @@ func (s *SchedulerTestSuite) TestWorkerMayRunStatusRequested(t *check.C) {
 	assert.Equal(t, false, resp.MayKeepRunning)
 }
 
+func (s *SchedulerTestSuite) TestWorkerMayRunDrainDeadline(t *check.C) {
+	task := ConstructTestTask("aaaaaaaaaaaaaaaaaaaaaaaa", "sleeping")
+	if err := s.db.C("flamenco_tasks").Insert(task); err != nil {
+		t.Fatal("Unable to insert test task", err)
+	}
+
+	respRec, ar := WorkerTestRequest(s.workerLnx.ID, "GET", "/task")
+	s.sched.ScheduleTask(respRec, ar)
+
+	// Before the deadline the worker may finish its task.
+	assert.Nil(t, s.workerLnx.RequestDrain(time.Now().UTC().Add(time.Hour), s.db))
+	respRec, ar = WorkerTestRequest(s.workerLnx.ID, "GET", "/may-i-run/%s", task.ID.Hex())
+	s.sched.WorkerMayRunTask(respRec, ar, s.db, task.ID)
+
+	resp := MayKeepRunningResponse{}
+	parseJSON(t, respRec, 200, &resp)
+	assert.Equal(t, true, resp.MayKeepRunning)
+
+	// After the deadline it should stop.
+	assert.Nil(t, s.workerLnx.RequestDrain(time.Now().UTC().Add(-time.Second), s.db))
+	respRec, ar = WorkerTestRequest(s.workerLnx.ID, "GET", "/may-i-run/%s", task.ID.Hex())
+	s.sched.WorkerMayRunTask(respRec, ar, s.db, task.ID)
+
+	resp = MayKeepRunningResponse{}
+	parseJSON(t, respRec, 200, &resp)
+	assert.Equal(t, false, resp.MayKeepRunning)
+	assert.Equal(t, "worker status change to shutdown requested", resp.Reason)
+
+	found := Worker{}
+	assert.Nil(t, s.db.C("flamenco_workers").FindId(s.workerLnx.ID).One(&found))
+	assert.Equal(t, Immediate, found.LazyStatusRequest)
+}
+
 func (s *SchedulerTestSuite) TestBlacklist(c *check.C) {
 	// Insert a number of tasks of different type & job.
 	job1 := bson.NewObjectId()
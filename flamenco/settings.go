@@ -89,6 +89,8 @@ var (
 			CancelTaskFetchInterval:     10 * time.Second,
 			ActiveTaskTimeoutInterval:   10 * time.Minute,
 			ActiveWorkerTimeoutInterval: 1 * time.Minute,
+			WorkerDrainDeadline:         2 * time.Hour,
+			WakeOnLANBroadcastAddress:   "255.255.255.255:9",
 			FlamencoStr:                 defaultServerURL,
 			// Days are assumed to be 24 hours long. This is not exactly accurate, but should
 			// be accurate enough for this type of cleanup.
@@ -97,8 +99,31 @@ var (
 			SSDPDeviceUUID:    "7401c189-ef69-434b-b4d8-56d00075faf5",
 
 			BlacklistThreshold:         3,
+			BlacklistExpiry:            7 * 24 * time.Hour,
 			TaskFailAfterSoftFailCount: 3,
 
+			QuarantineWindow:       1 * time.Hour,
+			QuarantineFailureCount: 5,
+			QuarantineFailureRate:  0.8,
+			QuarantineJobCount:     2,
+
+			FailureClasses: defaultFailureClassRules,
+
+			RuntimeEstimationSamples: 20,
+			RuntimeAnomalyFactor:     3,
+
+			TaskLogIndexExpiry: 30 * 24 * time.Hour,
+			TaskLogCompressAge: 7 * 24 * time.Hour,
+			TaskLogStorage:     TaskLogStorageConfig{Type: taskLogStorageLocal},
+
+			TaskLogUploadParallelism: 4,
+
+			LatestImagesPerJob: 24,
+			ImageConverter:     imageConverterAuto,
+
+			PreviewMovieFPS:             24,
+			PreviewMovieRenderTaskTypes: []string{"blender-render"},
+
 			WorkerCleanupStatus: []string{workerStatusOffline},
 
 			TestTasks: TestTasks{
@@ -182,6 +207,22 @@ type TestTasks struct {
 	BlenderRender BlenderRenderConfig `yaml:"test_blender_render"`
 }
 
+// TaskLogStorageConfig represents the 'task_log_storage' key in the Manager's configuration file.
+type TaskLogStorageConfig struct {
+	Type string                 `yaml:"type"` // either "local" or "s3"
+	S3   TaskLogStorageS3Config `yaml:"s3"`
+}
+
+// TaskLogStorageS3Config configures storing task logs in an S3-compatible object storage.
+type TaskLogStorageS3Config struct {
+	Endpoint  string `yaml:"endpoint"` // URL of the storage service, like "https://s3.eu-west-1.amazonaws.com"
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"` // prepended to the object keys, like "task-logs/"
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+}
+
 // ConfMeta contains configuration file metadata.
 type ConfMeta struct {
 	// Version of the config file structure.
@@ -225,6 +266,19 @@ type Base struct {
 	ActiveTaskTimeoutInterval   time.Duration `yaml:"active_task_timeout_interval"`
 	ActiveWorkerTimeoutInterval time.Duration `yaml:"active_worker_timeout_interval"`
 
+	// Overrides for ActiveTaskTimeoutInterval, per task type and per job ID.
+	// A job override takes precedence over a task type override.
+	TaskTypeTimeoutIntervals map[string]time.Duration `yaml:"task_type_timeout_intervals,omitempty"`
+	JobTimeoutIntervals      map[string]time.Duration `yaml:"job_timeout_intervals,omitempty"`
+
+	// Default time a draining worker gets to finish its current task before it is forced to stop.
+	WorkerDrainDeadline time.Duration `yaml:"worker_drain_deadline"`
+
+	// Wake-on-LAN magic packets are sent to this "host:port" address.
+	WakeOnLANBroadcastAddress string `yaml:"wake_on_lan_broadcast_address"`
+	// Wake up offline workers when there are more queued tasks than awake workers.
+	WakeOnLANForQueuedWork bool `yaml:"wake_on_lan_for_queued_work"`
+
 	TaskCleanupMaxAge   time.Duration `yaml:"task_cleanup_max_age"`
 	WorkerCleanupMaxAge time.Duration `yaml:"worker_cleanup_max_age"`
 	WorkerCleanupStatus []string      `yaml:"worker_cleanup_status"`
@@ -233,11 +287,71 @@ type Base struct {
 	 * from that task type on that job. */
 	BlacklistThreshold int `yaml:"blacklist_threshold"`
 
+	/* Blacklist entries expire after this duration, after which the worker is on probation:
+	 * it may run tasks of that type on that job again, but a single failure bans it again.
+	 * Set to 0 to never expire blacklist entries. */
+	BlacklistExpiry time.Duration `yaml:"blacklist_expiry"`
+
 	// When this many workers have tried the task and failed, it will be hard-failed
 	// (even when there are workers left that could technically retry the task).
 	TaskFailAfterSoftFailCount int `yaml:"task_fail_after_softfail_count"`
 
+	/* Workers are quarantined when, within the last QuarantineWindow, they failed at least
+	 * QuarantineFailureCount tasks of at least QuarantineJobCount different jobs, and those
+	 * failures make up at least QuarantineFailureRate (0-1) of the tasks they finished.
+	 * Set QuarantineWindow to 0 to disable quarantining. */
+	QuarantineWindow       time.Duration `yaml:"quarantine_window"`
+	QuarantineFailureCount int           `yaml:"quarantine_failure_count"`
+	QuarantineFailureRate  float64       `yaml:"quarantine_failure_rate"`
+	QuarantineJobCount     int           `yaml:"quarantine_job_count"`
+	// Only release a worker from quarantine after it successfully ran a test task.
+	QuarantineTestTask bool `yaml:"quarantine_test_task"`
+
+	// Rules to classify task failures based on the task log. The first matching rule wins.
+	FailureClasses []FailureClassRule `yaml:"failure_classes"`
+
+	// Task runtimes are estimated from the median runtime of this many recently completed
+	// tasks of the same job and task type.
+	RuntimeEstimationSamples int `yaml:"runtime_estimation_samples"`
+	// Active tasks running this many times longer than the estimated runtime are reported
+	// as anomalies on the dashboard, and flagged as stragglers. Set to 0 to disable.
+	RuntimeAnomalyFactor float64 `yaml:"runtime_anomaly_factor"`
+	// Run a duplicate of straggler tasks on otherwise idle workers. The first to complete wins.
+	SpeculativeExecution bool `yaml:"speculative_execution"`
+
+	// Task log chunks are indexed in MongoDB for searching, and removed from the index after
+	// this duration. The log files themselves are not affected. Set to 0 to disable indexing.
+	TaskLogIndexExpiry time.Duration `yaml:"task_log_index_expiry"`
+
+	/* Log files of finished tasks are gzipped when they have not been written to for
+	 * TaskLogCompressAge, and deleted after TaskLogDeleteAge. When all task logs together
+	 * are larger than TaskLogMaxTotalSizeMB, the oldest are deleted. Logs of unfinished
+	 * tasks are never touched. Set any of these to 0 to disable that part of the cleanup. */
+	TaskLogCompressAge    time.Duration `yaml:"task_log_compress_age"`
+	TaskLogDeleteAge      time.Duration `yaml:"task_log_delete_age"`
+	TaskLogMaxTotalSizeMB int64         `yaml:"task_log_max_total_size_mb"`
+	// Only log what the task log cleanup would do, without touching any files.
+	TaskLogCleanupDryRun bool `yaml:"task_log_cleanup_dry_run"`
+	// Maximum number of task logs that are uploaded to Flamenco Server at the same time.
+	TaskLogUploadParallelism int `yaml:"task_log_upload_parallelism"`
+	// Where task logs are stored; by default in TaskLogsPath on the local disk.
+	TaskLogStorage TaskLogStorageConfig `yaml:"task_log_storage"`
+
 	WatchForLatestImage string `yaml:"watch_for_latest_image"`
+	// Number of thumbnails kept in the gallery of each job.
+	LatestImagesPerJob int `yaml:"latest_images_per_job"`
+	// How rendered images are converted for the dashboard: "auto", "builtin" or "imagemagick".
+	ImageConverter string `yaml:"image_converter"`
+
+	// Check the files produced by workers, see RenderOutputVerifier.
+	VerifyRenderOutput        bool  `yaml:"verify_render_output"`
+	VerifyRenderOutputRequeue bool  `yaml:"verify_render_output_requeue"`
+	VerifyRenderOutputMinSize int64 `yaml:"verify_render_output_min_size"`
+
+	// Encode a preview movie of each job's frames, see PreviewMovieAssembler.
+	PreviewMovies               bool     `yaml:"preview_movies"`
+	PreviewMovieFPS             float64  `yaml:"preview_movie_fps"`
+	PreviewMovieRenderTaskTypes []string `yaml:"preview_movie_render_task_types"`
 
 	SSDPDiscovery  bool   `yaml:"ssdp_discovery"`
 	SSDPDeviceUUID string `yaml:"ssdp_device_uuid"`
@@ -597,6 +711,11 @@ func (c *Conf) HasCustomTLS() bool {
 	return c.TLSCert != "" && c.TLSKey != ""
 }
 
+// usesLocalTaskLogStorage returns true when task logs are stored in TaskLogsPath.
+func (c *Conf) usesLocalTaskLogStorage() bool {
+	return c.TaskLogStorage.Type == "" || c.TaskLogStorage.Type == taskLogStorageLocal
+}
+
 // HasTLS returns true if either a custom certificate or ACME/Let's Encrypt is used.
 func (c *Conf) HasTLS() bool {
 	return c.ACMEDomainName != "" || c.HasCustomTLS()
@@ -0,0 +1,115 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const sleepScheduleTemplatesCollection = "flamenco_sleep_schedule_templates"
+
+// ScheduleTemplates returns all sleep schedule templates, sorted by name.
+func (ss *SleepScheduler) ScheduleTemplates(db *mgo.Database) ([]SleepScheduleTemplate, error) {
+	templates := []SleepScheduleTemplate{}
+	err := db.C(sleepScheduleTemplatesCollection).Find(bson.M{}).Sort("_id").All(&templates)
+	return templates, err
+}
+
+// SaveScheduleTemplate creates or updates a sleep schedule template.
+// Workers following the template are refreshed on the next RefreshAllWorkers() call.
+func (ss *SleepScheduler) SaveScheduleTemplate(template SleepScheduleTemplate, db *mgo.Database) error {
+	template.Name = strings.TrimSpace(template.Name)
+	if template.Name == "" {
+		return errors.New("sleep schedule template name is required")
+	}
+	template.DaysOfWeek = ss.cleanupDaysOfWeek(template.DaysOfWeek)
+	exceptionDates, err := cleanupScheduleCalendar(template.TimeZone, template.ExceptionDates)
+	if err != nil {
+		return err
+	}
+	template.ExceptionDates = exceptionDates
+
+	if _, err := db.C(sleepScheduleTemplatesCollection).UpsertId(template.Name, template); err != nil {
+		return err
+	}
+
+	// Erasing 'next_check' makes RefreshAllWorkers() pick up these workers.
+	info, err := db.C("flamenco_workers").UpdateAll(
+		bson.M{"sleep_schedule.template": template.Name},
+		bson.M{"$unset": bson.M{"sleep_schedule.next_check": true}},
+	)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"template":         template.Name,
+		"workers_attached": info.Matched,
+	}).Info("sleep schedule template saved")
+	return nil
+}
+
+// DeleteScheduleTemplate deletes a sleep schedule template.
+// Workers following the template keep their current schedule, but no longer follow the template.
+func (ss *SleepScheduler) DeleteScheduleTemplate(name string, db *mgo.Database) error {
+	if err := db.C(sleepScheduleTemplatesCollection).RemoveId(name); err != nil {
+		return err
+	}
+
+	info, err := db.C("flamenco_workers").UpdateAll(
+		bson.M{"sleep_schedule.template": name},
+		bson.M{"$unset": bson.M{"sleep_schedule.template": true}},
+	)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"template":         name,
+		"workers_detached": info.Updated,
+	}).Info("sleep schedule template deleted")
+	return nil
+}
+
+// applyScheduleTemplate copies the days, times, and calendar of the schedule's template into the schedule.
+func (ss *SleepScheduler) applyScheduleTemplate(schedule *ScheduleInfo, db *mgo.Database) error {
+	template := SleepScheduleTemplate{}
+	err := db.C(sleepScheduleTemplatesCollection).FindId(schedule.Template).One(&template)
+	if err == mgo.ErrNotFound {
+		return fmt.Errorf("sleep schedule template %q does not exist", schedule.Template)
+	}
+	if err != nil {
+		return err
+	}
+
+	schedule.DaysOfWeek = template.DaysOfWeek
+	schedule.TimeStart = template.TimeStart
+	schedule.TimeEnd = template.TimeEnd
+	schedule.TimeZone = template.TimeZone
+	schedule.ExceptionDates = template.ExceptionDates
+	return nil
+}
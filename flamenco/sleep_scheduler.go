@@ -38,14 +38,16 @@ const sleepSchedulerCheckInterval = 1 * time.Minute
 type SleepScheduler struct {
 	closable
 	session *mgo.Session
+	waker   *WorkerWaker     // may be nil, in which case workers are not woken up by Wake-on-LAN
 	now     func() time.Time // for mocking the time.Now() function
 }
 
 // CreateSleepScheduler creates a new SleepScheduler.
-func CreateSleepScheduler(session *mgo.Session) *SleepScheduler {
+func CreateSleepScheduler(session *mgo.Session, waker *WorkerWaker) *SleepScheduler {
 	return &SleepScheduler{
 		makeClosable(),
 		session,
+		waker,
 		time.Now,
 	}
 }
@@ -127,6 +129,11 @@ func (ss *SleepScheduler) RequestWorkerStatus(worker *Worker, db *mgo.Database)
 	if err := worker.RequestStatusChange(scheduled, Immediate, db); err != nil {
 		logger.WithError(err).Error("unable to store status change in database")
 	}
+
+	// A powered-off worker won't see the requested status, so it has to be woken up first.
+	if scheduled == workerStatusAwake && ss.waker != nil && canBeWokenByLAN(worker) {
+		ss.waker.WakeWorker(worker, db)
+	}
 }
 
 func (ss *SleepScheduler) refreshWorker(worker *Worker, db *mgo.Database) {
@@ -142,7 +149,6 @@ func (ss *SleepScheduler) refreshWorker(worker *Worker, db *mgo.Database) {
 // Returns an empty string when the schedule is inactive or the worker already has
 // the appropriate status.
 func (ss *SleepScheduler) scheduledWorkerStatus(worker *Worker, forTime time.Time) string {
-	tod := MakeTimeOfDay(forTime)
 	logger := log.WithField("worker", worker.Identifier())
 	sched := worker.SleepSchedule
 	if !sched.ScheduleActive {
@@ -150,6 +156,14 @@ func (ss *SleepScheduler) scheduledWorkerStatus(worker *Worker, forTime time.Tim
 		return ""
 	}
 
+	loc, err := sched.location()
+	if err != nil {
+		logger.WithError(err).WithField("time_zone", sched.TimeZone).Warning("worker sleep schedule has invalid time zone")
+		return ""
+	}
+	forTime = forTime.In(loc)
+	tod := MakeTimeOfDay(forTime)
+
 	weekdayName := strings.ToLower(forTime.Weekday().String()[:2])
 	logger = logger.WithFields(log.Fields{
 		"day_of_week": weekdayName,
@@ -159,6 +173,10 @@ func (ss *SleepScheduler) scheduledWorkerStatus(worker *Worker, forTime time.Tim
 	// Little inner function that allows us to return early¸ instead of
 	// writing if/else clauses.
 	timeBasedStatus := func() string {
+		if sched.isExceptionDate(forTime) {
+			logger.Debug("today is an exception date, staying awake")
+			return workerStatusAwake
+		}
 		if len(sched.DaysOfWeek) > 0 && !strings.Contains(sched.DaysOfWeek, weekdayName) {
 			// There are days configured, but today is not a sleeping day.
 			logger.WithField("sleep_days", sched.DaysOfWeek).Debug("today is not a sleep day")
@@ -198,10 +216,21 @@ func (ss *SleepScheduler) scheduledWorkerStatus(worker *Worker, forTime time.Tim
 }
 
 // SetSleepSchedule stores the given schedule as the worker's new sleep schedule and applies it.
+// When the schedule follows a template, the days and times are taken from that template.
 // Updates both the Worker object itself and the Mongo database.
 // Instantly requests a new status for the worker according to the schedule.
 func (ss *SleepScheduler) SetSleepSchedule(worker *Worker, schedule ScheduleInfo, db *mgo.Database) error {
+	if schedule.Template != "" {
+		if err := ss.applyScheduleTemplate(&schedule, db); err != nil {
+			return err
+		}
+	}
 	schedule.DaysOfWeek = ss.cleanupDaysOfWeek(schedule.DaysOfWeek)
+	exceptionDates, err := cleanupScheduleCalendar(schedule.TimeZone, schedule.ExceptionDates)
+	if err != nil {
+		return err
+	}
+	schedule.ExceptionDates = exceptionDates
 	schedule.NextCheck = schedule.calculateNextCheck(ss.now())
 
 	updates := bson.M{"$set": bson.M{"sleep_schedule": schedule}}
@@ -242,10 +271,18 @@ func (ss *SleepScheduler) DeactivateSleepSchedule(worker *Worker, db *mgo.Databa
 // This ignores the time of day, and just sets a time.
 // The returned timestamp can be used for ScheduleInfo.NextCheck.
 func (si ScheduleInfo) calculateNextCheck(forTime time.Time) *time.Time {
+	// An invalid time zone is refused by SetSleepSchedule(); if it becomes invalid
+	// later (f.e. a time zone database update), just fall back to local time.
+	if loc, err := si.location(); err == nil {
+		forTime = forTime.In(loc)
+	}
+
 	calcNext := func(tod TimeOfDay) time.Time {
 		nextCheck := tod.OnDate(forTime)
 		if nextCheck.Before(forTime) {
-			nextCheck = nextCheck.AddDate(0, 0, 1)
+			// Compute on the next calendar date, rather than adding 24 hours,
+			// so that the wall clock time is kept across DST transitions.
+			nextCheck = tod.OnDate(forTime.AddDate(0, 0, 1))
 		}
 		return nextCheck
 	}
@@ -50,7 +50,7 @@ func (s *SleepSchedulerTestSuite) SetUpSuite(c *check.C) {
 }
 
 func (s *SleepSchedulerTestSuite) SetUpTest(c *check.C) {
-	s.ss = CreateSleepScheduler(s.session)
+	s.ss = CreateSleepScheduler(s.session, nil)
 	s.worker = Worker{
 		Platform:           "linux",
 		SupportedTaskTypes: []string{"sleeping"},
@@ -275,3 +275,54 @@ func (s *SleepSchedulerTestSuite) TestRefresh(c *check.C) {
 	s.ss.RefreshAllWorkers()
 	check(workerStatusAsleep, workerStatusAwake, TimeOfDay{24, 0}.OnDate(now))
 }
+
+func (s *SleepSchedulerTestSuite) TestScheduleTemplate(c *check.C) {
+	now := time.Date(2018, 12, 12, 12, 0, 0, 0, time.Local)
+	assert.Equal(c, now.Weekday(), time.Wednesday)
+	s.ss.now = func() time.Time { return now }
+
+	template := SleepScheduleTemplate{
+		Name:       "office desktops",
+		DaysOfWeek: "Monday Tuesday",
+		TimeStart:  &TimeOfDay{8, 0},
+		TimeEnd:    &TimeOfDay{17, 0},
+	}
+	assert.Nil(c, s.ss.SaveScheduleTemplate(template, s.db))
+
+	// Following the template should copy its days and times.
+	assert.Nil(c, s.ss.SetSleepSchedule(&s.worker, ScheduleInfo{
+		ScheduleActive: true,
+		DaysOfWeek:     "we",
+		Template:       "office desktops",
+	}, s.db))
+	found, err := FindWorkerByID(s.worker.ID, s.db)
+	assert.Nil(c, err)
+	assert.Equal(c, "mo tu", found.SleepSchedule.DaysOfWeek)
+	assert.Equal(c, "office desktops", found.SleepSchedule.Template)
+	assert.Equal(c, "", found.StatusRequested)
+
+	// Editing the template should reach the worker on the next refresh.
+	template.DaysOfWeek = "we"
+	assert.Nil(c, s.ss.SaveScheduleTemplate(template, s.db))
+	s.ss.RefreshAllWorkers()
+
+	found, err = FindWorkerByID(s.worker.ID, s.db)
+	assert.Nil(c, err)
+	assert.Equal(c, "we", found.SleepSchedule.DaysOfWeek)
+	assert.Equal(c, workerStatusAsleep, found.StatusRequested)
+
+	// Deleting the template should detach the worker but keep its schedule.
+	assert.Nil(c, s.ss.DeleteScheduleTemplate("office desktops", s.db))
+	found, err = FindWorkerByID(s.worker.ID, s.db)
+	assert.Nil(c, err)
+	assert.Equal(c, "", found.SleepSchedule.Template)
+	assert.Equal(c, "we", found.SleepSchedule.DaysOfWeek)
+}
+
+func (s *SleepSchedulerTestSuite) TestScheduleTemplateUnknown(c *check.C) {
+	err := s.ss.SetSleepSchedule(&s.worker, ScheduleInfo{
+		ScheduleActive: true,
+		Template:       "does not exist",
+	}, s.db)
+	assert.NotNil(c, err)
+}
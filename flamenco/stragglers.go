@@ -0,0 +1,237 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// isStraggler returns whether a task running for 'elapsed' seconds takes more than 'factor'
+// times its expected runtime. An unknown expected runtime (0) never makes a straggler.
+func isStraggler(elapsed, expected, factor float64) bool {
+	return factor > 0 && expected > 0 && elapsed > factor*expected
+}
+
+// isSpeculativeFor returns whether the worker runs a speculative duplicate of this task.
+func (task *Task) isSpeculativeFor(workerID bson.ObjectId) bool {
+	return task.SpeculativeWorkerID != nil && *task.SpeculativeWorkerID == workerID
+}
+
+// unsetSpeculativeRun adds the removal of the task's speculative duplicate to the updates.
+func unsetSpeculativeRun(updates bson.M) {
+	unset := GetOrCreateMap(updates, "$unset")
+	unset["speculative_worker_id"] = true
+	unset["speculative_worker"] = true
+	unset["speculative_ping"] = true
+}
+
+// checkStragglers flags active tasks running far longer than their completed siblings.
+func (ttc *TimeoutChecker) checkStragglers(db *mgo.Database) {
+	factor := ttc.config.RuntimeAnomalyFactor
+	if factor <= 0 {
+		return
+	}
+	now := *UtcNow()
+
+	var activeTasks []Task
+	query := M{
+		"status":       statusActive,
+		"straggler":    M{"$ne": true},
+		"activated_at": M{"$exists": true},
+		"job_type":     M{"$ne": managerLocalJobType},
+	}
+	projection := M{"job": 1, "job_type": 1, "task_type": 1, "name": 1, "status": 1, "worker": 1, "activated_at": 1}
+	if err := db.C("flamenco_tasks").Find(query).Select(projection).All(&activeTasks); err != nil {
+		log.WithError(err).Warning("Error finding active tasks to check for stragglers")
+		return
+	}
+
+	expected := map[runtimeKey]float64{}
+	for _, task := range activeTasks {
+		key := runtimeKey{task.Job, task.TaskType}
+		runtime, found := expected[key]
+		if !found {
+			var err error
+			runtime, err = ttc.runtimes.ExpectedRuntime(task.Job, task.TaskType, db)
+			if err != nil {
+				log.WithError(err).WithField("job_id", task.Job.Hex()).Warning("Unable to estimate task runtime")
+				return
+			}
+			expected[key] = runtime
+		}
+
+		elapsed := now.Sub(*task.ActivatedAt)
+		if !isStraggler(elapsed.Seconds(), runtime, factor) {
+			continue
+		}
+		ttc.flagStraggler(&task, elapsed, runtime, db)
+	}
+}
+
+func (ttc *TimeoutChecker) flagStraggler(task *Task, elapsed time.Duration, expected float64, db *mgo.Database) {
+	expectedDuration := secondsToDuration(expected).Round(time.Second)
+	log.WithFields(log.Fields{
+		"task_id":  task.ID.Hex(),
+		"worker":   task.Worker,
+		"elapsed":  elapsed.Round(time.Second),
+		"expected": expectedDuration,
+	}).Warning("Task is a straggler, running much longer than its completed siblings")
+
+	tupdate := TaskUpdate{
+		isManagerLocal: task.isManagerLocalTask(),
+		TaskID:         task.ID,
+		Log: fmt.Sprintf("%s Task %s has been running for %s on worker %s, while similar tasks took %s",
+			UtcNow().Format(IsoFormat), task.ID.Hex(), elapsed.Round(time.Second), task.Worker, expectedDuration),
+	}
+	extraUpdates := bson.M{"$set": bson.M{"straggler": true}}
+	if err := ttc.queue.QueueTaskUpdateWithExtra(task, &tupdate, db, extraUpdates); err != nil {
+		log.WithError(err).WithField("task_id", task.ID.Hex()).Error("Unable to flag task as straggler")
+	}
+}
+
+// checkSpeculativeRuns forgets about speculative duplicates whose worker stopped pinging,
+// or whose task is no longer active, so that another worker can try again.
+func (ttc *TimeoutChecker) checkSpeculativeRuns(db *mgo.Database) {
+	timeoutThreshold := UtcNow().Add(-ttc.config.ActiveTaskTimeoutInterval)
+	query := M{
+		"speculative_worker_id": M{"$exists": true},
+		"$or": []M{
+			M{"status": M{"$ne": statusActive}},
+			M{"speculative_ping": M{"$lte": timeoutThreshold}},
+			M{"speculative_ping": M{"$exists": false}},
+		},
+	}
+	updates := bson.M{}
+	unsetSpeculativeRun(updates)
+	info, err := db.C("flamenco_tasks").UpdateAll(query, updates)
+	if err != nil {
+		log.WithError(err).Warning("Error removing timed-out speculative task runs")
+		return
+	}
+	if info.Updated > 0 {
+		log.WithField("count", info.Updated).Info("Removed timed-out speculative task runs")
+	}
+}
+
+// fetchSpeculativeTask returns a straggler task for which the worker can run a speculative
+// duplicate, or nil if there is none. Only call this for workers without any other work.
+func (ts *TaskScheduler) fetchSpeculativeTask(db *mgo.Database, worker *Worker) *Task {
+	if !ts.config.SpeculativeExecution || worker.Quarantine != nil {
+		return nil
+	}
+
+	query := M{"$and": []M{
+		M{
+			"status":                statusActive,
+			"straggler":             true,
+			"speculative_worker_id": M{"$exists": false},
+			"worker_id":             M{"$ne": worker.ID},
+			"task_type":             M{"$in": worker.SupportedTaskTypes},
+			"job_type":              M{"$ne": managerLocalJobType},
+			"failed_by_workers.id":  M{"$ne": worker.ID},
+		},
+		ts.blacklist.BlacklistForWorker(worker.ID),
+	}}
+
+	task := Task{}
+	err := db.C("flamenco_tasks").Find(query).Sort("activated_at").One(&task)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			log.WithError(err).WithField("worker", worker.Identifier()).Error("TaskScheduler: unable to query for straggler tasks")
+		}
+		return nil
+	}
+	return &task
+}
+
+// assignSpeculativeTask lets the worker run a duplicate of a task that is active on another worker.
+// Whichever worker completes the task first wins; the other one is told to stop.
+func (ts *TaskScheduler) assignSpeculativeTask(task *Task, worker *Worker, db *mgo.Database, logger *log.Entry) error {
+	logger.Info("assignSpeculativeTask: running speculative duplicate of straggler task")
+
+	// The worker may be asking again for the duplicate it is already running.
+	query := M{
+		"_id":    task.ID,
+		"status": statusActive,
+		"$or": []M{
+			M{"speculative_worker_id": M{"$exists": false}},
+			M{"speculative_worker_id": worker.ID},
+		},
+	}
+	updates := M{"$set": M{
+		"speculative_worker_id": worker.ID,
+		"speculative_worker":    worker.Nickname,
+		"speculative_ping":      UtcNow(),
+	}}
+	if err := db.C("flamenco_tasks").Update(query, updates); err != nil {
+		logger.WithError(err).Error("Unable to assign speculative duplicate of task")
+		return err
+	}
+
+	worker.SetCurrentTask(task.ID, db)
+	return nil
+}
+
+// handleSpeculativeUpdate adjusts a task update for a task that has a speculative duplicate.
+// Only the completion of the duplicate is sent to the Server; its other updates are kept
+// local so that the Server doesn't receive every update twice.
+func (tuq *TaskUpdateQueue) handleSpeculativeUpdate(worker *Worker, task *Task, tupdate *TaskUpdate, extraUpdates bson.M) {
+	logger := log.WithFields(log.Fields{
+		"task_id":     task.ID.Hex(),
+		"worker":      worker.Identifier(),
+		"task_status": tupdate.TaskStatus,
+	})
+
+	if !task.isSpeculativeFor(worker.ID) {
+		// The original run finished, so the duplicate is no longer needed.
+		if tupdate.TaskStatus != "" && tupdate.TaskStatus != statusActive {
+			unsetSpeculativeRun(extraUpdates)
+		}
+		return
+	}
+
+	switch tupdate.TaskStatus {
+	case statusCompleted:
+		// The duplicate won. It takes over the task, so that the original worker is told to stop.
+		logger.Info("speculative duplicate completed before the original task")
+		updatesSet := GetOrCreateMap(extraUpdates, "$set")
+		updatesSet["worker_id"] = worker.ID
+		updatesSet["worker"] = worker.Nickname
+		unsetSpeculativeRun(extraUpdates)
+		return
+	case statusFailed:
+		// The original run may still complete, so this doesn't fail the task.
+		logger.Warning("speculative duplicate failed, original task keeps running")
+		unsetSpeculativeRun(extraUpdates)
+	}
+
+	tupdate.TaskStatus = ""
+	tupdate.Activity = ""
+	tupdate.Metrics = nil
+	tupdate.isManagerLocal = true
+}
@@ -0,0 +1,105 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type StragglerTestSuite struct{}
+
+var _ = check.Suite(&StragglerTestSuite{})
+
+func (s *StragglerTestSuite) TestIsStraggler(c *check.C) {
+	assert.False(c, isStraggler(100, 60, 3))
+	assert.True(c, isStraggler(181, 60, 3))
+
+	// Without estimate or factor there are no stragglers.
+	assert.False(c, isStraggler(1000, 0, 3))
+	assert.False(c, isStraggler(1000, 60, 0))
+}
+
+func (s *StragglerTestSuite) TestSpeculativeUpdates(c *check.C) {
+	config := GetTestConfig()
+	tuq := CreateTaskUpdateQueue(&config, nil, nil, nil, newLocalTaskLogStore(&config))
+
+	original := Worker{ID: bson.NewObjectId(), Nickname: "original"}
+	duplicate := Worker{ID: bson.NewObjectId(), Nickname: "duplicate"}
+	task := Task{
+		ID:                  bson.NewObjectId(),
+		Status:              statusActive,
+		WorkerID:            &original.ID,
+		SpeculativeWorkerID: &duplicate.ID,
+	}
+	speculativeUnset := bson.M{
+		"speculative_worker_id": true,
+		"speculative_worker":    true,
+		"speculative_ping":      true,
+	}
+
+	// Progress of the duplicate stays local.
+	tupdate := TaskUpdate{TaskStatus: statusActive, Activity: "rendering", Log: "frame 1"}
+	extraUpdates := bson.M{}
+	tuq.handleSpeculativeUpdate(&duplicate, &task, &tupdate, extraUpdates)
+	assert.True(c, tupdate.isManagerLocal)
+	assert.Equal(c, "", tupdate.TaskStatus)
+	assert.Equal(c, "", tupdate.Activity)
+	assert.Equal(c, "frame 1", tupdate.Log)
+	assert.Equal(c, bson.M{}, extraUpdates)
+
+	// A failing duplicate doesn't fail the task.
+	tupdate = TaskUpdate{TaskStatus: statusFailed}
+	extraUpdates = bson.M{}
+	tuq.handleSpeculativeUpdate(&duplicate, &task, &tupdate, extraUpdates)
+	assert.True(c, tupdate.isManagerLocal)
+	assert.Equal(c, "", tupdate.TaskStatus)
+	assert.Equal(c, bson.M{"$unset": speculativeUnset}, extraUpdates)
+
+	// A completed duplicate takes over the task.
+	tupdate = TaskUpdate{TaskStatus: statusCompleted}
+	extraUpdates = bson.M{}
+	tuq.handleSpeculativeUpdate(&duplicate, &task, &tupdate, extraUpdates)
+	assert.False(c, tupdate.isManagerLocal)
+	assert.Equal(c, statusCompleted, tupdate.TaskStatus)
+	assert.Equal(c, bson.M{
+		"$set":   bson.M{"worker_id": duplicate.ID, "worker": "duplicate"},
+		"$unset": speculativeUnset,
+	}, extraUpdates)
+
+	// Updates of the original run are sent as usual.
+	tupdate = TaskUpdate{TaskStatus: statusActive, Activity: "rendering"}
+	extraUpdates = bson.M{}
+	tuq.handleSpeculativeUpdate(&original, &task, &tupdate, extraUpdates)
+	assert.False(c, tupdate.isManagerLocal)
+	assert.Equal(c, "rendering", tupdate.Activity)
+	assert.Equal(c, bson.M{}, extraUpdates)
+
+	// When the original run completes, the duplicate is no longer needed.
+	tupdate = TaskUpdate{TaskStatus: statusCompleted}
+	extraUpdates = bson.M{}
+	tuq.handleSpeculativeUpdate(&original, &task, &tupdate, extraUpdates)
+	assert.Equal(c, statusCompleted, tupdate.TaskStatus)
+	assert.Equal(c, bson.M{"$unset": speculativeUnset}, extraUpdates)
+}
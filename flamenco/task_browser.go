@@ -0,0 +1,389 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	taskQueryDefaultLimit = 50
+	taskQueryMaxLimit     = 500
+	taskQueryDefaultSort  = "-last_updated"
+)
+
+// Fields the task query API can sort on, mapped to their MongoDB field names.
+var taskQuerySortFields = map[string]string{
+	"id":           "_id",
+	"name":         "name",
+	"status":       "status",
+	"priority":     "priority",
+	"job_priority": "job_priority",
+	"task_type":    "task_type",
+	"worker":       "worker",
+	"last_updated": "last_updated",
+}
+
+// TaskQuery selects a page of tasks for the task browser. Empty fields are ignored.
+type TaskQuery struct {
+	Status   []string
+	JobID    bson.ObjectId
+	TaskType string
+	Worker   string
+
+	SortField      string // MongoDB field name, see taskQuerySortFields.
+	SortDescending bool
+	Limit          int
+	Cursor         *taskQueryCursor
+}
+
+// taskQueryCursor points to the last task of the previous page. The sort value is
+// included so that the next page can continue after it, regardless of its type.
+type taskQueryCursor struct {
+	SortValue interface{}   `bson:"v"`
+	TaskID    bson.ObjectId `bson:"id"`
+}
+
+// TaskSummary is a task as listed by the task browser.
+type TaskSummary struct {
+	ID           bson.ObjectId `bson:"_id" json:"_id"`
+	Job          bson.ObjectId `bson:"job" json:"job"`
+	Name         string        `bson:"name" json:"name"`
+	Status       string        `bson:"status" json:"status"`
+	Priority     int           `bson:"priority" json:"priority"`
+	JobPriority  int           `bson:"job_priority" json:"job_priority"`
+	TaskType     string        `bson:"task_type" json:"task_type"`
+	Worker       string        `bson:"worker,omitempty" json:"worker,omitempty"`
+	Activity     string        `bson:"activity,omitempty" json:"activity,omitempty"`
+	FailureClass string        `bson:"failure_class,omitempty" json:"failure_class,omitempty"`
+	LastUpdated  *time.Time    `bson:"last_updated,omitempty" json:"last_updated,omitempty"`
+}
+
+// TaskQueryResponse is sent in response to GET /api/tasks.
+type TaskQueryResponse struct {
+	Tasks []TaskSummary `json:"tasks"`
+	// Pass this as 'cursor' to get the next page. Empty when this is the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// TaskDetails is sent in response to GET /api/tasks/{task-id}. It includes the fields
+// that are normally only used internally by the Manager.
+type TaskDetails struct {
+	Task
+	WorkerID       *bson.ObjectId `json:"worker_id,omitempty"`
+	LastWorkerPing *time.Time     `json:"last_worker_ping,omitempty"`
+	LastUpdated    *time.Time     `json:"last_updated,omitempty"`
+	ActivatedAt    *time.Time     `json:"activated_at,omitempty"`
+	FailureClass   string         `json:"failure_class,omitempty"`
+	LogURL         string         `json:"log_url"`
+
+	RenderOutputProblems []RenderOutputProblem `json:"render_output_problems,omitempty"`
+}
+
+var taskSummaryProjection = M{
+	"_id":           1,
+	"job":           1,
+	"name":          1,
+	"status":        1,
+	"priority":      1,
+	"job_priority":  1,
+	"task_type":     1,
+	"worker":        1,
+	"activity":      1,
+	"failure_class": 1,
+	"last_updated":  1,
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// parseTaskQuery parses the URL query parameters of a GET /api/tasks request.
+// Statuses can be given as repeated parameters, comma-separated, or both.
+func parseTaskQuery(params url.Values) (TaskQuery, error) {
+	query := TaskQuery{
+		TaskType: params.Get("task_type"),
+		Worker:   params.Get("worker"),
+		Limit:    taskQueryDefaultLimit,
+	}
+
+	for _, param := range params["status"] {
+		for _, status := range strings.Split(param, ",") {
+			if status = strings.TrimSpace(status); status != "" {
+				query.Status = append(query.Status, status)
+			}
+		}
+	}
+
+	if jobID := params.Get("job"); jobID != "" {
+		if !bson.IsObjectIdHex(jobID) {
+			return query, fmt.Errorf("invalid job ID %q", jobID)
+		}
+		query.JobID = bson.ObjectIdHex(jobID)
+	}
+
+	sort := params.Get("sort")
+	if sort == "" {
+		sort = taskQueryDefaultSort
+	}
+	query.SortDescending = strings.HasPrefix(sort, "-")
+	field, found := taskQuerySortFields[strings.TrimPrefix(sort, "-")]
+	if !found {
+		return query, fmt.Errorf("cannot sort on %q", sort)
+	}
+	query.SortField = field
+
+	if limit := params.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 1 || parsed > taskQueryMaxLimit {
+			return query, fmt.Errorf("limit should be a number between 1 and %d", taskQueryMaxLimit)
+		}
+		query.Limit = parsed
+	}
+
+	if cursor := params.Get("cursor"); cursor != "" {
+		parsed, err := decodeTaskQueryCursor(cursor)
+		if err != nil {
+			return query, err
+		}
+		query.Cursor = parsed
+	}
+
+	return query, nil
+}
+
+func encodeTaskQueryCursor(cursor taskQueryCursor) (string, error) {
+	asBSON, err := bson.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(asBSON), nil
+}
+
+func decodeTaskQueryCursor(encoded string) (*taskQueryCursor, error) {
+	asBSON, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	cursor := taskQueryCursor{}
+	if err := bson.Unmarshal(asBSON, &cursor); err != nil || !cursor.TaskID.Valid() {
+		return nil, errInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// mongoQuery returns the MongoDB query to find the tasks of this page.
+func (query *TaskQuery) mongoQuery() M {
+	mongoQuery := M{}
+	if len(query.Status) > 0 {
+		mongoQuery["status"] = M{"$in": query.Status}
+	}
+	if query.JobID != "" {
+		mongoQuery["job"] = query.JobID
+	}
+	if query.TaskType != "" {
+		mongoQuery["task_type"] = query.TaskType
+	}
+	if query.Worker != "" {
+		mongoQuery["worker"] = query.Worker
+	}
+
+	if query.Cursor != nil {
+		mongoQuery["$or"] = query.afterCursor()
+	}
+	return mongoQuery
+}
+
+// afterCursor returns the clauses that select the tasks after the cursor, in sort order.
+// Tasks are sorted on the sort field, then on their ID, so that the order is stable.
+func (query *TaskQuery) afterCursor() []M {
+	compare := "$gt"
+	if query.SortDescending {
+		compare = "$lt"
+	}
+
+	cursor := query.Cursor
+	afterID := M{"_id": M{compare: cursor.TaskID}}
+	if query.SortField == "_id" {
+		return []M{afterID}
+	}
+
+	sameValue := M{
+		query.SortField: cursor.SortValue,
+		"_id":           M{compare: cursor.TaskID},
+	}
+	if cursor.SortValue == nil {
+		// Missing values sort before everything else. Comparing with nil doesn't work,
+		// so an explicit existence check is needed.
+		if query.SortDescending {
+			return []M{sameValue}
+		}
+		return []M{sameValue, M{query.SortField: M{"$ne": nil}}}
+	}
+	return []M{sameValue, M{query.SortField: M{compare: cursor.SortValue}}}
+}
+
+func (query *TaskQuery) sortOrder() []string {
+	if query.SortDescending {
+		return []string{"-" + query.SortField, "-_id"}
+	}
+	return []string{query.SortField, "_id"}
+}
+
+// FindTasks returns a page of tasks matching the query.
+func FindTasks(query TaskQuery, db *mgo.Database) (TaskQueryResponse, error) {
+	response := TaskQueryResponse{Tasks: []TaskSummary{}}
+
+	// Fetch one more task than requested, to know whether there is a next page.
+	var rawTasks []bson.Raw
+	err := db.C("flamenco_tasks").Find(query.mongoQuery()).
+		Select(taskSummaryProjection).
+		Sort(query.sortOrder()...).
+		Limit(query.Limit + 1).
+		All(&rawTasks)
+	if err != nil {
+		return response, err
+	}
+
+	hasNextPage := len(rawTasks) > query.Limit
+	if hasNextPage {
+		rawTasks = rawTasks[:query.Limit]
+	}
+	for _, rawTask := range rawTasks {
+		summary := TaskSummary{}
+		if err := rawTask.Unmarshal(&summary); err != nil {
+			return response, err
+		}
+		response.Tasks = append(response.Tasks, summary)
+	}
+
+	if hasNextPage {
+		// The cursor needs the sort value as stored in MongoDB, not as converted to Go.
+		lastTask := bson.M{}
+		if err := rawTasks[len(rawTasks)-1].Unmarshal(&lastTask); err != nil {
+			return response, err
+		}
+		cursor := taskQueryCursor{
+			SortValue: lastTask[query.SortField],
+			TaskID:    response.Tasks[len(response.Tasks)-1].ID,
+		}
+		if response.NextCursor, err = encodeTaskQueryCursor(cursor); err != nil {
+			return response, err
+		}
+	}
+
+	return response, nil
+}
+
+// queryTasks handles GET /api/tasks.
+func (dash *Dashboard) queryTasks(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithFields(log.Fields{
+		"remote_addr": r.RemoteAddr,
+		"query":       r.URL.RawQuery,
+	})
+
+	query, err := parseTaskQuery(r.URL.Query())
+	if err != nil {
+		logger.WithError(err).Warning("queryTasks: invalid query")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mongoSess := dash.session.Copy()
+	defer mongoSess.Close()
+
+	response, err := FindTasks(query, mongoSess.DB(""))
+	if err != nil {
+		logger.WithError(err).Error("queryTasks: unable to query tasks")
+		http.Error(w, "unable to query tasks", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.WithError(err).Debug("queryTasks: unable to send response")
+	}
+}
+
+// taskDetails handles GET /api/tasks/{task-id}.
+func (dash *Dashboard) taskDetails(w http.ResponseWriter, r *http.Request) {
+	taskID, err := ObjectIDFromRequest(w, r, "task-id")
+	if err != nil {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"remote_addr": r.RemoteAddr,
+		"task_id":     taskID.Hex(),
+	})
+
+	mongoSess := dash.session.Copy()
+	defer mongoSess.Close()
+
+	task := Task{}
+	if err := mongoSess.DB("").C("flamenco_tasks").FindId(taskID).One(&task); err != nil {
+		if err == mgo.ErrNotFound {
+			http.Error(w, "task not found", http.StatusNotFound)
+			return
+		}
+		logger.WithError(err).Error("taskDetails: unable to find task")
+		http.Error(w, "unable to find task", http.StatusInternalServerError)
+		return
+	}
+
+	details := TaskDetails{
+		Task:           task,
+		WorkerID:       task.WorkerID,
+		LastWorkerPing: task.LastWorkerPing,
+		LastUpdated:    task.LastUpdated,
+		ActivatedAt:    task.ActivatedAt,
+		FailureClass:   task.FailureClass,
+		LogURL:         fmt.Sprintf("/logfile/%s/%s", task.Job.Hex(), task.ID.Hex()),
+
+		RenderOutputProblems: task.RenderOutputProblems,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(details); err != nil {
+		logger.WithError(err).Debug("taskDetails: unable to send response")
+	}
+}
+
+func (dash *Dashboard) showTaskBrowserPage(w http.ResponseWriter, r *http.Request) {
+	dash.showTemplate("templates/task-browser.html", w, r)
+}
+
+func (dash *Dashboard) showTaskDetailsPage(w http.ResponseWriter, r *http.Request) {
+	dash.showTemplate("templates/task-details.html", w, r)
+}
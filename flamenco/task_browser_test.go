@@ -0,0 +1,123 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type TaskBrowserTestSuite struct{}
+
+var _ = check.Suite(&TaskBrowserTestSuite{})
+
+func (s *TaskBrowserTestSuite) TestParseTaskQueryDefaults(c *check.C) {
+	query, err := parseTaskQuery(url.Values{})
+	assert.Nil(c, err)
+	assert.Equal(c, "last_updated", query.SortField)
+	assert.True(c, query.SortDescending)
+	assert.Equal(c, taskQueryDefaultLimit, query.Limit)
+	assert.Nil(c, query.Cursor)
+	assert.Equal(c, M{}, query.mongoQuery())
+	assert.Equal(c, []string{"-last_updated", "-_id"}, query.sortOrder())
+}
+
+func (s *TaskBrowserTestSuite) TestParseTaskQueryFilter(c *check.C) {
+	jobID := bson.NewObjectId()
+	params := url.Values{
+		"status":    []string{"queued,active", "failed"},
+		"job":       []string{jobID.Hex()},
+		"task_type": []string{"blender-render"},
+		"worker":    []string{"renderer-1"},
+		"sort":      []string{"priority"},
+		"limit":     []string{"10"},
+	}
+	query, err := parseTaskQuery(params)
+	assert.Nil(c, err)
+	assert.Equal(c, 10, query.Limit)
+	assert.Equal(c, []string{"priority", "_id"}, query.sortOrder())
+	assert.Equal(c, M{
+		"status":    M{"$in": []string{"queued", "active", "failed"}},
+		"job":       jobID,
+		"task_type": "blender-render",
+		"worker":    "renderer-1",
+	}, query.mongoQuery())
+}
+
+func (s *TaskBrowserTestSuite) TestParseTaskQueryInvalid(c *check.C) {
+	for _, params := range []url.Values{
+		url.Values{"job": []string{"not-an-id"}},
+		url.Values{"sort": []string{"commands"}},
+		url.Values{"limit": []string{"0"}},
+		url.Values{"limit": []string{"100000"}},
+		url.Values{"cursor": []string{"garbage"}},
+	} {
+		_, err := parseTaskQuery(params)
+		assert.NotNil(c, err, "params %v should be rejected", params)
+	}
+}
+
+func (s *TaskBrowserTestSuite) TestCursor(c *check.C) {
+	taskID := bson.NewObjectId()
+	updated := time.Date(2019, 12, 1, 10, 0, 0, 0, time.UTC)
+	encoded, err := encodeTaskQueryCursor(taskQueryCursor{updated, taskID})
+	assert.Nil(c, err)
+
+	// The sort value should keep its type, for MongoDB to compare it correctly.
+	query, err := parseTaskQuery(url.Values{"cursor": []string{encoded}})
+	assert.Nil(c, err)
+	if !assert.NotNil(c, query.Cursor) {
+		return
+	}
+	assert.Equal(c, taskID, query.Cursor.TaskID)
+	assert.Equal(c, updated, query.Cursor.SortValue.(time.Time).UTC())
+
+	assert.Equal(c, M{"$or": []M{
+		M{"last_updated": query.Cursor.SortValue, "_id": M{"$lt": taskID}},
+		M{"last_updated": M{"$lt": query.Cursor.SortValue}},
+	}}, query.mongoQuery())
+}
+
+func (s *TaskBrowserTestSuite) TestAfterCursorMissingValue(c *check.C) {
+	taskID := bson.NewObjectId()
+	query := TaskQuery{
+		SortField: "worker",
+		Cursor:    &taskQueryCursor{nil, taskID},
+	}
+	assert.Equal(c, []M{
+		M{"worker": nil, "_id": M{"$gt": taskID}},
+		M{"worker": M{"$ne": nil}},
+	}, query.afterCursor())
+
+	query.SortDescending = true
+	assert.Equal(c, []M{
+		M{"worker": nil, "_id": M{"$lt": taskID}},
+	}, query.afterCursor())
+
+	query.SortField = "_id"
+	assert.Equal(c, []M{M{"_id": M{"$lt": taskID}}}, query.afterCursor())
+}
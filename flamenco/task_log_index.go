@@ -0,0 +1,305 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// Maximum number of log chunks inspected for a single search.
+	taskLogSearchMaxChunks = 1000
+	// Maximum number of matching lines returned per task.
+	taskLogSearchMaxExcerpts = 5
+	// Maximum length of a returned line, in bytes.
+	taskLogSearchMaxExcerptLength = 500
+
+	taskLogSearchDefaultLimit = 50
+	taskLogSearchMaxLimit     = 500
+)
+
+// TaskLogIndex stores task log chunks in MongoDB, so that they can be searched.
+type TaskLogIndex struct {
+	config  *Conf
+	session *mgo.Session
+}
+
+// taskLogChunk is the text written to a task log by a single task update.
+type taskLogChunk struct {
+	TaskID    bson.ObjectId `bson:"task_id"`
+	JobID     bson.ObjectId `bson:"job_id"`
+	TaskType  string        `bson:"task_type"`
+	Worker    string        `bson:"worker,omitempty"`
+	Text      string        `bson:"text"`
+	WrittenAt time.Time     `bson:"written_at"`
+	CleanupAt time.Time     `bson:"cleanup_at"`
+}
+
+// TaskLogSearch describes which task logs to search for which text.
+type TaskLogSearch struct {
+	Text  string
+	JobID bson.ObjectId // optional
+	Since *time.Time    // optional
+	Until *time.Time    // optional
+	Limit int           // maximum number of tasks to return
+}
+
+// TaskLogSearchResult contains the matching lines of a single task's log.
+type TaskLogSearchResult struct {
+	TaskID      bson.ObjectId `json:"task_id"`
+	JobID       bson.ObjectId `json:"job_id"`
+	TaskType    string        `json:"task_type"`
+	Worker      string        `json:"worker,omitempty"`
+	LastWritten time.Time     `json:"last_written"`
+	Excerpts    []string      `json:"excerpts"`
+	LogURL      string        `json:"log_url"`
+}
+
+var errEmptySearchText = errors.New("search text should not be empty")
+
+// CreateTaskLogIndex creates a new TaskLogIndex.
+func CreateTaskLogIndex(config *Conf, session *mgo.Session) *TaskLogIndex {
+	return &TaskLogIndex{
+		config,
+		session,
+	}
+}
+
+func (tli *TaskLogIndex) collection(db *mgo.Database) *mgo.Collection {
+	return db.C("task_log_chunks")
+}
+
+// EnsureDBIndices ensures the MongoDB indices are there.
+func (tli *TaskLogIndex) EnsureDBIndices() {
+	coll := tli.collection(tli.session.DB(""))
+
+	coll.EnsureIndex(mgo.Index{
+		Name: "text",
+		Key:  []string{"$text:text"},
+	})
+	coll.EnsureIndex(mgo.Index{
+		Name: "job-written-at",
+		Key:  []string{"job_id", "-written_at"},
+	})
+	coll.EnsureIndex(mgo.Index{
+		Name:        "cleanup-at",
+		Key:         []string{"cleanup_at"},
+		ExpireAfter: 1 * time.Second,
+	})
+}
+
+// IndexChunk stores the log text that was just written to the task log.
+// Errors are logged but otherwise ignored, as the log file itself was written fine.
+func (tli *TaskLogIndex) IndexChunk(task *Task, logText string, db *mgo.Database) {
+	if tli == nil || tli.config.TaskLogIndexExpiry <= 0 {
+		return
+	}
+	if strings.TrimSpace(logText) == "" || task.Job == unknownJobID {
+		return
+	}
+
+	now := time.Now().UTC()
+	chunk := taskLogChunk{
+		TaskID:    task.ID,
+		JobID:     task.Job,
+		TaskType:  task.TaskType,
+		Worker:    task.Worker,
+		Text:      logText,
+		WrittenAt: now,
+		CleanupAt: now.Add(tli.config.TaskLogIndexExpiry),
+	}
+	if err := tli.collection(db).Insert(chunk); err != nil {
+		log.WithFields(log.Fields{
+			"task_id":    task.ID.Hex(),
+			log.ErrorKey: err,
+		}).Warning("unable to index task log chunk")
+	}
+}
+
+// Search returns the tasks whose log contains the search text, most recently written first.
+func (tli *TaskLogIndex) Search(search TaskLogSearch, db *mgo.Database) ([]TaskLogSearchResult, error) {
+	var chunks []taskLogChunk
+	err := tli.collection(db).Find(search.mongoQuery()).
+		Sort("-written_at").
+		Limit(taskLogSearchMaxChunks).
+		All(&chunks)
+	if err != nil {
+		return nil, err
+	}
+	return groupSearchResults(chunks, search.Text, search.Limit), nil
+}
+
+// mongoQuery returns the MongoDB query that finds the log chunks containing the search text.
+func (search TaskLogSearch) mongoQuery() M {
+	// Search for the entire text as a phrase, rather than for any of its words.
+	phrase := `"` + strings.Replace(search.Text, `"`, ``, -1) + `"`
+	query := M{"$text": M{"$search": phrase}}
+	if search.JobID != "" {
+		query["job_id"] = search.JobID
+	}
+	writtenAt := M{}
+	if search.Since != nil {
+		writtenAt["$gte"] = *search.Since
+	}
+	if search.Until != nil {
+		writtenAt["$lte"] = *search.Until
+	}
+	if len(writtenAt) > 0 {
+		query["written_at"] = writtenAt
+	}
+	return query
+}
+
+// groupSearchResults groups the log chunks per task, in the order of the chunks, and extracts
+// the lines that contain the search text.
+func groupSearchResults(chunks []taskLogChunk, text string, limit int) []TaskLogSearchResult {
+	results := []TaskLogSearchResult{}
+	resultIndex := map[bson.ObjectId]int{}
+	needle := strings.ToLower(text)
+
+	for _, chunk := range chunks {
+		idx, found := resultIndex[chunk.TaskID]
+		if !found {
+			if len(results) >= limit {
+				continue
+			}
+			idx = len(results)
+			resultIndex[chunk.TaskID] = idx
+			results = append(results, TaskLogSearchResult{
+				TaskID:      chunk.TaskID,
+				JobID:       chunk.JobID,
+				TaskType:    chunk.TaskType,
+				Worker:      chunk.Worker,
+				LastWritten: chunk.WrittenAt,
+				Excerpts:    []string{},
+				LogURL:      fmt.Sprintf("/logfile/%s/%s", chunk.JobID.Hex(), chunk.TaskID.Hex()),
+			})
+		}
+		result := &results[idx]
+
+		for _, line := range strings.Split(chunk.Text, "\n") {
+			if len(result.Excerpts) >= taskLogSearchMaxExcerpts {
+				break
+			}
+			if !strings.Contains(strings.ToLower(line), needle) {
+				continue
+			}
+			if len(line) > taskLogSearchMaxExcerptLength {
+				line = line[:taskLogSearchMaxExcerptLength] + "…"
+			}
+			result.Excerpts = append(result.Excerpts, line)
+		}
+	}
+	return results
+}
+
+// parseTaskLogSearch parses the URL query parameters of a GET /api/task-logs/search request.
+func parseTaskLogSearch(params url.Values) (TaskLogSearch, error) {
+	search := TaskLogSearch{
+		Text:  strings.TrimSpace(params.Get("q")),
+		Limit: taskLogSearchDefaultLimit,
+	}
+	if search.Text == "" {
+		return search, errEmptySearchText
+	}
+
+	if jobID := params.Get("job"); jobID != "" {
+		if !bson.IsObjectIdHex(jobID) {
+			return search, fmt.Errorf("invalid job ID %q", jobID)
+		}
+		search.JobID = bson.ObjectIdHex(jobID)
+	}
+
+	parseTime := func(param string) (*time.Time, error) {
+		value := params.Get(param)
+		if value == "" {
+			return nil, nil
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp for %q, expecting RFC 3339 format", param)
+		}
+		return &parsed, nil
+	}
+	var err error
+	if search.Since, err = parseTime("since"); err != nil {
+		return search, err
+	}
+	if search.Until, err = parseTime("until"); err != nil {
+		return search, err
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 1 || parsed > taskLogSearchMaxLimit {
+			return search, fmt.Errorf("limit should be a number between 1 and %d", taskLogSearchMaxLimit)
+		}
+		search.Limit = parsed
+	}
+
+	return search, nil
+}
+
+// searchTaskLogs handles GET /api/task-logs/search.
+func (dash *Dashboard) searchTaskLogs(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("remote_addr", r.RemoteAddr)
+
+	search, err := parseTaskLogSearch(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger = logger.WithField("search", search.Text)
+
+	mongoSess := dash.session.Copy()
+	defer mongoSess.Close()
+
+	results, err := dash.logIndex.Search(search, mongoSess.DB(""))
+	if err != nil {
+		logger.WithError(err).Error("searchTaskLogs: unable to search task logs")
+		http.Error(w, "unable to search task logs", http.StatusInternalServerError)
+		return
+	}
+	logger.WithField("found_tasks", len(results)).Debug("searchTaskLogs: searched task logs")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		logger.WithError(err).Debug("searchTaskLogs: unable to send response")
+	}
+}
+
+func (dash *Dashboard) showTaskLogSearchPage(w http.ResponseWriter, r *http.Request) {
+	dash.showTemplate("templates/task-log-search.html", w, r)
+}
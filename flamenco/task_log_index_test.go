@@ -0,0 +1,168 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	check "gopkg.in/check.v1"
+)
+
+type TaskLogSearchQueryTestSuite struct{}
+
+var _ = check.Suite(&TaskLogSearchQueryTestSuite{})
+
+func (s *TaskLogSearchQueryTestSuite) TestParseTaskLogSearch(c *check.C) {
+	jobID := bson.NewObjectId()
+	params := url.Values{
+		"q":     []string{" CUDA error "},
+		"job":   []string{jobID.Hex()},
+		"since": []string{"2019-11-20T14:00:00Z"},
+		"limit": []string{"10"},
+	}
+	search, err := parseTaskLogSearch(params)
+	assert.Nil(c, err)
+	assert.Equal(c, "CUDA error", search.Text)
+	assert.Equal(c, jobID, search.JobID)
+	assert.Equal(c, 10, search.Limit)
+	assert.Nil(c, search.Until)
+	if assert.NotNil(c, search.Since) {
+		assert.True(c, time.Date(2019, 11, 20, 14, 0, 0, 0, time.UTC).Equal(*search.Since))
+	}
+
+	query := search.mongoQuery()
+	assert.Equal(c, M{"$search": `"CUDA error"`}, query["$text"])
+	assert.Equal(c, jobID, query["job_id"])
+	assert.Equal(c, M{"$gte": *search.Since}, query["written_at"])
+}
+
+func (s *TaskLogSearchQueryTestSuite) TestParseTaskLogSearchErrors(c *check.C) {
+	_, err := parseTaskLogSearch(url.Values{})
+	assert.Equal(c, errEmptySearchText, err)
+
+	_, err = parseTaskLogSearch(url.Values{"q": []string{"x"}, "job": []string{"nope"}})
+	assert.NotNil(c, err)
+
+	_, err = parseTaskLogSearch(url.Values{"q": []string{"x"}, "until": []string{"yesterday"}})
+	assert.NotNil(c, err)
+
+	_, err = parseTaskLogSearch(url.Values{"q": []string{"x"}, "limit": []string{"100000"}})
+	assert.NotNil(c, err)
+}
+
+func (s *TaskLogSearchQueryTestSuite) TestGroupSearchResults(c *check.C) {
+	task1 := bson.NewObjectId()
+	task2 := bson.NewObjectId()
+	task3 := bson.NewObjectId()
+	now := time.Now().UTC()
+	chunks := []taskLogChunk{
+		{TaskID: task1, Text: "rendering\nCUDA error: out of memory\nquitting", WrittenAt: now},
+		{TaskID: task2, Text: "cuda ERROR in kernel", WrittenAt: now.Add(-time.Minute)},
+		{TaskID: task1, Text: "CUDA error: launch failed", WrittenAt: now.Add(-2 * time.Minute)},
+		{TaskID: task3, Text: "CUDA error", WrittenAt: now.Add(-3 * time.Minute)},
+	}
+
+	results := groupSearchResults(chunks, "CUDA error", 2)
+	if !assert.Len(c, results, 2) {
+		return
+	}
+	assert.Equal(c, task1, results[0].TaskID)
+	assert.Equal(c, []string{"CUDA error: out of memory", "CUDA error: launch failed"}, results[0].Excerpts)
+	assert.Equal(c, now, results[0].LastWritten)
+	assert.Equal(c, task2, results[1].TaskID)
+	assert.Equal(c, []string{"cuda ERROR in kernel"}, results[1].Excerpts)
+
+	// Long lines should be truncated, and only a few lines per task returned.
+	longLine := "CUDA error " + strings.Repeat("x", 2*taskLogSearchMaxExcerptLength)
+	chunks = []taskLogChunk{
+		{TaskID: task1, Text: strings.Repeat(longLine+"\n", 2*taskLogSearchMaxExcerpts)},
+	}
+	results = groupSearchResults(chunks, "CUDA error", 2)
+	assert.Len(c, results[0].Excerpts, taskLogSearchMaxExcerpts)
+	assert.True(c, len(results[0].Excerpts[0]) < len(longLine))
+}
+
+type TaskLogIndexTestSuite struct {
+	config Conf
+	db     *mgo.Database
+	index  *TaskLogIndex
+}
+
+var _ = check.Suite(&TaskLogIndexTestSuite{})
+
+func (s *TaskLogIndexTestSuite) SetUpTest(c *check.C) {
+	s.config = GetTestConfig()
+	s.config.TaskLogIndexExpiry = time.Hour
+	session := MongoSession(&s.config)
+	s.db = session.DB("")
+	s.index = CreateTaskLogIndex(&s.config, session)
+	s.index.EnsureDBIndices()
+}
+
+func (s *TaskLogIndexTestSuite) TearDownTest(c *check.C) {
+	log.Info("TaskLogIndexTestSuite tearing down test, dropping database.")
+	s.db.DropDatabase()
+}
+
+func (s *TaskLogIndexTestSuite) TestIndexAndSearch(c *check.C) {
+	task1 := ConstructTestTask(bson.NewObjectId().Hex(), "blender-render")
+	task2 := ConstructTestTask(bson.NewObjectId().Hex(), "blender-render")
+	task2.Job = bson.NewObjectId()
+
+	s.index.IndexChunk(&task1, "Fra:1 Mem:12M\nCUDA error: out of memory\n", s.db)
+	s.index.IndexChunk(&task2, "CUDA error in kernel\n", s.db)
+	s.index.IndexChunk(&task2, "all is fine\n", s.db)
+
+	results, err := s.index.Search(TaskLogSearch{Text: "cuda error", Limit: 10}, s.db)
+	assert.Nil(c, err)
+	assert.Len(c, results, 2)
+
+	results, err = s.index.Search(TaskLogSearch{Text: "cuda error", JobID: task1.Job, Limit: 10}, s.db)
+	assert.Nil(c, err)
+	if assert.Len(c, results, 1) {
+		assert.Equal(c, task1.ID, results[0].TaskID)
+		assert.Equal(c, []string{"CUDA error: out of memory"}, results[0].Excerpts)
+	}
+
+	future := time.Now().Add(time.Hour)
+	results, err = s.index.Search(TaskLogSearch{Text: "cuda error", Since: &future, Limit: 10}, s.db)
+	assert.Nil(c, err)
+	assert.Empty(c, results)
+}
+
+func (s *TaskLogIndexTestSuite) TestIndexingDisabled(c *check.C) {
+	s.config.TaskLogIndexExpiry = 0
+	task := ConstructTestTask(bson.NewObjectId().Hex(), "blender-render")
+	s.index.IndexChunk(&task, "CUDA error\n", s.db)
+
+	count, err := s.index.collection(s.db).Count()
+	assert.Nil(c, err)
+	assert.Equal(c, 0, count)
+}
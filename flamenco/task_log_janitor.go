@@ -0,0 +1,359 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Delay for the initial cleanup, and the interval between cleanups. The initial delay is
+// longer than the task cleanup initial delay, so that those two don't happen at the same time.
+const (
+	taskLogJanitorInitialSleep  = 7 * time.Minute
+	taskLogJanitorCheckInterval = 1 * time.Hour
+)
+
+// Matches the filenames of current and rotated task logs, gzipped or not; see taskLogPath().
+var taskLogFilenameRegexp = regexp.MustCompile(`^task-([0-9a-f]{24})\.txt(\.[0-9]+)?(\.gz)?$`)
+
+// Task statuses for which the logs are still being written, or will be written to again.
+var unfinishedTaskLogStatuses = append([]string{statusCancelRequested}, unfinishedTaskStatuses...)
+
+// TaskLogJanitor periodically compresses and deletes old task log files.
+type TaskLogJanitor struct {
+	closable
+	config  *Conf
+	session *mgo.Session
+}
+
+// TaskLogJanitorStats contains statistics of a task log cleanup run.
+type TaskLogJanitorStats struct {
+	NumFilesChecked   int   `json:"num_files_checked"`
+	NumFilesSkipped   int   `json:"num_files_skipped"` // logs of unfinished tasks.
+	NumCompressed     int   `json:"num_compressed"`
+	NumDeletedExpired int   `json:"num_deleted_expired"`
+	NumDeletedQuota   int   `json:"num_deleted_quota"`
+	BytesReclaimed    int64 `json:"bytes_reclaimed"`
+	TotalBytes        int64 `json:"total_bytes"` // size of all task logs after the cleanup.
+}
+
+// taskLogFile is a task log file found on disk.
+type taskLogFile struct {
+	path    string
+	taskID  bson.ObjectId
+	size    int64
+	modTime time.Time
+}
+
+func (file taskLogFile) isCompressed() bool {
+	return strings.HasSuffix(file.path, ".gz")
+}
+
+// CreateTaskLogJanitor creates a new TaskLogJanitor.
+func CreateTaskLogJanitor(config *Conf, session *mgo.Session) *TaskLogJanitor {
+	return &TaskLogJanitor{
+		makeClosable(),
+		config,
+		session,
+	}
+}
+
+// Go starts a new goroutine to perform the periodic cleanup.
+// Task logs are only cleaned up when they are stored on the local disk.
+func (tlj *TaskLogJanitor) Go() {
+	if !tlj.config.usesLocalTaskLogStorage() {
+		log.WithField("task_log_storage", tlj.config.TaskLogStorage.Type).Info(
+			"TaskLogJanitor: not cleaning up task logs, they are not stored on the local disk")
+		return
+	}
+
+	tlj.closableAdd(1)
+	go func() {
+		session := tlj.session.Copy()
+		db := session.DB("")
+		defer session.Close()
+		defer tlj.closableDone()
+		defer log.Info("TaskLogJanitor: shutting down.")
+
+		timer := Timer("TaskLogJanitor", taskLogJanitorCheckInterval, taskLogJanitorInitialSleep, &tlj.closable)
+		for range timer {
+			tlj.Cleanup(tlj.config.TaskLogCleanupDryRun, db)
+		}
+	}()
+}
+
+// Close gracefully shuts down the task log janitor goroutine.
+func (tlj *TaskLogJanitor) Close() {
+	log.Debug("TaskLogJanitor: Close() called.")
+	tlj.closableCloseAndWait()
+	log.Debug("TaskLogJanitor: shutdown complete.")
+}
+
+// Cleanup compresses old task logs, deletes expired ones, and then deletes the oldest logs
+// until the total size is within the configured maximum. With doDryRun=true no files are touched,
+// and the space saved by compressing logs is not included in the stats.
+func (tlj *TaskLogJanitor) Cleanup(doDryRun bool, db *mgo.Database) (stats TaskLogJanitorStats) {
+	logger := log.WithField("task_logs_path", tlj.config.TaskLogsPath)
+	if doDryRun {
+		logger = logger.WithField("dry_run", doDryRun)
+	}
+	logger.Info("TaskLogJanitor: cleaning up task logs")
+
+	unfinished, err := unfinishedTaskIDs(db)
+	if err != nil {
+		logger.WithError(err).Error("TaskLogJanitor: unable to find unfinished tasks")
+		return
+	}
+
+	files, err := findTaskLogFiles(tlj.config.TaskLogsPath)
+	if err != nil {
+		logger.WithError(err).Error("TaskLogJanitor: unable to find task log files")
+		return
+	}
+
+	stats = tlj.cleanupFiles(files, unfinished, time.Now(), doDryRun, logger)
+
+	logger.WithFields(log.Fields{
+		"num_files_checked":   stats.NumFilesChecked,
+		"num_files_skipped":   stats.NumFilesSkipped,
+		"num_compressed":      stats.NumCompressed,
+		"num_deleted_expired": stats.NumDeletedExpired,
+		"num_deleted_quota":   stats.NumDeletedQuota,
+		"reclaimed_bytes":     stats.BytesReclaimed,
+		"reclaimed_size":      humanizeByteSize(stats.BytesReclaimed),
+		"total_size":          humanizeByteSize(stats.TotalBytes),
+	}).Info("TaskLogJanitor: cleaned up task logs")
+	return
+}
+
+// cleanupFiles performs the actual cleanup of the given task log files, which should be sorted by path.
+func (tlj *TaskLogJanitor) cleanupFiles(files []taskLogFile, unfinished map[bson.ObjectId]bool,
+	now time.Time, doDryRun bool, logger *log.Entry) (stats TaskLogJanitorStats) {
+
+	stats.NumFilesChecked = len(files)
+	cleanable := make([]taskLogFile, 0, len(files))
+	for _, file := range files {
+		stats.TotalBytes += file.size
+		if unfinished[file.taskID] {
+			stats.NumFilesSkipped++
+			continue
+		}
+		cleanable = append(cleanable, file)
+	}
+
+	// Delete expired logs, and compress the remaining old ones.
+	kept := make([]taskLogFile, 0, len(cleanable))
+	overwritten := map[string]bool{} // compressed copies made by the TaskLogUploader.
+	sizes := make(map[string]int64, len(cleanable))
+	for _, file := range cleanable {
+		sizes[file.path] = file.size
+	}
+	for _, file := range cleanable {
+		if overwritten[file.path] {
+			// The files are sorted by path, so this copy is always seen after its original.
+			continue
+		}
+		age := now.Sub(file.modTime)
+		fileLogger := logger.WithField("log_file", file.path)
+
+		switch {
+		case tlj.config.TaskLogDeleteAge > 0 && age > tlj.config.TaskLogDeleteAge:
+			if tlj.deleteFile(file, doDryRun, fileLogger) {
+				stats.NumDeletedExpired++
+				stats.BytesReclaimed += file.size
+				stats.TotalBytes -= file.size
+				continue
+			}
+		case tlj.config.TaskLogCompressAge > 0 && age > tlj.config.TaskLogCompressAge && !file.isCompressed():
+			compressed, ok := tlj.compressFile(file, doDryRun, fileLogger)
+			if ok {
+				if oldSize, found := sizes[compressed.path]; found {
+					overwritten[compressed.path] = true
+					stats.TotalBytes -= oldSize
+					stats.BytesReclaimed += oldSize
+				}
+				stats.NumCompressed++
+				stats.BytesReclaimed += file.size - compressed.size
+				stats.TotalBytes -= file.size - compressed.size
+				file = compressed
+			}
+		}
+		kept = append(kept, file)
+	}
+
+	// Delete the oldest logs until the total size is within bounds.
+	maxTotalBytes := tlj.config.TaskLogMaxTotalSizeMB * 1024 * 1024
+	if maxTotalBytes > 0 && stats.TotalBytes > maxTotalBytes {
+		sort.Slice(kept, func(i, j int) bool { return kept[i].modTime.Before(kept[j].modTime) })
+		for _, file := range kept {
+			if stats.TotalBytes <= maxTotalBytes {
+				break
+			}
+			if tlj.deleteFile(file, doDryRun, logger.WithField("log_file", file.path)) {
+				stats.NumDeletedQuota++
+				stats.BytesReclaimed += file.size
+				stats.TotalBytes -= file.size
+			}
+		}
+	}
+
+	return
+}
+
+func (tlj *TaskLogJanitor) deleteFile(file taskLogFile, doDryRun bool, logger *log.Entry) bool {
+	if doDryRun {
+		logger.Debug("TaskLogJanitor: would delete task log")
+		return true
+	}
+	if err := os.Remove(file.path); err != nil {
+		logger.WithError(err).Warning("TaskLogJanitor: unable to delete task log")
+		return false
+	}
+	logger.Debug("TaskLogJanitor: deleted task log")
+
+	// Remove the job directory when this was its last log file; this fails when it is not empty.
+	os.Remove(filepath.Dir(file.path))
+	return true
+}
+
+// compressFile gzips the file and removes the original. The modification time of the
+// original is kept, so that the age of the log remains the same.
+func (tlj *TaskLogJanitor) compressFile(file taskLogFile, doDryRun bool, logger *log.Entry) (taskLogFile, bool) {
+	compressed := file
+	compressed.path = file.path + ".gz"
+
+	if doDryRun {
+		logger.Debug("TaskLogJanitor: would compress task log")
+		// The compressed size is unknown without compressing, so no savings are counted.
+		// This makes the dry run overestimate the number of logs deleted to stay within quota.
+		return compressed, true
+	}
+
+	size, err := gzipFile(file.path, compressed.path)
+	if err != nil {
+		logger.WithError(err).Warning("TaskLogJanitor: unable to compress task log")
+		os.Remove(compressed.path)
+		return file, false
+	}
+	if err := os.Chtimes(compressed.path, file.modTime, file.modTime); err != nil {
+		logger.WithError(err).Warning("TaskLogJanitor: unable to set modification time of compressed task log")
+	}
+	if err := os.Remove(file.path); err != nil {
+		logger.WithError(err).Warning("TaskLogJanitor: unable to remove compressed task log")
+		os.Remove(compressed.path)
+		return file, false
+	}
+
+	logger.WithField("compressed_size", humanizeByteSize(size)).Debug("TaskLogJanitor: compressed task log")
+	compressed.size = size
+	return compressed, true
+}
+
+// gzipFile writes a compressed copy of the source file, and returns its size.
+func gzipFile(sourcePath, gzPath string) (int64, error) {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+
+	gzFile, err := os.Create(gzPath)
+	if err != nil {
+		return 0, err
+	}
+	defer gzFile.Close()
+
+	gzWriter, err := gzip.NewWriterLevel(gzFile, 9)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(gzWriter, source); err != nil {
+		return 0, err
+	}
+	if err := gzWriter.Close(); err != nil {
+		return 0, err
+	}
+
+	stat, err := gzFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// findTaskLogFiles returns all task log files under the task logs path.
+func findTaskLogFiles(taskLogsPath string) ([]taskLogFile, error) {
+	files := []taskLogFile{}
+	visit := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == taskLogsPath {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		match := taskLogFilenameRegexp.FindStringSubmatch(info.Name())
+		if match == nil {
+			return nil
+		}
+		files = append(files, taskLogFile{
+			path:    path,
+			taskID:  bson.ObjectIdHex(match[1]),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+		return nil
+	}
+	if err := filepath.Walk(taskLogsPath, visit); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// unfinishedTaskIDs returns the IDs of the tasks whose logs should be left alone.
+func unfinishedTaskIDs(db *mgo.Database) (map[bson.ObjectId]bool, error) {
+	var tasks []Task
+	query := M{"status": M{"$in": unfinishedTaskLogStatuses}}
+	if err := db.C("flamenco_tasks").Find(query).Select(M{"_id": 1}).All(&tasks); err != nil {
+		return nil, err
+	}
+
+	taskIDs := make(map[bson.ObjectId]bool, len(tasks))
+	for _, task := range tasks {
+		taskIDs[task.ID] = true
+	}
+	return taskIDs, nil
+}
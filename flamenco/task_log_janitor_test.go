@@ -0,0 +1,187 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+
+	check "gopkg.in/check.v1"
+)
+
+type TaskLogJanitorTestSuite struct {
+	config  Conf
+	janitor *TaskLogJanitor
+	jobDir  string
+	now     time.Time
+}
+
+var _ = check.Suite(&TaskLogJanitorTestSuite{})
+
+func (s *TaskLogJanitorTestSuite) SetUpTest(c *check.C) {
+	temppath, err := ioutil.TempDir("", "testlogs")
+	assert.Nil(c, err)
+	s.config = Conf{}
+	s.config.TaskLogsPath = temppath
+	s.janitor = CreateTaskLogJanitor(&s.config, nil)
+	s.now = time.Now()
+
+	s.jobDir, _ = taskLogPath(bson.NewObjectId(), bson.NewObjectId(), &s.config)
+	assert.Nil(c, os.MkdirAll(s.jobDir, 0755))
+}
+
+func (s *TaskLogJanitorTestSuite) TearDownTest(c *check.C) {
+	os.RemoveAll(s.config.TaskLogsPath)
+}
+
+// writeLog writes a task log file of the given size, last written 'age' ago.
+func (s *TaskLogJanitorTestSuite) writeLog(c *check.C, taskID bson.ObjectId, suffix string, size int, age time.Duration) string {
+	path := filepath.Join(s.jobDir, "task-"+taskID.Hex()+".txt"+suffix)
+	assert.Nil(c, ioutil.WriteFile(path, []byte(strings.Repeat("log line\n", size/9)), 0644))
+	modTime := s.now.Add(-age)
+	assert.Nil(c, os.Chtimes(path, modTime, modTime))
+	return path
+}
+
+func (s *TaskLogJanitorTestSuite) cleanup(c *check.C, unfinished map[bson.ObjectId]bool, doDryRun bool) TaskLogJanitorStats {
+	files, err := findTaskLogFiles(s.config.TaskLogsPath)
+	assert.Nil(c, err)
+	return s.janitor.cleanupFiles(files, unfinished, s.now, doDryRun, log.WithField("test", true))
+}
+
+func (s *TaskLogJanitorTestSuite) TestFindTaskLogFiles(c *check.C) {
+	taskID := bson.NewObjectId()
+	s.writeLog(c, taskID, "", 90, time.Hour)
+	s.writeLog(c, taskID, ".1.gz", 90, time.Hour)
+	assert.Nil(c, ioutil.WriteFile(filepath.Join(s.jobDir, "README.txt"), []byte("not a log"), 0644))
+
+	files, err := findTaskLogFiles(s.config.TaskLogsPath)
+	assert.Nil(c, err)
+	if assert.Len(c, files, 2) {
+		assert.Equal(c, taskID, files[0].taskID)
+		assert.False(c, files[0].isCompressed())
+		assert.True(c, files[1].isCompressed())
+	}
+
+	// A non-existing task log directory is fine.
+	files, err = findTaskLogFiles(filepath.Join(s.config.TaskLogsPath, "nonexisting"))
+	assert.Nil(c, err)
+	assert.Empty(c, files)
+}
+
+func (s *TaskLogJanitorTestSuite) TestCompress(c *check.C) {
+	s.config.TaskLogCompressAge = 24 * time.Hour
+	oldTask := bson.NewObjectId()
+	newTask := bson.NewObjectId()
+	unfinishedTask := bson.NewObjectId()
+	oldPath := s.writeLog(c, oldTask, "", 9000, 48*time.Hour)
+	newPath := s.writeLog(c, newTask, "", 9000, time.Hour)
+	unfinishedPath := s.writeLog(c, unfinishedTask, "", 9000, 48*time.Hour)
+
+	// A dry run shouldn't touch anything.
+	stats := s.cleanup(c, map[bson.ObjectId]bool{unfinishedTask: true}, true)
+	assert.Equal(c, 1, stats.NumCompressed)
+	assert.Equal(c, int64(0), stats.BytesReclaimed, "compression savings cannot be known in a dry run")
+	assert.Equal(c, int64(3*9000), stats.TotalBytes)
+	assert.True(c, fileExists(oldPath))
+	assert.False(c, fileExists(oldPath+".gz"))
+
+	stats = s.cleanup(c, map[bson.ObjectId]bool{unfinishedTask: true}, false)
+	assert.Equal(c, 3, stats.NumFilesChecked)
+	assert.Equal(c, 1, stats.NumFilesSkipped)
+	assert.Equal(c, 1, stats.NumCompressed)
+	assert.True(c, stats.BytesReclaimed > 0)
+	assert.False(c, fileExists(oldPath))
+	assert.True(c, fileExists(oldPath+".gz"))
+	assert.True(c, fileExists(newPath))
+	assert.True(c, fileExists(unfinishedPath))
+
+	// The compressed file should keep the age of the original.
+	stat, err := os.Stat(oldPath + ".gz")
+	assert.Nil(c, err)
+	assert.True(c, stat.ModTime().Before(s.now.Add(-47*time.Hour)))
+
+	// And it should contain the original log.
+	gzFile, err := os.Open(oldPath + ".gz")
+	assert.Nil(c, err)
+	defer gzFile.Close()
+	gzReader, err := gzip.NewReader(gzFile)
+	assert.Nil(c, err)
+	contents, err := ioutil.ReadAll(gzReader)
+	assert.Nil(c, err)
+	assert.Equal(c, 9000, len(contents))
+}
+
+func (s *TaskLogJanitorTestSuite) TestCompressOverwritesUploadCopy(c *check.C) {
+	s.config.TaskLogCompressAge = 24 * time.Hour
+	taskID := bson.NewObjectId()
+	path := s.writeLog(c, taskID, "", 9000, 48*time.Hour)
+	s.writeLog(c, taskID, ".gz", 900, 48*time.Hour)
+
+	stats := s.cleanup(c, nil, false)
+	assert.Equal(c, 1, stats.NumCompressed)
+	assert.False(c, fileExists(path))
+	assert.True(c, fileExists(path+".gz"))
+
+	stat, err := os.Stat(path + ".gz")
+	assert.Nil(c, err)
+	assert.Equal(c, stat.Size(), stats.TotalBytes)
+}
+
+func (s *TaskLogJanitorTestSuite) TestDeleteExpired(c *check.C) {
+	s.config.TaskLogCompressAge = 24 * time.Hour
+	s.config.TaskLogDeleteAge = 72 * time.Hour
+	taskID := bson.NewObjectId()
+	expired := s.writeLog(c, taskID, ".1.gz", 900, 96*time.Hour)
+	recent := s.writeLog(c, taskID, "", 900, time.Hour)
+
+	stats := s.cleanup(c, nil, false)
+	assert.Equal(c, 1, stats.NumDeletedExpired)
+	assert.Equal(c, int64(900), stats.BytesReclaimed)
+	assert.Equal(c, int64(900), stats.TotalBytes)
+	assert.False(c, fileExists(expired))
+	assert.True(c, fileExists(recent))
+}
+
+func (s *TaskLogJanitorTestSuite) TestMaxTotalSize(c *check.C) {
+	s.config.TaskLogMaxTotalSizeMB = 1
+	oldest := s.writeLog(c, bson.NewObjectId(), "", 400*1024, 3*time.Hour)
+	unfinished := bson.NewObjectId()
+	unfinishedPath := s.writeLog(c, unfinished, "", 400*1024, 2*time.Hour)
+	newest := s.writeLog(c, bson.NewObjectId(), "", 400*1024, time.Hour)
+
+	stats := s.cleanup(c, map[bson.ObjectId]bool{unfinished: true}, false)
+	assert.Equal(c, 1, stats.NumDeletedQuota)
+	assert.False(c, fileExists(oldest))
+	assert.True(c, fileExists(unfinishedPath))
+	assert.True(c, fileExists(newest))
+	assert.True(c, stats.TotalBytes <= 1024*1024)
+}
@@ -0,0 +1,283 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Types of task log storage, see TaskLogStorageConfig.
+const (
+	taskLogStorageLocal = "local"
+	taskLogStorageS3    = "s3"
+)
+
+// Sent to Flamenco Server when it asks for a log that does not exist.
+const taskLogMissingText = "log file does not exist on Flamenco Manager"
+
+// TaskLogStore stores the logs of tasks, keeping the log of each attempt at running a task.
+// Functions that take an attempt number use 0 for the current attempt, 1 for the one
+// before that, etc. Missing logs are reported with an error for which os.IsNotExist() is true.
+type TaskLogStore interface {
+	// Append adds the text to the log of the current attempt.
+	Append(jobID, taskID bson.ObjectId, text string) error
+	// Rotate starts the log of a new attempt, so that the current log becomes attempt 1.
+	Rotate(jobID, taskID bson.ObjectId) error
+	// Attempts lists the logs of all attempts, current attempt first. The URL is not set.
+	Attempts(jobID, taskID bson.ObjectId) ([]TaskLogAttempt, error)
+	// Open returns the contents of the log of the given attempt. When the attempt is
+	// Compressed, the reader returns the gzipped contents and should not be seeked.
+	Open(jobID, taskID bson.ObjectId, attempt int) (TaskLogReader, TaskLogAttempt, error)
+	// Compressed returns the gzipped log of the current attempt, for uploading to Flamenco Server.
+	Compressed(jobID, taskID bson.ObjectId) (io.ReadCloser, error)
+}
+
+// TaskLogReader reads a task log; seeking allows for only reading its tail.
+type TaskLogReader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// CreateTaskLogStore creates the task log store as configured.
+func CreateTaskLogStore(config *Conf) (TaskLogStore, error) {
+	switch {
+	case config.usesLocalTaskLogStorage():
+		return newLocalTaskLogStore(config), nil
+	case config.TaskLogStorage.Type == taskLogStorageS3:
+		return newS3TaskLogStore(config.TaskLogStorage.S3)
+	default:
+		return nil, fmt.Errorf("unknown task log storage type %q", config.TaskLogStorage.Type)
+	}
+}
+
+// localTaskLogStore stores task logs as files under the TaskLogsPath directory.
+// Logs of previous attempts are rotated to numbered files; see rotateLogFile().
+type localTaskLogStore struct {
+	config *Conf
+}
+
+func newLocalTaskLogStore(config *Conf) *localTaskLogStore {
+	return &localTaskLogStore{config}
+}
+
+func (store *localTaskLogStore) logPath(jobID, taskID bson.ObjectId) string {
+	dirpath, filename := taskLogPath(jobID, taskID, store.config)
+	return path.Join(dirpath, filename)
+}
+
+func (store *localTaskLogStore) Append(jobID, taskID bson.ObjectId, text string) error {
+	logpath := store.logPath(jobID, taskID)
+	if err := os.MkdirAll(path.Dir(logpath), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(logpath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(text); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (store *localTaskLogStore) Rotate(jobID, taskID bson.ObjectId) error {
+	return rotateLogFile(store.logPath(jobID, taskID))
+}
+
+func (store *localTaskLogStore) Attempts(jobID, taskID bson.ObjectId) ([]TaskLogAttempt, error) {
+	logpath := store.logPath(jobID, taskID)
+	found, err := filepath.Glob(logpath + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	byAttempt := map[int]TaskLogAttempt{}
+	for _, filename := range found {
+		compressed := strings.HasSuffix(filename, ".gz")
+		plainName := strings.TrimSuffix(filename, ".gz")
+
+		attempt := 0
+		if plainName != logpath {
+			numbered := createNumberedPath(plainName)
+			if numbered.number < 1 || numbered.basepath != logpath {
+				continue
+			}
+			attempt = numbered.number
+		}
+
+		// The plain file is preferred over a compressed copy of it.
+		if existing, seen := byAttempt[attempt]; seen && !existing.Compressed {
+			continue
+		}
+
+		stat, err := os.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+		info := TaskLogAttempt{
+			Attempt:    attempt,
+			Size:       stat.Size(),
+			Compressed: compressed,
+			Modified:   stat.ModTime().UTC(),
+		}
+		if file, err := os.Open(filename); err == nil {
+			info.Started, info.Worker = readAttemptHeader(file, compressed)
+			file.Close()
+		}
+		byAttempt[attempt] = info
+	}
+
+	return sortedAttempts(byAttempt), nil
+}
+
+func (store *localTaskLogStore) Open(jobID, taskID bson.ObjectId, attempt int) (TaskLogReader, TaskLogAttempt, error) {
+	filename := taskLogAttemptFilename(store.logPath(jobID, taskID), attempt)
+	info := TaskLogAttempt{Attempt: attempt}
+
+	stat, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		// Attempt to access the gzipped file.
+		filename += ".gz"
+		stat, err = os.Stat(filename)
+		info.Compressed = true
+	}
+	if err != nil {
+		return nil, info, err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, info, err
+	}
+	info.Size = stat.Size()
+	info.Modified = stat.ModTime().UTC()
+	info.generation = store.countRotatedFiles(jobID, taskID)
+	return file, info, nil
+}
+
+// countRotatedFiles returns the number of rotated log files, which changes when the log is rotated.
+func (store *localTaskLogStore) countRotatedFiles(jobID, taskID bson.ObjectId) int {
+	logpath := store.logPath(jobID, taskID)
+	found, err := filepath.Glob(logpath + ".*")
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, filename := range found {
+		if createNumberedPath(strings.TrimSuffix(filename, ".gz")).number > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func (store *localTaskLogStore) Compressed(jobID, taskID bson.ObjectId) (io.ReadCloser, error) {
+	logpath := store.logPath(jobID, taskID)
+	logger := log.WithFields(log.Fields{
+		"job_id":   jobID.Hex(),
+		"task_id":  taskID.Hex(),
+		"filepath": logpath,
+	})
+
+	gzPath, err := store.compressFile(logpath, logger)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(gzPath)
+}
+
+// Compress the given file and return the compressed file's path.
+// If the compressed file already exists on disk and is newer than the original,
+// the original won't be recompressed.
+func (store *localTaskLogStore) compressFile(filepath string, logger *log.Entry) (string, error) {
+	gzPath := filepath + ".gz"
+	origStat, origErr := os.Stat(filepath)
+	gzStat, gzErr := os.Stat(gzPath)
+
+	if gzErr == nil && os.IsNotExist(origErr) {
+		// The original is gone, but the gzipped log file is still there.
+		logger.Debug("plain log file does not exist, but gzipped does")
+		return gzPath, nil
+	}
+	if origErr == nil && gzErr == nil && origStat.ModTime().Before(gzStat.ModTime()) {
+		// Both exist, and gzipped file is newer.
+		logger.Debug("plain and gzipped log file does not exist, gzipped is newer")
+		return gzPath, nil
+	}
+	if os.IsNotExist(origErr) {
+		// Original file does not exist, so just create a file that states this so that
+		// we at least have something to send to the Server. Otherwise the server will
+		// keep asking us for the log file indefinitely.
+		logger.Debug("requested log file does not exist")
+		err := ioutil.WriteFile(filepath, []byte(taskLogMissingText), 0777)
+		if err != nil {
+			logger.WithError(err).Error("unable to write 'the log file does not exist'")
+			return "", err
+		}
+		origStat, origErr = os.Stat(filepath)
+	}
+	if origErr != nil {
+		// Original cannot be accessed, and gzipped file is not there either.
+		logger.WithError(origErr).Debug("log file cannot be accessed, but it does exist")
+		return "", origErr
+	}
+
+	logger = logger.WithField("bytes_uncompressed", origStat.Size())
+	logger.Info("compressing logfile")
+
+	if _, err := gzipFile(filepath, gzPath); err != nil {
+		logger.WithError(err).Debug("unable to compress log file")
+		return "", err
+	}
+	return gzPath, nil
+}
+
+// gzipBytes returns the gzipped contents of the reader, for stores that do not keep
+// compressed logs around.
+func gzipBytes(reader io.Reader) (*bytes.Buffer, error) {
+	buffer := bytes.Buffer{}
+	gzWriter, err := gzip.NewWriterLevel(&buffer, 9)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(gzWriter, reader); err != nil {
+		return nil, err
+	}
+	if err := gzWriter.Close(); err != nil {
+		return nil, err
+	}
+	return &buffer, nil
+}
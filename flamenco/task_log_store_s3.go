@@ -0,0 +1,397 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// s3TaskLogStore stores task logs in an S3-compatible object storage. As objects cannot be
+// appended to, every write to a task log is stored as a separate chunk object:
+//
+//	{prefix}job-XXXX/{job ID}/task-{task ID}/attempt-{sequence}/chunk-{number}.txt
+//
+// Rotating a task log starts a new sequence number; the highest one is the current attempt.
+type s3TaskLogStore struct {
+	client *s3Client
+	prefix string
+
+	mutex sync.Mutex
+	// Task ID → where the next chunk of that task's log goes. Only the most recently
+	// used tasks are kept; the state of others is loaded from the listing again.
+	tasks     map[bson.ObjectId]*s3TaskLogState
+	recent    *list.List // Task IDs, most recently used first.
+	maxStates int
+}
+
+const (
+	// Number of tasks for which the store remembers the current attempt.
+	s3TaskLogMaxStates = 1000
+	// Number of bytes downloaded to read the attempt header from the first chunk.
+	s3AttemptHeaderMaxSize = 1024
+)
+
+// s3TaskLogState tracks the current attempt of one task; it is loaded from the object listing.
+type s3TaskLogState struct {
+	mutex sync.Mutex
+	// Both protected by the store's mutex.
+	users   int // Number of callers of taskState() that have not released the state yet.
+	element *list.Element
+
+	loaded    bool
+	sequence  int
+	nextChunk int
+	// Whether any chunk was written for the current sequence number.
+	hasChunks bool
+}
+
+// s3TaskLogAttempt is the list of chunks of one attempt.
+type s3TaskLogAttempt struct {
+	sequence int
+	chunks   []s3Object
+}
+
+func newS3TaskLogStore(config TaskLogStorageS3Config) (*s3TaskLogStore, error) {
+	client, err := newS3Client(config)
+	if err != nil {
+		return nil, err
+	}
+	return &s3TaskLogStore{
+		client:    client,
+		prefix:    config.Prefix,
+		tasks:     map[bson.ObjectId]*s3TaskLogState{},
+		recent:    list.New(),
+		maxStates: s3TaskLogMaxStates,
+	}, nil
+}
+
+// taskPrefix returns the key prefix of all chunks of the task log.
+func (store *s3TaskLogStore) taskPrefix(jobID, taskID bson.ObjectId) string {
+	jobHex := jobID.Hex()
+	if jobHex == "" {
+		jobHex = testTaskJobID.Hex()
+	}
+	return fmt.Sprintf("%sjob-%s/%s/task-%s/", store.prefix, jobHex[:4], jobHex, taskID.Hex())
+}
+
+func (store *s3TaskLogStore) chunkKey(jobID, taskID bson.ObjectId, sequence, chunk int) string {
+	return fmt.Sprintf("%sattempt-%06d/chunk-%08d.txt", store.taskPrefix(jobID, taskID), sequence, chunk)
+}
+
+// parseChunkKey returns the attempt sequence number and chunk number from a chunk key.
+func parseChunkKey(taskPrefix, key string) (sequence, chunk int, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(key, taskPrefix), "/")
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "attempt-") ||
+		!strings.HasPrefix(parts[1], "chunk-") || !strings.HasSuffix(parts[1], ".txt") {
+		return 0, 0, false
+	}
+	sequence, err := strconv.Atoi(strings.TrimPrefix(parts[0], "attempt-"))
+	if err != nil {
+		return 0, 0, false
+	}
+	chunk, err = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(parts[1], "chunk-"), ".txt"))
+	if err != nil {
+		return 0, 0, false
+	}
+	return sequence, chunk, true
+}
+
+// listAttempts returns the chunks of every attempt, current attempt first.
+func (store *s3TaskLogStore) listAttempts(jobID, taskID bson.ObjectId) ([]s3TaskLogAttempt, error) {
+	taskPrefix := store.taskPrefix(jobID, taskID)
+	objects, err := store.client.listObjects(taskPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	bySequence := map[int]*s3TaskLogAttempt{}
+	for _, object := range objects {
+		sequence, _, ok := parseChunkKey(taskPrefix, object.Key)
+		if !ok {
+			continue
+		}
+		attempt, found := bySequence[sequence]
+		if !found {
+			attempt = &s3TaskLogAttempt{sequence: sequence}
+			bySequence[sequence] = attempt
+		}
+		// The listing is sorted by key, so the chunks are in order.
+		attempt.chunks = append(attempt.chunks, object)
+	}
+
+	attempts := make([]s3TaskLogAttempt, 0, len(bySequence))
+	for _, attempt := range bySequence {
+		attempts = append(attempts, *attempt)
+	}
+	sort.Slice(attempts, func(i, j int) bool { return attempts[i].sequence > attempts[j].sequence })
+	return attempts, nil
+}
+
+// taskState returns the state of the task's current attempt, loading it when necessary.
+// The returned state is locked, and should be released by the caller with releaseState().
+func (store *s3TaskLogStore) taskState(jobID, taskID bson.ObjectId) (*s3TaskLogState, error) {
+	store.mutex.Lock()
+	state, found := store.tasks[taskID]
+	if found {
+		store.recent.MoveToFront(state.element)
+	} else {
+		state = &s3TaskLogState{element: store.recent.PushFront(taskID)}
+		store.tasks[taskID] = state
+		store.evictStates()
+	}
+	state.users++
+	store.mutex.Unlock()
+
+	state.mutex.Lock()
+	if state.loaded {
+		return state, nil
+	}
+
+	attempts, err := store.listAttempts(jobID, taskID)
+	if err != nil {
+		store.releaseState(state)
+		return nil, err
+	}
+	if len(attempts) > 0 {
+		current := attempts[0]
+		lastChunk := current.chunks[len(current.chunks)-1]
+		_, chunk, _ := parseChunkKey(store.taskPrefix(jobID, taskID), lastChunk.Key)
+		state.sequence = current.sequence
+		state.nextChunk = chunk + 1
+		state.hasChunks = true
+	}
+	state.loaded = true
+	return state, nil
+}
+
+// releaseState unlocks the state returned by taskState().
+func (store *s3TaskLogStore) releaseState(state *s3TaskLogState) {
+	state.mutex.Unlock()
+	store.mutex.Lock()
+	state.users--
+	store.mutex.Unlock()
+}
+
+// evictStates forgets the least recently used states, until at most maxStates are left.
+// States in use are kept, as forgetting them could make two callers write the same chunk.
+// The store's mutex should be locked by the caller.
+func (store *s3TaskLogStore) evictStates() {
+	element := store.recent.Back()
+	for len(store.tasks) > store.maxStates && element != nil {
+		previous := element.Prev()
+		taskID := element.Value.(bson.ObjectId)
+		if store.tasks[taskID].users == 0 {
+			store.recent.Remove(element)
+			delete(store.tasks, taskID)
+		}
+		element = previous
+	}
+}
+
+func (store *s3TaskLogStore) Append(jobID, taskID bson.ObjectId, text string) error {
+	state, err := store.taskState(jobID, taskID)
+	if err != nil {
+		return err
+	}
+	defer store.releaseState(state)
+
+	key := store.chunkKey(jobID, taskID, state.sequence, state.nextChunk)
+	if err := store.client.putObject(key, []byte(text)); err != nil {
+		return err
+	}
+	state.nextChunk++
+	state.hasChunks = true
+	return nil
+}
+
+func (store *s3TaskLogStore) Rotate(jobID, taskID bson.ObjectId) error {
+	state, err := store.taskState(jobID, taskID)
+	if err != nil {
+		return err
+	}
+	defer store.releaseState(state)
+
+	// Just like with log files, there is no need to rotate an empty log.
+	if !state.hasChunks {
+		return nil
+	}
+	state.sequence++
+	state.nextChunk = 0
+	state.hasChunks = false
+	return nil
+}
+
+func (store *s3TaskLogStore) Attempts(jobID, taskID bson.ObjectId) ([]TaskLogAttempt, error) {
+	attempts, err := store.listAttempts(jobID, taskID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]TaskLogAttempt, 0, len(attempts))
+	for index, attempt := range attempts {
+		info := attempt.info(index)
+		if header, err := store.client.getObject(attempt.chunks[0].Key, 0, s3AttemptHeaderMaxSize); err == nil {
+			info.Started, info.Worker = readAttemptHeader(bytes.NewReader(header), false)
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+func (store *s3TaskLogStore) Open(jobID, taskID bson.ObjectId, attempt int) (TaskLogReader, TaskLogAttempt, error) {
+	info := TaskLogAttempt{Attempt: attempt}
+	attempts, err := store.listAttempts(jobID, taskID)
+	if err != nil {
+		return nil, info, err
+	}
+	if attempt < 0 || attempt >= len(attempts) {
+		return nil, info, &os.PathError{Op: "open", Path: store.taskPrefix(jobID, taskID), Err: os.ErrNotExist}
+	}
+
+	info = attempts[attempt].info(attempt)
+	info.generation = attempts[0].sequence
+	reader := &s3ChunkReader{
+		client: store.client,
+		chunks: attempts[attempt].chunks,
+		size:   info.Size,
+	}
+	return reader, info, nil
+}
+
+func (store *s3TaskLogStore) Compressed(jobID, taskID bson.ObjectId) (io.ReadCloser, error) {
+	var contents io.Reader
+	reader, _, err := store.Open(jobID, taskID, 0)
+	switch {
+	case os.IsNotExist(err):
+		// Send something to the Server, otherwise it will keep asking for the log file.
+		contents = strings.NewReader(taskLogMissingText)
+	case err != nil:
+		return nil, err
+	default:
+		defer reader.Close()
+		contents = reader
+	}
+
+	buffer, err := gzipBytes(contents)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(buffer), nil
+}
+
+// info returns the description of this attempt, without header information.
+func (attempt s3TaskLogAttempt) info(attemptNumber int) TaskLogAttempt {
+	info := TaskLogAttempt{Attempt: attemptNumber}
+	for _, chunk := range attempt.chunks {
+		info.Size += chunk.Size
+		if chunk.LastModified.After(info.Modified) {
+			info.Modified = chunk.LastModified.UTC()
+		}
+	}
+	return info
+}
+
+// s3ChunkReader reads the chunks of a task log as if they were a single file.
+// Only one chunk is kept in memory at a time.
+type s3ChunkReader struct {
+	client *s3Client
+	chunks []s3Object
+	size   int64
+	offset int64
+
+	// The contents of the chunk that was read last, and its offset in the log.
+	chunkOffset int64
+	chunkData   []byte
+}
+
+func (reader *s3ChunkReader) Read(p []byte) (int, error) {
+	if reader.offset >= reader.size {
+		return 0, io.EOF
+	}
+
+	if reader.chunkData == nil || reader.offset < reader.chunkOffset ||
+		reader.offset >= reader.chunkOffset+int64(len(reader.chunkData)) {
+		if err := reader.loadChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	copied := copy(p, reader.chunkData[reader.offset-reader.chunkOffset:])
+	reader.offset += int64(copied)
+	return copied, nil
+}
+
+// loadChunk downloads the chunk that contains the current offset.
+func (reader *s3ChunkReader) loadChunk() error {
+	chunkOffset := int64(0)
+	for _, chunk := range reader.chunks {
+		if reader.offset < chunkOffset+chunk.Size {
+			data, err := reader.client.getObject(chunk.Key, 0, 0)
+			if err != nil {
+				return err
+			}
+			if int64(len(data)) != chunk.Size {
+				return fmt.Errorf("chunk %s has size %d, expected %d", chunk.Key, len(data), chunk.Size)
+			}
+			reader.chunkOffset = chunkOffset
+			reader.chunkData = data
+			return nil
+		}
+		chunkOffset += chunk.Size
+	}
+	return io.EOF
+}
+
+func (reader *s3ChunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += reader.offset
+	case io.SeekEnd:
+		offset += reader.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	reader.offset = offset
+	return offset, nil
+}
+
+func (reader *s3ChunkReader) Close() error {
+	reader.chunkData = nil
+	return nil
+}
@@ -24,105 +24,184 @@ package flamenco
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
-	"os"
-	"path"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
 // TaskLogUploader sends compressed task log files to Flamenco Server.
 //
-// The task IDs are queued first. If the tuple is already queued, queueing is a
-// no-op, even when uploading is already in progress. This allows the Server to
-// maintain the queue of to-be-uploaded task logs; we don't have to persist
-// anything to disk.
+// The Server asks for task logs in its response to task updates. Those requests are
+// stored in a queue in MongoDB, so that they survive restarts of the Manager. Queued
+// logs are uploaded in parallel, and failed uploads are retried with an increasing
+// delay. A queue entry is only removed when the Server has accepted the upload, when
+// the Server no longer knows the task, or when the Server keeps rejecting the upload.
 type TaskLogUploader struct {
 	closable
-	sync.RWMutex
-	config        *Conf
-	queue         chan JobTask
-	alreadyQueued map[JobTask]bool
-	upstream      *UpstreamConnection
+	sync.Mutex
+	config   *Conf
+	session  *mgo.Session
+	upstream *UpstreamConnection
+	logStore TaskLogStore
+
+	// Send anything here to check the queue for uploads now.
+	kickChan chan struct{}
+	// Task ID → progress of the upload of that task's log.
+	inProgress map[bson.ObjectId]*TaskLogUploadProgress
 }
 
-const taskLogUploadQueueSize = 1
+const (
+	taskLogUploadQueueCollection = "task_log_upload_queue"
+	taskLogUploadCheckInterval   = 10 * time.Second
+	taskLogUploadRetryMinDelay   = 30 * time.Second
+	taskLogUploadRetryMaxDelay   = 1 * time.Hour
+	taskLogUploadTimeout         = 10 * time.Minute
+
+	// Uploads the Server rejects are given up after this many attempts.
+	taskLogUploadMaxRejectedAttempts = 5
+)
+
+// Returned by uploadFile() when the Server doesn't know the task; retrying is pointless.
+var errTaskLogTaskGone = errors.New("server does not know this task")
+
+// taskLogRejectedError is returned by uploadFile() when the Server rejects the upload
+// with a 4xx status that is unlikely to change by retrying.
+type taskLogRejectedError struct {
+	statusCode int
+}
+
+func (e taskLogRejectedError) Error() string {
+	return fmt.Sprintf("server rejected the upload with status %d", e.statusCode)
+}
+
+// taskLogUpload is an entry in the task log upload queue.
+type taskLogUpload struct {
+	TaskID      bson.ObjectId `bson:"_id"`
+	JobID       bson.ObjectId `bson:"job"`
+	QueuedAt    time.Time     `bson:"queued_at"`
+	Attempts    int           `bson:"attempts"`
+	NextAttempt time.Time     `bson:"next_attempt"`
+	LastError   string        `bson:"last_error,omitempty"`
+}
+
+// TaskLogUploadProgress describes a task log that is being uploaded.
+type TaskLogUploadProgress struct {
+	JobID      bson.ObjectId `json:"job_id"`
+	TaskID     bson.ObjectId `json:"task_id"`
+	Attempt    int           `json:"attempt"` // 1 for the first attempt at uploading this log.
+	Started    time.Time     `json:"started"`
+	BytesSent  int64         `json:"bytes_sent"`
+	BytesTotal int64         `json:"bytes_total"`
+}
+
+// TaskLogUploadReport is part of a StatusReport and describes the task log upload queue.
+type TaskLogUploadReport struct {
+	Queued    int                     `json:"queued"`   // including the uploads in progress.
+	Retrying  int                     `json:"retrying"` // uploads that failed at least once.
+	LastError string                  `json:"last_error,omitempty"`
+	Uploading []TaskLogUploadProgress `json:"uploading"`
+}
 
 // CreateTaskLogUploader creates a new TaskLogUploader.
-func CreateTaskLogUploader(config *Conf, upstream *UpstreamConnection) *TaskLogUploader {
+func CreateTaskLogUploader(config *Conf, session *mgo.Session, upstream *UpstreamConnection,
+	logStore TaskLogStore) *TaskLogUploader {
 	tlu := TaskLogUploader{
-		closable:      makeClosable(),
-		config:        config,
-		queue:         make(chan JobTask, taskLogUploadQueueSize),
-		alreadyQueued: make(map[JobTask]bool),
-		upstream:      upstream,
+		closable:   makeClosable(),
+		config:     config,
+		session:    session,
+		upstream:   upstream,
+		logStore:   logStore,
+		kickChan:   make(chan struct{}, 1),
+		inProgress: map[bson.ObjectId]*TaskLogUploadProgress{},
 	}
 	return &tlu
 }
 
-func (tlu *TaskLogUploader) isAlreadyQueued(jobTask JobTask) bool {
-	tlu.RLock()
-	defer tlu.RUnlock()
-
-	return tlu.alreadyQueued[jobTask]
+func (tlu *TaskLogUploader) collection(db *mgo.Database) *mgo.Collection {
+	return db.C(taskLogUploadQueueCollection)
 }
 
-func (tlu *TaskLogUploader) markAlreadyQueued(jobTask JobTask) {
-	tlu.Lock()
-	defer tlu.Unlock()
+// EnsureDBIndices ensures the queue can be efficiently searched for uploads that are due.
+func (tlu *TaskLogUploader) EnsureDBIndices() {
+	session := tlu.session.Copy()
+	defer session.Close()
 
-	tlu.alreadyQueued[jobTask] = true
+	index := mgo.Index{
+		Key:        []string{"next_attempt"},
+		Background: true,
+		Name:       "due-uploads",
+	}
+	if err := tlu.collection(session.DB("")).EnsureIndex(index); err != nil {
+		log.WithError(err).Error("TaskLogUploader: unable to create index on upload queue")
+	}
 }
 
-func (tlu *TaskLogUploader) unmarkAlreadyQueued(jobTask JobTask) {
-	tlu.Lock()
-	defer tlu.Unlock()
+// QueueAll places all (Job ID, Task ID) tuples on the queue for uploading.
+// Tasks that are already queued keep their place and retry schedule.
+func (tlu *TaskLogUploader) QueueAll(jobTasks []JobTask) {
+	if len(jobTasks) == 0 {
+		return
+	}
 
-	delete(tlu.alreadyQueued, jobTask)
-}
+	session := tlu.session.Copy()
+	defer session.Close()
+	coll := tlu.collection(session.DB(""))
 
-// QueueAll places all (Job ID, Task ID) tuples on the queue for uploading later.
-// This function will keep getting called with tasks until those tasks have had
-// their logfile uploaded to the Server.
-func (tlu *TaskLogUploader) QueueAll(jobTasks []JobTask) {
+	now := time.Now().UTC()
+	queued := 0
 	for _, jobTask := range jobTasks {
-		if tlu.isAlreadyQueued(jobTask) {
-			log.WithFields(log.Fields{
-				"job_id":  jobTask.Job.Hex(),
-				"task_id": jobTask.Task.Hex(),
-			}).Debug("skipped already-queued task log upload request")
+		logger := log.WithFields(log.Fields{
+			"job_id":  jobTask.Job.Hex(),
+			"task_id": jobTask.Task.Hex(),
+		})
+		info, err := coll.UpsertId(jobTask.Task, M{"$setOnInsert": taskLogUpload{
+			TaskID:      jobTask.Task,
+			JobID:       jobTask.Job,
+			QueuedAt:    now,
+			NextAttempt: now,
+		}})
+		if err != nil {
+			logger.WithError(err).Error("TaskLogUploader: unable to queue task log upload")
 			continue
 		}
-		tlu.markAlreadyQueued(jobTask)
-
-		select {
-		case tlu.queue <- jobTask:
-			log.WithFields(log.Fields{
-				"job_id":  jobTask.Job.Hex(),
-				"task_id": jobTask.Task.Hex(),
-			}).Debug("queued request to upload task log")
-		default:
-			log.WithFields(log.Fields{
-				"received": len(jobTasks),
-				"queued":   taskLogUploadQueueSize,
-			}).Debug("received too many task upload requests, only handling a subset now")
-			return
+		if info.UpsertedId == nil {
+			logger.Debug("TaskLogUploader: skipped already-queued task log upload request")
+			continue
 		}
+		logger.Debug("TaskLogUploader: queued request to upload task log")
+		queued++
+	}
+
+	if queued > 0 {
+		tlu.kick()
+	}
+}
+
+// kick makes the uploader check the queue now; it never blocks.
+func (tlu *TaskLogUploader) kick() {
+	select {
+	case tlu.kickChan <- struct{}{}:
+	default:
 	}
 }
 
-// Close gracefully shuts down the task uploader goroutine.
+// Close gracefully shuts down the task uploader goroutine. Uploads in progress are
+// aborted, and retried after the Manager has started again.
 func (tlu *TaskLogUploader) Close() {
 	log.Debug("TaskLogUploader: Close() called.")
-	close(tlu.queue)
 	tlu.closableCloseAndWait()
 	log.Debug("TaskLogUploader: shutdown complete.")
 }
@@ -134,116 +213,179 @@ func (tlu *TaskLogUploader) Go() {
 		defer tlu.closableDone()
 		defer log.Info("TaskLogUploader: shutting down.")
 
-		for jobTask := range tlu.queue {
-			tlu.compressAndUpload(jobTask)
-			tlu.unmarkAlreadyQueued(jobTask)
+		session := tlu.session.Copy()
+		defer session.Close()
+		db := session.DB("")
+
+		// Abort uploads in progress when shutting down.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-tlu.doneChan
+			cancel()
+		}()
+
+		timer := Timer("TaskLogUploader", taskLogUploadCheckInterval, 0, &tlu.closable)
+		for {
+			select {
+			case _, ok := <-timer:
+				if !ok {
+					return
+				}
+			case <-tlu.kickChan:
+			}
+			tlu.startDueUploads(ctx, db)
 		}
 	}()
 }
 
-func (tlu *TaskLogUploader) compressAndUpload(jobTask JobTask) {
-	dirpath, filename := taskLogPath(jobTask.Job, jobTask.Task, tlu.config)
-	filepath := path.Join(dirpath, filename)
-
-	logger := log.WithFields(log.Fields{
-		"job_id":   jobTask.Job.Hex(),
-		"task_id":  jobTask.Task.Hex(),
-		"filepath": filepath,
-	})
+// startDueUploads starts uploading queued task logs that are due, for as far as the
+// maximum number of parallel uploads allows.
+func (tlu *TaskLogUploader) startDueUploads(ctx context.Context, db *mgo.Database) {
+	tlu.Lock()
+	defer tlu.Unlock()
 
-	filepath, err := tlu.compressFile(filepath, logger)
-	if err != nil {
-		logger.WithError(err).Error("unable to compress log file for uploading to Server")
+	if ctx.Err() != nil {
 		return
 	}
-
-	url, err := tlu.upstream.ResolveURL("/api/flamenco/managers/%s/attach-task-log/%s", tlu.config.ManagerID, jobTask.Task.Hex())
-	if err != nil {
-		logger.WithError(err).Error("unable to resolve URL to attach-task-log Server endpoint")
+	available := tlu.parallelism() - len(tlu.inProgress)
+	if available <= 0 {
 		return
 	}
-	logger = logger.WithFields(log.Fields{
-		"url":      url.String(),
-		"filepath": filepath,
-	})
-	tlu.uploadFile(jobTask.Task, filepath, url.String(), logger)
-}
 
-// Compress the given file and return the compressed file's path.
-// If the compressed file already exists on disk and is newer than the original,
-// the original won't be recompressed.
-func (tlu *TaskLogUploader) compressFile(filepath string, logger *log.Entry) (string, error) {
-	gzPath := filepath + ".gz"
-	origStat, origErr := os.Stat(filepath)
-	gzStat, gzErr := os.Stat(gzPath)
-
-	if gzErr == nil && os.IsNotExist(origErr) {
-		// The original is gone, but the gzipped log file is still there.
-		logger.Debug("plain log file does not exist, but gzipped does")
-		return gzPath, nil
+	uploading := make([]bson.ObjectId, 0, len(tlu.inProgress))
+	for taskID := range tlu.inProgress {
+		uploading = append(uploading, taskID)
 	}
-	if origErr == nil && gzErr == nil && origStat.ModTime().Before(gzStat.ModTime()) {
-		// Both exist, and gzipped file is newer.
-		logger.Debug("plain and gzipped log file does not exist, gzipped is newer")
-		return gzPath, nil
+
+	due := []taskLogUpload{}
+	err := tlu.collection(db).Find(M{
+		"_id":          M{"$nin": uploading},
+		"next_attempt": M{"$lte": time.Now().UTC()},
+	}).Sort("next_attempt").Limit(available).All(&due)
+	if err != nil {
+		log.WithError(err).Error("TaskLogUploader: unable to query upload queue")
+		return
 	}
-	if os.IsNotExist(origErr) {
-		// Original file does not exist, so just create a file that states this so that
-		// we at least have something to send to the Server. Otherwise the server will
-		// keep asking us for the log file indefinitely.
-		logger.Debug("requested log file does not exist")
-		err := ioutil.WriteFile(filepath, []byte("log file does not exist on Flamenco Manager"), 0777)
-		if err != nil {
-			logger.WithError(err).Error("unable to write 'the log file does not exist'")
-			return "", err
+
+	for _, upload := range due {
+		progress := &TaskLogUploadProgress{
+			JobID:   upload.JobID,
+			TaskID:  upload.TaskID,
+			Attempt: upload.Attempts + 1,
+			Started: time.Now().UTC(),
 		}
-		origStat, origErr = os.Stat(filepath)
+		tlu.inProgress[upload.TaskID] = progress
+
+		tlu.closableAdd(1)
+		go func(upload taskLogUpload) {
+			defer tlu.closableDone()
+			tlu.upload(ctx, upload, progress)
+		}(upload)
 	}
-	if origErr != nil {
-		// Original cannot be accessed, and gzipped file is not there either.
-		logger.WithError(origErr).Debug("log file cannot be accessed, but it does exist")
-		return "", origErr
+}
+
+func (tlu *TaskLogUploader) parallelism() int {
+	if tlu.config.TaskLogUploadParallelism < 1 {
+		return 1
 	}
+	return tlu.config.TaskLogUploadParallelism
+}
 
-	logger = logger.WithField("bytes_uncompressed", origStat.Size())
-	logger.Info("compressing logfile")
+// upload compresses and uploads a single task log, and updates the queue accordingly.
+func (tlu *TaskLogUploader) upload(ctx context.Context, upload taskLogUpload, progress *TaskLogUploadProgress) {
+	logger := log.WithFields(log.Fields{
+		"job_id":  upload.JobID.Hex(),
+		"task_id": upload.TaskID.Hex(),
+		"attempt": progress.Attempt,
+	})
 
-	origFile, err := os.Open(filepath)
-	if err != nil {
-		logger.WithError(err).Debug("unable to open logfile for reading")
-		return "", err
-	}
-	defer origFile.Close()
+	err := tlu.compressAndUpload(ctx, upload, progress, logger)
 
-	gzFile, err := os.Create(gzPath)
-	if err != nil {
-		logger.WithError(err).Debug("error creating compressed logfile for writing")
-		return "", err
+	session := tlu.session.Copy()
+	defer session.Close()
+	coll := tlu.collection(session.DB(""))
+
+	_, rejected := err.(taskLogRejectedError)
+	switch {
+	case err == nil:
+		if err := coll.RemoveId(upload.TaskID); err != nil && err != mgo.ErrNotFound {
+			logger.WithError(err).Error("TaskLogUploader: unable to remove uploaded task log from queue")
+		}
+	case ctx.Err() != nil:
+		// Aborted by Close(); leave the queue entry alone so it's uploaded after a restart.
+		logger.Debug("TaskLogUploader: upload aborted by shutdown")
+	case err == errTaskLogTaskGone:
+		logger.Info("TaskLogUploader: Server does not know the task, removing task log from upload queue")
+		if err := coll.RemoveId(upload.TaskID); err != nil && err != mgo.ErrNotFound {
+			logger.WithError(err).Error("TaskLogUploader: unable to remove task log from queue")
+		}
+	case rejected && progress.Attempt >= taskLogUploadMaxRejectedAttempts:
+		logger.WithError(err).Error("TaskLogUploader: Server keeps rejecting task log, removing it from upload queue")
+		if err := coll.RemoveId(upload.TaskID); err != nil && err != mgo.ErrNotFound {
+			logger.WithError(err).Error("TaskLogUploader: unable to remove task log from queue")
+		}
+	default:
+		delay := taskLogUploadRetryDelay(progress.Attempt)
+		logger.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"retry_in":   delay,
+		}).Warning("TaskLogUploader: unable to upload task log, will retry later")
+
+		update := M{
+			"$inc": M{"attempts": 1},
+			"$set": M{
+				"next_attempt": time.Now().Add(delay).UTC(),
+				"last_error":   err.Error(),
+			},
+		}
+		if err := coll.UpdateId(upload.TaskID, update); err != nil && err != mgo.ErrNotFound {
+			logger.WithError(err).Error("TaskLogUploader: unable to reschedule task log upload")
+		}
 	}
-	defer gzFile.Close()
 
-	gzWriter, err := gzip.NewWriterLevel(gzFile, 9)
-	if err != nil {
-		logger.WithError(err).Debug("unable to create GZip writer")
-		return "", err
+	tlu.Lock()
+	delete(tlu.inProgress, upload.TaskID)
+	tlu.Unlock()
+
+	// There is room for another upload now.
+	tlu.kick()
+}
+
+// taskLogUploadRetryDelay returns how long to wait before retrying after the given
+// number of failed attempts. The delay doubles with each failure, up to a maximum.
+func taskLogUploadRetryDelay(failedAttempts int) time.Duration {
+	delay := taskLogUploadRetryMinDelay
+	for attempt := 1; attempt < failedAttempts; attempt++ {
+		delay *= 2
+		if delay >= taskLogUploadRetryMaxDelay {
+			return taskLogUploadRetryMaxDelay
+		}
 	}
-	defer gzWriter.Close()
+	return delay
+}
 
-	_, err = io.Copy(gzWriter, origFile)
+func (tlu *TaskLogUploader) compressAndUpload(ctx context.Context, upload taskLogUpload,
+	progress *TaskLogUploadProgress, logger *log.Entry) error {
+
+	compressed, err := tlu.logStore.Compressed(upload.JobID, upload.TaskID)
 	if err != nil {
-		logger.WithError(err).Debug("error copying bytes from plain to gzipped log")
-		return "", err
+		return fmt.Errorf("unable to compress log file for uploading to Server: %v", err)
 	}
-	return gzPath, nil
-}
+	defer compressed.Close()
 
-func (tlu *TaskLogUploader) uploadFile(taskID bson.ObjectId, filepath string, url string, logger *log.Entry) {
-	fileReader, err := os.Open(filepath)
+	url, err := tlu.upstream.ResolveURL("/api/flamenco/managers/%s/attach-task-log/%s", tlu.config.ManagerID, upload.TaskID.Hex())
 	if err != nil {
-		logger.WithError(err).Error("unable to open compressed log file for uploading")
-		return
+		return fmt.Errorf("unable to resolve URL to attach-task-log Server endpoint: %v", err)
 	}
+	logger = logger.WithField("url", url.String())
+	return tlu.uploadFile(ctx, upload.TaskID, compressed, url.String(), progress, logger)
+}
 
+// uploadFile sends the already-compressed task log to the Server.
+// It returns an error unless the Server accepted the upload.
+func (tlu *TaskLogUploader) uploadFile(ctx context.Context, taskID bson.ObjectId, fileReader io.Reader,
+	url string, progress *TaskLogUploadProgress, logger *log.Entry) error {
 	// Read the compressed file into memory to construct the multipart/form body.
 	var b bytes.Buffer
 	w := multipart.NewWriter(&b)
@@ -253,46 +395,116 @@ func (tlu *TaskLogUploader) uploadFile(taskID bson.ObjectId, filepath string, ur
 	header.Set("Content-Type", "text/plain+gzip")
 	fieldwriter, err := w.CreatePart(header)
 	if err != nil {
-		logger.WithError(err).Error("unable to create multipart/form field writer")
-		return
+		return fmt.Errorf("unable to create multipart/form field writer: %v", err)
 	}
 	if _, err := io.Copy(fieldwriter, fileReader); err != nil {
-		logger.WithError(err).Error("unable to read compressed log file")
-		return
+		return fmt.Errorf("unable to read compressed log file: %v", err)
 	}
 	w.Close()
 
-	req, err := http.NewRequest("POST", url, &b)
+	bodySize := int64(b.Len())
+	atomic.StoreInt64(&progress.BytesTotal, bodySize)
+	body := &progressReader{reader: &b, progress: &progress.BytesSent}
+
+	req, err := http.NewRequest("POST", url, body)
 	if err != nil {
-		logger.WithError(err).Error("unable to create POST request")
-		return
+		return fmt.Errorf("unable to create POST request: %v", err)
 	}
+	req = req.WithContext(ctx)
+	req.ContentLength = bodySize
 	req.SetBasicAuth(tlu.config.ManagerSecret, "")
 	req.Header.Set("Content-Type", w.FormDataContentType())
 
 	logger.Info("uploading task log")
-	client := &http.Client{}
+	client := &http.Client{Timeout: taskLogUploadTimeout}
 	resp, err := client.Do(req)
 	if err != nil {
-		logger.WithError(err).Error("error uploading task log file")
-		return
+		return fmt.Errorf("error uploading task log file: %v", err)
 	}
 	logger = logger.WithField("http_status", resp.StatusCode)
 
-	body, err := ioutil.ReadAll(resp.Body)
+	respBody, err := ioutil.ReadAll(resp.Body)
 	defer resp.Body.Close()
 	if err != nil {
-		logger.WithError(err).Warning("error reading response to uploaded task log file")
-		return
+		return fmt.Errorf("error reading response to uploaded task log file: %v", err)
 	}
 
-	if resp.StatusCode >= 300 {
-		if resp.StatusCode != 404 {
-			logger = logger.WithField("body", string(body))
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		logger.Warning("server does not know the task of the uploaded task log file")
+		return errTaskLogTaskGone
+	case resp.StatusCode >= 300:
+		logger.WithField("body", string(respBody)).Warning("received error response from server after uploading task log file")
+		if isPermanentUploadRejection(resp.StatusCode) {
+			return taskLogRejectedError{resp.StatusCode}
 		}
-		logger.Warning("received error response from server after uploading task log file")
-		return
+		return fmt.Errorf("server responded with status %d", resp.StatusCode)
 	}
 
 	logger.Info("task log file uploaded succesfully")
+	return nil
+}
+
+// progressReader counts the bytes read from the reader.
+type progressReader struct {
+	reader   io.Reader
+	progress *int64
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.reader.Read(p)
+	atomic.AddInt64(pr.progress, int64(n))
+	return n, err
+}
+
+// Report returns the state of the upload queue, for showing on the dashboard.
+func (tlu *TaskLogUploader) Report(db *mgo.Database) (*TaskLogUploadReport, error) {
+	coll := tlu.collection(db)
+	report := TaskLogUploadReport{Uploading: []TaskLogUploadProgress{}}
+
+	var err error
+	if report.Queued, err = coll.Count(); err != nil {
+		return nil, err
+	}
+	if report.Retrying, err = coll.Find(M{"attempts": M{"$gt": 0}}).Count(); err != nil {
+		return nil, err
+	}
+
+	lastFailed := taskLogUpload{}
+	err = coll.Find(M{"attempts": M{"$gt": 0}}).Sort("-next_attempt").One(&lastFailed)
+	switch err {
+	case nil:
+		report.LastError = lastFailed.LastError
+	case mgo.ErrNotFound:
+	default:
+		return nil, err
+	}
+
+	tlu.Lock()
+	for _, progress := range tlu.inProgress {
+		report.Uploading = append(report.Uploading, TaskLogUploadProgress{
+			JobID:      progress.JobID,
+			TaskID:     progress.TaskID,
+			Attempt:    progress.Attempt,
+			Started:    progress.Started,
+			BytesSent:  atomic.LoadInt64(&progress.BytesSent),
+			BytesTotal: atomic.LoadInt64(&progress.BytesTotal),
+		})
+	}
+	tlu.Unlock()
+
+	sort.Slice(report.Uploading, func(i, j int) bool {
+		return report.Uploading[i].Started.Before(report.Uploading[j].Started)
+	})
+	return &report, nil
+}
+
+// isPermanentUploadRejection returns whether retrying an upload won't change the Server's
+// response. Authentication problems are excluded, as those are fixed in the configuration.
+func isPermanentUploadRejection(statusCode int) bool {
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return statusCode >= 400 && statusCode < 500
 }
@@ -25,6 +25,7 @@ package flamenco
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -47,6 +48,7 @@ type TaskLogUploaderTestSuite struct {
 	session         *mgo.Session
 	upstream        *UpstreamConnection
 	taskLogUploader *TaskLogUploader
+	logStore        *localTaskLogStore
 }
 
 var _ = check.Suite(&TaskLogUploaderTestSuite{})
@@ -64,7 +66,8 @@ func (s *TaskLogUploaderTestSuite) SetUpTest(c *check.C) {
 	s.config.TaskLogsPath = taskLogsPath
 
 	s.upstream = ConnectUpstream(&s.config, s.session)
-	s.taskLogUploader = CreateTaskLogUploader(&s.config, s.upstream)
+	s.logStore = newLocalTaskLogStore(&s.config)
+	s.taskLogUploader = CreateTaskLogUploader(&s.config, s.session, s.upstream, s.logStore)
 }
 
 func (s *TaskLogUploaderTestSuite) TearDownTest(c *check.C) {
@@ -82,7 +85,7 @@ func (s *TaskLogUploaderTestSuite) TestCompressFile(t *check.C) {
 	err := ioutil.WriteFile(fname, payload, 0666)
 	assert.Nil(t, err)
 
-	gzPath, err := s.taskLogUploader.compressFile(fname, log.WithField("filepath", fname))
+	gzPath, err := s.logStore.compressFile(fname, log.WithField("filepath", fname))
 	assert.Nil(t, err)
 	assert.Equal(t, fname+".gz", gzPath)
 
@@ -113,7 +116,7 @@ func (s *TaskLogUploaderTestSuite) TestNoRecompressFile(t *check.C) {
 	err = ioutil.WriteFile(fname+".gz", gzPayload, 0666)
 	assert.Nil(t, err)
 
-	gzPath, err := s.taskLogUploader.compressFile(fname, log.WithField("filepath", fname))
+	gzPath, err := s.logStore.compressFile(fname, log.WithField("filepath", fname))
 	assert.Nil(t, err)
 	assert.Equal(t, fname+".gz", gzPath)
 
@@ -131,7 +134,7 @@ func (s *TaskLogUploaderTestSuite) TestCompressNoOriginalFile(t *check.C) {
 	err := ioutil.WriteFile(fname+".gz", gzPayload, 0666)
 	assert.Nil(t, err)
 
-	gzPath, err := s.taskLogUploader.compressFile(fname, log.WithField("filepath", fname))
+	gzPath, err := s.logStore.compressFile(fname, log.WithField("filepath", fname))
 	assert.Nil(t, err)
 	assert.Equal(t, fname+".gz", gzPath)
 
@@ -144,7 +147,7 @@ func (s *TaskLogUploaderTestSuite) TestCompressNoOriginalFile(t *check.C) {
 func (s *TaskLogUploaderTestSuite) TestCompressNoFile(t *check.C) {
 	fname := path.Join(s.config.TaskLogsPath, "testfile.txt")
 
-	gzPath, err := s.taskLogUploader.compressFile(fname, log.WithField("filepath", fname))
+	gzPath, err := s.logStore.compressFile(fname, log.WithField("filepath", fname))
 	assert.Nil(t, err)
 	assert.Equal(t, fname+".gz", gzPath)
 
@@ -192,6 +195,194 @@ func (s *TaskLogUploaderTestSuite) TestUploadFile(t *check.C) {
 		},
 	)
 
-	s.taskLogUploader.uploadFile(bson.NewObjectId(), fname, "http://localhost:51234/the-url", log.WithField("unit", "test"))
+	fileReader, err := os.Open(fname)
+	assert.Nil(t, err)
+	defer fileReader.Close()
+
+	progress := TaskLogUploadProgress{}
+	err = s.taskLogUploader.uploadFile(context.Background(), bson.NewObjectId(), fileReader,
+		"http://localhost:51234/the-url", &progress, log.WithField("unit", "test"))
+	assert.Nil(t, err)
 	assert.True(t, requestMade)
+	assert.True(t, progress.BytesTotal > int64(len(payload)))
+	assert.Equal(t, progress.BytesTotal, progress.BytesSent)
+}
+
+func (s *TaskLogUploaderTestSuite) attachURL(taskID bson.ObjectId) string {
+	return "http://localhost:51234/api/flamenco/managers/" + s.config.ManagerID + "/attach-task-log/" + taskID.Hex()
+}
+
+func (s *TaskLogUploaderTestSuite) queuedUploads(t *check.C) []taskLogUpload {
+	queued := []taskLogUpload{}
+	assert.Nil(t, s.taskLogUploader.collection(s.session.DB("")).Find(nil).Sort("_id").All(&queued))
+	return queued
+}
+
+func (s *TaskLogUploaderTestSuite) TestQueueAll(t *check.C) {
+	jobTasks := []JobTask{
+		{Job: bson.NewObjectId(), Task: bson.NewObjectId()},
+		{Job: bson.NewObjectId(), Task: bson.NewObjectId()},
+	}
+	s.taskLogUploader.QueueAll(jobTasks)
+
+	// Queueing again should not reset the retry schedule.
+	coll := s.taskLogUploader.collection(s.session.DB(""))
+	assert.Nil(t, coll.UpdateId(jobTasks[0].Task, M{"$set": M{"attempts": 3}}))
+	s.taskLogUploader.QueueAll(jobTasks)
+
+	queued := s.queuedUploads(t)
+	if assert.Len(t, queued, 2) {
+		assert.Equal(t, jobTasks[0].Task, queued[0].TaskID)
+		assert.Equal(t, jobTasks[0].Job, queued[0].JobID)
+		assert.Equal(t, 3, queued[0].Attempts)
+		assert.Equal(t, 0, queued[1].Attempts)
+	}
+}
+
+func (s *TaskLogUploaderTestSuite) TestUploadAcknowledged(t *check.C) {
+	jobTask := JobTask{Job: bson.NewObjectId(), Task: bson.NewObjectId()}
+	s.taskLogUploader.QueueAll([]JobTask{jobTask})
+	httpmock.RegisterResponder("POST", s.attachURL(jobTask.Task), httpmock.NewBytesResponder(204, nil))
+
+	upload := s.queuedUploads(t)[0]
+	s.taskLogUploader.upload(context.Background(), upload, &TaskLogUploadProgress{Attempt: 1})
+
+	assert.Equal(t, 1, httpmock.GetTotalCallCount())
+	assert.Empty(t, s.queuedUploads(t))
+}
+
+func (s *TaskLogUploaderTestSuite) TestUploadFailureIsRetried(t *check.C) {
+	jobTask := JobTask{Job: bson.NewObjectId(), Task: bson.NewObjectId()}
+	s.taskLogUploader.QueueAll([]JobTask{jobTask})
+	httpmock.RegisterResponder("POST", s.attachURL(jobTask.Task), httpmock.NewStringResponder(502, "bad gateway"))
+
+	upload := s.queuedUploads(t)[0]
+	s.taskLogUploader.upload(context.Background(), upload, &TaskLogUploadProgress{Attempt: 1})
+
+	queued := s.queuedUploads(t)
+	if assert.Len(t, queued, 1) {
+		assert.Equal(t, 1, queued[0].Attempts)
+		assert.Contains(t, queued[0].LastError, "502")
+		assert.True(t, queued[0].NextAttempt.After(time.Now().Add(taskLogUploadRetryMinDelay/2)))
+	}
+
+	report, err := s.taskLogUploader.Report(s.session.DB(""))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Queued)
+	assert.Equal(t, 1, report.Retrying)
+	assert.Contains(t, report.LastError, "502")
+	assert.Empty(t, report.Uploading)
+}
+
+func (s *TaskLogUploaderTestSuite) TestUploadUnknownTaskIsDropped(t *check.C) {
+	jobTasks := []JobTask{
+		{Job: bson.NewObjectId(), Task: bson.NewObjectId()},
+		{Job: bson.NewObjectId(), Task: bson.NewObjectId()},
+	}
+	s.taskLogUploader.QueueAll(jobTasks)
+	httpmock.RegisterResponder("POST", s.attachURL(jobTasks[0].Task), httpmock.NewStringResponder(404, "not found"))
+	httpmock.RegisterResponder("POST", s.attachURL(jobTasks[1].Task), httpmock.NewStringResponder(410, "gone"))
+
+	for _, upload := range s.queuedUploads(t) {
+		s.taskLogUploader.upload(context.Background(), upload, &TaskLogUploadProgress{Attempt: 1})
+	}
+
+	assert.Equal(t, 2, httpmock.GetTotalCallCount())
+	assert.Empty(t, s.queuedUploads(t))
+}
+
+func (s *TaskLogUploaderTestSuite) TestUploadRejectedIsDropped(t *check.C) {
+	jobTask := JobTask{Job: bson.NewObjectId(), Task: bson.NewObjectId()}
+	s.taskLogUploader.QueueAll([]JobTask{jobTask})
+	httpmock.RegisterResponder("POST", s.attachURL(jobTask.Task), httpmock.NewStringResponder(413, "too large"))
+
+	// Rejected uploads are retried a few times.
+	upload := s.queuedUploads(t)[0]
+	s.taskLogUploader.upload(context.Background(), upload, &TaskLogUploadProgress{Attempt: 1})
+	queued := s.queuedUploads(t)
+	if assert.Len(t, queued, 1) {
+		assert.Contains(t, queued[0].LastError, "413")
+	}
+
+	s.taskLogUploader.upload(context.Background(), upload,
+		&TaskLogUploadProgress{Attempt: taskLogUploadMaxRejectedAttempts})
+	assert.Empty(t, s.queuedUploads(t))
+}
+
+func (s *TaskLogUploaderTestSuite) TestUploadAbortedIsKept(t *check.C) {
+	jobTask := JobTask{Job: bson.NewObjectId(), Task: bson.NewObjectId()}
+	s.taskLogUploader.QueueAll([]JobTask{jobTask})
+	upload := s.queuedUploads(t)[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	httpmock.RegisterResponder("POST", s.attachURL(jobTask.Task), func(req *http.Request) (*http.Response, error) {
+		cancel()
+		return nil, ctx.Err()
+	})
+	s.taskLogUploader.upload(ctx, upload, &TaskLogUploadProgress{Attempt: 1})
+
+	assert.Equal(t, []taskLogUpload{upload}, s.queuedUploads(t))
+}
+
+func (s *TaskLogUploaderTestSuite) TestStartDueUploads(t *check.C) {
+	s.config.TaskLogUploadParallelism = 2
+	jobTasks := []JobTask{
+		{Job: bson.NewObjectId(), Task: bson.NewObjectId()},
+		{Job: bson.NewObjectId(), Task: bson.NewObjectId()},
+		{Job: bson.NewObjectId(), Task: bson.NewObjectId()},
+	}
+	s.taskLogUploader.QueueAll(jobTasks)
+
+	// Block the uploads until the test has inspected the uploads in progress.
+	release := make(chan struct{})
+	httpmock.RegisterNoResponder(func(req *http.Request) (*http.Response, error) {
+		<-release
+		return httpmock.NewBytesResponse(204, nil), nil
+	})
+
+	s.taskLogUploader.startDueUploads(context.Background(), s.session.DB(""))
+	report, err := s.taskLogUploader.Report(s.session.DB(""))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Queued)
+	assert.Len(t, report.Uploading, 2, "parallelism should be limited")
+
+	close(release)
+	s.taskLogUploader.closableCloseAndWait()
+	assert.Len(t, s.queuedUploads(t), 1)
+}
+
+type TaskLogUploadRetryTestSuite struct{}
+
+var _ = check.Suite(&TaskLogUploadRetryTestSuite{})
+
+func (s *TaskLogUploadRetryTestSuite) TestPermanentUploadRejection(t *check.C) {
+	assert.True(t, isPermanentUploadRejection(http.StatusBadRequest))
+	assert.True(t, isPermanentUploadRejection(http.StatusRequestEntityTooLarge))
+	assert.False(t, isPermanentUploadRejection(http.StatusForbidden))
+	assert.False(t, isPermanentUploadRejection(http.StatusTooManyRequests))
+	assert.False(t, isPermanentUploadRejection(http.StatusBadGateway))
+}
+
+func (s *TaskLogUploadRetryTestSuite) TestRetryDelay(t *check.C) {
+	assert.Equal(t, 30*time.Second, taskLogUploadRetryDelay(0))
+	assert.Equal(t, 30*time.Second, taskLogUploadRetryDelay(1))
+	assert.Equal(t, 1*time.Minute, taskLogUploadRetryDelay(2))
+	assert.Equal(t, 4*time.Minute, taskLogUploadRetryDelay(4))
+	assert.Equal(t, 1*time.Hour, taskLogUploadRetryDelay(8))
+	assert.Equal(t, 1*time.Hour, taskLogUploadRetryDelay(1000))
+}
+
+func (s *TaskLogUploadRetryTestSuite) TestProgressReader(t *check.C) {
+	var progress int64
+	reader := &progressReader{reader: bytes.NewReader(make([]byte, 1500)), progress: &progress}
+
+	buf := make([]byte, 1000)
+	n, err := reader.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, n)
+	assert.Equal(t, int64(1000), progress)
+
+	_, err = ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1500), progress)
 }
@@ -26,12 +26,12 @@ package flamenco
 import (
 	"fmt"
 	"net/http"
-	"os"
 	"path"
 	"strings"
 	"time"
 
 	auth "github.com/abbot/go-http-auth"
+	"github.com/armadillica/flamenco-manager/flamenco/chantools"
 	log "github.com/sirupsen/logrus"
 
 	mgo "gopkg.in/mgo.v2"
@@ -42,6 +42,9 @@ const (
 	queueMgoCollection      = "task_update_queue"
 	taskQueueInspectPeriod  = 1 * time.Second
 	taskQueueRetainLogLines = 10 // How many lines of logging are sent to the server.
+
+	// Number of "log was written" notifications that can be queued for followers of task logs.
+	taskLogNotificationQueueSize = 100
 )
 
 // In the specific case where the Server asks us to cancel a task we know nothing about,
@@ -65,15 +68,31 @@ type TaskUpdatePusher struct {
 
 // TaskUpdateQueue queues task updates for later pushing, and writes log files to disk.
 type TaskUpdateQueue struct {
-	config    *Conf
-	blacklist *WorkerBlacklist
+	config     *Conf
+	blacklist  *WorkerBlacklist
+	quarantine *WorkerQuarantine
+	classifier *failureClassifier
+	logIndex   *TaskLogIndex
+	logStore   TaskLogStore
+
+	// Receives the hex ID of a task whenever its log file was written to.
+	logWritten     chan string
+	logBroadcaster *chantools.OneToManyChan
 }
 
 // CreateTaskUpdateQueue creates a new TaskUpdateQueue.
-func CreateTaskUpdateQueue(config *Conf, blacklist *WorkerBlacklist) *TaskUpdateQueue {
+func CreateTaskUpdateQueue(config *Conf, blacklist *WorkerBlacklist, quarantine *WorkerQuarantine,
+	logIndex *TaskLogIndex, logStore TaskLogStore) *TaskUpdateQueue {
+	logWritten := make(chan string, taskLogNotificationQueueSize)
 	tuq := TaskUpdateQueue{
 		config,
 		blacklist,
+		quarantine,
+		newFailureClassifier(config.FailureClasses),
+		logIndex,
+		logStore,
+		logWritten,
+		chantools.NewOneToManyChan(logWritten),
 	}
 	return &tuq
 }
@@ -88,7 +107,7 @@ func (tuq *TaskUpdateQueue) QueueTaskUpdateFromWorker(w http.ResponseWriter, r *
 	}
 
 	// Get the worker
-	worker, err := FindWorker(r.Username, bson.M{"address": 1, "nickname": 1}, db)
+	worker, err := FindWorker(r.Username, bson.M{"address": 1, "nickname": 1, "status": 1, "quarantine": 1}, db)
 	if err != nil {
 		log.WithFields(logFields).WithError(err).Warning("QueueTaskUpdate: Unable to find worker")
 		w.WriteHeader(http.StatusForbidden)
@@ -123,7 +142,7 @@ func (tuq *TaskUpdateQueue) QueueTaskUpdateFromWorker(w http.ResponseWriter, r *
 		logFields["current_task_worker_id"] = task.WorkerID.Hex()
 	}
 
-	if task.WorkerID != nil && *task.WorkerID != worker.ID {
+	if task.WorkerID != nil && *task.WorkerID != worker.ID && !task.isSpeculativeFor(worker.ID) {
 		log.WithFields(logFields).Warning("QueueTaskUpdateFromWorker: task update rejected, task belongs to other worker")
 		w.WriteHeader(http.StatusConflict)
 		fmt.Fprintf(w, "Task %s is assigned to another worker.", taskID.Hex())
@@ -139,14 +158,39 @@ func (tuq *TaskUpdateQueue) QueueTaskUpdateFromWorker(w http.ResponseWriter, r *
 		log.WithFields(logFields).Debug("QueueTaskUpdateFromWorker: task has non-runnable status, ignoring new task status & activity")
 	}
 
-	// Handle blacklisting and soft-failing before actually queueing this task update.
+	// handleSpeculativeUpdate clears the status of a failed speculative duplicate,
+	// so check for that before it runs.
+	speculativeFailure := task.isSpeculativeFor(worker.ID) && tupdate.TaskStatus == statusFailed
 	extraUpdates := bson.M{}
-	switch tupdate.TaskStatus {
-	case statusFailed:
-		tuq.onTaskFailed(&task, &tupdate, db, extraUpdates)
+	if task.SpeculativeWorkerID != nil {
+		tuq.handleSpeculativeUpdate(worker, &task, &tupdate, extraUpdates)
 	}
 
-	tupdate.isManagerLocal = task.isManagerLocalTask()
+	// Handle blacklisting and soft-failing before actually queueing this task update.
+	// Failures are always held against the worker that reported them, which is not
+	// task.WorkerID when a speculative duplicate fails.
+	switch {
+	case speculativeFailure:
+		// The task keeps running on its original worker, so only the duplicate's worker is blamed.
+		rule := tuq.classifyFailure(worker, &task, &tupdate, db)
+		if rule == nil || !rule.SkipBlacklist {
+			tuq.maybeBlacklistWorker(worker, &task, db)
+			tuq.quarantine.RecordTaskOutcome(worker, &task, true, db)
+		}
+	case tupdate.TaskStatus == statusFailed:
+		rule := tuq.classifyFailure(worker, &task, &tupdate, db)
+		storeFailureClass(&task, rule, extraUpdates)
+		blameWorker := rule == nil || !rule.SkipBlacklist
+		tuq.onTaskFailed(worker, &task, &tupdate, blameWorker, db, extraUpdates)
+		if blameWorker {
+			tuq.quarantine.RecordTaskOutcome(worker, &task, true, db)
+		}
+	case tupdate.TaskStatus == statusCompleted:
+		tuq.blacklist.EndProbation(worker.ID, &task)
+		tuq.quarantine.RecordTaskOutcome(worker, &task, false, db)
+	}
+
+	tupdate.isManagerLocal = tupdate.isManagerLocal || task.isManagerLocalTask()
 	if err := tuq.QueueTaskUpdateWithExtra(&task, &tupdate, db, extraUpdates); err != nil {
 		log.WithFields(logFields).WithError(err).Warning("QueueTaskUpdateFromWorker: unable to update task")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -157,11 +201,52 @@ func (tuq *TaskUpdateQueue) QueueTaskUpdateFromWorker(w http.ResponseWriter, r *
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// classifyFailure determines the failure class from the log of the failing task, and stores it
+// on the worker that reported the failure. Returns the matching rule, or nil if there is none.
+func (tuq *TaskUpdateQueue) classifyFailure(worker *Worker, task *Task, tupdate *TaskUpdate, db *mgo.Database) *FailureClassRule {
+	rule := tuq.classifier.classify(tupdate.Log)
+	if rule == nil {
+		return nil
+	}
+
+	logger := log.WithFields(log.Fields{
+		"task_id":       task.ID.Hex(),
+		"worker":        worker.Identifier(),
+		"failure_class": rule.Class,
+	})
+	logger.Info("classified task failure")
+
+	err := db.C("flamenco_workers").UpdateId(worker.ID, M{
+		"$set": M{"current_task_failure_class": rule.Class},
+	})
+	if err != nil {
+		logger.WithError(err).Error("unable to store failure class on worker")
+	}
+	return rule
+}
+
+// storeFailureClass stores the failure class of the rule on the task, or clears it when rule is nil.
+func storeFailureClass(task *Task, rule *FailureClassRule, extraUpdates bson.M) {
+	if rule == nil {
+		GetOrCreateMap(extraUpdates, "$unset")["failure_class"] = true
+		return
+	}
+	task.FailureClass = rule.Class
+	GetOrCreateMap(extraUpdates, "$set")["failure_class"] = rule.Class
+}
+
 // Handle task failure on the worker.
 // This function decides whether a task is soft- or hard-failed, and deals with blacklisting.
-func (tuq *TaskUpdateQueue) onTaskFailed(task *Task, tupdate *TaskUpdate, db *mgo.Database, extraUpdates bson.M) {
-	workersLeft := tuq.maybeBlacklistWorker(task, tupdate, db)
-	tuq.addWorkerToFailedList(task, tupdate, db, extraUpdates)
+// When blameWorker is false, the failure is not held against the worker and it is never blacklisted.
+func (tuq *TaskUpdateQueue) onTaskFailed(worker *Worker, task *Task, tupdate *TaskUpdate, blameWorker bool, db *mgo.Database, extraUpdates bson.M) {
+	var workersLeft map[bson.ObjectId]bool
+	if blameWorker {
+		workersLeft = tuq.maybeBlacklistWorker(worker, task, db)
+	} else {
+		workersLeft = tuq.blacklist.WorkersLeft(task.Job, task.TaskType)
+		delete(workersLeft, worker.ID)
+	}
+	tuq.addWorkerToFailedList(worker, task, tupdate, extraUpdates)
 
 	logger := log.WithFields(log.Fields{
 		"task_id": task.ID.Hex(),
@@ -251,6 +336,7 @@ func (tuq *TaskUpdateQueue) QueueTaskUpdateWithExtra(task *Task, tupdate *TaskUp
 	if err := tuq.writeTaskLog(task, logToWrite); err != nil {
 		return err
 	}
+	tuq.logIndex.IndexChunk(task, logToWrite, db)
 
 	if len(updatesOnTask) > 0 {
 		log.WithFields(logFields).WithField("updates", updatesOnTask).Debug("QueueTaskUpdate: updating task")
@@ -360,7 +446,7 @@ func trimLogForTaskUpdate(logText string) string {
 	return strings.Join(lines[fromLine:], "\n") + "\n"
 }
 
-func (tuq *TaskUpdateQueue) addWorkerToFailedList(task *Task, tupdate *TaskUpdate, db *mgo.Database, extraUpdates bson.M) {
+func (tuq *TaskUpdateQueue) addWorkerToFailedList(worker *Worker, task *Task, tupdate *TaskUpdate, extraUpdates bson.M) {
 	logger := log.WithFields(log.Fields{
 		"task_id":    task.ID.Hex(),
 		"new_status": tupdate.TaskStatus,
@@ -369,7 +455,7 @@ func (tuq *TaskUpdateQueue) addWorkerToFailedList(task *Task, tupdate *TaskUpdat
 	logger.Info("task failed, adding worker to failed list")
 
 	workerRef := WorkerRef{
-		ID:         *task.WorkerID,
+		ID:         worker.ID,
 		Identifier: tupdate.Worker,
 	}
 
@@ -395,55 +481,34 @@ func (tuq *TaskUpdateQueue) writeTaskLog(task *Task, logText string) error {
 		return nil
 	}
 
-	dirpath, filename := tuq.taskLogPath(task.Job, task.ID)
-	filepath := path.Join(dirpath, filename)
-	logger = logger.WithField("filepath", filepath)
-
-	if err := os.MkdirAll(dirpath, 0755); err != nil {
-		logger.WithError(err).Error("unable to create directory for log file")
-		return err
-	}
-
-	file, err := os.OpenFile(filepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		logger.WithError(err).Error("unable to open log file for append/create/write")
-		return err
+	if logText[len(logText)-1] != '\n' {
+		logText += "\n"
 	}
 
-	if n, err := file.WriteString(logText); n < len(logText) || err != nil {
-		logger.WithFields(log.Fields{
-			"written":      n,
-			"total_length": len(logText),
-			log.ErrorKey:   err,
-		}).Error("could only write partial log file")
-		file.Close()
+	if err := tuq.logStore.Append(task.Job, task.ID, logText); err != nil {
+		logger.WithError(err).Error("unable to write task log")
 		return err
 	}
 
-	if logText[len(logText)-1] != '\n' {
-		if n, err := file.WriteString("\n"); n < 1 || err != nil {
-			logger.WithError(err).Error("could not append line end")
-			file.Close()
-			return err
-		}
-	}
+	tuq.notifyLogWritten(task.ID)
+	return nil
+}
 
-	if err := file.Close(); err != nil {
-		logger.WithError(err).Error("error closing log file")
-		return err
+// notifyLogWritten lets followers of the task log know there is something new to read.
+// This never blocks; when nobody reads the notifications they are dropped.
+func (tuq *TaskUpdateQueue) notifyLogWritten(taskID bson.ObjectId) {
+	select {
+	case tuq.logWritten <- taskID.Hex():
+	default:
+		log.WithField("task_id", taskID.Hex()).Debug("task log notification queue is full")
 	}
-	return nil
 }
 
 // rotateTaskLogFile rotates the task's log file, ignoring (but logging) any errors that occur.
 func (tuq *TaskUpdateQueue) rotateTaskLogFile(task *Task) {
-	dirpath, filename := tuq.taskLogPath(task.Job, task.ID)
-	filepath := path.Join(dirpath, filename)
-
-	if err := rotateLogFile(filepath); err != nil {
+	if err := tuq.logStore.Rotate(task.Job, task.ID); err != nil {
 		log.WithFields(log.Fields{
 			"task_id":    task.ID.Hex(),
-			"log_file":   filepath,
 			log.ErrorKey: err,
 		}).Warning("unable to rotate log; keeping them un-rotated")
 	}
@@ -454,19 +519,19 @@ func (tuq *TaskUpdateQueue) taskLogPath(jobID, taskID bson.ObjectId) (string, st
 	return taskLogPath(jobID, taskID, tuq.config)
 }
 
-/* Blacklists the worker if this failure pushes it over the threshold.
+/* Blacklists the worker if this failure pushes it over the threshold, or when the worker was on probation.
  * If the task is re-queued due to blacklisting the worker, tupdate.Status is reset to "claimed-by-manager"
  * to avoid sending the failure status to the Server (but logs are still sent). Preventing the failure
  * status from reaching the server is important because the server should not cancel the entire job because
  * of this. */
-func (tuq *TaskUpdateQueue) maybeBlacklistWorker(task *Task, tupdate *TaskUpdate, db *mgo.Database) (workersLeft map[bson.ObjectId]bool) {
+func (tuq *TaskUpdateQueue) maybeBlacklistWorker(worker *Worker, task *Task, db *mgo.Database) (workersLeft map[bson.ObjectId]bool) {
 	workersLeft = tuq.blacklist.WorkersLeft(task.Job, task.TaskType)
-	delete(workersLeft, *task.WorkerID)
+	delete(workersLeft, worker.ID)
 
 	coll := db.C("flamenco_tasks")
 
 	queryFields := M{
-		"worker_id": task.WorkerID,
+		"worker_id": worker.ID,
 		"job":       task.Job,
 		"task_type": task.TaskType,
 		// For counting the number of failures so far (for this worker), we
@@ -475,7 +540,7 @@ func (tuq *TaskUpdateQueue) maybeBlacklistWorker(task *Task, tupdate *TaskUpdate
 		"status": M{"$in": []string{statusFailed, statusSoftFailed}},
 	}
 	logger := log.WithFields(log.Fields{
-		"worker_id": task.WorkerID.Hex(),
+		"worker_id": worker.ID.Hex(),
 		"job":       task.Job.Hex(),
 		"task_type": task.TaskType,
 	})
@@ -492,15 +557,17 @@ func (tuq *TaskUpdateQueue) maybeBlacklistWorker(task *Task, tupdate *TaskUpdate
 	failedCount++
 	logger = logger.WithField("failed_task_count", failedCount)
 
-	if failedCount < tuq.config.BlacklistThreshold {
+	if tuq.blacklist.IsOnProbation(worker.ID, task.Job, task.TaskType) {
+		logger.Info("worker failed task while on probation, adding to blacklist again")
+	} else if failedCount < tuq.config.BlacklistThreshold {
 		logger.Debug("not enough failed tasks to blacklist worker")
 		return
+	} else {
+		logger.Info("too many failed tasks, adding to blacklist")
 	}
 
-	logger.Info("too many failed tasks, adding to blacklist")
-
 	// Blacklist this worker.
-	err = tuq.blacklist.Add(*task.WorkerID, task)
+	err = tuq.blacklist.Add(worker.ID, task)
 	if err != nil {
 		logger.WithError(err).Error("unable to blacklist worker")
 		return
@@ -518,7 +585,7 @@ func (tuq *TaskUpdateQueue) maybeBlacklistWorker(task *Task, tupdate *TaskUpdate
 	verb = "hard-failed"
 	newTaskStatus = statusFailed
 
-	updateMessage := fmt.Sprintf("Manager %s task after blacklisting worker %s", verb, task.Worker)
+	updateMessage := fmt.Sprintf("Manager %s task after blacklisting worker %s", verb, worker.Nickname)
 	found := Task{}
 	iter := query.Iter()
 	for iter.Next(&found) {
@@ -68,9 +68,9 @@ func (s *TaskUpdatesTestSuite) SetUpTest(c *check.C) {
 	s.config.TaskLogsPath = taskLogsPath
 
 	s.upstream = ConnectUpstream(&s.config, s.session)
-	s.taskLogUploader = CreateTaskLogUploader(&s.config, s.upstream)
+	s.taskLogUploader = CreateTaskLogUploader(&s.config, s.session, s.upstream, newLocalTaskLogStore(&s.config))
 	s.blacklist = CreateWorkerBlackList(&s.config, s.session)
-	s.queue = CreateTaskUpdateQueue(&s.config, s.blacklist)
+	s.queue = CreateTaskUpdateQueue(&s.config, s.blacklist, CreateWorkerQuarantine(&s.config, s.session), nil, newLocalTaskLogStore(&s.config))
 	pusher := CreateTaskUpdatePusher(&s.config, s.upstream, s.session, s.queue, nil)
 	s.sched = CreateTaskScheduler(&s.config, s.upstream, s.session, s.queue, s.blacklist, pusher)
 }
@@ -734,3 +734,111 @@ func (s *TaskUpdatesTestSuite) TestMaxSoftFailCount(c *check.C) {
 		statusActive, statusSoftFailed,
 		statusActive, statusFailed)
 }
+
+func (s *TaskUpdatesTestSuite) TestFailureClassification(c *check.C) {
+	s.config.BlacklistThreshold = 1
+	s.config.FailureClasses = defaultFailureClassRules
+	s.queue = CreateTaskUpdateQueue(&s.config, s.blacklist, CreateWorkerQuarantine(&s.config, s.session), nil, newLocalTaskLogStore(&s.config))
+	s.sched.queue = s.queue
+	tasksColl := s.db.C("flamenco_tasks")
+
+	task1 := ConstructTestTask("1aaaaaaaaaaaaaaaaaaaaaaa", "testing")
+	task2 := ConstructTestTask("2aaaaaaaaaaaaaaaaaaaaaaa", "testing")
+	assert.Nil(c, tasksColl.Insert(task1, task2))
+
+	worker1 := Worker{
+		Platform:           "linux",
+		Nickname:           "worker1",
+		SupportedTaskTypes: []string{"testing"},
+	}
+	assert.Nil(c, StoreNewWorker(&worker1, s.db))
+	worker2 := Worker{
+		Platform:           "linux",
+		Nickname:           "worker2",
+		SupportedTaskTypes: []string{"testing"},
+	}
+	assert.Nil(c, StoreNewWorker(&worker2, s.db))
+
+	assertFailureClass := func(taskID bson.ObjectId, workerID bson.ObjectId, expectClass string) {
+		dbTask := Task{}
+		assert.Nil(c, tasksColl.FindId(taskID).One(&dbTask))
+		assert.Equal(c, expectClass, dbTask.FailureClass)
+
+		dbWorker, err := FindWorkerByID(workerID, s.db)
+		assert.Nil(c, err)
+		assert.Equal(c, expectClass, dbWorker.CurrentTaskFailureClass)
+	}
+
+	// A missing file is not the worker's fault, so it shouldn't be blacklisted.
+	s.sched.assignTaskToWorker(&task1, &worker1, s.db, log.WithField("unittest", "TestFailureClassification"))
+	s.sendTaskUpdate(c, task1.ID, worker1.ID, statusFailed, "failing task",
+		"Error: /render/shot.blend: No such file or directory\n")
+	assertFailureClass(task1.ID, worker1.ID, "missing-file")
+	assertTaskStatus(c, s.db, task1.ID, statusSoftFailed)
+	assert.Equal(c, M{}, s.blacklist.BlacklistForWorker(worker1.ID))
+
+	// Running out of memory does get the worker blacklisted.
+	s.sched.assignTaskToWorker(&task2, &worker2, s.db, log.WithField("unittest", "TestFailureClassification"))
+	s.sendTaskUpdate(c, task2.ID, worker2.ID, statusFailed, "failing task",
+		"Error: Out of memory in CUDA queue enqueue\n")
+	assertFailureClass(task2.ID, worker2.ID, "out-of-memory")
+	assert.NotEqual(c, M{}, s.blacklist.BlacklistForWorker(worker2.ID))
+
+	// A new task update should clear the worker's failure class.
+	s.sched.assignTaskToWorker(&task1, &worker2, s.db, log.WithField("unittest", "TestFailureClassification"))
+	s.sendTaskUpdate(c, task1.ID, worker2.ID, statusActive, "running", "")
+	dbWorker, err := FindWorkerByID(worker2.ID, s.db)
+	assert.Nil(c, err)
+	assert.Equal(c, "", dbWorker.CurrentTaskFailureClass)
+}
+
+func (s *TaskUpdatesTestSuite) TestSpeculativeFailureBlamesDuplicate(c *check.C) {
+	s.config.BlacklistThreshold = 1
+	s.config.FailureClasses = defaultFailureClassRules
+	s.queue = CreateTaskUpdateQueue(&s.config, s.blacklist, CreateWorkerQuarantine(&s.config, s.session), nil, newLocalTaskLogStore(&s.config))
+	s.sched.queue = s.queue
+	tasksColl := s.db.C("flamenco_tasks")
+
+	task := ConstructTestTask("1aaaaaaaaaaaaaaaaaaaaaaa", "testing")
+	assert.Nil(c, tasksColl.Insert(task))
+
+	original := Worker{
+		Platform:           "linux",
+		Nickname:           "original",
+		SupportedTaskTypes: []string{"testing"},
+	}
+	assert.Nil(c, StoreNewWorker(&original, s.db))
+	duplicate := Worker{
+		Platform:           "linux",
+		Nickname:           "duplicate",
+		SupportedTaskTypes: []string{"testing"},
+	}
+	assert.Nil(c, StoreNewWorker(&duplicate, s.db))
+
+	s.sched.assignTaskToWorker(&task, &original, s.db, log.WithField("unittest", "TestSpeculativeFailureBlamesDuplicate"))
+	s.sendTaskUpdate(c, task.ID, original.ID, statusActive, "running", "")
+	assert.Nil(c, tasksColl.UpdateId(task.ID, M{"$set": M{
+		"speculative_worker_id": duplicate.ID,
+		"speculative_worker":    duplicate.Nickname,
+	}}))
+
+	s.sendTaskUpdate(c, task.ID, duplicate.ID, statusFailed, "failing task",
+		"Error: Out of memory in CUDA queue enqueue\n")
+
+	// The failure is held against the duplicate's worker, not the one still running the task.
+	dbDuplicate, err := FindWorkerByID(duplicate.ID, s.db)
+	assert.Nil(c, err)
+	assert.Equal(c, "out-of-memory", dbDuplicate.CurrentTaskFailureClass)
+	assert.NotEqual(c, M{}, s.blacklist.BlacklistForWorker(duplicate.ID))
+
+	dbOriginal, err := FindWorkerByID(original.ID, s.db)
+	assert.Nil(c, err)
+	assert.Equal(c, "", dbOriginal.CurrentTaskFailureClass)
+	assert.Equal(c, M{}, s.blacklist.BlacklistForWorker(original.ID))
+
+	dbTask := Task{}
+	assert.Nil(c, tasksColl.FindId(task.ID).One(&dbTask))
+	assert.Equal(c, statusActive, dbTask.Status)
+	assert.Equal(c, "", dbTask.FailureClass)
+	assert.Nil(c, dbTask.SpeculativeWorkerID)
+}
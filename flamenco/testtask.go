@@ -66,6 +66,11 @@ func CreateTestTask(worker *Worker, conf *Conf, db *mgo.Database) (string, error
 		return "", fmt.Errorf("worker is in status '%s', test jobs only work in status '%s'",
 			worker.Status, workerStatusTesting)
 	}
+	return queueTestTasks(worker, conf, db)
+}
+
+// queueTestTasks queues a test task for each of the worker's supported task types we know of.
+func queueTestTasks(worker *Worker, conf *Conf, db *mgo.Database) (string, error) {
 	logger := log.WithFields(log.Fields{
 		"worker":    worker.Identifier(),
 		"worker_id": worker.ID.Hex(),
@@ -69,10 +69,10 @@ func (ot TimeOfDay) IsAfter(other TimeOfDay) bool {
 	return ot.Minute > other.Minute
 }
 
-// OnDate returns the time of day in the local timezone on the given date.
+// OnDate returns the time of day on the given date, in the timezone of that date.
 func (ot TimeOfDay) OnDate(date time.Time) time.Time {
 	year, month, day := date.Date()
-	return time.Date(year, month, day, ot.Hour, ot.Minute, 0, 0, time.Local)
+	return time.Date(year, month, day, ot.Hour, ot.Minute, 0, 0, date.Location())
 }
 
 func (ot TimeOfDay) String() string {
@@ -83,6 +83,13 @@ func (s *TimeOfDayTestSuite) TestOnDate(c *check.C) {
 	expect = time.Date(2018, 12, 14, 0, 0, 0, 0, time.Local)
 	assert.Equal(c, expect, tod.OnDate(theDate))
 
+	// The timezone of the date should be kept.
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	assert.Nil(c, err)
+	theDate = time.Date(2018, 12, 13, 7, 59, 43, 123, tokyo)
+	tod = TimeOfDay{16, 47}
+	expect = time.Date(2018, 12, 13, 16, 47, 0, 0, tokyo)
+	assert.Equal(c, expect, tod.OnDate(theDate))
 }
 
 func (s *TimeOfDayTestSuite) TestMarshalJSON(c *check.C) {
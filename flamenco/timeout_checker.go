@@ -28,6 +28,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 // Interval for checking all active tasks and workers for timeouts.
@@ -44,16 +45,19 @@ type TimeoutChecker struct {
 	session   *mgo.Session
 	queue     *TaskUpdateQueue
 	scheduler *TaskScheduler
+	runtimes  *RuntimeEstimator
 }
 
 // CreateTimeoutChecker creates a new TimeoutChecker.
-func CreateTimeoutChecker(config *Conf, session *mgo.Session, queue *TaskUpdateQueue, scheduler *TaskScheduler) *TimeoutChecker {
+func CreateTimeoutChecker(config *Conf, session *mgo.Session, queue *TaskUpdateQueue,
+	scheduler *TaskScheduler, runtimes *RuntimeEstimator) *TimeoutChecker {
 	return &TimeoutChecker{
 		makeClosable(),
 		config,
 		session,
 		queue,
 		scheduler,
+		runtimes,
 	}
 }
 
@@ -74,6 +78,9 @@ func (ttc *TimeoutChecker) Go() {
 		for range timer {
 			ttc.checkTasks(db)
 			ttc.checkWorkers(db)
+			ttc.checkDrainingWorkers(db)
+			ttc.checkStragglers(db)
+			ttc.checkSpeculativeRuns(db)
 		}
 	}()
 }
@@ -85,31 +92,167 @@ func (ttc *TimeoutChecker) Close() {
 	log.Debug("TimeoutChecker: shutdown complete.")
 }
 
+// Name of the command setting that overrides the timeout of its task.
+const taskTimeoutSetting = "timeout"
+
+// taskTimeoutClass is a set of active tasks that share the same timeout interval.
+type taskTimeoutClass struct {
+	description string
+	query       M // Selects the active tasks of this class.
+	interval    time.Duration
+}
+
+// taskTimeoutClasses returns the timeout classes for the configured per-job and per-task-type
+// timeout intervals, and the global ActiveTaskTimeoutInterval. Each active task is in exactly
+// one class, unless its timeout is overridden by a command setting; see taskTimeout().
+func taskTimeoutClasses(config *Conf) []taskTimeoutClass {
+	settingKey := "commands.settings." + taskTimeoutSetting
+	noSettingOverride := M{"$exists": false}
+	classes := []taskTimeoutClass{}
+
+	overriddenJobs := []bson.ObjectId{}
+	for jobIDstr, interval := range config.JobTimeoutIntervals {
+		if !bson.IsObjectIdHex(jobIDstr) {
+			log.WithField("job_id", jobIDstr).Warning("invalid job ID in job timeout intervals, ignoring")
+			continue
+		}
+		jobID := bson.ObjectIdHex(jobIDstr)
+		overriddenJobs = append(overriddenJobs, jobID)
+		classes = append(classes, taskTimeoutClass{
+			description: "job " + jobIDstr,
+			query:       M{"job": jobID, settingKey: noSettingOverride},
+			interval:    interval,
+		})
+	}
+
+	overriddenTaskTypes := []string{}
+	for taskType, interval := range config.TaskTypeTimeoutIntervals {
+		overriddenTaskTypes = append(overriddenTaskTypes, taskType)
+		classes = append(classes, taskTimeoutClass{
+			description: "task type " + taskType,
+			query: M{
+				"task_type": taskType,
+				"job":       M{"$nin": overriddenJobs},
+				settingKey:  noSettingOverride,
+			},
+			interval: interval,
+		})
+	}
+
+	classes = append(classes, taskTimeoutClass{
+		description: "default",
+		query: M{
+			"task_type": M{"$nin": overriddenTaskTypes},
+			"job":       M{"$nin": overriddenJobs},
+			settingKey:  noSettingOverride,
+		},
+		interval: config.ActiveTaskTimeoutInterval,
+	})
+	return classes
+}
+
+// taskTimeout returns the timeout interval set on one of the task's commands.
+// The setting can be a duration string like "40m", or a number of seconds.
+func taskTimeout(task *Task) (time.Duration, bool) {
+	for _, cmd := range task.Commands {
+		value, found := cmd.Settings[taskTimeoutSetting]
+		if !found {
+			continue
+		}
+
+		var interval time.Duration
+		switch v := value.(type) {
+		case string:
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				return 0, false
+			}
+			interval = parsed
+		case int:
+			interval = time.Duration(v) * time.Second
+		case int64:
+			interval = time.Duration(v) * time.Second
+		case float64:
+			interval = time.Duration(v * float64(time.Second))
+		default:
+			return 0, false
+		}
+		return interval, interval > 0
+	}
+	return 0, false
+}
+
+var taskTimeoutProjection = M{
+	"_id":              1,
+	"last_worker_ping": 1,
+	"worker_id":        1,
+	"worker":           1,
+	"name":             1,
+	"job":              1,
+	"task_type":        1,
+}
+
 func (ttc *TimeoutChecker) checkTasks(db *mgo.Database) {
-	timeoutThreshold := UtcNow().Add(-ttc.config.ActiveTaskTimeoutInterval)
-	log.Debugf("Failing all active tasks that have not been touched since %s", timeoutThreshold)
+	now := *UtcNow()
+	tasksColl := db.C("flamenco_tasks")
+
+	for _, class := range taskTimeoutClasses(ttc.config) {
+		timeoutThreshold := now.Add(-class.interval)
+		log.Debugf("Failing all active tasks of %s that have not been touched since %s",
+			class.description, timeoutThreshold)
+
+		var timedoutTasks []Task
+		// find all active tasks that either have never been pinged, or were pinged long ago.
+		query := M{
+			"status": statusActive,
+			"$or": []M{
+				M{"last_worker_ping": M{"$lte": timeoutThreshold}},
+				M{"last_worker_ping": M{"$exists": false}},
+			},
+		}
+		for key, value := range class.query {
+			query[key] = value
+		}
+		if err := tasksColl.Find(query).Select(taskTimeoutProjection).All(&timedoutTasks); err != nil {
+			log.Warningf("Error finding timed-out tasks: %s", err)
+		}
+
+		for _, task := range timedoutTasks {
+			ttc.timeoutTask(&task, db)
+		}
+	}
 
-	var timedoutTasks []Task
-	// find all active tasks that either have never been pinged, or were pinged long ago.
+	ttc.checkTasksWithTimeoutSetting(now, db)
+}
+
+// checkTasksWithTimeoutSetting times out active tasks that have their own timeout interval.
+func (ttc *TimeoutChecker) checkTasksWithTimeoutSetting(now time.Time, db *mgo.Database) {
+	var activeTasks []Task
 	query := M{
 		"status": statusActive,
-		"$or": []M{
-			M{"last_worker_ping": M{"$lte": timeoutThreshold}},
-			M{"last_worker_ping": M{"$exists": false}},
-		},
+		"commands.settings." + taskTimeoutSetting: M{"$exists": true},
 	}
-	projection := M{
-		"_id":              1,
-		"last_worker_ping": 1,
-		"worker_id":        1,
-		"worker":           1,
-		"name":             1,
+	projection := M{"commands": 1}
+	for key, value := range taskTimeoutProjection {
+		projection[key] = value
 	}
-	if err := db.C("flamenco_tasks").Find(query).Select(projection).All(&timedoutTasks); err != nil {
-		log.Warningf("Error finding timed-out tasks: %s", err)
+	if err := db.C("flamenco_tasks").Find(query).Select(projection).All(&activeTasks); err != nil {
+		log.Warningf("Error finding tasks with timeout setting: %s", err)
+		return
 	}
 
-	for _, task := range timedoutTasks {
+	for _, task := range activeTasks {
+		interval, ok := taskTimeout(&task)
+		if !ok {
+			log.WithFields(log.Fields{
+				"task_id": task.ID.Hex(),
+				"setting": taskTimeoutSetting,
+			}).Warning("invalid task timeout setting, using the default timeout")
+			interval = ttc.config.ActiveTaskTimeoutInterval
+		}
+		if task.LastWorkerPing != nil && now.Sub(*task.LastWorkerPing) < interval {
+			continue
+		}
 		ttc.timeoutTask(&task, db)
 	}
 }
@@ -174,3 +317,25 @@ func (ttc *TimeoutChecker) checkWorkers(db *mgo.Database) {
 		worker.Timeout(db, ttc.scheduler)
 	}
 }
+
+// checkDrainingWorkers forces draining workers to stop when they passed their drain deadline.
+func (ttc *TimeoutChecker) checkDrainingWorkers(db *mgo.Database) {
+	now := *UtcNow()
+
+	var drainingWorkers []Worker
+	query := M{
+		"lazy_status_request": Lazy,
+		"drain_deadline":      M{"$lte": now},
+	}
+	if err := db.C("flamenco_workers").Find(query).All(&drainingWorkers); err != nil {
+		log.WithError(err).Warning("Error finding workers past their drain deadline")
+		return
+	}
+
+	for _, worker := range drainingWorkers {
+		logFields := log.Fields{"worker": worker.Identifier()}
+		if err := worker.enforceDrainDeadline(logFields, db, ttc.scheduler); err != nil {
+			log.WithFields(logFields).WithError(err).Warning("unable to enforce drain deadline")
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type TaskTimeoutTestSuite struct{}
+
+var _ = check.Suite(&TaskTimeoutTestSuite{})
+
+func (s *TaskTimeoutTestSuite) TestTaskTimeoutSetting(c *check.C) {
+	taskWithSetting := func(value interface{}) *Task {
+		return &Task{Commands: []Command{
+			Command{Name: "echo", Settings: bson.M{"message": "hello"}},
+			Command{Name: "blender_render", Settings: bson.M{taskTimeoutSetting: value}},
+		}}
+	}
+	assertTimeout := func(task *Task, expectTimeout time.Duration, expectOK bool) {
+		timeout, ok := taskTimeout(task)
+		assert.Equal(c, expectOK, ok)
+		assert.Equal(c, expectTimeout, timeout)
+	}
+
+	assertTimeout(&Task{}, 0, false)
+	assertTimeout(taskWithSetting("40m"), 40*time.Minute, true)
+	assertTimeout(taskWithSetting(120), 2*time.Minute, true)
+	assertTimeout(taskWithSetting(int64(30)), 30*time.Second, true)
+	assertTimeout(taskWithSetting(1.5), 1500*time.Millisecond, true)
+	assertTimeout(taskWithSetting("forty minutes"), 0, false)
+	assertTimeout(taskWithSetting("-5m"), -5*time.Minute, false)
+	assertTimeout(taskWithSetting([]string{"5m"}), 0, false)
+}
+
+func (s *TaskTimeoutTestSuite) TestTimeoutClasses(c *check.C) {
+	config := GetTestConfig()
+	config.ActiveTaskTimeoutInterval = 10 * time.Minute
+
+	// Without overrides there is only the default class.
+	classes := taskTimeoutClasses(&config)
+	if assert.Equal(c, 1, len(classes)) {
+		assert.Equal(c, "default", classes[0].description)
+		assert.Equal(c, 10*time.Minute, classes[0].interval)
+	}
+
+	jobID := bson.NewObjectId()
+	config.TaskTypeTimeoutIntervals = map[string]time.Duration{"file-management": 2 * time.Minute}
+	config.JobTimeoutIntervals = map[string]time.Duration{
+		jobID.Hex(): 40 * time.Minute,
+		"not-an-id": 1 * time.Minute,
+	}
+	classes = taskTimeoutClasses(&config)
+	if !assert.Equal(c, 3, len(classes)) {
+		return
+	}
+
+	settingKey := "commands.settings." + taskTimeoutSetting
+	noSetting := M{"$exists": false}
+
+	assert.Equal(c, 40*time.Minute, classes[0].interval)
+	assert.Equal(c, M{"job": jobID, settingKey: noSetting}, classes[0].query)
+
+	assert.Equal(c, 2*time.Minute, classes[1].interval)
+	assert.Equal(c, M{
+		"task_type": "file-management",
+		"job":       M{"$nin": []bson.ObjectId{jobID}},
+		settingKey:  noSetting,
+	}, classes[1].query)
+
+	assert.Equal(c, 10*time.Minute, classes[2].interval)
+	assert.Equal(c, M{
+		"task_type": M{"$nin": []string{"file-management"}},
+		"job":       M{"$nin": []bson.ObjectId{jobID}},
+		settingKey:  noSetting,
+	}, classes[2].query)
+}
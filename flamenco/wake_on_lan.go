@@ -0,0 +1,194 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// Time period for checking whether more workers should be woken up.
+const wakeOnLANCheckInterval = 1 * time.Minute
+
+// Don't send another magic packet to the same worker within this time, to give it time to boot.
+const wakeOnLANResendInterval = 10 * time.Minute
+
+var errNoMACAddress = errors.New("worker has no known MAC address")
+
+// WorkerWaker sends Wake-on-LAN magic packets to powered-off workers.
+type WorkerWaker struct {
+	closable
+	config  *Conf
+	session *mgo.Session
+}
+
+// CreateWorkerWaker creates a new WorkerWaker.
+func CreateWorkerWaker(config *Conf, session *mgo.Session) *WorkerWaker {
+	return &WorkerWaker{
+		makeClosable(),
+		config,
+		session,
+	}
+}
+
+// Go starts a new goroutine that wakes up workers when there is more work than awake workers.
+func (ww *WorkerWaker) Go() {
+	if !ww.config.WakeOnLANForQueuedWork {
+		log.Debug("WorkerWaker: not waking up workers for queued work")
+		return
+	}
+
+	ww.closableAdd(1)
+	go func() {
+		session := ww.session.Copy()
+		db := session.DB("")
+		defer session.Close()
+		defer ww.closableDone()
+		defer log.Info("WorkerWaker: shutting down.")
+
+		timer := Timer("WorkerWaker", wakeOnLANCheckInterval, wakeOnLANCheckInterval, &ww.closable)
+		for range timer {
+			ww.wakeForQueuedWork(db)
+		}
+	}()
+}
+
+// Close gracefully shuts down the worker waker goroutine.
+func (ww *WorkerWaker) Close() {
+	log.Debug("WorkerWaker: Close() called.")
+	ww.closableCloseAndWait()
+	log.Debug("WorkerWaker: shutdown complete.")
+}
+
+// WakeWorker sends a Wake-on-LAN magic packet to the worker's MAC address.
+func (ww *WorkerWaker) WakeWorker(worker *Worker, db *mgo.Database) error {
+	if worker.MACAddress == "" {
+		return errNoMACAddress
+	}
+	mac, err := net.ParseMAC(worker.MACAddress)
+	if err != nil {
+		return err
+	}
+
+	logger := log.WithFields(log.Fields{
+		"worker":      worker.Identifier(),
+		"mac_address": worker.MACAddress,
+		"broadcast":   ww.config.WakeOnLANBroadcastAddress,
+	})
+	if err := sendMagicPacket(mac, ww.config.WakeOnLANBroadcastAddress); err != nil {
+		logger.WithError(err).Error("unable to send Wake-on-LAN packet")
+		return err
+	}
+	logger.Info("sent Wake-on-LAN packet to worker")
+
+	now := UtcNow()
+	worker.WakeOnLANSent = now
+	return db.C("flamenco_workers").UpdateId(worker.ID, M{"$set": M{"wol_sent": now}})
+}
+
+// wakeForQueuedWork wakes up offline workers when there are more queued tasks than awake workers.
+// Workers with an active sleep schedule are left to their schedule.
+func (ww *WorkerWaker) wakeForQueuedWork(db *mgo.Database) {
+	queuedTasks, err := db.C("flamenco_tasks").Find(M{
+		"status": M{"$in": schedulableTaskStatuses},
+	}).Count()
+	if err != nil {
+		log.WithError(err).Error("WorkerWaker: unable to count queued tasks")
+		return
+	}
+
+	workersColl := db.C("flamenco_workers")
+	awakeWorkers, err := workersColl.Find(M{
+		"status": M{"$in": []string{workerStatusAwake, workerStatusStarting}},
+	}).Count()
+	if err != nil {
+		log.WithError(err).Error("WorkerWaker: unable to count awake workers")
+		return
+	}
+
+	shortage := queuedTasks - awakeWorkers
+	if shortage <= 0 {
+		return
+	}
+
+	var sleepingWorkers []Worker
+	query := M{
+		"status":                         M{"$in": []string{workerStatusOffline, workerStatusTimeout}},
+		"mac_address":                    M{"$exists": true, "$ne": ""},
+		"sleep_schedule.schedule_active": M{"$ne": true},
+		"$or": []M{
+			M{"wol_sent": M{"$exists": false}},
+			M{"wol_sent": M{"$lt": UtcNow().Add(-wakeOnLANResendInterval)}},
+		},
+	}
+	if err := workersColl.Find(query).Sort("-last_activity").Limit(shortage).All(&sleepingWorkers); err != nil {
+		log.WithError(err).Error("WorkerWaker: unable to find workers to wake up")
+		return
+	}
+	if len(sleepingWorkers) == 0 {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"queued_tasks":    queuedTasks,
+		"awake_workers":   awakeWorkers,
+		"workers_to_wake": len(sleepingWorkers),
+	}).Info("WorkerWaker: more queued tasks than awake workers, waking up workers")
+	for idx := range sleepingWorkers {
+		ww.WakeWorker(&sleepingWorkers[idx], db)
+	}
+}
+
+// magicPacket constructs a Wake-on-LAN magic packet: 6 bytes 0xFF followed by 16 repetitions of the MAC address.
+func magicPacket(mac net.HardwareAddr) []byte {
+	packet := bytes.Repeat([]byte{0xFF}, 6)
+	for i := 0; i < 16; i++ {
+		packet = append(packet, mac...)
+	}
+	return packet
+}
+
+// sendMagicPacket sends a Wake-on-LAN magic packet over UDP to the given "host:port" address.
+func sendMagicPacket(mac net.HardwareAddr, address string) error {
+	if len(mac) != 6 {
+		return errors.New("Wake-on-LAN requires a 6-byte MAC address")
+	}
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(magicPacket(mac))
+	return err
+}
+
+// The status the worker has when it may need to be woken up by Wake-on-LAN.
+func canBeWokenByLAN(worker *Worker) bool {
+	return worker.MACAddress != "" && (worker.Status == workerStatusOffline || worker.Status == workerStatusTimeout)
+}
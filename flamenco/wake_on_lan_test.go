@@ -0,0 +1,170 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	check "gopkg.in/check.v1"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// listenUDP starts a local UDP listener and returns its address and a channel that receives the first packet.
+func listenUDP(c *check.C) (string, <-chan []byte) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal("Unable to listen on UDP", err)
+	}
+	received := make(chan []byte, 1)
+	go func() {
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buffer := make([]byte, 1024)
+		size, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			close(received)
+			return
+		}
+		received <- buffer[:size]
+	}()
+	return conn.LocalAddr().String(), received
+}
+
+type WakeOnLANTestSuite struct{}
+
+var _ = check.Suite(&WakeOnLANTestSuite{})
+
+func (s *WakeOnLANTestSuite) TestMagicPacket(c *check.C) {
+	mac, _ := net.ParseMAC("00:1a:2b:3c:4d:5e")
+	packet := magicPacket(mac)
+
+	assert.Equal(c, 102, len(packet))
+	assert.Equal(c, bytes.Repeat([]byte{0xFF}, 6), packet[:6])
+	for i := 0; i < 16; i++ {
+		offset := 6 + i*6
+		assert.Equal(c, []byte(mac), packet[offset:offset+6])
+	}
+}
+
+func (s *WakeOnLANTestSuite) TestSendMagicPacket(c *check.C) {
+	address, received := listenUDP(c)
+	mac, _ := net.ParseMAC("00:1a:2b:3c:4d:5e")
+
+	assert.Nil(c, sendMagicPacket(mac, address))
+	assert.Equal(c, magicPacket(mac), <-received)
+}
+
+func (s *WakeOnLANTestSuite) TestRefuseLongMAC(c *check.C) {
+	mac, _ := net.ParseMAC("00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01")
+	assert.NotNil(c, sendMagicPacket(mac, "127.0.0.1:9"))
+}
+
+type WorkerWakerTestSuite struct {
+	config  Conf
+	session *mgo.Session
+	db      *mgo.Database
+	waker   *WorkerWaker
+}
+
+var _ = check.Suite(&WorkerWakerTestSuite{})
+
+func (s *WorkerWakerTestSuite) SetUpSuite(c *check.C) {
+	s.config = GetTestConfig()
+	s.session = MongoSession(&s.config)
+	s.db = s.session.DB("")
+}
+
+func (s *WorkerWakerTestSuite) SetUpTest(c *check.C) {
+	s.waker = CreateWorkerWaker(&s.config, s.session)
+}
+
+func (s *WorkerWakerTestSuite) TearDownTest(c *check.C) {
+	s.db.DropDatabase()
+}
+
+func (s *WorkerWakerTestSuite) storeWorker(c *check.C, nickname, status, mac string) *Worker {
+	worker := Worker{
+		Platform:           "linux",
+		SupportedTaskTypes: []string{"sleeping"},
+		Nickname:           nickname,
+		Status:             status,
+		MACAddress:         mac,
+	}
+	if err := StoreNewWorker(&worker, s.db); err != nil {
+		c.Fatal("Unable to insert test worker", err)
+	}
+	return &worker
+}
+
+func (s *WorkerWakerTestSuite) TestWakeWorker(c *check.C) {
+	address, received := listenUDP(c)
+	s.config.WakeOnLANBroadcastAddress = address
+
+	worker := s.storeWorker(c, "offline", workerStatusOffline, "00:1a:2b:3c:4d:5e")
+	assert.Nil(c, s.waker.WakeWorker(worker, s.db))
+
+	mac, _ := net.ParseMAC(worker.MACAddress)
+	assert.Equal(c, magicPacket(mac), <-received)
+
+	found, err := FindWorkerByID(worker.ID, s.db)
+	assert.Nil(c, err)
+	assert.NotNil(c, found.WakeOnLANSent)
+
+	noMAC := s.storeWorker(c, "no-mac", workerStatusOffline, "")
+	assert.Equal(c, errNoMACAddress, s.waker.WakeWorker(noMAC, s.db))
+}
+
+func (s *WorkerWakerTestSuite) TestWakeForQueuedWork(c *check.C) {
+	address, received := listenUDP(c)
+	s.config.WakeOnLANBroadcastAddress = address
+
+	s.storeWorker(c, "awake", workerStatusAwake, "00:00:00:00:00:01")
+	offline := s.storeWorker(c, "offline", workerStatusOffline, "00:00:00:00:00:02")
+	scheduled := s.storeWorker(c, "scheduled", workerStatusOffline, "00:00:00:00:00:03")
+	assert.Nil(c, s.db.C("flamenco_workers").UpdateId(scheduled.ID,
+		bson.M{"$set": bson.M{"sleep_schedule.schedule_active": true}}))
+
+	// A single task can be handled by the awake worker.
+	task := ConstructTestTask("aaaaaaaaaaaaaaaaaaaaaaaa", "sleeping")
+	assert.Nil(c, s.db.C("flamenco_tasks").Insert(task))
+	s.waker.wakeForQueuedWork(s.db)
+	found, err := FindWorkerByID(offline.ID, s.db)
+	assert.Nil(c, err)
+	assert.Nil(c, found.WakeOnLANSent)
+
+	// Two tasks require another worker; the one with the sleep schedule is left alone.
+	task = ConstructTestTask("bbbbbbbbbbbbbbbbbbbbbbbb", "sleeping")
+	assert.Nil(c, s.db.C("flamenco_tasks").Insert(task))
+	s.waker.wakeForQueuedWork(s.db)
+
+	mac, _ := net.ParseMAC(offline.MACAddress)
+	assert.Equal(c, magicPacket(mac), <-received)
+	found, err = FindWorkerByID(scheduled.ID, s.db)
+	assert.Nil(c, err)
+	assert.Nil(c, found.WakeOnLANSent)
+}
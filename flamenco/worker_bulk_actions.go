@@ -0,0 +1,204 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package flamenco
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Pseudo-action for the bulk API, as sleep schedules are set via their own endpoint for single workers.
+const bulkActionSetSleepSchedule = "set-sleep-schedule"
+
+// Returned by Dashboard.performWorkerAction() for unknown actions.
+var errInvalidWorkerAction = errors.New("invalid worker action")
+
+// BulkWorkerActionRequest is sent by the dashboard to perform an action on multiple workers.
+// Either WorkerIDs or Filter (or both) must be given; when both are given, only workers
+// matching both are affected.
+type BulkWorkerActionRequest struct {
+	Action        string            `json:"action"`
+	Params        map[string]string `json:"params,omitempty"`
+	SleepSchedule *ScheduleInfo     `json:"sleep_schedule,omitempty"`
+	WorkerIDs     []bson.ObjectId   `json:"worker_ids,omitempty"`
+	Filter        *WorkerFilter     `json:"filter,omitempty"`
+}
+
+// WorkerFilter selects workers for bulk actions. Empty fields are ignored.
+type WorkerFilter struct {
+	Status   []string `json:"status,omitempty"`
+	Platform string   `json:"platform,omitempty"`
+	TaskType string   `json:"task_type,omitempty"`
+	Nickname string   `json:"nickname,omitempty"` // Glob pattern, like "render-*".
+}
+
+// BulkWorkerActionResult is the result of a bulk action on a single worker.
+type BulkWorkerActionResult struct {
+	WorkerID bson.ObjectId `json:"worker_id"`
+	Nickname string        `json:"nickname"`
+	OK       bool          `json:"ok"`
+	Result   string        `json:"result,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// BulkWorkerActionResponse is sent back to the dashboard after performing a bulk action.
+type BulkWorkerActionResponse struct {
+	Results []BulkWorkerActionResult `json:"results"`
+}
+
+// query returns the MongoDB query for this filter. The nickname glob is not part of the
+// query, and should be checked with matchesNickname().
+func (filter *WorkerFilter) query() M {
+	query := M{}
+	if filter == nil {
+		return query
+	}
+	if len(filter.Status) > 0 {
+		query["status"] = M{"$in": filter.Status}
+	}
+	if filter.Platform != "" {
+		query["platform"] = filter.Platform
+	}
+	if filter.TaskType != "" {
+		query["supported_task_types"] = filter.TaskType
+	}
+	return query
+}
+
+func (filter *WorkerFilter) matchesNickname(nickname string) bool {
+	if filter == nil || filter.Nickname == "" {
+		return true
+	}
+	matches, _ := path.Match(filter.Nickname, nickname)
+	return matches
+}
+
+func (filter *WorkerFilter) validate() error {
+	if filter == nil || filter.Nickname == "" {
+		return nil
+	}
+	_, err := path.Match(filter.Nickname, "")
+	return err
+}
+
+func (dash *Dashboard) bulkWorkerAction(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("remote_addr", r.RemoteAddr)
+
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "expected JSON", http.StatusNotAcceptable)
+		return
+	}
+
+	var request BulkWorkerActionRequest
+	if err := DecodeJSON(w, r.Body, &request, "bulkWorkerAction"); err != nil {
+		return
+	}
+	logger = logger.WithField("action", request.Action)
+
+	if len(request.WorkerIDs) == 0 && request.Filter == nil {
+		logger.Warning("bulkWorkerAction: no workers selected")
+		http.Error(w, "either worker_ids or filter is required", http.StatusBadRequest)
+		return
+	}
+	if err := request.Filter.validate(); err != nil {
+		logger.WithError(err).Warning("bulkWorkerAction: invalid nickname pattern")
+		http.Error(w, "invalid nickname pattern: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Action != bulkActionSetSleepSchedule && !isValidWorkerAction(request.Action) {
+		logger.Warning("bulkWorkerAction: invalid action requested")
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+	if request.Action == bulkActionSetSleepSchedule && request.SleepSchedule == nil {
+		http.Error(w, "sleep_schedule is required for action "+bulkActionSetSleepSchedule, http.StatusBadRequest)
+		return
+	}
+
+	session := dash.session.Clone()
+	defer session.Close()
+	db := session.DB("")
+
+	query := request.Filter.query()
+	if len(request.WorkerIDs) > 0 {
+		query["_id"] = M{"$in": request.WorkerIDs}
+	}
+
+	var workers []Worker
+	if err := db.C("flamenco_workers").Find(query).Sort("nickname").All(&workers); err != nil {
+		logger.WithError(err).Error("bulkWorkerAction: unable to find workers")
+		http.Error(w, "unable to find workers", http.StatusInternalServerError)
+		return
+	}
+
+	params := url.Values{}
+	for key, value := range request.Params {
+		params.Set(key, value)
+	}
+
+	response := BulkWorkerActionResponse{
+		Results: []BulkWorkerActionResult{},
+	}
+	for idx := range workers {
+		worker := &workers[idx]
+		if !request.Filter.matchesNickname(worker.Nickname) {
+			continue
+		}
+
+		workerLogger := logger.WithField("worker", worker.Identifier())
+		var actionResult string
+		var actionErr error
+		if request.Action == bulkActionSetSleepSchedule {
+			actionErr = dash.sleeper.SetSleepSchedule(worker, *request.SleepSchedule, db)
+		} else {
+			actionResult, workerLogger, actionErr = dash.performWorkerAction(worker, request.Action, params, workerLogger, db)
+		}
+
+		result := BulkWorkerActionResult{
+			WorkerID: worker.ID,
+			Nickname: worker.Nickname,
+			OK:       actionErr == nil,
+			Result:   actionResult,
+		}
+		if actionErr != nil {
+			result.Error = actionErr.Error()
+			workerLogger.WithError(actionErr).Warning("bulkWorkerAction: error occurred")
+		} else {
+			workerLogger.Info("bulkWorkerAction: action OK")
+		}
+		response.Results = append(response.Results, result)
+	}
+
+	logger.WithField("worker_count", len(response.Results)).Info("bulkWorkerAction: performed action")
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(response); err != nil {
+		logger.WithError(err).Warning("bulkWorkerAction: unable to send response")
+	}
+}
@@ -58,7 +58,7 @@ func (s *WorkerRemoverTestSuite) SetUpTest(c *check.C) {
 
 	upstream := ConnectUpstream(&s.config, s.session)
 	blacklist := CreateWorkerBlackList(&s.config, s.session)
-	queue := CreateTaskUpdateQueue(&s.config, blacklist)
+	queue := CreateTaskUpdateQueue(&s.config, blacklist, CreateWorkerQuarantine(&s.config, s.session), nil, newLocalTaskLogStore(&s.config))
 
 	pusher := CreateTaskUpdatePusher(&s.config, upstream, s.session, queue, nil)
 	s.sched = CreateTaskScheduler(&s.config, upstream, s.session, queue, blacklist, pusher)
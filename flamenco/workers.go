@@ -28,6 +28,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"time"
 
 	auth "github.com/abbot/go-http-auth"
 	log "github.com/sirupsen/logrus"
@@ -88,7 +89,14 @@ func (worker *Worker) SetStatus(status string, db *mgo.Database) error {
 }
 
 // SetAwake sets the worker status to Awake, but only if's not already awake or testing.
+// Quarantined workers are kept in quarantine.
 func (worker *Worker) SetAwake(db *mgo.Database) error {
+	if worker.Quarantine != nil {
+		if worker.Status == workerStatusQuarantined {
+			return nil
+		}
+		return worker.SetStatus(workerStatusQuarantined, db)
+	}
 	if worker.Status == workerStatusAwake || worker.Status == workerStatusTesting {
 		return nil
 	}
@@ -113,13 +121,63 @@ func (worker *Worker) RequestStatusChange(newStatus string, lazy Lazyness, db *m
 
 	worker.StatusRequested = newStatus
 	worker.LazyStatusRequest = lazy
+	worker.DrainDeadline = nil
 	updates := M{
 		"status_requested":    newStatus,
 		"lazy_status_request": lazy,
 	}
+	return db.C("flamenco_workers").UpdateId(worker.ID, M{
+		"$set":   updates,
+		"$unset": M{"drain_deadline": true},
+	})
+}
+
+// RequestDrain lets the worker finish its current task, but not take any new ones, after which it
+// shuts down. If the worker is still running a task at the deadline, the shutdown request becomes
+// immediate and the worker's tasks are re-queued; see enforceDrainDeadline().
+func (worker *Worker) RequestDrain(deadline time.Time, db *mgo.Database) error {
+	worker.StatusRequested = workerStatusShutdown
+	worker.LazyStatusRequest = Lazy
+	worker.DrainDeadline = &deadline
+	updates := M{
+		"status_requested":    workerStatusShutdown,
+		"lazy_status_request": Lazy,
+		"drain_deadline":      deadline,
+	}
 	return db.C("flamenco_workers").UpdateId(worker.ID, M{"$set": updates})
 }
 
+// drainDeadlinePassed returns true when the worker is draining and should have been done by now.
+func (worker *Worker) drainDeadlinePassed(now time.Time) bool {
+	if worker.DrainDeadline == nil || worker.LazyStatusRequest != Lazy {
+		return false
+	}
+	return !now.Before(*worker.DrainDeadline)
+}
+
+// expireDrainDeadline turns the worker's lazy status request into an immediate one.
+// The worker will be told to stop its current task on the next call to /may-i-run.
+func (worker *Worker) expireDrainDeadline(db *mgo.Database) error {
+	log.WithFields(log.Fields{
+		"worker":           worker.Identifier(),
+		"status_requested": worker.StatusRequested,
+		"drain_deadline":   worker.DrainDeadline,
+	}).Warning("worker did not finish draining before the deadline, making status change immediate")
+
+	worker.LazyStatusRequest = Immediate
+	return db.C("flamenco_workers").UpdateId(worker.ID, M{
+		"$set": M{"lazy_status_request": Immediate},
+	})
+}
+
+// enforceDrainDeadline makes the requested status change immediate and re-queues the worker's tasks.
+func (worker *Worker) enforceDrainDeadline(logFields log.Fields, db *mgo.Database, scheduler *TaskScheduler) error {
+	if err := worker.expireDrainDeadline(db); err != nil {
+		return err
+	}
+	return worker.returnAllTasks(logFields, db, scheduler, "worker did not finish draining before the deadline")
+}
+
 // AckStatusChange acknowledges the requested status change by moving it to the actual status.
 // Only the "shutdown" status should not be acknowledged, but just result in a signoff and thus
 // directly go to "offline" state.
@@ -138,10 +196,14 @@ func (worker *Worker) AckStatusChange(newStatus string, db *mgo.Database) error
 
 	worker.Status = newStatus
 	worker.StatusRequested = ""
+	worker.DrainDeadline = nil
 
 	return db.C("flamenco_workers").UpdateId(worker.ID, M{
-		"$set":   M{"status": newStatus},
-		"$unset": M{"status_requested": true},
+		"$set": M{"status": newStatus},
+		"$unset": M{
+			"status_requested": true,
+			"drain_deadline":   true,
+		},
 	})
 }
 
@@ -430,27 +492,36 @@ func WorkerPingedTask(workerID bson.ObjectId, taskID bson.ObjectId, taskStatus s
 	}
 
 	now := UtcNow()
-	updates := bson.M{
-		"last_worker_ping": now,
-		"worker_id":        workerID,
-	}
 
-	log.WithFields(logFields).WithField("updates", updates).Debug("WorkerPingedTask: updating task")
-	if err := tasksColl.UpdateId(taskID, bson.M{"$set": updates}); err != nil {
+	// A worker running a speculative duplicate of the task should not take over the task.
+	speculativeQuery := bson.M{"_id": taskID, "speculative_worker_id": workerID}
+	err := tasksColl.Update(speculativeQuery, bson.M{"$set": bson.M{"speculative_ping": now}})
+	if err == mgo.ErrNotFound {
+		updates := bson.M{
+			"last_worker_ping": now,
+			"worker_id":        workerID,
+		}
+		log.WithFields(logFields).WithField("updates", updates).Debug("WorkerPingedTask: updating task")
+		err = tasksColl.UpdateId(taskID, bson.M{"$set": updates})
+	}
+	if err != nil {
 		log.WithFields(logFields).WithError(err).Error("WorkerPingedTask: unable to update last_worker_ping on task")
 		return
 	}
 
 	// Also update this worker to reflect the last time it pinged a task.
-	updates = bson.M{
+	updates := bson.M{
 		"current_task_updated": now,
 	}
+	workerUpdate := bson.M{"$set": updates}
 	if len(taskStatus) > 0 {
 		updates["current_task_status"] = taskStatus
+		// A new failure class is set when the task update is classified as failure.
+		workerUpdate["$unset"] = bson.M{"current_task_failure_class": true}
 	}
 	logFields["updates"] = updates
 	log.WithFields(logFields).Debug("WorkerPingedTask: updating worker")
-	if err := workersColl.UpdateId(workerID, bson.M{"$set": updates}); err != nil {
+	if err := workersColl.UpdateId(workerID, workerUpdate); err != nil {
 		log.WithFields(logFields).WithError(err).Error("WorkerPingedTask: unable to update current_task_updated on task")
 		return
 	}
@@ -511,6 +582,15 @@ func WorkerSignOn(w http.ResponseWriter, r *auth.AuthenticatedRequest, db *mgo.D
 		log.WithFields(logFields).Info("Worker changed nickname")
 		updateSet["nickname"] = winfo.Nickname
 	}
+	if winfo.MACAddress != "" {
+		if mac, err := net.ParseMAC(winfo.MACAddress); err != nil {
+			log.WithFields(logFields).WithError(err).Warning("Worker sent invalid MAC address, ignoring")
+		} else if mac.String() != worker.MACAddress {
+			logFields["mac_address"] = mac.String()
+			log.WithFields(logFields).Info("Worker changed MAC address")
+			updateSet["mac_address"] = mac.String()
+		}
+	}
 	if len(winfo.SupportedTaskTypes) > 0 && !Equal(winfo.SupportedTaskTypes, worker.SupportedTaskTypes) {
 		updateSet["supported_task_types"] = winfo.SupportedTaskTypes
 		log.WithFields(logFields).WithField("task_types", winfo.SupportedTaskTypes).Info("Worker changed supported task types")
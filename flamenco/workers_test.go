@@ -68,7 +68,7 @@ func (s *WorkerTestSuite) SetUpTest(c *check.C) {
 
 	s.upstream = ConnectUpstream(s.config, s.session)
 	s.blacklist = CreateWorkerBlackList(s.config, s.session)
-	s.queue = CreateTaskUpdateQueue(s.config, s.blacklist)
+	s.queue = CreateTaskUpdateQueue(s.config, s.blacklist, CreateWorkerQuarantine(s.config, s.session), nil, newLocalTaskLogStore(s.config))
 	pusher := CreateTaskUpdatePusher(s.config, s.upstream, s.session, s.queue, nil)
 	s.sched = CreateTaskScheduler(s.config, s.upstream, s.session, s.queue, s.blacklist, pusher)
 	s.notifier = CreateUpstreamNotifier(s.config, s.upstream, s.session)
@@ -371,6 +371,50 @@ func (s *WorkerTestSuite) TestAckStatusChange(t *check.C) {
 	assert.Equal(t, workerStatusAsleep, found.Status)
 }
 
+func (s *WorkerTestSuite) TestWorkerSignOnMACAddress(t *check.C) {
+	signon := func(body string) {
+		respRec, ar := WorkerTestRequestWithBody(
+			s.workerLnx.ID, strings.NewReader(body),
+			"POST", "/sign-on")
+		WorkerSignOn(respRec, ar, s.db, s.notifier)
+		assert.Equal(t, 204, respRec.Code)
+	}
+
+	signon("{\"mac_address\": \"00-1A-2B-3C-4D-5E\"}")
+	found, err := FindWorkerByID(s.workerLnx.ID, s.db)
+	assert.Nil(t, err)
+	assert.Equal(t, "00:1a:2b:3c:4d:5e", found.MACAddress)
+
+	// Invalid MAC addresses should be ignored.
+	signon("{\"mac_address\": \"not a MAC\"}")
+	found, err = FindWorkerByID(s.workerLnx.ID, s.db)
+	assert.Nil(t, err)
+	assert.Equal(t, "00:1a:2b:3c:4d:5e", found.MACAddress)
+}
+
+func (s *WorkerTestSuite) TestRequestDrain(t *check.C) {
+	deadline := time.Now().UTC().Add(time.Hour).Round(time.Millisecond)
+	assert.Nil(t, s.workerLnx.RequestDrain(deadline, s.db))
+
+	found := Worker{}
+	err := s.db.C("flamenco_workers").FindId(s.workerLnx.ID).One(&found)
+	assert.Nil(t, err, "Unable to find workerLnx")
+	assert.Equal(t, workerStatusShutdown, found.StatusRequested)
+	assert.Equal(t, Lazy, found.LazyStatusRequest)
+	if assert.NotNil(t, found.DrainDeadline) {
+		assert.True(t, deadline.Equal(*found.DrainDeadline))
+	}
+	assert.False(t, found.drainDeadlinePassed(deadline.Add(-time.Second)))
+	assert.True(t, found.drainDeadlinePassed(deadline))
+
+	// Acknowledging the status change should remove the deadline.
+	assert.Nil(t, s.workerLnx.AckStatusChange(workerStatusShutdown, s.db))
+	found = Worker{}
+	err = s.db.C("flamenco_workers").FindId(s.workerLnx.ID).One(&found)
+	assert.Nil(t, err, "Unable to find workerLnx")
+	assert.Nil(t, found.DrainDeadline)
+}
+
 func (s *WorkerTestSuite) TestAckStatusChangeHTTP(t *check.C) {
 	err := s.workerLnx.RequestStatusChange(workerStatusAsleep, Immediate, s.db)
 	assert.Nil(t, err)
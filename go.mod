@@ -19,6 +19,7 @@ require (
 	github.com/stretchr/testify v1.3.0
 	gitlab.com/blender-institute/gossdp v0.0.0-20181105120310-0fce4178969b
 	golang.org/x/crypto v0.0.0-20191111213947-16651526fdb4
+	golang.org/x/image v0.0.0-20191009234506-e7c1f5e7dbb8
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127
 	gopkg.in/jarcoal/httpmock.v1 v1.0.0-20181117152235-275e9df93516
 	gopkg.in/mgo.v2 v2.0.0-20180705113604-9856a29383ce
@@ -44,10 +44,34 @@ var applicationVersion = "set-during-build"
 func garbageCollectMode() {
 	config.Shaman.GarbageCollect.SilentlyDisable = true
 	shamanServer = shaman.NewServer(config.Shaman, jwtauth.AlwaysDeny{})
+	if shamanServer == nil {
+		log.Fatal("Shaman is disabled, there is nothing to clean up")
+	}
+
+	// The retention policy needs to know which jobs use which checkouts.
+	tracker := flamenco.CreateCheckoutUsageTracker(&config, session)
+	tracker.Scan(session.DB(""))
+	shamanServer.SetCheckoutUsageProvider(tracker)
+
+	expired := shamanServer.RemoveExpiredCheckouts(!cliArgs.iKnowWhatIAmDoing)
+	log.Debugf("ran checkout retention: %#v", expired)
 	stats := shamanServer.GCStorage(!cliArgs.iKnowWhatIAmDoing)
 	log.Debugf("ran GC: %#v", stats)
 }
 
+func shamanStatsMode() {
+	config.Shaman.GarbageCollect.SilentlyDisable = true
+	shamanServer = shaman.NewServer(config.Shaman, jwtauth.AlwaysDeny{})
+	if shamanServer == nil {
+		log.Fatal("Shaman is disabled, there are no statistics to show")
+	}
+	stats, err := shamanServer.StorageStats()
+	if err != nil {
+		log.WithError(err).Fatal("unable to gather Shaman storage statistics")
+	}
+	stats.WriteReport(os.Stdout)
+}
+
 func showStartup() {
 	// This *always* has to be logged.
 	oldLevel := log.GetLevel()
@@ -118,8 +142,8 @@ func main() {
 	var setup *websetup.Routes
 	if cliArgs.setup {
 		setup, router, err = setupMode()
-	} else if cliArgs.garbageCollect {
-		garbageCollectMode()
+	} else if cliArgs.shamanStats {
+		shamanStatsMode()
 		return
 	} else {
 		router, err = normalMode()
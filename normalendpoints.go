@@ -25,6 +25,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/armadillica/flamenco-manager/jwtauth"
 
@@ -51,6 +52,9 @@ func AddRoutes(router *mux.Router,
 	router.HandleFunc("/sign-off", workerAuthenticator.Wrap(httpWorkerSignOff)).Methods("POST")
 	router.Handle("/kick", userAuthenticator.WrapFunc(httpKick))
 	router.Handle("/logfile/{job-id}/{task-id}", userAuthenticator.WrapFunc(httpTaskLog))
+	router.Handle("/logfile/{job-id}/{task-id}/follow", userAuthenticator.WrapFunc(httpFollowTaskLog))
+	router.Handle("/logfile/{job-id}/{task-id}/attempts", userAuthenticator.WrapFunc(httpTaskLogAttempts))
+	router.Handle("/logfile/{job-id}/{task-id}/attempts/{attempt:[0-9]+}", userAuthenticator.WrapFunc(httpTaskLogAttempt))
 }
 
 func httpRegisterWorker(w http.ResponseWriter, r *http.Request) {
@@ -96,6 +100,50 @@ func httpTaskLog(w http.ResponseWriter, r *http.Request) {
 	flamenco.ServeTaskLog(w, r, jobID, taskID, taskUpdateQueue)
 }
 
+func httpTaskLogAttempts(w http.ResponseWriter, r *http.Request) {
+	jobID, err := flamenco.ObjectIDFromRequest(w, r, "job-id")
+	if err != nil {
+		return
+	}
+	taskID, err := flamenco.ObjectIDFromRequest(w, r, "task-id")
+	if err != nil {
+		return
+	}
+
+	flamenco.ServeTaskLogAttempts(w, r, jobID, taskID, taskUpdateQueue)
+}
+
+func httpTaskLogAttempt(w http.ResponseWriter, r *http.Request) {
+	jobID, err := flamenco.ObjectIDFromRequest(w, r, "job-id")
+	if err != nil {
+		return
+	}
+	taskID, err := flamenco.ObjectIDFromRequest(w, r, "task-id")
+	if err != nil {
+		return
+	}
+	attempt, err := strconv.Atoi(mux.Vars(r)["attempt"])
+	if err != nil {
+		http.Error(w, "invalid attempt number", http.StatusBadRequest)
+		return
+	}
+
+	flamenco.ServeTaskLogAttempt(w, r, jobID, taskID, attempt, taskUpdateQueue)
+}
+
+func httpFollowTaskLog(w http.ResponseWriter, r *http.Request) {
+	jobID, err := flamenco.ObjectIDFromRequest(w, r, "job-id")
+	if err != nil {
+		return
+	}
+	taskID, err := flamenco.ObjectIDFromRequest(w, r, "task-id")
+	if err != nil {
+		return
+	}
+
+	flamenco.FollowTaskLog(w, r, jobID, taskID, taskUpdateQueue, session)
+}
+
 func httpTaskUpdate(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 	mongoSess := session.Copy()
 	defer mongoSess.Close()
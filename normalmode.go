@@ -71,6 +71,22 @@ func normalMode() (*mux.Router, error) {
 		return nil, nil
 	}
 
+	if cliArgs.garbageCollect {
+		garbageCollectMode()
+		log.Warning("Shutting down after performing Shaman garbage collection")
+		os.Exit(0)
+		return nil, nil
+	}
+
+	if cliArgs.cleanLogs {
+		janitor := flamenco.CreateTaskLogJanitor(&config, session)
+		stats := janitor.Cleanup(!cliArgs.iKnowWhatIAmDoing, session.DB(""))
+		log.Debugf("ran task log cleanup: %#v", stats)
+		log.Warning("Shutting down after performing task log cleanup")
+		os.Exit(0)
+		return nil, nil
+	}
+
 	if config.HasCustomTLS() {
 		config.OwnURL = strings.Replace(config.OwnURL, "http://", "https://", 1)
 	} else {
@@ -84,20 +100,35 @@ func normalMode() (*mux.Router, error) {
 	upstream = flamenco.ConnectUpstream(&config, session)
 	upstreamNotifier = flamenco.CreateUpstreamNotifier(&config, upstream, session)
 	blacklist = flamenco.CreateWorkerBlackList(&config, session)
-	taskUpdateQueue = flamenco.CreateTaskUpdateQueue(&config, blacklist)
-	sleeper = flamenco.CreateSleepScheduler(session)
-	taskLogUploader = flamenco.CreateTaskLogUploader(&config, upstream)
+	workerQuarantine = flamenco.CreateWorkerQuarantine(&config, session)
+	runtimeEstimator = flamenco.CreateRuntimeEstimator(&config)
+	taskLogIndex = flamenco.CreateTaskLogIndex(&config, session)
+	taskLogStore, err := flamenco.CreateTaskLogStore(&config)
+	if err != nil {
+		log.WithError(err).Fatal("Error setting up task log storage")
+	}
+	taskUpdateQueue = flamenco.CreateTaskUpdateQueue(&config, blacklist, workerQuarantine, taskLogIndex, taskLogStore)
+	workerWaker = flamenco.CreateWorkerWaker(&config, session)
+	sleeper = flamenco.CreateSleepScheduler(session, workerWaker)
+	taskLogUploader = flamenco.CreateTaskLogUploader(&config, session, upstream, taskLogStore)
 	taskUpdatePusher = flamenco.CreateTaskUpdatePusher(&config, upstream, session, taskUpdateQueue, taskLogUploader)
 	taskScheduler = flamenco.CreateTaskScheduler(&config, upstream, session, taskUpdateQueue, blacklist, taskUpdatePusher)
-	timeoutChecker = flamenco.CreateTimeoutChecker(&config, session, taskUpdateQueue, taskScheduler)
+	timeoutChecker = flamenco.CreateTimeoutChecker(&config, session, taskUpdateQueue, taskScheduler, runtimeEstimator)
 	taskCleaner = flamenco.CreateTaskCleaner(&config, session)
+	taskLogJanitor = flamenco.CreateTaskLogJanitor(&config, session)
 	dynamicPoolPoller = dppoller.NewPoller(config.DynamicPoolPlatforms)
-	dashboard = flamenco.CreateDashboard(&config, session, sleeper, blacklist, dynamicPoolPoller, applicationVersion)
-	latestImageSystem = flamenco.CreateLatestImageSystem(config.WatchForLatestImage)
+	dashboard = flamenco.CreateDashboard(&config, session, sleeper, workerWaker, blacklist, workerQuarantine, runtimeEstimator, taskLogIndex, taskLogUploader, dynamicPoolPoller, applicationVersion)
+	renderOutputVerifier = flamenco.CreateRenderOutputVerifier(&config, session, taskUpdateQueue, taskScheduler)
+	previewMovieAssembler = flamenco.CreatePreviewMovieAssembler(&config, session)
+	latestImageSystem = flamenco.CreateLatestImageSystem(&config, session, renderOutputVerifier, previewMovieAssembler)
 	workerRemover = flamenco.CreateWorkerRemover(&config, session, taskScheduler)
 	jwtRedirector := jwtauth.NewRedirector(config.ManagerID, config.ManagerSecret, config.Flamenco, "/")
 	jwtAuther := jwtauth.Load(config.JWT)
 	shamanServer = shaman.NewServer(config.Shaman, jwtAuther)
+	checkoutUsageTracker = flamenco.CreateCheckoutUsageTracker(&config, session)
+	if shamanServer != nil && checkoutUsageTracker != nil {
+		shamanServer.SetCheckoutUsageProvider(checkoutUsageTracker)
+	}
 
 	// Set up our own HTTP server
 	workerAuthenticator := auth.NewBasicAuthenticator("Flamenco Manager", workerSecret)
@@ -106,6 +137,9 @@ func normalMode() (*mux.Router, error) {
 
 	latestImageSystem.AddRoutes(router, workerAuthenticator, jwtAuther)
 	dashboard.AddRoutes(router, jwtAuther)
+	if previewMovieAssembler != nil {
+		previewMovieAssembler.AddRoutes(router, jwtAuther)
+	}
 	if shamanServer != nil {
 		shamanServer.AddRoutes(router)
 	}
@@ -116,16 +150,35 @@ func normalMode() (*mux.Router, error) {
 
 	upstreamNotifier.SendStartupNotification()
 	blacklist.EnsureDBIndices()
+	workerQuarantine.EnsureDBIndices()
+	taskLogIndex.EnsureDBIndices()
+	taskLogUploader.EnsureDBIndices()
+	if previewMovieAssembler != nil {
+		previewMovieAssembler.EnsureDBIndices()
+	}
 
 	sleeper.Go()
+	workerWaker.Go()
 	taskUpdatePusher.Go()
 	timeoutChecker.Go()
 	taskCleaner.Go()
+	taskLogJanitor.Go()
 	latestImageSystem.Go()
 	taskLogUploader.Go()
 	if workerRemover != nil {
 		workerRemover.Go()
 	}
+	if renderOutputVerifier != nil {
+		renderOutputVerifier.Go()
+	}
+	if previewMovieAssembler != nil {
+		previewMovieAssembler.Go()
+	}
+	if checkoutUsageTracker != nil {
+		// Scan before Shaman starts, so that its first cleanup knows which jobs use which checkouts.
+		checkoutUsageTracker.Scan(session.DB(""))
+		checkoutUsageTracker.Go()
+	}
 	if shamanServer != nil {
 		shamanServer.Go()
 	}
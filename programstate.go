@@ -48,10 +48,13 @@ var (
 	httpServer        httpserver.Server
 	latestImageSystem *flamenco.LatestImageSystem
 	mongoRunner       *bundledmongo.Runner
+	runtimeEstimator  *flamenco.RuntimeEstimator
 	session           *mgo.Session
 	sleeper           *flamenco.SleepScheduler
 	ssdp              *gossdp.Ssdp
 	taskCleaner       *flamenco.TaskCleaner
+	taskLogIndex      *flamenco.TaskLogIndex
+	taskLogJanitor    *flamenco.TaskLogJanitor
 	taskLogUploader   *flamenco.TaskLogUploader
 	taskScheduler     *flamenco.TaskScheduler
 	taskUpdatePusher  *flamenco.TaskUpdatePusher
@@ -59,10 +62,16 @@ var (
 	timeoutChecker    *flamenco.TimeoutChecker
 	upstream          *flamenco.UpstreamConnection
 	upstreamNotifier  *flamenco.UpstreamNotifier
+	workerQuarantine  *flamenco.WorkerQuarantine
 	workerRemover     *flamenco.WorkerRemover
+	workerWaker       *flamenco.WorkerWaker
 
 	shamanServer      *shaman.Server
 	dynamicPoolPoller *dppoller.Poller
+
+	renderOutputVerifier  *flamenco.RenderOutputVerifier
+	previewMovieAssembler *flamenco.PreviewMovieAssembler
+	checkoutUsageTracker  *flamenco.CheckoutUsageTracker
 )
 
 var shutdownComplete chan struct{}
@@ -100,6 +109,9 @@ func shutdown(signum os.Signal) {
 		if shamanServer != nil {
 			shamanServer.Close()
 		}
+		if checkoutUsageTracker != nil {
+			checkoutUsageTracker.Close()
+		}
 		jwtauth.CloseKeyStore()
 
 		if timeoutChecker != nil {
@@ -111,12 +123,24 @@ func shutdown(signum os.Signal) {
 		if taskLogUploader != nil {
 			taskLogUploader.Close()
 		}
+		if taskLogJanitor != nil {
+			taskLogJanitor.Close()
+		}
 		if upstream != nil {
 			upstream.Close()
 		}
 		if workerRemover != nil {
 			workerRemover.Close()
 		}
+		if renderOutputVerifier != nil {
+			renderOutputVerifier.Close()
+		}
+		if previewMovieAssembler != nil {
+			previewMovieAssembler.Close()
+		}
+		if workerWaker != nil {
+			workerWaker.Close()
+		}
 		if mongoRunner != nil {
 			mongoRunner.Close(session)
 		}
@@ -156,8 +180,10 @@ var cliArgs struct {
 	// Options that run a certain operation, then exit the process:
 	cleanSlate        bool
 	purgeQueue        bool
+	cleanLogs         bool
 	version           bool
 	garbageCollect    bool
+	shamanStats       bool
 	iKnowWhatIAmDoing bool
 
 	// Used for setup mode and restarting the process:
@@ -177,12 +203,14 @@ func parseCliArgs() {
 	flag.BoolVar(&cliArgs.jsonLog, "json", false, "Log in JSON format")
 	flag.BoolVar(&cliArgs.cleanSlate, "cleanslate", false, "Start with a clean slate; erases all tasks from the local MongoDB")
 	flag.BoolVar(&cliArgs.purgeQueue, "purgequeue", false, "Purges all queued task updates from the local MongoDB")
+	flag.BoolVar(&cliArgs.cleanLogs, "cleanlogs", false, "Runs the task log cleanup in dry-run mode, then exits.")
 	flag.BoolVar(&cliArgs.version, "version", false, "Show the version of Flamenco Manager")
 	flag.BoolVar(&cliArgs.setup, "setup", false, "Enter setup mode, enabling the web-based configuration system")
 
-	flag.BoolVar(&cliArgs.garbageCollect, "gc", false, "Runs the Shaman garbage collector in dry-run mode, then exits.")
+	flag.BoolVar(&cliArgs.garbageCollect, "gc", false, "Runs the Shaman checkout retention and garbage collector in dry-run mode, then exits.")
+	flag.BoolVar(&cliArgs.shamanStats, "shaman-stats", false, "Shows Shaman storage and deduplication statistics, then exits.")
 	flag.BoolVar(&cliArgs.iKnowWhatIAmDoing, "i-know-what-i-am-doing", false,
-		"Together with -gc runs the garbage collector for real (so DELETES FILES), then exits.")
+		"Together with -gc or -cleanlogs runs the garbage collector or task log cleanup for real (so DELETES FILES), then exits.")
 
 	flag.StringVar(&cliArgs.mode, "mode", "", "Run mode, either 'develop' or 'production'. Overrides the 'mode' in the configuration file.")
 	if runtime.GOOS == "windows" {
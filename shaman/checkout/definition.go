@@ -52,9 +52,9 @@ func (cfie FileInvalidError) Error() string {
 
 // DefinitionLine is a single line in a checkout definition file.
 type DefinitionLine struct {
-	Checksum string
-	FileSize int64
-	FilePath string
+	Checksum string `json:"checksum"`
+	FileSize int64  `json:"fileSize"`
+	FilePath string `json:"filePath"`
 }
 
 // DefinitionReader reads and parses a checkout definition
@@ -0,0 +1,167 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package checkout
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrCheckoutNotFound is returned when a checkout with the given ID does not exist.
+var ErrCheckoutNotFound = errors.New("A checkout with this ID does not exist")
+
+// Info describes an existing checkout.
+type Info struct {
+	CheckoutID   string `json:"checkoutID"`
+	RelativePath string `json:"relativePath"`
+	NumFiles     int    `json:"numFiles"`
+	TotalSize    int64  `json:"totalSize"`
+	// Modification time of the checkout directory, which is set when the checkout is created.
+	Created time.Time `json:"created"`
+}
+
+// ListCheckouts returns information about all checkouts, newest first.
+func (m *Manager) ListCheckouts() ([]Info, error) {
+	checkouts := []Info{}
+
+	// Checkouts are stored as {last two characters of ID}/{ID}, see pathForCheckoutID().
+	prefixDirs, err := ioutil.ReadDir(m.checkoutBasePath)
+	if err != nil {
+		packageLogger.WithError(err).Error("unable to list checkout directory")
+		return nil, err
+	}
+	for _, prefixDir := range prefixDirs {
+		if !prefixDir.IsDir() {
+			continue
+		}
+		checkoutDirs, err := ioutil.ReadDir(path.Join(m.checkoutBasePath, prefixDir.Name()))
+		if err != nil {
+			packageLogger.WithError(err).WithField("path", prefixDir.Name()).Warning("unable to list checkout directory; ignoring")
+			continue
+		}
+		for _, checkoutDir := range checkoutDirs {
+			checkoutID := checkoutDir.Name()
+			if !checkoutDir.IsDir() || !isValidCheckoutID(checkoutID) || !strings.HasSuffix(checkoutID, prefixDir.Name()) {
+				continue
+			}
+			info, _, err := m.inspectCheckout(checkoutID, false)
+			if err != nil {
+				continue
+			}
+			checkouts = append(checkouts, info)
+		}
+	}
+
+	sort.Slice(checkouts, func(i, j int) bool {
+		return checkouts[i].Created.After(checkouts[j].Created)
+	})
+	return checkouts, nil
+}
+
+// CheckoutInfo returns information about a single checkout.
+func (m *Manager) CheckoutInfo(checkoutID string) (Info, error) {
+	info, _, err := m.inspectCheckout(checkoutID, false)
+	return info, err
+}
+
+// CheckoutDefinition returns information about a single checkout, and the
+// definition it was created from, sorted by file path.
+func (m *Manager) CheckoutDefinition(checkoutID string) (Info, []DefinitionLine, error) {
+	return m.inspectCheckout(checkoutID, true)
+}
+
+// inspectCheckout reconstructs checkout information from the symlinks in the checkout.
+func (m *Manager) inspectCheckout(checkoutID string, withDefinition bool) (Info, []DefinitionLine, error) {
+	checkoutPaths, err := m.pathForCheckoutID(checkoutID)
+	if err != nil {
+		return Info{}, nil, err
+	}
+	logger := packageLogger.WithFields(logrus.Fields{
+		"checkoutPath": checkoutPaths.absolutePath,
+		"checkoutID":   checkoutID,
+	})
+
+	stat, err := os.Stat(checkoutPaths.absolutePath)
+	if err != nil || !stat.IsDir() {
+		if err != nil && !os.IsNotExist(err) {
+			logger.WithError(err).Error("unable to stat checkout directory")
+			return Info{}, nil, err
+		}
+		return Info{}, nil, ErrCheckoutNotFound
+	}
+
+	info := Info{
+		CheckoutID:   checkoutID,
+		RelativePath: checkoutPaths.RelativePath,
+		Created:      stat.ModTime(),
+	}
+	definition := []DefinitionLine{}
+
+	visit := func(linkPath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fileInfo.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+
+		blobPath, err := os.Readlink(linkPath)
+		if err != nil {
+			logger.WithError(err).WithField("linkPath", linkPath).Warning("unable to read symlink; ignoring")
+			return nil
+		}
+		checksum, filesize, err := m.fileStore.StoredFileInfo(blobPath)
+		if err != nil {
+			// Not a link into the file store, so not part of the checkout definition.
+			return nil
+		}
+
+		info.NumFiles++
+		info.TotalSize += filesize
+		if withDefinition {
+			relPath, err := filepath.Rel(checkoutPaths.absolutePath, linkPath)
+			if err != nil {
+				return err
+			}
+			definition = append(definition, DefinitionLine{checksum, filesize, filepath.ToSlash(relPath)})
+		}
+		return nil
+	}
+	if err := filepath.Walk(checkoutPaths.absolutePath, visit); err != nil {
+		logger.WithError(err).Error("unable to walk checkout directory")
+		return Info{}, nil, err
+	}
+
+	sort.Slice(definition, func(i, j int) bool {
+		return definition[i].FilePath < definition[j].FilePath
+	})
+	return info, definition, nil
+}
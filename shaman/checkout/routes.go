@@ -23,6 +23,7 @@
 package checkout
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
@@ -46,6 +47,9 @@ const (
 func (m *Manager) AddRoutes(router *mux.Router, auther jwtauth.Authenticator) {
 	router.Handle("/checkout/requirements", auther.WrapFunc(m.reportRequirements)).Methods("POST")
 	router.Handle("/checkout/create/{checkoutID}", auther.WrapFunc(m.createCheckout)).Methods("POST")
+	router.Handle("/checkouts", auther.WrapFunc(m.listCheckouts)).Methods("GET")
+	router.Handle("/checkouts/{checkoutID}", auther.WrapFunc(m.showCheckout)).Methods("GET")
+	router.Handle("/checkouts/{checkoutID}", auther.WrapFunc(m.deleteCheckout)).Methods("DELETE")
 }
 
 func (m *Manager) reportRequirements(w http.ResponseWriter, r *http.Request) {
@@ -189,3 +193,69 @@ func (m *Manager) createCheckout(w http.ResponseWriter, r *http.Request) {
 	checkoutOK = true // Prevent the checkout directory from being erased again.
 	logger.Info("checkout created")
 }
+
+func (m *Manager) listCheckouts(w http.ResponseWriter, r *http.Request) {
+	logger := packageLogger.WithFields(jwtauth.RequestLogFields(r))
+	logger.Debug("user requested list of checkouts")
+
+	checkouts, err := m.ListCheckouts()
+	if err != nil {
+		http.Error(w, "unable to list checkouts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(checkouts)
+}
+
+// checkoutWithDefinition is sent by showCheckout().
+type checkoutWithDefinition struct {
+	Info
+	Files []DefinitionLine `json:"files"`
+}
+
+func (m *Manager) showCheckout(w http.ResponseWriter, r *http.Request) {
+	checkoutID := mux.Vars(r)["checkoutID"]
+	logger := packageLogger.WithFields(jwtauth.RequestLogFields(r)).WithField("checkoutID", checkoutID)
+	logger.Debug("user requested checkout definition")
+
+	info, definition, err := m.CheckoutDefinition(checkoutID)
+	if err != nil {
+		sendCheckoutError(w, checkoutID, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(checkoutWithDefinition{info, definition})
+}
+
+func (m *Manager) deleteCheckout(w http.ResponseWriter, r *http.Request) {
+	checkoutID := mux.Vars(r)["checkoutID"]
+	logger := packageLogger.WithFields(jwtauth.RequestLogFields(r)).WithField("checkoutID", checkoutID)
+
+	if _, err := m.CheckoutInfo(checkoutID); err != nil {
+		sendCheckoutError(w, checkoutID, err)
+		return
+	}
+	if err := m.EraseCheckout(checkoutID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The files in the file store are left alone; the garbage collector removes them when unused.
+	logger.Info("checkout deleted by user")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func sendCheckoutError(w http.ResponseWriter, checkoutID string, err error) {
+	switch err {
+	case ErrInvalidCheckoutID:
+		http.Error(w, fmt.Sprintf("invalid checkout ID '%s'", checkoutID), http.StatusBadRequest)
+	case ErrCheckoutNotFound:
+		http.Error(w, fmt.Sprintf("checkout '%s' does not exist", checkoutID), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
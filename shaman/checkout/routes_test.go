@@ -23,6 +23,7 @@
 package checkout
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -123,3 +124,103 @@ func assertLinksTo(t *testing.T, linkPath, expectedTarget string) {
 	assert.Nil(t, err)
 	assert.Equal(t, expectedTarget, actualTarget)
 }
+
+func createTestCheckout(t *testing.T, manager *Manager, checkoutID string) {
+	defFile, err := ioutil.ReadFile("../_test_file_store/checkout_definition.txt")
+	assert.Nil(t, err)
+
+	respRec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/checkout/create/{checkoutID}", httpserver.CompressBuffer(defFile))
+	req = mux.SetURLVars(req, map[string]string{"checkoutID": checkoutID})
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Content-Encoding", "gzip")
+	manager.createCheckout(respRec, req)
+	assert.Equal(t, http.StatusOK, respRec.Code, respRec.Body.String())
+}
+
+func TestListCheckouts(t *testing.T) {
+	manager, cleanup := createTestManager()
+	defer cleanup()
+
+	filestore.LinkTestFileStore(manager.fileStore.BasePath())
+	createTestCheckout(t, manager, "jemoeder")
+	createTestCheckout(t, manager, "opjehoofd")
+
+	respRec := httptest.NewRecorder()
+	manager.listCheckouts(respRec, httptest.NewRequest("GET", "/checkouts", nil))
+	assert.Equal(t, http.StatusOK, respRec.Code)
+
+	checkouts := []Info{}
+	assert.Nil(t, json.NewDecoder(respRec.Body).Decode(&checkouts))
+	assert.Len(t, checkouts, 2)
+	for _, checkout := range checkouts {
+		assert.Equal(t, 4, checkout.NumFiles, checkout.CheckoutID)
+		assert.EqualValues(t, 3367+7488+486+7217, checkout.TotalSize, checkout.CheckoutID)
+		assert.False(t, checkout.Created.IsZero(), checkout.CheckoutID)
+	}
+	assert.ElementsMatch(t, []string{"jemoeder", "opjehoofd"},
+		[]string{checkouts[0].CheckoutID, checkouts[1].CheckoutID})
+}
+
+func TestShowCheckout(t *testing.T) {
+	manager, cleanup := createTestManager()
+	defer cleanup()
+
+	filestore.LinkTestFileStore(manager.fileStore.BasePath())
+	createTestCheckout(t, manager, "jemoeder")
+
+	respRec := httptest.NewRecorder()
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/checkouts/{checkoutID}", nil),
+		map[string]string{"checkoutID": "jemoeder"})
+	manager.showCheckout(respRec, req)
+	assert.Equal(t, http.StatusOK, respRec.Code)
+
+	checkout := checkoutWithDefinition{}
+	assert.Nil(t, json.NewDecoder(respRec.Body).Decode(&checkout))
+	assert.Equal(t, "er/jemoeder", checkout.RelativePath)
+	assert.Equal(t, []DefinitionLine{
+		{"80b749c27b2fef7255e7e7b3c2029b03b31299c75ff1f1c72732081c70a713a3", 7488, "feed.py"},
+		{"d6fc7289b5196cc96748ea72f882a22c39b8833b457fe854ef4c03a01f5db0d3", 7217, "filesystemstuff.py"},
+		{"914853599dd2c351ab7b82b219aae6e527e51518a667f0ff32244b0c94c75688", 486, "httpstuff.py"},
+		{"590c148428d5c35fab3ebad2f3365bb469ab9c531b60831f3e826c472027a0b9", 3367, "subdir/replacer.py"},
+	}, checkout.Files)
+
+	// Unknown and invalid checkouts.
+	respRec = httptest.NewRecorder()
+	req = mux.SetURLVars(httptest.NewRequest("GET", "/checkouts/{checkoutID}", nil),
+		map[string]string{"checkoutID": "unknown"})
+	manager.showCheckout(respRec, req)
+	assert.Equal(t, http.StatusNotFound, respRec.Code)
+
+	respRec = httptest.NewRecorder()
+	req = mux.SetURLVars(httptest.NewRequest("GET", "/checkouts/{checkoutID}", nil),
+		map[string]string{"checkoutID": "../../etc"})
+	manager.showCheckout(respRec, req)
+	assert.Equal(t, http.StatusBadRequest, respRec.Code)
+}
+
+func TestDeleteCheckout(t *testing.T) {
+	manager, cleanup := createTestManager()
+	defer cleanup()
+
+	filestore.LinkTestFileStore(manager.fileStore.BasePath())
+	createTestCheckout(t, manager, "jemoeder")
+
+	deleteRequest := func() *httptest.ResponseRecorder {
+		respRec := httptest.NewRecorder()
+		req := mux.SetURLVars(httptest.NewRequest("DELETE", "/checkouts/{checkoutID}", nil),
+			map[string]string{"checkoutID": "jemoeder"})
+		manager.deleteCheckout(respRec, req)
+		return respRec
+	}
+
+	assert.Equal(t, http.StatusNoContent, deleteRequest().Code)
+	_, err := os.Stat(path.Join(manager.checkoutBasePath, "er", "jemoeder"))
+	assert.True(t, os.IsNotExist(err), "checkout should have been removed")
+
+	// The stored files should be left for the garbage collector.
+	assert.FileExists(t, path.Join(manager.fileStore.StoragePath(),
+		"80", "b749c27b2fef7255e7e7b3c2029b03b31299c75ff1f1c72732081c70a713a3", "7488.blob"))
+
+	assert.Equal(t, http.StatusNotFound, deleteRequest().Code)
+}
@@ -49,6 +49,8 @@ func (s *Server) periodicCleanup() {
 	defer s.wg.Done()
 
 	for {
+		// Removing checkouts first allows their files to be garbage collected.
+		s.RemoveExpiredCheckouts(false)
 		s.GCStorage(false)
 
 		select {
@@ -37,7 +37,8 @@ type Config struct {
 	FileStorePath string `yaml:"fileStorePath"`
 	CheckoutPath  string `yaml:"checkoutPath"`
 
-	GarbageCollect GarbageCollect `yaml:"garbageCollect"`
+	GarbageCollect    GarbageCollect    `yaml:"garbageCollect"`
+	CheckoutRetention CheckoutRetention `yaml:"checkoutRetention"`
 }
 
 // GarbageCollect contains the config options for the GC.
@@ -53,3 +54,13 @@ type GarbageCollect struct {
 	// while we're performing a manual sweep.
 	SilentlyDisable bool `yaml:"-"`
 }
+
+// CheckoutRetention contains the config options for removing checkouts.
+// Only checkouts in CheckoutPath are removed, never those in ExtraCheckoutDirs.
+type CheckoutRetention struct {
+	// Checkouts are removed when they haven't been used by any job for this long. 0 disables this.
+	MaxIdle time.Duration `yaml:"maxIdle"`
+	// Checkouts used by jobs are removed this long after those jobs finished, provided that
+	// no job used them in the meantime. 0 disables this.
+	AfterJobFinished time.Duration `yaml:"afterJobFinished"`
+}
@@ -25,7 +25,9 @@ package filestore
 import (
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/armadillica/flamenco-manager/shaman/config"
 	"github.com/sirupsen/logrus"
@@ -194,3 +196,31 @@ func (s *Store) RemoveStoredFile(filePath string) error {
 	}
 	return s.removeFile(filePath)
 }
+
+// StoredFileInfo returns the checksum and file size of a file in the 'stored' storage bin.
+// This is the inverse of the path construction in partialFilePath().
+func (s *Store) StoredFileInfo(filePath string) (checksum string, filesize int64, err error) {
+	// Symlinks in checkouts point to absolute paths, even when the store path is relative.
+	prefix := s.stored.storagePrefix("") + "/"
+	if path.IsAbs(filePath) && !path.IsAbs(prefix) {
+		if absPrefix, err := filepath.Abs(prefix); err == nil {
+			prefix = absPrefix + "/"
+		}
+	}
+	if !strings.HasPrefix(filePath, prefix) {
+		return "", 0, ErrNotInStored
+	}
+
+	partial := strings.TrimPrefix(filePath, prefix)
+	partial = strings.TrimSuffix(partial, s.stored.fileSuffix)
+	parts := strings.Split(partial, "/")
+	if len(parts) != 3 {
+		return "", 0, ErrNotInStored
+	}
+
+	filesize, err = strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "", 0, ErrNotInStored
+	}
+	return parts[0] + parts[1], filesize, nil
+}
@@ -153,3 +153,20 @@ func assertDoesNotExist(t *testing.T, path string) {
 	_, err := os.Stat(path)
 	assert.True(t, os.IsNotExist(err), "%s should not exist, err=%v", path, err)
 }
+
+func TestStoredFileInfo(t *testing.T) {
+	store := CreateTestStore()
+	defer CleanupTestStore(store)
+
+	checksum, filesize, err := store.StoredFileInfo(path.Join(store.baseDir, "stored", "ab", "cdefxxx", "123.blob"))
+	assert.Nil(t, err)
+	assert.Equal(t, "abcdefxxx", checksum)
+	assert.EqualValues(t, 123, filesize)
+
+	_, _, err = store.StoredFileInfo(path.Join(store.baseDir, "uploading", "ab", "cdefxxx", "123-4567.tmp"))
+	assert.Equal(t, ErrNotInStored, err)
+	_, _, err = store.StoredFileInfo(path.Join(store.baseDir, "stored", "ab", "123.blob"))
+	assert.Equal(t, ErrNotInStored, err)
+	_, _, err = store.StoredFileInfo(path.Join(store.baseDir, "stored", "ab", "cdefxxx", "size.blob"))
+	assert.Equal(t, ErrNotInStored, err)
+}
@@ -52,6 +52,10 @@ type Storage interface {
 	// RemoveStoredFile removes a file from the 'stored' storage bin.
 	// This is intended to garbage collect old, unused files.
 	RemoveStoredFile(filePath string) error
+
+	// StoredFileInfo returns the checksum and file size of a file in the 'stored' storage bin.
+	// This only looks at the path, and does not check that the file exists.
+	StoredFileInfo(filePath string) (checksum string, filesize int64, err error)
 }
 
 // FileStatus represents the status of a file in the store.
@@ -78,4 +82,5 @@ const (
 var (
 	ErrFileDoesNotExist = errors.New("file does not exist")
 	ErrNotInUploading   = errors.New("file not stored in 'uploading' storage")
+	ErrNotInStored      = errors.New("file not stored in 'stored' storage")
 )
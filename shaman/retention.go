@@ -0,0 +1,187 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package shaman
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/armadillica/flamenco-manager/jwtauth"
+	"github.com/armadillica/flamenco-manager/shaman/checkout"
+	"github.com/sirupsen/logrus"
+)
+
+// Reasons for removing a checkout.
+const (
+	retentionReasonIdle        = "idle"
+	retentionReasonJobFinished = "job-finished"
+)
+
+// CheckoutUsage describes how jobs use a checkout.
+//
+// The provider may not know all tasks of a job; Flamenco Manager only knows the tasks
+// the Server sent it. This is why a checkout of finished jobs is only removed when no
+// job has used it for CheckoutRetention.AfterJobFinished either.
+type CheckoutUsage struct {
+	// Last time a job was seen using the checkout.
+	LastUsed time.Time
+	// When the jobs using the checkout were last seen finishing; nil while any job using it is unfinished.
+	JobsFinished *time.Time
+}
+
+// CheckoutUsageProvider knows which jobs use which checkouts.
+// Shaman itself knows nothing about jobs, so this is provided by Flamenco Manager.
+type CheckoutUsageProvider interface {
+	// CheckoutUsage returns how the checkout is used. When no job is known to
+	// use the checkout, found is false. When err is not nil, no checkout is removed.
+	CheckoutUsage(checkoutID string) (usage CheckoutUsage, found bool, err error)
+}
+
+// ExpiredCheckout is a checkout that should be removed according to the retention policy.
+type ExpiredCheckout struct {
+	checkout.Info
+	LastUsed     time.Time  `json:"lastUsed"`
+	JobsFinished *time.Time `json:"jobsFinished,omitempty"`
+	Reason       string     `json:"reason"`
+}
+
+// SetCheckoutUsageProvider sets the provider for job information used by the retention policy.
+// Without provider, checkouts are removed when they were created more than maxIdle ago.
+func (s *Server) SetCheckoutUsageProvider(provider CheckoutUsageProvider) {
+	s.usageProvider = provider
+}
+
+// retentionEnabled returns whether checkouts can be removed at all.
+func (s *Server) retentionEnabled() bool {
+	retention := s.config.CheckoutRetention
+	return retention.MaxIdle > 0 || retention.AfterJobFinished > 0
+}
+
+// ExpiredCheckouts returns the checkouts that should be removed according to the retention policy.
+func (s *Server) ExpiredCheckouts() ([]ExpiredCheckout, error) {
+	expired := []ExpiredCheckout{}
+	if !s.retentionEnabled() {
+		return expired, nil
+	}
+
+	checkouts, err := s.checkoutMan.ListCheckouts()
+	if err != nil {
+		return nil, err
+	}
+
+	retention := s.config.CheckoutRetention
+	now := time.Now()
+	for _, info := range checkouts {
+		var usage CheckoutUsage
+		var found bool
+		if s.usageProvider != nil {
+			usage, found, err = s.usageProvider.CheckoutUsage(info.CheckoutID)
+			if err != nil {
+				// Without knowing which jobs use the checkouts, it's not safe to remove any of them.
+				return nil, err
+			}
+		}
+
+		lastUsed := info.Created
+		if found && usage.LastUsed.After(lastUsed) {
+			lastUsed = usage.LastUsed
+		}
+		if found && usage.JobsFinished == nil {
+			// Never pull the files from under a job that may still need them.
+			continue
+		}
+
+		var reason string
+		switch {
+		case found && retention.AfterJobFinished > 0 &&
+			now.Sub(*usage.JobsFinished) > retention.AfterJobFinished &&
+			now.Sub(lastUsed) > retention.AfterJobFinished:
+			reason = retentionReasonJobFinished
+		case retention.MaxIdle > 0 && now.Sub(lastUsed) > retention.MaxIdle:
+			reason = retentionReasonIdle
+		default:
+			continue
+		}
+		expired = append(expired, ExpiredCheckout{info, lastUsed, usage.JobsFinished, reason})
+	}
+
+	return expired, nil
+}
+
+// RemoveExpiredCheckouts removes the checkouts that should be removed according to the
+// retention policy. The files they use are left for the garbage collector.
+func (s *Server) RemoveExpiredCheckouts(doDryRun bool) []ExpiredCheckout {
+	if !s.retentionEnabled() {
+		return nil
+	}
+
+	logger := packageLogger.WithField("checkoutPath", s.config.CheckoutPath)
+	if doDryRun {
+		logger = logger.WithField("dryRun", doDryRun)
+	}
+
+	expired, err := s.ExpiredCheckouts()
+	if err != nil {
+		logger.WithError(err).Error("unable to find expired checkouts")
+		return nil
+	}
+	if len(expired) == 0 {
+		logger.Debug("found no expired checkouts")
+		return expired
+	}
+
+	for _, checkout := range expired {
+		checkoutLogger := logger.WithFields(logrus.Fields{
+			"checkoutID": checkout.CheckoutID,
+			"lastUsed":   checkout.LastUsed,
+			"reason":     checkout.Reason,
+			"totalSize":  humanizeByteSize(checkout.TotalSize),
+		})
+		if doDryRun {
+			checkoutLogger.Info("would remove expired checkout")
+			continue
+		}
+		checkoutLogger.Info("removing expired checkout")
+		// Errors are logged by EraseCheckout, and the checkout will be retried at the next cleanup.
+		s.checkoutMan.EraseCheckout(checkout.CheckoutID)
+	}
+
+	return expired
+}
+
+// sendExpiredCheckouts shows which checkouts the retention policy would remove, without removing them.
+func (s *Server) sendExpiredCheckouts(w http.ResponseWriter, r *http.Request) {
+	logger := packageLogger.WithFields(jwtauth.RequestLogFields(r))
+	logger.Debug("user requested checkout retention preview")
+
+	expired, err := s.ExpiredCheckouts()
+	if err != nil {
+		http.Error(w, "unable to find expired checkouts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(expired)
+}
@@ -0,0 +1,208 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package shaman
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/armadillica/flamenco-manager/shaman/filestore"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeUsageProvider map[string]CheckoutUsage
+
+func (f fakeUsageProvider) CheckoutUsage(checkoutID string) (CheckoutUsage, bool, error) {
+	if checkoutID == "error" {
+		return CheckoutUsage{}, false, errors.New("unit test error")
+	}
+	usage, found := f[checkoutID]
+	return usage, found, nil
+}
+
+// createRetentionCheckout creates a checkout whose directory was last modified 'age' ago.
+func createRetentionCheckout(t *testing.T, server *Server, checkoutID string, age time.Duration) string {
+	blobPath := path.Join(server.config.FileStorePath,
+		"stored/dc/89f15de821ad1df3e78f8ef455e653a2d1862f2eb3f5ee78aa4ca68eb6fb35/781.blob")
+	relPath := path.Join(checkoutID[len(checkoutID)-2:], checkoutID)
+	assert.Nil(t, server.checkoutMan.SymlinkToCheckout(blobPath, server.config.CheckoutPath, path.Join(relPath, "shot.blend")))
+
+	absPath := path.Join(server.config.CheckoutPath, relPath)
+	mtime := time.Now().Add(-age)
+	assert.Nil(t, os.Chtimes(absPath, mtime, mtime))
+	return absPath
+}
+
+func expiredIDs(expired []ExpiredCheckout) map[string]string {
+	reasons := map[string]string{}
+	for _, checkout := range expired {
+		reasons[checkout.CheckoutID] = checkout.Reason
+	}
+	return reasons
+}
+
+func TestRetentionDisabled(t *testing.T) {
+	server, cleanup := createTestShaman()
+	defer cleanup()
+	filestore.LinkTestFileStore(server.config.FileStorePath)
+
+	createRetentionCheckout(t, server, "ancient", 1000*24*time.Hour)
+
+	expired, err := server.ExpiredCheckouts()
+	assert.Nil(t, err)
+	assert.Empty(t, expired)
+	assert.Nil(t, server.RemoveExpiredCheckouts(false))
+	assert.DirExists(t, path.Join(server.config.CheckoutPath, "nt", "ancient"))
+}
+
+func TestRetentionWithoutProvider(t *testing.T) {
+	server, cleanup := createTestShaman()
+	defer cleanup()
+	filestore.LinkTestFileStore(server.config.FileStorePath)
+	server.config.CheckoutRetention.MaxIdle = 7 * 24 * time.Hour
+
+	createRetentionCheckout(t, server, "old_checkout", 8*24*time.Hour)
+	createRetentionCheckout(t, server, "new_checkout", 6*24*time.Hour)
+
+	expired, err := server.ExpiredCheckouts()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"old_checkout": retentionReasonIdle}, expiredIDs(expired))
+}
+
+func TestRetentionWithProvider(t *testing.T) {
+	server, cleanup := createTestShaman()
+	defer cleanup()
+	filestore.LinkTestFileStore(server.config.FileStorePath)
+	server.config.CheckoutRetention.MaxIdle = 7 * 24 * time.Hour
+	server.config.CheckoutRetention.AfterJobFinished = 2 * 24 * time.Hour
+
+	now := time.Now()
+	daysAgo := func(days int) time.Time { return now.Add(time.Duration(-days) * 24 * time.Hour) }
+	longAgo := daysAgo(8)
+	recently := daysAgo(1)
+	lastWeek := daysAgo(3)
+
+	server.SetCheckoutUsageProvider(fakeUsageProvider{
+		// Old checkout, but still used by an active job.
+		"job_active": CheckoutUsage{LastUsed: now},
+		// Old checkout, but its job finished recently.
+		"job_finished_recently": CheckoutUsage{LastUsed: recently, JobsFinished: &recently},
+		// Its job finished long enough ago, even though the checkout hasn't been idle for maxIdle.
+		"job_finished_last_week": CheckoutUsage{LastUsed: lastWeek, JobsFinished: &lastWeek},
+		// Its job finished long enough ago, but the Manager has seen it used since.
+		// The Manager may not have been sent all tasks of the job at once.
+		"job_used_since": CheckoutUsage{LastUsed: recently, JobsFinished: &lastWeek},
+		// Its job finished a while ago, and it's been idle ever since.
+		"job_finished_long_ago": CheckoutUsage{LastUsed: longAgo, JobsFinished: &longAgo},
+	})
+
+	createRetentionCheckout(t, server, "job_active", 30*24*time.Hour)
+	createRetentionCheckout(t, server, "job_finished_recently", 30*24*time.Hour)
+	createRetentionCheckout(t, server, "job_finished_last_week", 4*24*time.Hour)
+	createRetentionCheckout(t, server, "job_used_since", 30*24*time.Hour)
+	createRetentionCheckout(t, server, "job_finished_long_ago", 9*24*time.Hour)
+	createRetentionCheckout(t, server, "no_job_idle", 30*24*time.Hour)
+	createRetentionCheckout(t, server, "no_job_fresh", 1*24*time.Hour)
+
+	expectExpired := map[string]string{
+		"job_finished_last_week": retentionReasonJobFinished,
+		"job_finished_long_ago":  retentionReasonJobFinished,
+		"no_job_idle":            retentionReasonIdle,
+	}
+
+	// Dry runs should not remove anything.
+	expired := server.RemoveExpiredCheckouts(true)
+	assert.Equal(t, expectExpired, expiredIDs(expired))
+	assert.DirExists(t, path.Join(server.config.CheckoutPath, "go", "job_finished_long_ago"))
+	assert.DirExists(t, path.Join(server.config.CheckoutPath, "le", "no_job_idle"))
+
+	expired = server.RemoveExpiredCheckouts(false)
+	assert.Equal(t, expectExpired, expiredIDs(expired))
+	for _, checkout := range expired {
+		assert.False(t, checkout.LastUsed.IsZero())
+	}
+
+	remaining, err := server.checkoutMan.ListCheckouts()
+	assert.Nil(t, err)
+	remainingIDs := []string{}
+	for _, info := range remaining {
+		remainingIDs = append(remainingIDs, info.CheckoutID)
+	}
+	assert.ElementsMatch(t, []string{"job_active", "job_finished_recently", "job_used_since", "no_job_fresh"}, remainingIDs)
+
+	// The removed checkouts should not be found any more.
+	expired, err = server.ExpiredCheckouts()
+	assert.Nil(t, err)
+	assert.Empty(t, expired)
+}
+
+func TestRetentionAfterJobFinished(t *testing.T) {
+	server, cleanup := createTestShaman()
+	defer cleanup()
+	filestore.LinkTestFileStore(server.config.FileStorePath)
+	server.config.CheckoutRetention.AfterJobFinished = 7 * 24 * time.Hour
+
+	finishedRecently := time.Now().Add(-3 * 24 * time.Hour)
+	finishedLongAgo := time.Now().Add(-10 * 24 * time.Hour)
+	server.SetCheckoutUsageProvider(fakeUsageProvider{
+		"job_finished_recently": CheckoutUsage{LastUsed: finishedRecently, JobsFinished: &finishedRecently},
+		"job_finished_long_ago": CheckoutUsage{LastUsed: finishedLongAgo, JobsFinished: &finishedLongAgo},
+	})
+	createRetentionCheckout(t, server, "job_finished_recently", 30*24*time.Hour)
+	createRetentionCheckout(t, server, "job_finished_long_ago", 30*24*time.Hour)
+	createRetentionCheckout(t, server, "no_job_idle", 30*24*time.Hour)
+
+	// Without maxIdle only checkouts of finished jobs are removed.
+	expired, err := server.ExpiredCheckouts()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"job_finished_long_ago": retentionReasonJobFinished}, expiredIDs(expired))
+
+	server.config.CheckoutRetention.MaxIdle = 20 * 24 * time.Hour
+	expired, err = server.ExpiredCheckouts()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"job_finished_long_ago": retentionReasonJobFinished,
+		"no_job_idle":           retentionReasonIdle,
+	}, expiredIDs(expired))
+}
+
+func TestRetentionProviderError(t *testing.T) {
+	server, cleanup := createTestShaman()
+	defer cleanup()
+	filestore.LinkTestFileStore(server.config.FileStorePath)
+	server.config.CheckoutRetention.MaxIdle = 7 * 24 * time.Hour
+	server.SetCheckoutUsageProvider(fakeUsageProvider{})
+
+	createRetentionCheckout(t, server, "no_job_idle", 30*24*time.Hour)
+	createRetentionCheckout(t, server, "error", 30*24*time.Hour)
+
+	_, err := server.ExpiredCheckouts()
+	assert.NotNil(t, err)
+
+	assert.Nil(t, server.RemoveExpiredCheckouts(false))
+	assert.DirExists(t, path.Join(server.config.CheckoutPath, "le", "no_job_idle"))
+	assert.DirExists(t, path.Join(server.config.CheckoutPath, "or", "error"))
+}
@@ -43,6 +43,9 @@ type Server struct {
 	fileServer  *fileserver.FileServer
 	checkoutMan *checkout.Manager
 
+	// Provides job information for the checkout retention policy; may be nil.
+	usageProvider CheckoutUsageProvider
+
 	shutdownChan chan struct{}
 	wg           sync.WaitGroup
 }
@@ -65,6 +68,7 @@ func NewServer(conf config.Config, auther jwtauth.Authenticator) *Server {
 		fileStore,
 		fileServer,
 		checkoutMan,
+		nil,
 
 		make(chan struct{}),
 		sync.WaitGroup{},
@@ -93,6 +97,8 @@ func (s *Server) Go() {
 func (s *Server) AddRoutes(router *mux.Router) {
 	s.checkoutMan.AddRoutes(router, s.auther)
 	s.fileServer.AddRoutes(router, s.auther)
+	router.Handle("/storage-stats", s.auther.WrapFunc(s.sendStorageStats)).Methods("GET")
+	router.Handle("/checkout-retention", s.auther.WrapFunc(s.sendExpiredCheckouts)).Methods("GET")
 
 	httpserver.RegisterTestRoutes(router, s.auther)
 }
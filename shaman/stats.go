@@ -0,0 +1,304 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package shaman
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/armadillica/flamenco-manager/jwtauth"
+	"github.com/sirupsen/logrus"
+)
+
+// Number of blobs reported in StorageStats.LargestBlobs.
+const storageStatsLargestBlobs = 10
+
+// StorageStats describes what deduplication in the file store saves.
+type StorageStats struct {
+	NumBlobs    int   `json:"numBlobs"`
+	StoredBytes int64 `json:"storedBytes"`
+
+	// Sum of the sizes of all symlinked files in all checkouts, i.e. what the
+	// checkouts would take up without deduplication.
+	NumSymlinks     int   `json:"numSymlinks"`
+	ReferencedBytes int64 `json:"referencedBytes"`
+
+	// Blobs not referenced by any checkout; these will be garbage collected once old enough.
+	NumUnreferencedBlobs int   `json:"numUnreferencedBlobs"`
+	UnreferencedBytes    int64 `json:"unreferencedBytes"`
+
+	// ReferencedBytes divided by the bytes of the referenced blobs.
+	DedupRatio float64 `json:"dedupRatio"`
+
+	LargestBlobs []BlobStats     `json:"largestBlobs"`
+	Checkouts    []CheckoutStats `json:"checkouts"`
+}
+
+// BlobStats describes a single file in the file store.
+type BlobStats struct {
+	Path          string `json:"path"` // Relative to the file store's 'stored' directory.
+	Size          int64  `json:"size"`
+	NumReferences int    `json:"numReferences"`
+}
+
+// CheckoutStats describes the storage used by a single checkout.
+type CheckoutStats struct {
+	Path            string `json:"path"`
+	NumSymlinks     int    `json:"numSymlinks"`
+	ReferencedBytes int64  `json:"referencedBytes"`
+	// Size of the blobs that are only used by this checkout. This is what
+	// would be garbage collected after removing the checkout.
+	UniqueBytes int64 `json:"uniqueBytes"`
+}
+
+// Per-blob bookkeeping while gathering the statistics.
+type blobUsage struct {
+	size      int64
+	checkouts map[string]int // Checkout path to number of symlinks to the blob.
+}
+
+// StorageStats inspects the file store and all checkouts to report on deduplication.
+// This walks the entire file store and checkout directories, so it can take a while.
+func (s *Server) StorageStats() (StorageStats, error) {
+	stats := StorageStats{
+		LargestBlobs: []BlobStats{},
+		Checkouts:    []CheckoutStats{},
+	}
+
+	storagePath := s.fileStore.StoragePath()
+	if resolved, err := filepath.EvalSymlinks(storagePath); err == nil {
+		storagePath = resolved
+	}
+	logger := packageLogger.WithField("fileStorePath", storagePath)
+	logger.Debug("gathering storage statistics")
+
+	blobs, err := s.statsFindBlobs(storagePath, logger)
+	if err != nil {
+		return stats, err
+	}
+
+	dirsToCheck := []string{s.config.CheckoutPath}
+	dirsToCheck = append(dirsToCheck, s.config.GarbageCollect.ExtraCheckoutDirs...)
+	for _, checkDir := range dirsToCheck {
+		if err := s.statsFindSymlinks(checkDir, blobs, logger); err != nil {
+			return stats, err
+		}
+	}
+
+	checkouts := map[string]*CheckoutStats{}
+	var dedupedBytes int64
+	for blobPath, usage := range blobs {
+		numReferences := 0
+		for checkoutPath, numLinks := range usage.checkouts {
+			checkout := checkouts[checkoutPath]
+			if checkout == nil {
+				checkout = &CheckoutStats{Path: checkoutPath}
+				checkouts[checkoutPath] = checkout
+			}
+			checkout.NumSymlinks += numLinks
+			checkout.ReferencedBytes += int64(numLinks) * usage.size
+			if len(usage.checkouts) == 1 {
+				checkout.UniqueBytes += usage.size
+			}
+			numReferences += numLinks
+		}
+
+		stats.NumBlobs++
+		stats.StoredBytes += usage.size
+		stats.NumSymlinks += numReferences
+		stats.ReferencedBytes += int64(numReferences) * usage.size
+		if numReferences == 0 {
+			stats.NumUnreferencedBlobs++
+			stats.UnreferencedBytes += usage.size
+		} else {
+			dedupedBytes += usage.size
+		}
+
+		relPath, err := filepath.Rel(storagePath, blobPath)
+		if err != nil {
+			relPath = blobPath
+		}
+		stats.LargestBlobs = append(stats.LargestBlobs, BlobStats{relPath, usage.size, numReferences})
+	}
+
+	if dedupedBytes > 0 {
+		stats.DedupRatio = float64(stats.ReferencedBytes) / float64(dedupedBytes)
+	}
+
+	sort.Slice(stats.LargestBlobs, func(i, j int) bool {
+		if stats.LargestBlobs[i].Size != stats.LargestBlobs[j].Size {
+			return stats.LargestBlobs[i].Size > stats.LargestBlobs[j].Size
+		}
+		return stats.LargestBlobs[i].Path < stats.LargestBlobs[j].Path
+	})
+	if len(stats.LargestBlobs) > storageStatsLargestBlobs {
+		stats.LargestBlobs = stats.LargestBlobs[:storageStatsLargestBlobs]
+	}
+
+	for _, checkout := range checkouts {
+		stats.Checkouts = append(stats.Checkouts, *checkout)
+	}
+	sort.Slice(stats.Checkouts, func(i, j int) bool {
+		return stats.Checkouts[i].Path < stats.Checkouts[j].Path
+	})
+
+	logger.WithFields(logrus.Fields{
+		"numBlobs":        stats.NumBlobs,
+		"storedBytes":     stats.StoredBytes,
+		"referencedBytes": stats.ReferencedBytes,
+		"dedupRatio":      stats.DedupRatio,
+	}).Debug("gathered storage statistics")
+	return stats, nil
+}
+
+// statsFindBlobs returns the size of every file in the file store.
+func (s *Server) statsFindBlobs(storagePath string, logger *logrus.Entry) (map[string]*blobUsage, error) {
+	blobs := map[string]*blobUsage{}
+	visit := func(path string, info os.FileInfo, err error) error {
+		select {
+		case <-s.shutdownChan:
+			return filepath.SkipDir
+		default:
+		}
+
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		blobs[path] = &blobUsage{info.Size(), map[string]int{}}
+		return nil
+	}
+	if err := filepath.Walk(storagePath, visit); err != nil {
+		logger.WithError(err).Error("unable to walk file store path to gather statistics")
+		return nil, err
+	}
+	return blobs, nil
+}
+
+// statsFindSymlinks counts the symlinks to the blobs, per checkout.
+// Checkouts are the directories two levels below checkoutRoot, as created by
+// the checkout manager; symlinks higher up are attributed to checkoutRoot itself.
+func (s *Server) statsFindSymlinks(checkoutRoot string, blobs map[string]*blobUsage, logger *logrus.Entry) error {
+	logger = logger.WithField("checkoutPath", checkoutRoot)
+
+	visit := func(path string, info os.FileInfo, err error) error {
+		select {
+		case <-s.shutdownChan:
+			return filepath.SkipDir
+		default:
+		}
+
+		if err != nil {
+			if os.IsNotExist(err) && path == checkoutRoot {
+				// Extra checkout directories do not have to exist.
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() || info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+
+		linkTarget, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.WithFields(logrus.Fields{
+					"linkPath":      path,
+					logrus.ErrorKey: err,
+				}).Warning("unable to determine target of symlink; ignoring")
+			}
+			return nil
+		}
+		usage, found := blobs[linkTarget]
+		if !found {
+			// Links to outside the file store are not our concern.
+			return nil
+		}
+		usage.checkouts[checkoutOfPath(checkoutRoot, path)]++
+		return nil
+	}
+	if err := filepath.Walk(checkoutRoot, visit); err != nil {
+		logger.WithError(err).Error("unable to walk checkout path to gather statistics")
+		return err
+	}
+	return nil
+}
+
+// checkoutOfPath returns the checkout directory containing the path.
+func checkoutOfPath(checkoutRoot, path string) string {
+	relPath, err := filepath.Rel(checkoutRoot, path)
+	if err != nil {
+		return checkoutRoot
+	}
+	parts := strings.SplitN(filepath.ToSlash(relPath), "/", 3)
+	if len(parts) < 3 {
+		return checkoutRoot
+	}
+	return filepath.Join(checkoutRoot, parts[0], parts[1])
+}
+
+// WriteReport writes the statistics in human-readable form.
+func (stats StorageStats) WriteReport(w io.Writer) {
+	fmt.Fprintf(w, "Stored blobs       : %d (%s)\n", stats.NumBlobs, humanizeByteSize(stats.StoredBytes))
+	fmt.Fprintf(w, "Referenced by links: %d (%s)\n", stats.NumSymlinks, humanizeByteSize(stats.ReferencedBytes))
+	fmt.Fprintf(w, "Unreferenced blobs : %d (%s)\n", stats.NumUnreferencedBlobs, humanizeByteSize(stats.UnreferencedBytes))
+	fmt.Fprintf(w, "Deduplication ratio: %.2f\n", stats.DedupRatio)
+
+	if len(stats.LargestBlobs) > 0 {
+		fmt.Fprintln(w, "\nLargest blobs:")
+		for _, blob := range stats.LargestBlobs {
+			fmt.Fprintf(w, "  %10s  %4d links  %s\n", humanizeByteSize(blob.Size), blob.NumReferences, blob.Path)
+		}
+	}
+
+	if len(stats.Checkouts) > 0 {
+		fmt.Fprintln(w, "\nCheckouts (referenced / unique):")
+		for _, checkout := range stats.Checkouts {
+			fmt.Fprintf(w, "  %10s / %10s  %s\n",
+				humanizeByteSize(checkout.ReferencedBytes), humanizeByteSize(checkout.UniqueBytes), checkout.Path)
+		}
+	}
+}
+
+func (s *Server) sendStorageStats(w http.ResponseWriter, r *http.Request) {
+	logger := packageLogger.WithFields(jwtauth.RequestLogFields(r))
+	logger.Debug("user requested storage statistics")
+
+	stats, err := s.StorageStats()
+	if err != nil {
+		http.Error(w, "unable to gather storage statistics", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(stats)
+}
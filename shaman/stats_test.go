@@ -0,0 +1,102 @@
+/* (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package shaman
+
+import (
+	"bytes"
+	"path"
+	"testing"
+
+	"github.com/armadillica/flamenco-manager/shaman/filestore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorageStats(t *testing.T) {
+	server, cleanup := createTestShaman()
+	defer cleanup()
+
+	extraCheckoutDir := path.Join(server.config.TestTempDir, "extra-checkout")
+	server.config.GarbageCollect.ExtraCheckoutDirs = []string{extraCheckoutDir}
+
+	filestore.LinkTestFileStore(server.config.FileStorePath)
+	blobPath := func(relPath string) string {
+		return path.Join(server.config.FileStorePath, "stored", relPath)
+	}
+	blob3367 := blobPath("59/0c148428d5c35fab3ebad2f3365bb469ab9c531b60831f3e826c472027a0b9/3367.blob")
+	blob781 := blobPath("dc/89f15de821ad1df3e78f8ef455e653a2d1862f2eb3f5ee78aa4ca68eb6fb35/781.blob")
+	blob7488 := blobPath("80/b749c27b2fef7255e7e7b3c2029b03b31299c75ff1f1c72732081c70a713a3/7488.blob")
+
+	// Links into the checkout layout used by the checkout manager, "{last 2 chars}/{checkout ID}".
+	link := func(blobPath, checkoutRoot, checkoutID, relPath string) {
+		relPath = path.Join(checkoutID[len(checkoutID)-2:], checkoutID, relPath)
+		assert.Nil(t, server.checkoutMan.SymlinkToCheckout(blobPath, checkoutRoot, relPath))
+	}
+
+	// Checkout A uses a file twice, and one file nobody else uses.
+	link(blob3367, server.config.CheckoutPath, "aaaa", "textures/one.png")
+	link(blob3367, server.config.CheckoutPath, "aaaa", "textures/two.png")
+	link(blob781, server.config.CheckoutPath, "aaaa", "shot.blend")
+	// Checkout B shares a file with A.
+	link(blob3367, server.config.CheckoutPath, "bbbb", "textures/three.png")
+	// Old checkouts can live in the extra checkout directories.
+	link(blob7488, extraCheckoutDir, "cccc", "shot.blend")
+
+	stats, err := server.StorageStats()
+	assert.Nil(t, err)
+
+	assert.Equal(t, 8, stats.NumBlobs)
+	assert.EqualValues(t, 39463, stats.StoredBytes)
+	assert.Equal(t, 5, stats.NumSymlinks)
+	assert.EqualValues(t, 3*3367+781+7488, stats.ReferencedBytes)
+	assert.Equal(t, 5, stats.NumUnreferencedBlobs)
+	assert.EqualValues(t, 39463-3367-781-7488, stats.UnreferencedBytes)
+	assert.InDelta(t, float64(3*3367+781+7488)/float64(3367+781+7488), stats.DedupRatio, 0.0001)
+
+	assert.Len(t, stats.LargestBlobs, 8)
+	assert.Equal(t, BlobStats{"80/b749c27b2fef7255e7e7b3c2029b03b31299c75ff1f1c72732081c70a713a3/7488.blob", 7488, 1},
+		stats.LargestBlobs[0])
+	assert.Equal(t, BlobStats{"59/0c148428d5c35fab3ebad2f3365bb469ab9c531b60831f3e826c472027a0b9/3367.blob", 3367, 3},
+		stats.LargestBlobs[5])
+
+	assert.Equal(t, []CheckoutStats{
+		{path.Join(server.config.CheckoutPath, "aa", "aaaa"), 3, 2*3367 + 781, 781},
+		{path.Join(server.config.CheckoutPath, "bb", "bbbb"), 1, 3367, 0},
+		{path.Join(extraCheckoutDir, "cc", "cccc"), 1, 7488, 7488},
+	}, stats.Checkouts)
+
+	report := bytes.Buffer{}
+	stats.WriteReport(&report)
+	assert.Contains(t, report.String(), "Stored blobs       : 8 (38.5 KiB)")
+}
+
+func TestStorageStatsEmpty(t *testing.T) {
+	server, cleanup := createTestShaman()
+	defer cleanup()
+
+	stats, err := server.StorageStats()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, stats.NumBlobs)
+	assert.Equal(t, 0.0, stats.DedupRatio)
+	assert.Equal(t, []BlobStats{}, stats.LargestBlobs)
+	assert.Equal(t, []CheckoutStats{}, stats.Checkouts)
+}
@@ -52,6 +52,15 @@ WORKER_ACTIONS = Object.freeze({
         payload: { action: 'shutdown', lazy: false },
         available(worker_status) { return false },
     },
+    drain: {
+        label: 'Drain (finish task, then shut down)',
+        icon: '⏳',
+        title: 'Let the worker finish its current task without taking new ones, then shut down. When the drain deadline passes, the task is re-queued.',
+        payload: { action: 'drain' },
+        available(worker_status, requested_status) {
+            return worker_status != 'timeout' && worker_status != 'offline' && requested_status != 'shutdown';
+        },
+    },
     asleep_lazy: {
         label: 'Send to Sleep (after task is finished)',
         icon: '😴',
@@ -79,12 +88,26 @@ WORKER_ACTIONS = Object.freeze({
             return worker_status == 'asleep' || requested_status == 'asleep_immediate' || requested_status == 'asleep_lazy';
         },
     },
+    wake_on_lan: {
+        label: 'Wake on LAN',
+        icon: '⏻',
+        title: 'Send a Wake-on-LAN packet to power on the machine. Requires the worker to have sent its MAC address.',
+        payload: { action: 'wake' },
+        available(worker_status) { return worker_status == 'offline' || worker_status == 'timeout'; },
+    },
     ack_timeout: {
         label: 'Acknowledge Timeout',
         icon: '✓',
         payload: { action: 'ack-timeout' },
         available(worker_status) { return worker_status == 'timeout'; },
     },
+    release_quarantine: {
+        label: 'Release from Quarantine',
+        icon: '☣',
+        title: 'Let the worker run tasks again. Depending on the Manager configuration, it first has to complete a test task.',
+        payload: { action: 'release-quarantine' },
+        available(worker_status) { return worker_status == 'quarantined'; },
+    },
     testjob: {
         label: 'Send a Test Job',
         icon: 'T',
@@ -97,12 +120,42 @@ WORKER_ACTIONS = Object.freeze({
 Vue.component('page-header', {
     props: ['serverinfo'],
     template: '#template_header',
+    computed: {
+        log_uploads() {
+            return this.serverinfo.task_log_uploads || {queued: 0, retrying: 0, uploading: []};
+        },
+        log_uploads_title() {
+            let uploads = this.log_uploads;
+            let lines = ['Number of task logs queued for uploading to Flamenco Server.'];
+            for (let upload of uploads.uploading) {
+                let percentage = upload.bytes_total ? Math.round(100 * upload.bytes_sent / upload.bytes_total) : 0;
+                lines.push('Task ' + upload.task_id + ': ' + percentage + '% (attempt ' + upload.attempt + ')');
+            }
+            if (uploads.last_error) lines.push('Last error: ' + uploads.last_error);
+            return lines.join('\n');
+        },
+    },
 });
 
 Vue.component('status', {
-    props: ['serverinfo', 'errormsg', 'idle_workers', 'dynamic_pools'],
+    props: ['serverinfo', 'errormsg', 'idle_workers', 'quarantined_workers', 'dynamic_pools'],
     template: '#template_status',
+    computed: {
+        runtime_anomalies() {
+            if (!this.serverinfo.runtime) return [];
+            return this.serverinfo.runtime.tasks.filter(task => task.anomaly);
+        },
+    },
     methods: {
+        eta(timestamp) {
+            return time_until(timestamp);
+        },
+        runtime(seconds) {
+            return duration_text(seconds);
+        },
+        releaseWorker(worker) {
+            workerAction(worker._id, WORKER_ACTIONS.release_quarantine.payload);
+        },
         forgetWorker(worker) {
             workerAction(worker._id, { action: 'forget-worker' },
                 "Are you sure you want to erase " + worker.nickname + "?\n\n" +
@@ -227,9 +280,7 @@ Vue.component('action-bar', {
             let action = this.actions[this.selected_action];
             let payload = action.payload;
 
-            for(worker_id of this.selected_worker_ids) {
-                workerAction(worker_id, payload);
-            }
+            bulkWorkerAction(this.selected_worker_ids, payload);
         }
     }
 })
@@ -266,11 +317,7 @@ Vue.component('worker-table', {
     methods: {
         // Copy the given schedule to all selected workers.
         copySchedule(schedule) {
-            let promises = []
-            for (worker_id of this.selected_worker_ids) {
-                promises.push(scheduleSave(worker_id, schedule));
-            }
-            Promise.all(promises).then(vueApp.loadWorkers);
+            bulkWorkerAction(this.selected_worker_ids, {action: 'set-sleep-schedule'}, cleanSchedule(schedule));
         },
     },
     watch: {
@@ -307,6 +354,7 @@ Vue.component('worker-row', {
     data() { return {
         mode: this.show_schedule ? 'show_schedule' : '',
         edit_schedule: {},
+        edit_exception_dates: '',
     }},
     template: '#template_worker_row',
     computed: {
@@ -316,9 +364,17 @@ Vue.component('worker-row', {
         is_checked: function() {
             return this.selected_worker_ids.indexOf(this.worker._id) >= 0;
         },
+        schedule_templates: function () {
+            return vueApp.serverinfo.sleep_schedule_templates;
+        },
         task_id_text: function () {
             return '…' + this.worker.current_task.substr(-4);
         },
+        task_estimate: function () {
+            let runtime = vueApp.serverinfo.runtime;
+            if (!runtime) return null;
+            return runtime.tasks.find(task => task.task_id == this.worker.current_task);
+        },
         task_log_url: function () {
             return '/logfile/' + this.worker.current_job + '/' + this.worker.current_task;
         },
@@ -367,6 +423,12 @@ Vue.component('worker-row', {
         current_task_updated: function () {
             return time_diff(this.worker.current_task_updated);
         },
+        current_task_eta: function () {
+            return time_until(this.task_estimate.eta);
+        },
+        current_task_expected: function () {
+            return duration_text(this.task_estimate.expected);
+        },
         last_activity_rel: function () {
             return time_diff(this.worker.last_activity);
         },
@@ -380,6 +442,8 @@ Vue.component('worker-row', {
         },
         scheduleEditMode() {
             this.edit_schedule = this._cloneActiveSchedule();
+            if (!this.edit_schedule.template) this.edit_schedule.template = '';
+            this.edit_exception_dates = (this.edit_schedule.exception_dates || []).join(' ');
             this.mode = 'edit_schedule';
         },
         scheduleEditCancel() {
@@ -395,12 +459,65 @@ Vue.component('worker-row', {
             });
         },
         scheduleSave() {
+            this.edit_schedule.exception_dates = this.edit_exception_dates.split(/\s+/).filter(date => date);
             scheduleSave(this.worker._id, this.edit_schedule)
             .done(resp => {
                 this.mode = 'show_schedule';
                 vueApp.loadWorkers();
             });
         },
+        scheduleImportHolidays(event) {
+            let file = event.target.files[0];
+            if (!file) return;
+
+            let reader = new FileReader();
+            reader.onload = () => {
+                $.ajax({
+                    url: '/parse-holiday-calendar',
+                    method: 'POST',
+                    data: reader.result,
+                    contentType: 'text/calendar',
+                })
+                .done(resp => {
+                    let dates = this.edit_exception_dates.split(/\s+/).filter(date => date);
+                    this.edit_exception_dates = dates.concat(resp.dates).join(' ');
+                    toastr.success(resp.dates.length + ' dates', 'Holidays Imported');
+                })
+                .fail(error => {
+                    toastr.error(error.responseText, 'Error ' + error.status);
+                });
+            };
+            reader.readAsText(file);
+        },
+        scheduleSaveAsTemplate() {
+            let name = prompt('Name of the sleep schedule template. ' +
+                'Saving under an existing name updates all workers following that template.',
+                this.worker.sleep_schedule.template || '');
+            if (!name) return;
+
+            let schedule = cleanSchedule(this.worker.sleep_schedule);
+            let template = {
+                name: name,
+                days_of_week: schedule.days_of_week,
+                time_start: schedule.time_start,
+                time_end: schedule.time_end,
+                time_zone: schedule.time_zone,
+                exception_dates: schedule.exception_dates,
+            };
+            $.ajax({
+                url: '/sleep-schedule-templates',
+                method: 'POST',
+                data: JSON.stringify(template),
+                contentType: 'application/json',
+            })
+            .done(resp => {
+                toastr.success(name, "Sleep Schedule Template Saved");
+                vueApp.loadWorkers();
+            })
+            .fail(error => {
+                toastr.error(error.responseText, 'Error ' + error.status);
+            });
+        },
     },
     watch: {
         show_schedule(new_show) {
@@ -429,6 +546,9 @@ Vue.component('blacklist-row', {
         created: function () {
             return time_diff(this.listitem._created);
         },
+        on_probation: function () {
+            return !!this.listitem.expires && new Date(this.listitem.expires) <= Date.now();
+        },
         forget_blacklist_entry() {
             console.log("FORGET ", this.worker._id, this.listitem.job_id, this.listitem.task_type);
             workerAction(this.worker._id, {
@@ -471,11 +591,16 @@ Vue.component('bootstrap-modal', {
 
 
 
-function scheduleSave(worker_id, schedule) {
-    // Erase empty time-of-day properties, instead of sending them empty.
+// Erase empty time-of-day properties, instead of sending them empty.
+function cleanSchedule(schedule) {
     let scheduleCopy = JSON.parse(JSON.stringify(schedule));
     if (!scheduleCopy.time_start) delete scheduleCopy.time_start;
     if (!scheduleCopy.time_end) delete scheduleCopy.time_end;
+    return scheduleCopy;
+}
+
+function scheduleSave(worker_id, schedule) {
+    let scheduleCopy = cleanSchedule(schedule);
 
     // TODO: show 'saving...' somewhere.
     return $.ajax({
@@ -534,6 +659,9 @@ var vueApp = new Vue({
             },
             manager_name: "Flamenco Manager",
             manager_mode: "",
+            sleep_schedule_templates: [],
+            runtime: null,
+            task_log_uploads: null,
         },
         idle_workers: [],
         current_workers: [],
@@ -541,6 +669,9 @@ var vueApp = new Vue({
         dynamic_pools: {},
     },
     computed: {
+        quarantined_workers: function() {
+            return this.current_workers.filter(worker => worker.status == 'quarantined');
+        },
         all_workers_selected: function() {
             return Boolean(this.current_workers.length && this.current_workers.length == this.selected_worker_ids.length);
         },
@@ -715,6 +846,29 @@ function time_diff(timestamp) {
 }
 
 
+function time_until(timestamp) {
+    if (typeof timestamp == 'undefined' || timestamp == null) {
+        return 'unknown';
+    }
+
+    let timediff = new Date(timestamp) - Date.now();  // in milliseconds
+    if (timediff < 60000) {
+        return 'any moment now';
+    }
+    return 'in ' + duration_text(timediff / 1000);
+}
+
+function duration_text(seconds) {
+    if (seconds < 60) {
+        return Math.round(seconds) + ' sec';
+    }
+    if (seconds < 3600) {
+        return Math.round(seconds / 60) + ' min';
+    }
+    return (seconds / 3600).toFixed(1) + ' hours';
+}
+
+
 /* Perform a worker action like 'forget-worker', 'shutdown', etc.
  * See dashboard.go, function workerAction() */
 function workerAction(workerID, payload, confirmation) {
@@ -740,6 +894,50 @@ function workerAction(workerID, payload, confirmation) {
         ;
 }
 
+// Perform the same action on multiple workers in one request.
+// The payload is the same as for workerAction(); sleep_schedule is only used for
+// the 'set-sleep-schedule' action.
+function bulkWorkerAction(workerIDs, payload, sleep_schedule) {
+    let params = {};
+    for (let key in payload) {
+        if (key == 'action') continue;
+        params[key] = String(payload[key]);
+    }
+    let request = {
+        action: payload.action,
+        params: params,
+        worker_ids: workerIDs,
+    };
+    if (typeof sleep_schedule !== 'undefined') request.sleep_schedule = sleep_schedule;
+
+    return $.ajax({
+        url: '/worker-action-bulk',
+        method: 'POST',
+        data: JSON.stringify(request),
+        contentType: 'application/json',
+    })
+    .done(function (resp) {
+        let failed = resp.results.filter(result => !result.ok);
+        let succeeded = resp.results.length - failed.length;
+        if (succeeded > 0) toastr.success(succeeded + ' worker(s)', 'Request confirmed');
+        for (result of failed) {
+            toastr.error(result.error, result.nickname);
+        }
+        vueApp.loadWorkers();
+    })
+    .fail(function (error) {
+        var msg, title;
+        if (error.status) {
+            title = 'Error ' + error.status;
+            msg = error.responseText;
+        } else {
+            title = 'Unable to perform the action';
+            msg = 'Is the Manager still running & reachable?';
+        }
+        toastr.error(msg, title);
+    });
+}
+
 function downloadkick() {
     var button = $(this);
     button.fadeOut();
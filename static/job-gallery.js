@@ -0,0 +1,146 @@
+/* ***** BEGIN MIT LICENSE BLOCK *****
+ * (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * This file is part of Flamenco Manager.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ * ***** END MIT LICENCE BLOCK *****
+ */
+
+// Limits the number of thumbnails shown when new ones keep coming in over the event stream.
+const JOB_CONTACT_SHEET_MAX_IMAGES = 100;
+
+Vue.component('job-gallery-list', {
+    props: ['galleries', 'selected'],
+    template: '#template_job_gallery_list',
+    methods: {
+        timestamp(value) {
+            return format_timestamp(value);
+        },
+    },
+});
+
+/* Shows the thumbnails of a job, and adds new ones as they are rendered. */
+Vue.component('job-contact-sheet', {
+    props: ['jobId'],
+    template: '#template_job_contact_sheet',
+    data() {
+        return {
+            images: [],
+            movie: null,
+            source: null,
+        };
+    },
+    mounted() {
+        window.addEventListener('newJWTToken', this.onNewJWTToken);
+        this.loadImages();
+        this.loadPreviewMovie();
+        this.listen();
+    },
+    beforeDestroy() {
+        window.removeEventListener('newJWTToken', this.onNewJWTToken);
+        if (this.source != null) this.source.close();
+        this.source = null;
+    },
+    methods: {
+        loadImages() {
+            $.jwtAjax({url: '/api/latest-images/jobs/' + this.jobId})
+                .then(images => {
+                    this.images = images;
+                })
+                .catch(error => {
+                    this.$root.errormsg = task_browser_error(error);
+                });
+        },
+        loadPreviewMovie() {
+            // Failure is normal here; not every job has a preview movie,
+            // and the Manager may not be configured to create them at all.
+            $.jwtAjax({url: '/api/preview-movies/' + this.jobId})
+                .then(movie => {
+                    this.movie = movie;
+                })
+                .catch(() => {
+                    this.movie = null;
+                });
+        },
+        listen() {
+            if (this.source != null) this.source.close();
+
+            let source = new EventSource('/imagewatch/jobs/' + this.jobId);
+            source.addEventListener('image', event => {
+                this.addImage(event.data);
+            }, false);
+            source.onerror = obtainJWTToken;
+            this.source = source;
+        },
+        addImage(url) {
+            let filename = url.substring(url.lastIndexOf('/') + 1);
+            if (this.images.some(image => image.filename == filename)) return;
+
+            // Thumbnail filenames are "{nanoseconds}-{source}.jpg".
+            let dash = filename.indexOf('-');
+            let image = {
+                filename: filename,
+                source: filename.substring(dash + 1, filename.length - 4),
+                created: new Date(parseInt(filename.substring(0, dash)) / 1e6).toISOString(),
+                url: url,
+            };
+            this.images = [image].concat(this.images).slice(0, JOB_CONTACT_SHEET_MAX_IMAGES);
+        },
+        onNewJWTToken() {
+            this.listen();
+        },
+    },
+});
+
+function createJobGalleryApp() {
+    let params = new URLSearchParams(window.location.search);
+
+    return new Vue({
+        el: '#vue_app',
+        data: {
+            errormsg: '',
+            galleries: [],
+            selected: params.get('job') || '',
+            loaded: false,
+        },
+        created() {
+            this.loadGalleries();
+        },
+        methods: {
+            loadGalleries() {
+                $.jwtAjax({url: '/api/latest-images/jobs'})
+                    .then(galleries => {
+                        this.errormsg = '';
+                        this.galleries = galleries;
+                        this.loaded = true;
+                        if (!this.selected && galleries.length) this.selectJob(galleries[0].job_id);
+                    })
+                    .catch(error => {
+                        this.errormsg = task_browser_error(error);
+                    });
+            },
+            selectJob(jobID) {
+                this.selected = jobID;
+                window.history.replaceState(null, '', '?' + new URLSearchParams({job: jobID}).toString());
+            },
+        },
+    });
+}
@@ -0,0 +1,127 @@
+/* ***** BEGIN MIT LICENSE BLOCK *****
+ * (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * This file is part of Flamenco Manager.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ * ***** END MIT LICENCE BLOCK *****
+ */
+
+Vue.component('shaman-checkout-list', {
+    props: ['checkouts', 'selected', 'expired'],
+    template: '#template_shaman_checkout_list',
+    methods: {
+        timestamp(value) {
+            return format_timestamp(value);
+        },
+        bytes(value) {
+            return format_bytes(value);
+        },
+    },
+});
+
+/* Shows the files of a checkout, as they were given in its checkout definition. */
+Vue.component('shaman-checkout-files', {
+    props: ['checkoutId'],
+    template: '#template_shaman_checkout_files',
+    data() {
+        return {
+            checkout: null,
+        };
+    },
+    mounted() {
+        $.jwtAjax({url: '/checkouts/' + this.checkoutId})
+            .then(checkout => {
+                this.checkout = checkout;
+            })
+            .catch(error => {
+                this.$root.errormsg = task_browser_error(error);
+            });
+    },
+    methods: {
+        bytes(value) {
+            return format_bytes(value);
+        },
+    },
+});
+
+function createShamanCheckoutsApp() {
+    let params = new URLSearchParams(window.location.search);
+
+    return new Vue({
+        el: '#vue_app',
+        data: {
+            errormsg: '',
+            checkouts: [],
+            selected: params.get('checkout') || '',
+            loaded: false,
+            expired: {},  // Checkouts that the retention policy will remove, by checkout ID.
+        },
+        created() {
+            this.loadCheckouts();
+        },
+        methods: {
+            loadCheckouts() {
+                $.jwtAjax({url: '/checkouts'})
+                    .then(checkouts => {
+                        this.errormsg = '';
+                        this.checkouts = checkouts;
+                        this.loaded = true;
+                        this.loadExpired();
+                    })
+                    .catch(error => {
+                        if (error.status == 404) {
+                            this.errormsg = 'The Shaman is not enabled on this Manager.';
+                        } else {
+                            this.errormsg = task_browser_error(error);
+                        }
+                    });
+            },
+            loadExpired() {
+                $.jwtAjax({url: '/checkout-retention'})
+                    .then(expired => {
+                        let byID = {};
+                        for (let checkout of expired) byID[checkout.checkoutID] = checkout;
+                        this.expired = byID;
+                    })
+                    .catch(error => {
+                        toastr.error(error.responseText, 'Error ' + error.status + ' checking checkout retention');
+                    });
+            },
+            selectCheckout(checkoutID) {
+                this.selected = checkoutID;
+                window.history.replaceState(null, '', '?' + new URLSearchParams({checkout: checkoutID}).toString());
+            },
+            deleteCheckout(checkoutID) {
+                if (!confirm('Delete checkout ' + checkoutID + '? Jobs using it will no longer be able to find their files.')) return;
+
+                $.jwtAjax({method: 'DELETE', url: '/checkouts/' + checkoutID})
+                    .then(() => {
+                        toastr.success('Checkout ' + checkoutID + ' deleted; its files will be removed by the next garbage collection.');
+                        if (this.selected == checkoutID) this.selected = '';
+                        this.loadCheckouts();
+                    })
+                    .catch(error => {
+                        toastr.error(error.responseText, 'Error ' + error.status + ' deleting checkout');
+                    });
+            },
+        },
+    });
+}
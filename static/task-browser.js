@@ -0,0 +1,387 @@
+/* ***** BEGIN MIT LICENSE BLOCK *****
+ * (c) 2019, Blender Foundation - Sybren A. Stüvel
+ *
+ * This file is part of Flamenco Manager.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ * ***** END MIT LICENCE BLOCK *****
+ */
+
+/* Task statuses that can be toggled in the task filter. */
+const TASK_BROWSER_STATUSES = Object.freeze([
+    'queued', 'claimed-by-manager', 'active', 'soft-failed', 'failed', 'completed', 'canceled',
+]);
+const TASK_BROWSER_DEFAULT_STATUSES = Object.freeze(['queued', 'claimed-by-manager', 'active', 'soft-failed', 'failed']);
+const TASK_BROWSER_DEFAULT_SORT = '-last_updated';
+const TASK_BROWSER_PAGE_SIZE = 50;
+// Number of log lines kept in the follow-mode log panel.
+const TASK_LOG_FOLLOW_MAX_LINES = 5000;
+
+function format_timestamp(timestamp) {
+    if (typeof timestamp == 'undefined' || timestamp == null) {
+        return '-';
+    }
+    return new Date(timestamp).toLocaleString('en-GB', {
+        hour12: false,
+        year: 'numeric',
+        month: 'short',
+        day: 'numeric',
+        hour: '2-digit',
+        minute: '2-digit',
+        second: '2-digit',
+    });
+}
+
+/* Same as humanizeByteSize() in the Manager's Go code. */
+function format_bytes(size) {
+    const suffixes = ['B', 'KiB', 'MiB', 'GiB', 'TiB'];
+    let index = 0;
+    while (size > 1024 && index < suffixes.length - 1) {
+        size /= 1024;
+        index++;
+    }
+    return size.toFixed(1) + ' ' + suffixes[index];
+}
+
+/* Construct an error message from a failed $.jwtAjax() call. */
+function task_browser_error(error) {
+    if (error.status) {
+        return 'Error ' + error.status + ': ' + error.responseText;
+    }
+    return 'Unable to get the tasks. Is the Manager still running & reachable?';
+}
+
+Vue.component('task-page-header', {
+    props: ['title'],
+    template: '#template_task_page_header',
+});
+
+Vue.component('task-filter', {
+    props: ['filter'],
+    template: '#template_task_filter',
+    data() {
+        return {
+            statuses: TASK_BROWSER_STATUSES,
+            form: JSON.parse(JSON.stringify(this.filter)),
+        };
+    },
+    methods: {
+        toggleStatus(status) {
+            let statuses = new Set(this.form.status);
+            if (statuses.has(status)) statuses.delete(status);
+            else statuses.add(status);
+            this.form.status = TASK_BROWSER_STATUSES.filter(status => statuses.has(status));
+            this.apply();
+        },
+        apply() {
+            this.$emit('filter-changed', JSON.parse(JSON.stringify(this.form)));
+        },
+    },
+});
+
+Vue.component('task-table', {
+    props: ['tasks', 'sort'],
+    template: '#template_task_table',
+    data() {
+        return {
+            columns: [
+                { key: 'name', label: 'Name' },
+                { key: 'status', label: 'Status' },
+                { key: 'job_priority', label: 'Priority' },
+                { key: 'task_type', label: 'Type' },
+                { key: 'worker', label: 'Worker' },
+                { key: 'last_updated', label: 'Last Updated' },
+            ],
+        };
+    },
+    computed: {
+        sort_key() { return this.sort.replace(/^-/, ''); },
+        sort_descending() { return this.sort.startsWith('-'); },
+    },
+    methods: {
+        sortBy(key) {
+            let descending = (key == this.sort_key) ? !this.sort_descending : false;
+            this.$emit('sort-changed', (descending ? '-' : '') + key);
+        },
+        timestamp(value) {
+            return format_timestamp(value);
+        },
+    },
+});
+
+Vue.component('task-details', {
+    props: ['task'],
+    template: '#template_task_details',
+    methods: {
+        timestamp(value) {
+            return format_timestamp(value);
+        },
+    },
+});
+
+/* Lets the user pick the log of a previous attempt at running the task. */
+Vue.component('task-log-attempts', {
+    props: ['task'],
+    template: '#template_task_log_attempts',
+    data() {
+        return {
+            attempts: [],
+            selected: null,
+        };
+    },
+    created() {
+        $.jwtAjax({url: this.task.log_url + '/attempts'})
+            .then(attempts => {
+                this.attempts = attempts;
+                this.selected = attempts.length ? attempts[0] : null;
+            })
+            .catch(error => {
+                console.log('Unable to get task log attempts:', error);
+            });
+    },
+    methods: {
+        attempt_label(attempt) {
+            let label = attempt.attempt == 0 ? 'Current attempt' : attempt.attempt + ' attempt(s) ago';
+            if (attempt.worker) label += ' on ' + attempt.worker;
+            label += ', ' + format_timestamp(attempt.started || attempt.modified);
+            label += ', ' + format_bytes(attempt.size);
+            if (attempt.compressed) label += ' (gzipped)';
+            return label;
+        },
+    },
+});
+
+/* Follows the task log over Server-Sent Events while the task is active. */
+Vue.component('task-log-follow', {
+    props: ['task'],
+    template: '#template_task_log_follow',
+    data() {
+        return {
+            lines: [],
+            following: false,
+            end_status: '',
+            source: null,
+        };
+    },
+    mounted() {
+        window.addEventListener('newJWTToken', this.onNewJWTToken);
+    },
+    beforeDestroy() {
+        window.removeEventListener('newJWTToken', this.onNewJWTToken);
+        this.stop();
+    },
+    methods: {
+        start() {
+            this.stop();
+            this.lines = [];
+            this.end_status = '';
+            this.following = true;
+
+            let source = new EventSource(this.task.log_url + '/follow');
+            source.addEventListener('log', event => {
+                this.lines = this.lines.concat(event.data.split('\n')).slice(-TASK_LOG_FOLLOW_MAX_LINES);
+                this.$nextTick(this.scrollToBottom);
+            }, false);
+            source.addEventListener('end', event => {
+                this.end_status = event.data;
+                this.stop();
+            }, false);
+            source.onerror = obtainJWTToken;
+            this.source = source;
+        },
+        stop() {
+            if (this.source != null) this.source.close();
+            this.source = null;
+            this.following = false;
+        },
+        onNewJWTToken() {
+            // Reconnect with the new token, unless the user stopped following.
+            if (this.following) this.start();
+        },
+        scrollToBottom() {
+            let panel = this.$refs.panel;
+            if (panel) panel.scrollTop = panel.scrollHeight;
+        },
+    },
+});
+
+Vue.component('task-log-search-form', {
+    props: ['search'],
+    template: '#template_task_log_search_form',
+    data() {
+        return {
+            form: Object.assign({}, this.search),
+        };
+    },
+    methods: {
+        apply() {
+            this.$emit('search', Object.assign({}, this.form));
+        },
+    },
+});
+
+Vue.component('task-log-search-results', {
+    props: ['results'],
+    template: '#template_task_log_search_results',
+    methods: {
+        timestamp(value) {
+            return format_timestamp(value);
+        },
+    },
+});
+
+/* Read the task filter from the page URL, so that filtered views can be bookmarked. */
+function filterFromURL() {
+    let params = new URLSearchParams(window.location.search);
+    let status = params.get('status');
+    return {
+        status: status == null ? Array.from(TASK_BROWSER_DEFAULT_STATUSES) : status.split(',').filter(s => s),
+        job: params.get('job') || '',
+        task_type: params.get('task_type') || '',
+        worker: params.get('worker') || '',
+        sort: params.get('sort') || TASK_BROWSER_DEFAULT_SORT,
+    };
+}
+
+/* Convert the filter to query parameters for the /api/tasks endpoint. */
+function filterToParams(filter) {
+    let params = { status: filter.status.join(','), sort: filter.sort };
+    for (let key of ['job', 'task_type', 'worker']) {
+        if (filter[key]) params[key] = filter[key];
+    }
+    return params;
+}
+
+function createTaskBrowserApp() {
+    return new Vue({
+        el: '#vue_app',
+        data: {
+            errormsg: '',
+            filter: filterFromURL(),
+            tasks: [],
+            next_cursor: '',
+        },
+        created() {
+            this.loadTasks();
+        },
+        methods: {
+            loadTasks() {
+                this.fetchPage('', tasks => { this.tasks = tasks; });
+            },
+            loadNextPage() {
+                this.fetchPage(this.next_cursor, tasks => { this.tasks = this.tasks.concat(tasks); });
+            },
+            fetchPage(cursor, handleTasks) {
+                let params = filterToParams(this.filter);
+                params.limit = TASK_BROWSER_PAGE_SIZE;
+                if (cursor) params.cursor = cursor;
+
+                $.jwtAjax({url: '/api/tasks', data: params})
+                    .then(response => {
+                        this.errormsg = '';
+                        handleTasks(response.tasks);
+                        this.next_cursor = response.next_cursor || '';
+                    })
+                    .catch(error => {
+                        this.errormsg = task_browser_error(error);
+                    });
+            },
+            onFilterChanged(filter) {
+                this.filter = Object.assign({}, filter, { sort: this.filter.sort });
+            },
+            onSortChanged(sort) {
+                this.filter = Object.assign({}, this.filter, { sort: sort });
+            },
+        },
+        watch: {
+            filter(filter) {
+                let query = new URLSearchParams(filterToParams(filter)).toString();
+                window.history.replaceState(null, '', '?' + query);
+                this.loadTasks();
+            },
+        },
+    });
+}
+
+function createTaskDetailsApp() {
+    return new Vue({
+        el: '#vue_app',
+        data: {
+            errormsg: '',
+            task: null,
+        },
+        created() {
+            let taskID = window.location.pathname.split('/').pop();
+            $.jwtAjax({url: '/api/tasks/' + taskID})
+                .then(task => {
+                    this.task = task;
+                    document.title = task.name + ' - Flamenco Manager';
+                })
+                .catch(error => {
+                    this.errormsg = task_browser_error(error);
+                });
+        },
+    });
+}
+
+function createTaskLogSearchApp() {
+    let params = new URLSearchParams(window.location.search);
+
+    return new Vue({
+        el: '#vue_app',
+        data: {
+            errormsg: '',
+            search: {
+                q: params.get('q') || '',
+                job: params.get('job') || '',
+                since: '',
+                until: '',
+            },
+            results: [],
+            searched: false,
+        },
+        created() {
+            if (this.search.q) this.onSearch(this.search);
+        },
+        methods: {
+            onSearch(search) {
+                this.search = search;
+                let params = {q: search.q};
+                if (search.job) params.job = search.job;
+                // The datetime-local inputs are in local time, the API expects RFC 3339.
+                if (search.since) params.since = new Date(search.since).toISOString();
+                if (search.until) params.until = new Date(search.until).toISOString();
+
+                let query = new URLSearchParams({q: search.q, job: search.job}).toString();
+                window.history.replaceState(null, '', '?' + query);
+
+                $.jwtAjax({url: '/api/task-logs/search', data: params})
+                    .then(results => {
+                        this.errormsg = '';
+                        this.results = results;
+                        this.searched = true;
+                    })
+                    .catch(error => {
+                        this.errormsg = task_browser_error(error);
+                    });
+            },
+        },
+    });
+}